@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
@@ -11,12 +12,18 @@ import (
 	"orbitgraphql/config"
 	"orbitgraphql/graphcache"
 	"orbitgraphql/logger"
+	"sync"
 	"time"
+
+	"github.com/vektah/gqlparser/v2/ast"
+	"github.com/vektah/gqlparser/v2/gqlerror"
 )
 
 const CACHE_STATUS_BYPASS = "BYPASS"
 const CACHE_STATUS_HIT = "HIT"
 const CACHE_STATUS_MISS = "MISS"
+const CACHE_STATUS_PARTIAL = "PARTIAL"
+const CACHE_STATUS_STALE = "STALE"
 
 func CreateRequestID() string {
 	return fmt.Sprintf("%d", time.Now().UnixNano())
@@ -60,6 +67,20 @@ func CacheMiddleware(ctx context.Context, cfg *config.Config, w http.ResponseWri
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 	}
 
+	// automatic persisted queries can be sent with GET, they are handled like the same request sent with POST
+	if cfg.PersistedQueries && r.Method == http.MethodGet && r.URL.Query().Has("extensions") {
+		getRequest := graphcache.GraphQLRequest{}
+		if err := getRequest.FromQuery(r.URL.Query()); err != nil {
+			logger.Error(ctx, err)
+			return WriteGraphQLError(ctx, w, http.StatusBadRequest, err)
+		}
+		r = r.Clone(ctx)
+		r.Method = http.MethodPost
+		r.URL.RawQuery = ""
+		r.Body = io.NopCloser(bytes.NewReader(getRequest.Bytes()))
+		r.Header.Set("Content-Type", "application/json")
+	}
+
 	// only handle if the request is of content type application/json
 	// for all other content types, pass the request to the origin server
 	if r.Header.Get("Content-Type") != "application/json" {
@@ -101,20 +122,95 @@ func CacheMiddleware(ctx context.Context, cfg *config.Config, w http.ResponseWri
 	request.FromBytes(requestBody)
 	ctx = context.WithValue(ctx, "operationName", request.OperationName)
 
-	cache := graphcache.NewGraphCacheWithOptions(ctx, GetCacheOptions(cfg, GetScopeValues(cfg, proxyReq)))
+	scopeValues, err := GetScopeValues(cfg, proxyReq)
+	if err != nil {
+		logger.Warn(ctx, err)
+		return WriteGraphQLError(ctx, w, http.StatusUnauthorized, ErrInvalidToken)
+	}
+	cache := graphcache.NewGraphCacheWithOptions(ctx, GetCacheOptions(cfg, scopeValues))
+
+	// trusted documents can be sent with only their hash, like persisted queries
+	resolvedTrusted := false
+	if hash, ok := request.PersistedQueryHash(); ok && request.Query == "" {
+		if query, ok := TrustedDocuments.Query(hash); ok {
+			request.ResolvePersistedQuery(query)
+			proxyReq.Body = io.NopCloser(bytes.NewBuffer(request.Bytes()))
+			ctx = context.WithValue(ctx, "operationName", request.OperationName)
+			resolvedTrusted = true
+		}
+	}
+
+	// with trusted documents, only the operations of our own clients are executed, they are checked before
+	// anything is registered as an automatic persisted query
+	if TrustedDocuments != nil && !TrustedDocuments.Trusted(request.Query) {
+		if cfg.TrustedDocumentsMode != config.TRUSTED_DOCUMENTS_REPORT {
+			logger.Warn(ctx, graphcache.ErrOperationNotTrusted.Message)
+			return WriteGraphQLError(ctx, w, http.StatusBadRequest, graphcache.ErrOperationNotTrusted)
+		}
+		logger.Warn(ctx, graphcache.ErrOperationNotTrusted.Message, ", executed in report mode")
+	}
+
+	// automatic persisted queries are resolved by the proxy, the origin only receives full queries
+	if hash, ok := request.PersistedQueryHash(); ok && cfg.PersistedQueries && !resolvedTrusted {
+		query := request.Query
+		switch {
+		case query == "" && TrustedDocuments != nil:
+			// with trusted documents nothing is registered, only the trusted documents are sent with their hash
+			err = graphcache.ErrPersistedQueryNotFound
+		case query == "":
+			query, err = cache.PersistedQuery(hash)
+		case TrustedDocuments != nil:
+			err = graphcache.VerifyPersistedQuery(hash, query)
+		default:
+			err = cache.PersistQuery(hash, query)
+		}
+		if errors.Is(err, graphcache.ErrPersistedQueryNotFound) {
+			// the client sends the query with its hash next
+			return WriteGraphQLError(ctx, w, http.StatusOK, err)
+		}
+		if err != nil {
+			logger.Error(ctx, err)
+			return WriteGraphQLError(ctx, w, http.StatusBadRequest, err)
+		}
+		request.ResolvePersistedQuery(query)
+		proxyReq.Body = io.NopCloser(bytes.NewBuffer(request.Bytes()))
+		ctx = context.WithValue(ctx, "operationName", request.OperationName)
+	}
 
 	start := time.Now()
 
 	astQuery, err := graphcache.GetASTFromQuery(request.Query)
 	if err != nil {
 		logger.Error(ctx, err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return WriteGraphQLError(ctx, w, http.StatusBadRequest, err)
+	}
+
+	// with a schema, documents the origin would reject don't reach it
+	err = cache.ValidateQuery(request.Query)
+	if err != nil {
+		logger.Error(ctx, err)
+		return WriteGraphQLError(ctx, w, http.StatusBadRequest, err)
+	}
+
+	// a document can have more than one operation, the request names the one to execute
+	operation, err := graphcache.GetOperation(astQuery, request.OperationName)
+	if err != nil {
+		logger.Error(ctx, err)
+		return WriteGraphQLError(ctx, w, http.StatusBadRequest, err)
+	}
+	ctx = context.WithValue(ctx, "operationName", operation.Name)
+
+	// abusive operations are stopped before they reach the origin
+	err = cache.CheckQueryLimits(operation, request.Variables)
+	if err != nil {
+		logger.Warn(ctx, err)
+		return WriteGraphQLError(ctx, w, http.StatusBadRequest, err)
 	}
 
 	transformedBody, err := graphcache.AddTypenameToQuery(request.Query)
 	if err != nil {
 		logger.Error(ctx, err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return WriteGraphQLError(ctx, w, http.StatusBadRequest, err)
 	}
 
 	logger.Debug(ctx, "time taken to transform body ", time.Since(start))
@@ -122,8 +218,11 @@ func CacheMiddleware(ctx context.Context, cfg *config.Config, w http.ResponseWri
 	transformedRequest := request
 	transformedRequest.Query = transformedBody
 
-	if len(astQuery.Operations) > 0 && astQuery.Operations[0].Operation == "mutation" {
+	if operation.Operation == ast.Mutation {
 		// if the operation is a mutation, we don't cache it
+		if limitedCtx, limited := RateLimit(ctx, cfg, w, cache, RATE_LIMIT_MISSES, operation.Name); limited {
+			return limitedCtx
+		}
 
 		proxyReq.Body = io.NopCloser(bytes.NewBuffer(transformedRequest.Bytes()))
 		proxyReq.ContentLength = -1
@@ -133,7 +232,7 @@ func CacheMiddleware(ctx context.Context, cfg *config.Config, w http.ResponseWri
 		})
 		if err != nil {
 			logger.Error(ctx, err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return ctx
 		}
 		defer resp.Body.Close()
 
@@ -146,7 +245,19 @@ func CacheMiddleware(ctx context.Context, cfg *config.Config, w http.ResponseWri
 			logger.Error(ctx, err)
 		}
 
-		cache.InvalidateCache("data", responseMap, nil)
+		variables := make(map[string]interface{})
+		if request.Variables != nil {
+			variables = request.Variables
+		}
+		// a mutation the origin failed changed nothing, the fields that failed in a mutation with errors are null
+		// and invalidate nothing
+		if isSuccessStatus(resp.StatusCode) && responseMap["data"] != nil {
+			cache.InvalidateCache("data", cache.ResponseWithStorageKeys(operation, responseMap, variables), nil)
+			// side effects of the mutation the response doesn't show are invalidated with the configured rules
+			cache.ApplyInvalidationRules(operation, responseMap, variables)
+		} else {
+			logger.Debug(ctx, "mutation failed, cache not invalidated ", resp.StatusCode)
+		}
 
 		newResponse := &graphcache.GraphQLResponse{}
 		newResponse.FromBytes(responseBody.Bytes())
@@ -161,39 +272,103 @@ func CacheMiddleware(ctx context.Context, cfg *config.Config, w http.ResponseWri
 
 	cachedResponse, err := cache.ParseASTBuildResponse(astQuery, request)
 	if err == nil && cachedResponse != nil {
-		logger.Debug(ctx, "serving response from cache")
-		br, err := json.Marshal(cachedResponse)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+		if limitedCtx, limited := RateLimit(ctx, cfg, w, cache, RATE_LIMIT_HITS, operation.Name); limited {
+			return limitedCtx
 		}
+		logger.Debug(ctx, "serving response from cache")
+		ctx = WriteCachedResponse(ctx, cfg, w, cache, cachedResponse, CACHE_STATUS_HIT)
 		logger.Debug(ctx, "time taken to serve response from cache ", time.Since(start))
-		graphqlresponse := graphcache.GraphQLResponse{Data: json.RawMessage(br)}
-		res, err := cache.RemoveTypenameFromResponse(&graphqlresponse)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-		}
-		w.Header().Add(cfg.CacheHeaderName, CACHE_STATUS_HIT)
-		w.Write(res.Bytes())
-		ctx = context.WithValue(ctx, "status", http.StatusOK)
-		ctx = context.WithValue(ctx, "contentLength", len(res.Bytes()))
 		return ctx
 	}
+	if err != nil {
+		logger.Debug(ctx, "response not served from cache ", err)
+	}
+
+	variables := make(map[string]interface{})
+	if request.Variables != nil {
+		variables = request.Variables
+	}
+
+	// an expired response is served while it's refreshed in the background, for the operations that allow it
+	operationConfig := cfg.Operations[operation.Name]
+	stale, hasStale := cache.ReadStaleResponse(operation, variables)
+	if hasStale && stale.ExpiredFor >= 0 && stale.ExpiredFor <= time.Duration(operationConfig.StaleWhileRevalidate)*time.Second {
+		if limitedCtx, limited := RateLimit(ctx, cfg, w, cache, RATE_LIMIT_HITS, operation.Name); limited {
+			return limitedCtx
+		}
+		logger.Debug(ctx, "serving stale response while revalidating, expired for ", stale.ExpiredFor)
+		go RevalidateResponse(ctx, cfg, cache, proxyReq, transformedRequest)
+		return WriteCachedResponse(ctx, cfg, w, cache, stale.Data, CACHE_STATUS_STALE)
+	}
+	// serveStaleIfError serves the expired response when the origin fails, for the operations that allow it
+	serveStaleIfError := func() bool {
+		return hasStale && stale.ExpiredFor <= time.Duration(operationConfig.StaleIfError)*time.Second
+	}
+
+	if limitedCtx, limited := RateLimit(ctx, cfg, w, cache, RATE_LIMIT_MISSES, operation.Name); limited {
+		return limitedCtx
+	}
+
+	// identical requests that miss the cache at the same time wait for the response of the first one
+	if cfg.Coalescing {
+		key := cache.GetQueryKey(operation, variables)
+		inflight, first, err := coalescer.Join(key, cfg.CoalescingMaxWaiters)
+		if first {
+			coalescing := newCoalescingWriter(w)
+			w = coalescing
+			defer func() { coalescer.Done(key, inflight, coalescing.Response()) }()
+		} else if err == nil {
+			response, err := inflight.Wait(time.Duration(cfg.CoalescingTimeout) * time.Second)
+			if err == nil {
+				logger.Debug(ctx, "serving response of identical request in flight")
+				return response.Write(ctx, w)
+			}
+			logger.Warn(ctx, err)
+		} else {
+			logger.Warn(ctx, err)
+		}
+
+		// with a shared cache, the proxies wait for the one fetching the operation to cache it
+		if cfg.CacheBackend == "redis" {
+			if cache.LockOperation(operation, variables, time.Duration(cfg.CoalescingTimeout)*time.Second) {
+				defer cache.UnlockOperation(operation, variables)
+			} else if cachedResponse, ok := WaitForCachedResponse(cfg, cache, astQuery, operation, request); ok {
+				logger.Debug(ctx, "serving response cached by another proxy")
+				return WriteCachedResponse(ctx, cfg, w, cache, cachedResponse, CACHE_STATUS_HIT)
+			}
+		}
+	}
+
+	if missingQuery, err := cache.ParseASTBuildMissingQuery(astQuery, request); err == nil {
+		partialCtx, served := ServePartialResponse(ctx, cfg, w, proxyReq, cache, transformedRequest, missingQuery)
+		if served {
+			logger.Debug(partialCtx, "time taken to serve partial response from cache ", time.Since(start))
+			return partialCtx
+		}
+	}
 
 	proxyReq.Body = io.NopCloser(bytes.NewBuffer(transformedRequest.Bytes()))
 	proxyReq.ContentLength = -1
 
-	resp, err := SendRequest(&ctx, proxyReq, w, map[string]interface{}{
-		cfg.CacheHeaderName: CACHE_STATUS_MISS,
-	})
+	resp, err := ForwardRequest(proxyReq)
 	if err != nil {
 		logger.Error(ctx, err)
+		if serveStaleIfError() {
+			return WriteCachedResponse(ctx, cfg, w, cache, stale.Data, CACHE_STATUS_STALE)
+		}
 		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return ctx
 	}
 	defer resp.Body.Close()
 
 	responseBody := new(bytes.Buffer)
 	io.Copy(responseBody, resp.Body)
 
+	if resp.StatusCode >= http.StatusInternalServerError && serveStaleIfError() {
+		logger.Warn(ctx, "origin responded with status ", resp.StatusCode, ", serving stale response")
+		return WriteCachedResponse(ctx, cfg, w, cache, stale.Data, CACHE_STATUS_STALE)
+	}
+
 	responseMap := make(map[string]interface{})
 	err = json.Unmarshal(responseBody.Bytes(), &responseMap)
 	if err != nil {
@@ -202,43 +377,309 @@ func CacheMiddleware(ctx context.Context, cfg *config.Config, w http.ResponseWri
 
 	logger.Debug(ctx, "time taken to get response from API ", time.Since(start))
 
-	astWithTypes, err := graphcache.GetASTFromQuery(transformedRequest.Query)
-	if err != nil {
+	// a response that can't be cached is passed through
+	if err := CheckCacheable(cfg, cache, operation, resp, responseMap); err != nil {
+		logger.Warn(ctx, "response not cached: ", err)
+		WriteResponseHeaders(&ctx, w, resp, map[string]interface{}{
+			cfg.CacheHeaderName: CACHE_STATUS_BYPASS,
+		})
+		return WriteResponseBody(ctx, w, cache, responseBody.Bytes())
+	}
+
+	WriteResponseHeaders(&ctx, w, resp, map[string]interface{}{
+		cfg.CacheHeaderName: CACHE_STATUS_MISS,
+	})
+
+	if err := CacheOriginResponse(cfg, cache, transformedRequest, responseMap); err != nil {
 		logger.Error(ctx, err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
 	}
 
-	logger.Debug(ctx, "time taken to generate AST with types ", time.Since(start))
+	logger.Debug(ctx, "time taken to cache response ", time.Since(start), responseMap)
+
+	return WriteResponseBody(ctx, w, cache, responseBody.Bytes())
+}
+
+// CacheOriginResponse caches the response of the origin to the request, with the __typename fields added to its query,
+// and keeps it to be served stale when the operation allows it
+func CacheOriginResponse(cfg *config.Config, cache *graphcache.GraphCache, request graphcache.GraphQLRequest, responseMap map[string]interface{}) error {
+	astWithTypes, err := graphcache.GetASTFromQuery(request.Query)
+	if err != nil {
+		return err
+	}
 
-	reqVariables := transformedRequest.Variables
 	variables := make(map[string]interface{})
-	if reqVariables != nil {
-		variables = reqVariables
+	if request.Variables != nil {
+		variables = request.Variables
 	}
 
-	for _, op := range astWithTypes.Operations {
-		// for the operation op we need to traverse the response and build the relationship map where key is the requested field and value is the key where the actual response is stored in the cache
-		cache.CacheOperation(op, responseMap, variables)
+	opWithTypes, err := graphcache.GetOperation(astWithTypes, request.OperationName)
+	if err != nil {
+		return err
 	}
 
-	logger.Debug(ctx, "time taken to build response key ", time.Since(start))
+	// for the operation we need to traverse the response and build the relationship map where key is the requested field and value is the key where the actual response is stored in the cache
+	cache.CacheOperation(opWithTypes, responseMap, variables)
 
 	// go through the response. Every object that has a __typename field, and an id field cache it in the format of typename:id
 	// for example, if the response has an object with __typename: "Organisation" and id: "1234", cache it as Organisation:1234
 	// if the object has a nested object with __typename: "User" and id: "5678", cache
 	// it as User:5678
-	cache.CacheResponse("data", responseMap, nil)
+	cache.CacheResponse("data", cache.ResponseWithStorageKeys(opWithTypes, responseMap, variables), nil)
 
-	logger.Debug(ctx, "time taken to cache response ", time.Since(start), responseMap)
+	if window := StaleWindow(cfg, opWithTypes.Name); window > 0 {
+		cache.CacheStaleResponse(opWithTypes, responseMap, variables, window)
+	}
+	return nil
+}
+
+// StaleWindow is how long the responses of the operation are kept after they expire, to be served stale
+func StaleWindow(cfg *config.Config, operationName string) time.Duration {
+	operationConfig := cfg.Operations[operationName]
+	window := operationConfig.StaleWhileRevalidate
+	if operationConfig.StaleIfError > window {
+		window = operationConfig.StaleIfError
+	}
+	return time.Duration(window) * time.Second
+}
+
+// revalidating are the keys of the stale responses being refreshed, so a response is refreshed once at a time
+var revalidating sync.Map
+
+// REVALIDATE_TIMEOUT is how long the origin has to refresh a stale response
+const REVALIDATE_TIMEOUT = 30 * time.Second
+
+// RevalidateResponse refreshes the cached response of the request in the background, while the stale one is served
+func RevalidateResponse(ctx context.Context, cfg *config.Config, cache *graphcache.GraphCache, proxyReq *http.Request, request graphcache.GraphQLRequest) {
+	// the request is over, and its context canceled, before the response is refreshed
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), REVALIDATE_TIMEOUT)
+	defer cancel()
+	cache = cache.WithContext(ctx)
+
+	astQuery, err := graphcache.GetASTFromQuery(request.Query)
+	if err != nil {
+		return
+	}
+	operation, err := graphcache.GetOperation(astQuery, request.OperationName)
+	if err != nil {
+		return
+	}
+	key := cache.GetQueryKey(operation, request.Variables)
+	if _, loaded := revalidating.LoadOrStore(key, true); loaded {
+		return
+	}
+	defer revalidating.Delete(key)
+
+	revalidateReq, err := http.NewRequestWithContext(ctx, proxyReq.Method, proxyReq.URL.String(), bytes.NewReader(request.Bytes()))
+	if err != nil {
+		logger.Error(ctx, err)
+		return
+	}
+	revalidateReq.Header = proxyReq.Header.Clone()
+	revalidateReq.ContentLength = -1
 
+	resp, err := ForwardRequest(revalidateReq)
+	if err != nil {
+		logger.Error(ctx, "revalidating stale response failed: ", err)
+		return
+	}
+	defer resp.Body.Close()
+
+	responseMap := make(map[string]interface{})
+	if err := json.NewDecoder(resp.Body).Decode(&responseMap); err != nil {
+		logger.Error(ctx, "revalidating stale response failed: ", err)
+		return
+	}
+	if err := CheckCacheable(cfg, cache, operation, resp, responseMap); err != nil {
+		logger.Warn(ctx, "revalidated response not cached: ", err)
+		return
+	}
+	if err := CacheOriginResponse(cfg, cache, request, responseMap); err != nil {
+		logger.Error(ctx, err)
+	}
+}
+
+// WriteCachedResponse writes a response built from the cache, without the __typename fields
+func WriteCachedResponse(ctx context.Context, cfg *config.Config, w http.ResponseWriter, cache *graphcache.GraphCache, data interface{}, status string) context.Context {
+	br, err := json.Marshal(data)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return ctx
+	}
+	graphqlresponse := graphcache.GraphQLResponse{Data: json.RawMessage(br)}
+	res, err := cache.RemoveTypenameFromResponse(&graphqlresponse)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return ctx
+	}
+	w.Header().Add(cfg.CacheHeaderName, status)
+	w.Write(res.Bytes())
+	ctx = context.WithValue(ctx, "status", http.StatusOK)
+	ctx = context.WithValue(ctx, "contentLength", len(res.Bytes()))
+	return ctx
+}
+
+// CheckCacheable reports why a response of the origin can't be cached, responses with a status other than 2xx
+// aren't, and responses with errors only are when the operation caches partial data, without the fields
+// the errors nulled (they are removed from the response map)
+func CheckCacheable(cfg *config.Config, cache *graphcache.GraphCache, operation *ast.OperationDefinition, resp *http.Response, responseMap map[string]interface{}) error {
+	if !isSuccessStatus(resp.StatusCode) {
+		return fmt.Errorf("origin responded with status %d", resp.StatusCode)
+	}
+	if errs := graphcache.ResponseErrors(responseMap); len(errs) > 0 {
+		if !cfg.Operations[operation.Name].CachePartialData {
+			return fmt.Errorf("response has %d errors", len(errs))
+		}
+		if !graphcache.RemoveErroredFields(responseMap) {
+			return errors.New("response has errors that aren't in its data")
+		}
+	}
+	// a response with an object we can't make a cache key for can't be cached
+	return cache.ValidateObjectIDs(responseMap["data"])
+}
+
+func isSuccessStatus(status int) bool {
+	return status >= 200 && status < 300
+}
+
+// WriteResponseBody writes the response of the origin without the __typename fields added to the query
+func WriteResponseBody(ctx context.Context, w http.ResponseWriter, cache *graphcache.GraphCache, body []byte) context.Context {
 	newResponse := &graphcache.GraphQLResponse{}
-	newResponse.FromBytes(responseBody.Bytes())
+	newResponse.FromBytes(body)
 	res, err := cache.RemoveTypenameFromResponse(newResponse)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return ctx
+	}
+
+	w.Write(res.Bytes())
+	return ctx
+}
+
+// ServePartialResponse sends a query for the fields missing from the cache to the origin, caches its response
+// and serves the response built from the cache, it reports false without writing anything when the response
+// can't be built, so the request can still be sent to the origin as it is. The request has the __typename fields added
+// to its query, like the ones sent to the origin
+func ServePartialResponse(ctx context.Context, cfg *config.Config, w http.ResponseWriter, proxyReq *http.Request, cache *graphcache.GraphCache, request graphcache.GraphQLRequest, missingQuery string) (context.Context, bool) {
+	logger.Debug(ctx, "fetching fields missing from cache ", missingQuery)
+
+	missingRequest := request
+	missingRequest.Query = missingQuery
+	proxyReq.Body = io.NopCloser(bytes.NewBuffer(missingRequest.Bytes()))
+	proxyReq.ContentLength = -1
+
+	resp, err := ForwardRequest(proxyReq)
+	if err != nil {
+		logger.Error(ctx, err)
+		return ctx, false
+	}
+	defer resp.Body.Close()
+
+	responseBody := new(bytes.Buffer)
+	io.Copy(responseBody, resp.Body)
+
+	responseMap := make(map[string]interface{})
+	if err := json.Unmarshal(responseBody.Bytes(), &responseMap); err != nil {
+		logger.Debug(ctx, "origin could not resolve the fields missing from cache ", err)
+		return ctx, false
+	}
+
+	astWithTypes, err := graphcache.GetASTFromQuery(missingQuery)
+	if err != nil {
+		logger.Error(ctx, err)
+		return ctx, false
+	}
+
+	variables := make(map[string]interface{})
+	if request.Variables != nil {
+		variables = request.Variables
+	}
+
+	opWithTypes, err := graphcache.GetOperation(astWithTypes, request.OperationName)
+	if err != nil {
+		logger.Error(ctx, err)
+		return ctx, false
+	}
+
+	// the response for the missing fields is cached like the response of the whole operation would be
+	if err := CheckCacheable(cfg, cache, opWithTypes, resp, responseMap); err != nil {
+		logger.Debug(ctx, "origin could not resolve the fields missing from cache: ", err)
+		return ctx, false
 	}
 
+	cache.CacheOperation(opWithTypes, responseMap, variables)
+	cache.CacheResponse("data", cache.ResponseWithStorageKeys(opWithTypes, responseMap, variables), nil)
+
+	astQuery, err := graphcache.GetASTFromQuery(request.Query)
+	if err != nil {
+		logger.Error(ctx, err)
+		return ctx, false
+	}
+	operation, err := graphcache.GetOperation(astQuery, request.OperationName)
+	if err != nil {
+		logger.Error(ctx, err)
+		return ctx, false
+	}
+	cachedResponse, err := cache.ParseASTBuildResponse(astQuery, request)
+	if err != nil {
+		logger.Debug(ctx, "response not served from cache after fetching missing fields ", err)
+		return ctx, false
+	}
+
+	// the response served is cached for the whole operation, like a response of the origin to it, so it is
+	// invalidated with the objects in it and kept to be served stale
+	response := map[string]interface{}{"data": cachedResponse}
+	cache.CacheOperation(operation, response, variables)
+	if window := StaleWindow(cfg, operation.Name); window > 0 {
+		cache.CacheStaleResponse(operation, response, variables, window)
+	}
+
+	br, err := json.Marshal(cachedResponse)
+	if err != nil {
+		logger.Error(ctx, err)
+		return ctx, false
+	}
+	graphqlresponse := graphcache.GraphQLResponse{Data: json.RawMessage(br)}
+	res, err := cache.RemoveTypenameFromResponse(&graphqlresponse)
+	if err != nil {
+		logger.Error(ctx, err)
+		return ctx, false
+	}
+
+	for name, values := range resp.Header {
+		if name != "Content-Length" {
+			for _, value := range values {
+				w.Header().Add(name, value)
+			}
+		}
+	}
+	w.Header().Add(cfg.CacheHeaderName, CACHE_STATUS_PARTIAL)
+	w.WriteHeader(http.StatusOK)
 	w.Write(res.Bytes())
+	ctx = context.WithValue(ctx, "status", http.StatusOK)
+	ctx = context.WithValue(ctx, "contentLength", len(res.Bytes()))
+	return ctx, true
+}
+
+// WriteGraphQLError responds to a request that can't be executed with a GraphQL error
+func WriteGraphQLError(ctx context.Context, w http.ResponseWriter, status int, err error) context.Context {
+	response := graphcache.GraphQLResponse{
+		Errors: []interface{}{map[string]interface{}{"message": err.Error()}},
+	}
+	var errs gqlerror.List
+	var gqlErr *gqlerror.Error
+	if errors.As(err, &errs) {
+		// validation errors are reported one by one, with their locations
+		response.Errors = make([]interface{}, 0)
+		for _, e := range errs {
+			response.Errors = append(response.Errors, e)
+		}
+	} else if errors.As(err, &gqlErr) {
+		response.Errors = []interface{}{gqlErr}
+	}
+	w.WriteHeader(status)
+	w.Write(response.Bytes())
+	ctx = context.WithValue(ctx, "status", status)
+	ctx = context.WithValue(ctx, "contentLength", len(response.Bytes()))
 	return ctx
 }
 
@@ -262,14 +703,32 @@ func CopyRequest(ctx context.Context, r *http.Request, targetURL string) (*http.
 }
 
 func SendRequest(ctx *context.Context, proxyReq *http.Request, w http.ResponseWriter, headers map[string]interface{}) (*http.Response, error) {
-	client := http.Client{}
-	// Send the proxy request using the custom transport
-	resp, err := client.Do(proxyReq)
-	if err != nil || resp == nil {
+	resp, err := ForwardRequest(proxyReq)
+	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return resp, err
 	}
+	WriteResponseHeaders(ctx, w, resp, headers)
+	return resp, nil
+}
+
+// ORIGIN_TIMEOUT is how long the origin has to respond to a request
+const ORIGIN_TIMEOUT = 60 * time.Second
 
+// originClient sends every request to the origin, so their connections are reused
+var originClient = &http.Client{Timeout: ORIGIN_TIMEOUT}
+
+// ForwardRequest sends the request to the origin
+func ForwardRequest(proxyReq *http.Request) (*http.Response, error) {
+	resp, err := originClient.Do(proxyReq)
+	if err == nil && resp == nil {
+		err = errors.New("no response from origin")
+	}
+	return resp, err
+}
+
+// WriteResponseHeaders copies the status and headers of the origin's response, with the headers of the cache
+func WriteResponseHeaders(ctx *context.Context, w http.ResponseWriter, resp *http.Response, headers map[string]interface{}) {
 	// Copy the headers from the proxy response to the original response
 	for name, values := range resp.Header {
 		if name != "Content-Length" {
@@ -286,6 +745,4 @@ func SendRequest(ctx *context.Context, proxyReq *http.Request, w http.ResponseWr
 	w.WriteHeader(resp.StatusCode)
 	*ctx = context.WithValue(*ctx, "status", resp.StatusCode)
 	*ctx = context.WithValue(*ctx, "contentLength", resp.ContentLength)
-
-	return resp, nil
 }
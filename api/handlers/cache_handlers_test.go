@@ -0,0 +1,893 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"orbitgraphql/auth"
+	"orbitgraphql/config"
+	"orbitgraphql/graphcache"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestOrigin starts a GraphQL origin that answers every request with the response for its operation name
+func newTestOrigin(t *testing.T, responses map[string]string) (*httptest.Server, *[]graphcache.GraphQLRequest) {
+	requests := make([]graphcache.GraphQLRequest, 0)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		request := graphcache.GraphQLRequest{}
+		json.Unmarshal(body, &request)
+		requests = append(requests, request)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(responses[request.OperationName]))
+	}))
+	t.Cleanup(origin.Close)
+	return origin, &requests
+}
+
+func newTestConfig(origin string) *config.Config {
+	QueryStore = nil
+	ObjectStore = nil
+	Schema = nil
+	TrustedDocuments = nil
+	ScopeKeys = nil
+	return &config.Config{
+		Origin:          origin,
+		CacheBackend:    "in_memory",
+		CacheHeaderName: "x-orbit-cache",
+		CacheTTL:        300,
+		PrimaryKeyField: "id",
+	}
+}
+
+func sendTestRequest(cfg *config.Config, request map[string]interface{}) *httptest.ResponseRecorder {
+	body, _ := json.Marshal(request)
+	r := httptest.NewRequest(http.MethodPost, "/graphql", bytes.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	CacheMiddleware(context.Background(), cfg, w, r)
+	return w
+}
+
+func TestCacheMiddlewareOperationName(t *testing.T) {
+	origin, requests := newTestOrigin(t, map[string]string{
+		"GetUser":    `{"data":{"__typename":"Query","user":{"__typename":"User","id":"1","name":"John Doe"}}}`,
+		"UpdateUser": `{"data":{"__typename":"Mutation","updateUser":{"__typename":"User","id":"1","name":"Jane Doe"}}}`,
+	})
+	cfg := newTestConfig(origin.URL)
+	query := `query GetUser { user(id: "1") { id name } } mutation UpdateUser { updateUser(id: "1", name: "Jane Doe") { id name } }`
+
+	w := sendTestRequest(cfg, map[string]interface{}{"query": query})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.JSONEq(t, `{"data":null,"errors":[{"message":"must provide operation name if query contains multiple operations"}]}`, w.Body.String())
+
+	w = sendTestRequest(cfg, map[string]interface{}{"query": query, "operationName": "DeleteUser"})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.JSONEq(t, `{"data":null,"errors":[{"message":"unknown operation named \"DeleteUser\""}]}`, w.Body.String())
+	assert.Len(t, *requests, 0)
+
+	w = sendTestRequest(cfg, map[string]interface{}{"query": query, "operationName": "GetUser"})
+	assert.Equal(t, CACHE_STATUS_MISS, w.Header().Get(cfg.CacheHeaderName))
+	w = sendTestRequest(cfg, map[string]interface{}{"query": query, "operationName": "GetUser"})
+	assert.Equal(t, CACHE_STATUS_HIT, w.Header().Get(cfg.CacheHeaderName))
+	assert.JSONEq(t, `{"data":{"user":{"id":"1","name":"John Doe"}},"errors":null}`, w.Body.String())
+
+	// the mutation of the same document is not cached and invalidates the user
+	w = sendTestRequest(cfg, map[string]interface{}{"query": query, "operationName": "UpdateUser"})
+	assert.Equal(t, CACHE_STATUS_BYPASS, w.Header().Get(cfg.CacheHeaderName))
+	w = sendTestRequest(cfg, map[string]interface{}{"query": query, "operationName": "GetUser"})
+	assert.Equal(t, CACHE_STATUS_MISS, w.Header().Get(cfg.CacheHeaderName))
+
+	assert.Len(t, *requests, 3)
+	assert.Equal(t, "UpdateUser", (*requests)[1].OperationName)
+}
+
+func TestCacheMiddlewareRejectsInvalidDocuments(t *testing.T) {
+	origin, requests := newTestOrigin(t, map[string]string{
+		"GetUser": `{"data":{"__typename":"Query","user":{"__typename":"User","id":"1","name":"John Doe"}}}`,
+	})
+	cfg := newTestConfig(origin.URL)
+	cfg.SchemaPath = "../../graphcache/testdata/schema/schema.graphql"
+	assert.Nil(t, LoadSchema(cfg))
+
+	w := sendTestRequest(cfg, map[string]interface{}{"query": `query GetUser { user(id: "1") { id email } }`})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.JSONEq(t, `{"data":null,"errors":[{"message":"Cannot query field \"email\" on type \"User\".","locations":[{"line":1,"column":36}],"extensions":{"code":"GRAPHQL_VALIDATION_FAILED"}}]}`, w.Body.String())
+	assert.Len(t, *requests, 0)
+
+	w = sendTestRequest(cfg, map[string]interface{}{"query": `query GetUser { user(id: "1") { id name } }`})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, CACHE_STATUS_MISS, w.Header().Get(cfg.CacheHeaderName))
+	assert.Len(t, *requests, 1)
+}
+
+func TestFlushByTypeHandlerKeys(t *testing.T) {
+	origin, requests := newTestOrigin(t, map[string]string{
+		"GetMembership": `{"data":{"__typename":"Query","membership":{"__typename":"Membership","orgId":"1","userId":"2","role":"ADMIN"}}}`,
+	})
+	cfg := newTestConfig(origin.URL)
+	cfg.Types = map[string]config.TypeConfig{"Membership": {KeyFields: []interface{}{"orgId", "userId"}}}
+	query := `query GetMembership { membership(orgId: "1", userId: "2") { orgId userId role } }`
+
+	sendTestRequest(cfg, map[string]interface{}{"query": query})
+	w := sendTestRequest(cfg, map[string]interface{}{"query": query})
+	assert.Equal(t, CACHE_STATUS_HIT, w.Header().Get(cfg.CacheHeaderName))
+
+	flush := func(body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		GetFlushCacheByTypeHandler(cfg)(w, httptest.NewRequest(http.MethodPost, "/flush.type", bytes.NewReader([]byte(body))))
+		return w
+	}
+	assert.Equal(t, http.StatusBadRequest, flush(`{"type":"Membership","keys":{"orgId":"1"}}`).Code)
+	assert.Equal(t, http.StatusOK, flush(`{"type":"Membership","keys":{"userId":"2","orgId":"1"}}`).Code)
+
+	w = sendTestRequest(cfg, map[string]interface{}{"query": query})
+	assert.Equal(t, CACHE_STATUS_MISS, w.Header().Get(cfg.CacheHeaderName))
+	assert.Len(t, *requests, 2)
+}
+
+func TestCacheMiddlewareObjectIDs(t *testing.T) {
+	origin, requests := newTestOrigin(t, map[string]string{
+		"GetUser":     `{"data":{"__typename":"Query","user":{"__typename":"User","id":1,"name":"John Doe"}}}`,
+		"GetSettings": `{"data":{"__typename":"Query","settings":{"__typename":"Settings","id":true,"theme":"dark"}}}`,
+	})
+	cfg := newTestConfig(origin.URL)
+	cfg.Types = map[string]config.TypeConfig{"Query": {Fields: map[string]config.FieldConfig{"user": {Returns: "User"}}}}
+
+	// numeric ids are cached like string ids
+	w := sendTestRequest(cfg, map[string]interface{}{"query": `query GetUser { user(id: 1) { id name } }`})
+	assert.Equal(t, CACHE_STATUS_MISS, w.Header().Get(cfg.CacheHeaderName))
+	w = sendTestRequest(cfg, map[string]interface{}{"query": `query GetUser { user(id: "1") { name } }`})
+	assert.Equal(t, CACHE_STATUS_HIT, w.Header().Get(cfg.CacheHeaderName))
+	assert.JSONEq(t, `{"data":{"user":{"name":"John Doe"}},"errors":null}`, w.Body.String())
+
+	// an id that can't be part of a cache key is passed through without caching the response
+	for i := 0; i < 2; i++ {
+		w = sendTestRequest(cfg, map[string]interface{}{"query": `query GetSettings { settings { id theme } }`})
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, CACHE_STATUS_BYPASS, w.Header().Get(cfg.CacheHeaderName))
+		assert.JSONEq(t, `{"data":{"settings":{"id":true,"theme":"dark"}},"errors":null}`, w.Body.String())
+	}
+	assert.Len(t, *requests, 3)
+}
+
+func TestCacheMiddlewareMutationRules(t *testing.T) {
+	origin, requests := newTestOrigin(t, map[string]string{
+		"GetUser":    `{"data":{"__typename":"Query","user":{"__typename":"User","id":"1","completionRate":0.5}}}`,
+		"MarkAsDone": `{"data":{"__typename":"Mutation","markAsDone":{"__typename":"Todo","id":"7","done":true}}}`,
+	})
+	cfg := newTestConfig(origin.URL)
+	cfg.Mutations = map[string]config.MutationConfig{
+		"markAsDone": {InvalidateKeys: []string{"User:{{params.userId}}"}},
+	}
+
+	getUser := map[string]interface{}{"query": `query GetUser { user(id: "1") { id completionRate } }`}
+	sendTestRequest(cfg, getUser)
+	w := sendTestRequest(cfg, getUser)
+	assert.Equal(t, CACHE_STATUS_HIT, w.Header().Get(cfg.CacheHeaderName))
+
+	// marking a todo as done changes the completion rate of its user, which the mutation doesn't return
+	sendTestRequest(cfg, map[string]interface{}{
+		"query":     `mutation MarkAsDone($id: ID!, $userId: ID!) { markAsDone(id: $id, userId: $userId) { id done } }`,
+		"variables": map[string]interface{}{"id": "7", "userId": "1"},
+	})
+	w = sendTestRequest(cfg, getUser)
+	assert.Equal(t, CACHE_STATUS_MISS, w.Header().Get(cfg.CacheHeaderName))
+	assert.Len(t, *requests, 3)
+}
+
+func TestCacheMiddlewareResponsesWithErrors(t *testing.T) {
+	origin, requests := newTestOrigin(t, map[string]string{
+		"GetUser":     `{"data":{"__typename":"Query","user":{"__typename":"User","id":"1","name":"John Doe","email":null}},"errors":[{"message":"forbidden","path":["user","email"]}]}`,
+		"GetUserName": `{"data":{"__typename":"Query","user":{"__typename":"User","id":"1","name":"John Doe"}}}`,
+	})
+	getUser := map[string]interface{}{"query": `query GetUser { user(id: "1") { id name email } }`}
+	getUserName := map[string]interface{}{"query": `query GetUserName { user(id: "1") { id name } }`}
+
+	// responses with errors are passed through without caching them
+	cfg := newTestConfig(origin.URL)
+	w := sendTestRequest(cfg, getUser)
+	assert.Equal(t, CACHE_STATUS_BYPASS, w.Header().Get(cfg.CacheHeaderName))
+	assert.JSONEq(t, `{"data":{"user":{"id":"1","name":"John Doe","email":null}},"errors":[{"message":"forbidden","path":["user","email"]}]}`, w.Body.String())
+	w = sendTestRequest(cfg, getUserName)
+	assert.Equal(t, CACHE_STATUS_MISS, w.Header().Get(cfg.CacheHeaderName))
+	assert.Len(t, *requests, 2)
+
+	// an operation caching partial data caches the fields without errors
+	cfg = newTestConfig(origin.URL)
+	cfg.Operations = map[string]config.OperationConfig{"GetUser": {CachePartialData: true}}
+	w = sendTestRequest(cfg, getUser)
+	assert.Equal(t, CACHE_STATUS_MISS, w.Header().Get(cfg.CacheHeaderName))
+	w = sendTestRequest(cfg, getUserName)
+	assert.Equal(t, CACHE_STATUS_HIT, w.Header().Get(cfg.CacheHeaderName))
+	assert.Len(t, *requests, 3)
+}
+
+func TestCacheMiddlewareOriginErrors(t *testing.T) {
+	status := http.StatusOK
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		request := graphcache.GraphQLRequest{}
+		json.Unmarshal(body, &request)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		if request.OperationName == "UpdateUser" {
+			w.Write([]byte(`{"data":{"__typename":"Mutation","updateUser":{"__typename":"User","id":"1","name":"Jane Doe"}}}`))
+			return
+		}
+		w.Write([]byte(`{"data":{"__typename":"Query","user":{"__typename":"User","id":"1","name":"John Doe"}}}`))
+	}))
+	defer origin.Close()
+	cfg := newTestConfig(origin.URL)
+	getUser := map[string]interface{}{"query": `query GetUser { user(id: "1") { id name } }`}
+
+	// a response with a status other than 2xx isn't cached
+	status = http.StatusBadGateway
+	w := sendTestRequest(cfg, getUser)
+	assert.Equal(t, http.StatusBadGateway, w.Code)
+	assert.Equal(t, CACHE_STATUS_BYPASS, w.Header().Get(cfg.CacheHeaderName))
+
+	status = http.StatusOK
+	w = sendTestRequest(cfg, getUser)
+	assert.Equal(t, CACHE_STATUS_MISS, w.Header().Get(cfg.CacheHeaderName))
+
+	// a failed mutation doesn't invalidate the cache
+	status = http.StatusInternalServerError
+	sendTestRequest(cfg, map[string]interface{}{"query": `mutation UpdateUser { updateUser(id: "1", name: "Jane Doe") { id name } }`})
+	w = sendTestRequest(cfg, getUser)
+	assert.Equal(t, CACHE_STATUS_HIT, w.Header().Get(cfg.CacheHeaderName))
+}
+
+func TestCacheMiddlewareMaxAges(t *testing.T) {
+	origin, requests := newTestOrigin(t, map[string]string{
+		"GetUser":  `{"data":{"__typename":"Query","user":{"__typename":"User","id":"1","name":"John Doe","email":"john@example.com"}}}`,
+		"GetEmail": `{"data":{"__typename":"Query","user":{"__typename":"User","email":"john@example.com"}}}`,
+	})
+	cfg := newTestConfig(origin.URL)
+	noCache := 0
+	cfg.Types = map[string]config.TypeConfig{
+		"User":  {Fields: map[string]config.FieldConfig{"email": {MaxAge: &noCache}}},
+		"Query": {Fields: map[string]config.FieldConfig{"user": {Returns: "User"}}},
+	}
+
+	sendTestRequest(cfg, map[string]interface{}{"query": `query GetUser { user(id: "1") { id name email } }`})
+	w := sendTestRequest(cfg, map[string]interface{}{"query": `query GetName { user(id: "1") { id name } }`})
+	assert.Equal(t, CACHE_STATUS_HIT, w.Header().Get(cfg.CacheHeaderName))
+
+	// the email is fetched from the origin every time
+	w = sendTestRequest(cfg, map[string]interface{}{"query": `query GetEmail { user(id: "1") { email } }`})
+	assert.NotEqual(t, CACHE_STATUS_HIT, w.Header().Get(cfg.CacheHeaderName))
+	assert.JSONEq(t, `{"data":{"user":{"email":"john@example.com"}},"errors":null}`, w.Body.String())
+	assert.Len(t, *requests, 3)
+}
+
+func TestCacheMiddlewareStaleWhileRevalidate(t *testing.T) {
+	var requests atomic.Int32
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := "John Doe"
+		if requests.Add(1) > 1 {
+			name = "Jane Doe"
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"data":{"__typename":"Query","user":{"__typename":"User","id":"1","name":"` + name + `"}}}`))
+	}))
+	defer origin.Close()
+	cfg := newTestConfig(origin.URL)
+	noCache := 0
+	cfg.Types = map[string]config.TypeConfig{"User": {MaxAge: &noCache}}
+	cfg.Operations = map[string]config.OperationConfig{"GetUser": {StaleWhileRevalidate: 60}}
+	getUser := map[string]interface{}{"query": `query GetUser { user(id: "1") { id name } }`}
+
+	w := sendTestRequest(cfg, getUser)
+	assert.Equal(t, CACHE_STATUS_MISS, w.Header().Get(cfg.CacheHeaderName))
+
+	// the expired response is served while it's refreshed in the background
+	w = sendTestRequest(cfg, getUser)
+	assert.Equal(t, CACHE_STATUS_STALE, w.Header().Get(cfg.CacheHeaderName))
+	assert.JSONEq(t, `{"data":{"user":{"id":"1","name":"John Doe"}},"errors":null}`, w.Body.String())
+	assert.Eventually(t, func() bool { return requests.Load() == 2 }, time.Second, 10*time.Millisecond)
+	assert.Eventually(t, func() bool {
+		w = sendTestRequest(cfg, getUser)
+		return w.Header().Get(cfg.CacheHeaderName) == CACHE_STATUS_STALE && strings.Contains(w.Body.String(), "Jane Doe")
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestCacheMiddlewareStaleDocuments(t *testing.T) {
+	var requests atomic.Int32
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		requests.Add(1)
+		w.Header().Set("Content-Type", "application/json")
+		if strings.Contains(string(body), "email") {
+			w.Write([]byte(`{"data":{"__typename":"Query","user":{"__typename":"User","id":"1","email":"john@example.com"}}}`))
+			return
+		}
+		w.Write([]byte(`{"data":{"__typename":"Query","user":{"__typename":"User","id":"1","name":"John Doe"}}}`))
+	}))
+	defer origin.Close()
+	cfg := newTestConfig(origin.URL)
+	noCache := 0
+	cfg.Types = map[string]config.TypeConfig{"User": {MaxAge: &noCache}}
+	cfg.Operations = map[string]config.OperationConfig{"GetUser": {StaleWhileRevalidate: 60}}
+	getName := map[string]interface{}{"query": `query GetUser { user(id: "1") { id name } }`}
+	getEmail := map[string]interface{}{"query": `query GetUser { user(id: "1") { id email } }`}
+
+	w := sendTestRequest(cfg, getName)
+	assert.Equal(t, CACHE_STATUS_MISS, w.Header().Get(cfg.CacheHeaderName))
+
+	// documents with the same operation name and variables keep stale responses of their own
+	w = sendTestRequest(cfg, getEmail)
+	assert.Equal(t, CACHE_STATUS_MISS, w.Header().Get(cfg.CacheHeaderName))
+	assert.JSONEq(t, `{"data":{"user":{"id":"1","email":"john@example.com"}},"errors":null}`, w.Body.String())
+
+	// and are revalidated on their own
+	w = sendTestRequest(cfg, getName)
+	assert.Equal(t, CACHE_STATUS_STALE, w.Header().Get(cfg.CacheHeaderName))
+	assert.JSONEq(t, `{"data":{"user":{"id":"1","name":"John Doe"}},"errors":null}`, w.Body.String())
+	w = sendTestRequest(cfg, getEmail)
+	assert.Equal(t, CACHE_STATUS_STALE, w.Header().Get(cfg.CacheHeaderName))
+	assert.JSONEq(t, `{"data":{"user":{"id":"1","email":"john@example.com"}},"errors":null}`, w.Body.String())
+	assert.Eventually(t, func() bool { return requests.Load() == 4 }, time.Second, 10*time.Millisecond)
+}
+
+func TestRevalidateResponseAfterRequest(t *testing.T) {
+	origin, requests := newTestOrigin(t, map[string]string{
+		"GetProfile": `{"data":{"__typename":"Query","user":{"__typename":"User","id":"2","name":"Jane Doe"}}}`,
+	})
+	cfg := newTestConfig(origin.URL)
+	getProfile := map[string]interface{}{"query": `query GetProfile { user(id: "2") { id name } }`}
+
+	// the stale response was served and the context of the request canceled before it is refreshed
+	r := httptest.NewRequest(http.MethodPost, origin.URL, nil)
+	scopeValues, err := GetScopeValues(cfg, r)
+	assert.Nil(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	cache := graphcache.NewGraphCacheWithOptions(ctx, GetCacheOptions(cfg, scopeValues))
+	cancel()
+	RevalidateResponse(ctx, cfg, cache, r, graphcache.GraphQLRequest{OperationName: "GetProfile", Query: `query GetProfile { user(id: "2") { id name __typename } __typename }`})
+	assert.Len(t, *requests, 1)
+
+	w := sendTestRequest(cfg, getProfile)
+	assert.Equal(t, CACHE_STATUS_HIT, w.Header().Get(cfg.CacheHeaderName))
+	assert.Len(t, *requests, 1)
+}
+
+func TestCacheMiddlewarePartialResponses(t *testing.T) {
+	var status atomic.Int32
+	status.Store(http.StatusOK)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(int(status.Load()))
+		if strings.Contains(string(body), "email") {
+			w.Write([]byte(`{"data":{"__typename":"Query","user":{"__typename":"User","id":"1","email":"john@example.com"}}}`))
+			return
+		}
+		w.Write([]byte(`{"data":{"__typename":"Query","user":{"__typename":"User","id":"1","name":"John Doe"}}}`))
+	}))
+	defer origin.Close()
+	cfg := newTestConfig(origin.URL)
+	maxAge := 1
+	cfg.Types = map[string]config.TypeConfig{
+		"User":  {MaxAge: &maxAge},
+		"Query": {Fields: map[string]config.FieldConfig{"user": {Returns: "User"}}},
+	}
+	cfg.Operations = map[string]config.OperationConfig{"GetUser": {StaleIfError: 60}}
+	getUser := map[string]interface{}{"query": `query GetUser { user(id: "1") { id name email } }`}
+
+	w := sendTestRequest(cfg, map[string]interface{}{"query": `query GetName { user(id: "1") { id name } }`})
+	assert.Equal(t, CACHE_STATUS_MISS, w.Header().Get(cfg.CacheHeaderName))
+
+	// the response for the missing fields is checked like any response of the origin
+	status.Store(http.StatusNonAuthoritativeInfo)
+	w = sendTestRequest(cfg, getUser)
+	assert.Equal(t, CACHE_STATUS_PARTIAL, w.Header().Get(cfg.CacheHeaderName))
+	assert.JSONEq(t, `{"data":{"user":{"id":"1","name":"John Doe","email":"john@example.com"}},"errors":null}`, w.Body.String())
+
+	// and the response served is kept to be served stale
+	time.Sleep(1100 * time.Millisecond)
+	status.Store(http.StatusServiceUnavailable)
+	w = sendTestRequest(cfg, getUser)
+	assert.Equal(t, CACHE_STATUS_STALE, w.Header().Get(cfg.CacheHeaderName))
+	assert.JSONEq(t, `{"data":{"user":{"id":"1","name":"John Doe","email":"john@example.com"}},"errors":null}`, w.Body.String())
+}
+
+func TestCacheMiddlewareStaleIfError(t *testing.T) {
+	status := http.StatusOK
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		w.Write([]byte(`{"data":{"__typename":"Query","user":{"__typename":"User","id":"1","name":"John Doe"}}}`))
+	}))
+	cfg := newTestConfig(origin.URL)
+	noCache := 0
+	cfg.Types = map[string]config.TypeConfig{"User": {MaxAge: &noCache}}
+	cfg.Operations = map[string]config.OperationConfig{"GetUser": {StaleIfError: 60}}
+	getUser := map[string]interface{}{"query": `query GetUser { user(id: "1") { id name } }`}
+	getName := map[string]interface{}{"query": `query GetName { user(id: "1") { id name } }`}
+
+	w := sendTestRequest(cfg, getUser)
+	assert.Equal(t, CACHE_STATUS_MISS, w.Header().Get(cfg.CacheHeaderName))
+	sendTestRequest(cfg, getName)
+
+	// the expired response is only served when the origin fails
+	w = sendTestRequest(cfg, getUser)
+	assert.Equal(t, CACHE_STATUS_MISS, w.Header().Get(cfg.CacheHeaderName))
+
+	status = http.StatusServiceUnavailable
+	w = sendTestRequest(cfg, getUser)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, CACHE_STATUS_STALE, w.Header().Get(cfg.CacheHeaderName))
+	assert.JSONEq(t, `{"data":{"user":{"id":"1","name":"John Doe"}},"errors":null}`, w.Body.String())
+
+	// operations without stale-if-error pass the failure through
+	w = sendTestRequest(cfg, getName)
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+
+	origin.Close()
+	w = sendTestRequest(cfg, getUser)
+	assert.Equal(t, CACHE_STATUS_STALE, w.Header().Get(cfg.CacheHeaderName))
+}
+
+func TestCacheMiddlewareCoalescing(t *testing.T) {
+	var requests atomic.Int32
+	release := make(chan struct{})
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		<-release
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"data":{"__typename":"Query","user":{"__typename":"User","id":"1","name":"John Doe"}}}`))
+	}))
+	defer origin.Close()
+	cfg := newTestConfig(origin.URL)
+	cfg.Coalescing = true
+	cfg.CoalescingTimeout = 10
+	cfg.CoalescingMaxWaiters = 3
+	getUser := map[string]interface{}{"query": `query GetUser { user(id: "1") { id name } }`}
+
+	responses := make(chan *httptest.ResponseRecorder, 5)
+	for i := 0; i < 5; i++ {
+		go func() { responses <- sendTestRequest(cfg, getUser) }()
+	}
+	// the requests over the waiters cap of the request in flight send their own
+	assert.Eventually(t, func() bool { return requests.Load() == 2 }, time.Second, 10*time.Millisecond)
+	close(release)
+
+	for i := 0; i < 5; i++ {
+		w := <-responses
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.JSONEq(t, `{"data":{"user":{"id":"1","name":"John Doe"}},"errors":null}`, w.Body.String())
+	}
+	assert.Equal(t, int32(2), requests.Load())
+}
+
+func TestCacheMiddlewareCoalescingDocuments(t *testing.T) {
+	var requests atomic.Int32
+	release := make(chan struct{})
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		requests.Add(1)
+		<-release
+		w.Header().Set("Content-Type", "application/json")
+		if strings.Contains(string(body), "email") {
+			w.Write([]byte(`{"data":{"__typename":"Query","user":{"__typename":"User","id":"1","email":"john@example.com"}}}`))
+			return
+		}
+		w.Write([]byte(`{"data":{"__typename":"Query","user":{"__typename":"User","id":"1","name":"John Doe"}}}`))
+	}))
+	defer origin.Close()
+	cfg := newTestConfig(origin.URL)
+	cfg.Coalescing = true
+	cfg.CoalescingTimeout = 10
+	cfg.CoalescingMaxWaiters = 3
+
+	// anonymous documents have the same operation name and variables, but not the same response
+	names := make(chan *httptest.ResponseRecorder, 1)
+	emails := make(chan *httptest.ResponseRecorder, 1)
+	go func() {
+		names <- sendTestRequest(cfg, map[string]interface{}{"query": `{ user(id: "1") { id name } }`})
+	}()
+	go func() {
+		emails <- sendTestRequest(cfg, map[string]interface{}{"query": `{ user(id: "1") { id email } }`})
+	}()
+	assert.Eventually(t, func() bool { return requests.Load() == 2 }, time.Second, 10*time.Millisecond)
+	close(release)
+
+	assert.JSONEq(t, `{"data":{"user":{"id":"1","name":"John Doe"}},"errors":null}`, (<-names).Body.String())
+	assert.JSONEq(t, `{"data":{"user":{"id":"1","email":"john@example.com"}},"errors":null}`, (<-emails).Body.String())
+}
+
+func TestCoalescerTimeout(t *testing.T) {
+	c := NewCoalescer()
+	inflight, first, err := c.Join("GetUser", 10)
+	assert.Nil(t, err)
+	assert.True(t, first)
+
+	waiting, first, err := c.Join("GetUser", 10)
+	assert.Nil(t, err)
+	assert.False(t, first)
+	_, err = waiting.Wait(10 * time.Millisecond)
+	assert.Equal(t, errCoalescingTimeout, err)
+
+	c.Done("GetUser", inflight, &CoalescedResponse{status: http.StatusOK})
+	response, err := waiting.Wait(10 * time.Millisecond)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, response.status)
+
+	// the next request is sent again
+	_, first, _ = c.Join("GetUser", 10)
+	assert.True(t, first)
+}
+
+func TestWaitForCachedResponse(t *testing.T) {
+	origin, _ := newTestOrigin(t, map[string]string{})
+	cfg := newTestConfig(origin.URL)
+	cfg.CoalescingTimeout = 1
+	gc := graphcache.NewGraphCacheWithOptions(context.Background(), GetCacheOptions(cfg, nil))
+	request := graphcache.GraphQLRequest{Query: `query GetUser { user(id: "1") { id name } }`}
+	astQuery, _ := graphcache.GetASTFromQuery(request.Query)
+	operation := astQuery.Operations[0]
+
+	// another proxy is fetching the operation
+	assert.True(t, gc.LockOperation(operation, nil, time.Second))
+	assert.False(t, gc.LockOperation(operation, nil, time.Second))
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		transformed, _ := graphcache.AddTypenameToQuery(request.Query)
+		astWithTypes, _ := graphcache.GetASTFromQuery(transformed)
+		response := map[string]interface{}{}
+		json.Unmarshal([]byte(`{"data":{"__typename":"Query","user":{"__typename":"User","id":"1","name":"John Doe"}}}`), &response)
+		gc.CacheOperation(astWithTypes.Operations[0], response, nil)
+		gc.CacheResponse("data", gc.ResponseWithStorageKeys(astWithTypes.Operations[0], response, nil), nil)
+		gc.UnlockOperation(operation, nil)
+	}()
+	cachedResponse, ok := WaitForCachedResponse(cfg, gc, astQuery, operation, request)
+	assert.True(t, ok)
+	assert.NotNil(t, cachedResponse)
+
+	// the proxy fetches the operation itself when the lock is released without a response
+	gc.FlushByType("User", "1")
+	_, ok = WaitForCachedResponse(cfg, gc, astQuery, operation, request)
+	assert.False(t, ok)
+	assert.True(t, gc.LockOperation(operation, nil, time.Second))
+}
+
+func TestCacheMiddlewarePersistedQueries(t *testing.T) {
+	origin, requests := newTestOrigin(t, map[string]string{
+		"GetUser": `{"data":{"__typename":"Query","user":{"__typename":"User","id":"1","name":"John Doe"}}}`,
+	})
+	cfg := newTestConfig(origin.URL)
+	cfg.PersistedQueries = true
+	query := `query GetUser { user(id: "1") { id name } }`
+	sum := sha256.Sum256([]byte(query))
+	extensions := map[string]interface{}{"persistedQuery": map[string]interface{}{"version": 1, "sha256Hash": hex.EncodeToString(sum[:])}}
+
+	// an unknown hash asks the client for the query
+	w := sendTestRequest(cfg, map[string]interface{}{"extensions": extensions})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"data":null,"errors":[{"message":"PersistedQueryNotFound","extensions":{"code":"PERSISTED_QUERY_NOT_FOUND"}}]}`, w.Body.String())
+	assert.Len(t, *requests, 0)
+
+	w = sendTestRequest(cfg, map[string]interface{}{"query": query, "extensions": extensions})
+	assert.Equal(t, CACHE_STATUS_MISS, w.Header().Get(cfg.CacheHeaderName))
+	assert.Len(t, *requests, 1)
+	assert.Nil(t, (*requests)[0].Extensions)
+
+	w = sendTestRequest(cfg, map[string]interface{}{"extensions": extensions})
+	assert.Equal(t, CACHE_STATUS_HIT, w.Header().Get(cfg.CacheHeaderName))
+	assert.JSONEq(t, `{"data":{"user":{"id":"1","name":"John Doe"}},"errors":null}`, w.Body.String())
+
+	// persisted queries can be sent with GET
+	encoded, _ := json.Marshal(extensions)
+	r := httptest.NewRequest(http.MethodGet, "/graphql?extensions="+url.QueryEscape(string(encoded)), nil)
+	w = httptest.NewRecorder()
+	CacheMiddleware(context.Background(), cfg, w, r)
+	assert.Equal(t, CACHE_STATUS_HIT, w.Header().Get(cfg.CacheHeaderName))
+
+	// a query that doesn't match its hash isn't registered
+	w = sendTestRequest(cfg, map[string]interface{}{"query": `query GetUsers { users { id } }`, "extensions": extensions})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Len(t, *requests, 1)
+}
+
+func TestCacheMiddlewarePersistedQueryDocuments(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/json")
+		if strings.Contains(string(body), "email") {
+			w.Write([]byte(`{"data":{"__typename":"Query","user":{"__typename":"User","id":"1","email":"john@example.com"}}}`))
+			return
+		}
+		w.Write([]byte(`{"data":{"__typename":"Query","user":{"__typename":"User","id":"1","name":"John Doe"}}}`))
+	}))
+	defer origin.Close()
+	cfg := newTestConfig(origin.URL)
+	cfg.PersistedQueries = true
+	noCache := 0
+	cfg.Types = map[string]config.TypeConfig{"User": {MaxAge: &noCache}}
+	cfg.Operations = map[string]config.OperationConfig{"GetUser": {StaleIfError: 60}}
+	extensions := func(query string) map[string]interface{} {
+		sum := sha256.Sum256([]byte(query))
+		return map[string]interface{}{"persistedQuery": map[string]interface{}{"version": 1, "sha256Hash": hex.EncodeToString(sum[:])}}
+	}
+	getName := `query GetUser { user(id: "1") { id name } }`
+	getEmail := `query GetUser { user(id: "1") { id email } }`
+	sendTestRequest(cfg, map[string]interface{}{"query": getName, "extensions": extensions(getName)})
+	sendTestRequest(cfg, map[string]interface{}{"query": getEmail, "extensions": extensions(getEmail)})
+
+	// every persisted document is served the response kept for it
+	origin.Close()
+	w := sendTestRequest(cfg, map[string]interface{}{"extensions": extensions(getName)})
+	assert.Equal(t, CACHE_STATUS_STALE, w.Header().Get(cfg.CacheHeaderName))
+	assert.JSONEq(t, `{"data":{"user":{"id":"1","name":"John Doe"}},"errors":null}`, w.Body.String())
+	w = sendTestRequest(cfg, map[string]interface{}{"extensions": extensions(getEmail)})
+	assert.Equal(t, CACHE_STATUS_STALE, w.Header().Get(cfg.CacheHeaderName))
+	assert.JSONEq(t, `{"data":{"user":{"id":"1","email":"john@example.com"}},"errors":null}`, w.Body.String())
+}
+
+func TestCacheMiddlewareTrustedDocuments(t *testing.T) {
+	origin, requests := newTestOrigin(t, map[string]string{
+		"GetUser":  `{"data":{"__typename":"Query","user":{"__typename":"User","id":"1","name":"John Doe"}}}`,
+		"GetUsers": `{"data":{"__typename":"Query","users":[{"__typename":"User","id":"1"}]}}`,
+	})
+	cfg := newTestConfig(origin.URL)
+	documents, err := graphcache.ParseTrustedDocuments([]byte(`{"abc":"query GetUser { user(id: \"1\") { id name } }"}`))
+	assert.Nil(t, err)
+	TrustedDocuments = documents
+
+	w := sendTestRequest(cfg, map[string]interface{}{"query": "query GetUser {\n  user(id: \"1\") { id name }\n}"})
+	assert.Equal(t, CACHE_STATUS_MISS, w.Header().Get(cfg.CacheHeaderName))
+
+	// trusted documents can be sent with only their hash
+	w = sendTestRequest(cfg, map[string]interface{}{"extensions": map[string]interface{}{"persistedQuery": map[string]interface{}{"version": 1, "sha256Hash": "abc"}}})
+	assert.Equal(t, CACHE_STATUS_HIT, w.Header().Get(cfg.CacheHeaderName))
+
+	getUsers := map[string]interface{}{"query": `query GetUsers { users { id } }`}
+	w = sendTestRequest(cfg, getUsers)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.JSONEq(t, `{"data":null,"errors":[{"message":"operation is not in the trusted documents","extensions":{"code":"OPERATION_NOT_TRUSTED"}}]}`, w.Body.String())
+	assert.Len(t, *requests, 1)
+
+	// in report mode the documents that aren't trusted are only logged
+	cfg.TrustedDocumentsMode = config.TRUSTED_DOCUMENTS_REPORT
+	w = sendTestRequest(cfg, getUsers)
+	assert.Equal(t, CACHE_STATUS_MISS, w.Header().Get(cfg.CacheHeaderName))
+	assert.Len(t, *requests, 2)
+}
+
+func TestCacheMiddlewareTrustedDocumentsPersistedQueries(t *testing.T) {
+	origin, requests := newTestOrigin(t, map[string]string{
+		"GetUser":  `{"data":{"__typename":"Query","user":{"__typename":"User","id":"1","name":"John Doe"}}}`,
+		"GetUsers": `{"data":{"__typename":"Query","users":[{"__typename":"User","id":"1"}]}}`,
+	})
+	cfg := newTestConfig(origin.URL)
+	cfg.PersistedQueries = true
+	documents, err := graphcache.ParseTrustedDocuments([]byte(`{"abc":"query GetUser { user(id: \"1\") { id name } }"}`))
+	assert.Nil(t, err)
+	TrustedDocuments = documents
+	query := `query GetUsers { users { id } }`
+	sum := sha256.Sum256([]byte(query))
+	hash := hex.EncodeToString(sum[:])
+	extensions := map[string]interface{}{"persistedQuery": map[string]interface{}{"version": 1, "sha256Hash": hash}}
+	persisted := func() bool {
+		cache := graphcache.NewGraphCacheWithOptions(context.Background(), GetCacheOptions(cfg, nil))
+		_, err := cache.PersistedQuery(hash)
+		return err == nil
+	}
+
+	// trusted documents are sent with their hash from the manifest
+	w := sendTestRequest(cfg, map[string]interface{}{"extensions": map[string]interface{}{"persistedQuery": map[string]interface{}{"version": 1, "sha256Hash": "abc"}}})
+	assert.Equal(t, CACHE_STATUS_MISS, w.Header().Get(cfg.CacheHeaderName))
+
+	// a document that isn't trusted is rejected before it is registered
+	w = sendTestRequest(cfg, map[string]interface{}{"query": query, "extensions": extensions})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.False(t, persisted())
+
+	// in report mode it is executed, but still never registered
+	cfg.TrustedDocumentsMode = config.TRUSTED_DOCUMENTS_REPORT
+	w = sendTestRequest(cfg, map[string]interface{}{"query": query, "extensions": extensions})
+	assert.Equal(t, CACHE_STATUS_MISS, w.Header().Get(cfg.CacheHeaderName))
+	assert.False(t, persisted())
+	w = sendTestRequest(cfg, map[string]interface{}{"extensions": extensions})
+	assert.JSONEq(t, `{"data":null,"errors":[{"message":"PersistedQueryNotFound","extensions":{"code":"PERSISTED_QUERY_NOT_FOUND"}}]}`, w.Body.String())
+	assert.Len(t, *requests, 2)
+}
+
+func TestCacheMiddlewareQueryLimits(t *testing.T) {
+	origin, requests := newTestOrigin(t, map[string]string{
+		"GetUser": `{"data":{"__typename":"Query","user":{"__typename":"User","id":"1","name":"John Doe"}}}`,
+	})
+	cfg := newTestConfig(origin.URL)
+	cfg.MaxDepth = 2
+	cfg.MaxCost = 10
+	cfg.DefaultListSize = 10
+
+	w := sendTestRequest(cfg, map[string]interface{}{"query": `query GetUser { user(id: "1") { id name } }`})
+	assert.Equal(t, CACHE_STATUS_MISS, w.Header().Get(cfg.CacheHeaderName))
+
+	w = sendTestRequest(cfg, map[string]interface{}{"query": `query GetTodos { user(id: "1") { todos(first: 20) { id } } }`})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.JSONEq(t, `{"data":null,"errors":[
+		{"message":"operation has a depth of 3, over the limit of 2","extensions":{"code":"MAX_DEPTH_EXCEEDED"}},
+		{"message":"operation has a cost over the limit of 10","extensions":{"code":"MAX_COST_EXCEEDED"}}
+	]}`, w.Body.String())
+	assert.Len(t, *requests, 1)
+}
+
+func TestCacheMiddlewareRateLimit(t *testing.T) {
+	origin, requests := newTestOrigin(t, map[string]string{
+		"GetUser":  `{"data":{"__typename":"Query","user":{"__typename":"User","id":"1","name":"John Doe"}}}`,
+		"GetUsers": `{"data":{"__typename":"Query","users":[{"__typename":"User","id":"1"}]}}`,
+	})
+	cfg := newTestConfig(origin.URL)
+	cfg.RateLimitHits = 1
+	cfg.RateLimitHitsBurst = 2
+	cfg.RateLimitMisses = 0.1
+	cfg.RateLimitMissesBurst = 1
+	cfg.ScopeHeaders = "Authorization"
+	getUser := map[string]interface{}{"query": `query GetUser { user(id: "1") { id name } }`}
+
+	w := sendTestRequest(cfg, getUser)
+	assert.Equal(t, CACHE_STATUS_MISS, w.Header().Get(cfg.CacheHeaderName))
+
+	// the requests sent to the origin and the ones served from the cache have their own budgets
+	w = sendTestRequest(cfg, map[string]interface{}{"query": `query GetUsers { users { id } }`})
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "10", w.Header().Get("Retry-After"))
+	assert.JSONEq(t, `{"data":null,"errors":[{"message":"too many requests","extensions":{"code":"RATE_LIMITED"}}]}`, w.Body.String())
+	assert.Len(t, *requests, 1)
+
+	for i := 0; i < 2; i++ {
+		w = sendTestRequest(cfg, getUser)
+		assert.Equal(t, CACHE_STATUS_HIT, w.Header().Get(cfg.CacheHeaderName))
+	}
+	w = sendTestRequest(cfg, getUser)
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "1", w.Header().Get("Retry-After"))
+
+	// every scope has its own budget
+	body, _ := json.Marshal(getUser)
+	r := httptest.NewRequest(http.MethodPost, "/graphql", bytes.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set("Authorization", "Bearer other")
+	w = httptest.NewRecorder()
+	CacheMiddleware(context.Background(), cfg, w, r)
+	assert.Equal(t, CACHE_STATUS_MISS, w.Header().Get(cfg.CacheHeaderName))
+}
+
+func signTestToken(secret string, claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]interface{}{"alg": "HS256", "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(signed))
+	return signed + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func TestCacheMiddlewareRateLimitByOperation(t *testing.T) {
+	origin, requests := newTestOrigin(t, map[string]string{
+		"GetUser": `{"data":{"__typename":"Query","user":{"__typename":"User","id":"1","name":"John Doe"}}}`,
+	})
+	cfg := newTestConfig(origin.URL)
+	cfg.RateLimitMisses = 0.1
+	cfg.RateLimitMissesBurst = 3
+	cfg.RateLimitByOperation = true
+	cfg.Operations = map[string]config.OperationConfig{"GetUser": {RateLimitMisses: 0.1, RateLimitMissesBurst: 1}}
+	getUsers := func(name string) map[string]interface{} {
+		return map[string]interface{}{"query": `query ` + name + ` { users { id } }`}
+	}
+
+	// an operation configured with a budget of its own is limited by it
+	w := sendTestRequest(cfg, map[string]interface{}{"query": `query GetUser { user(id: "1") { id name } }`})
+	assert.Equal(t, CACHE_STATUS_MISS, w.Header().Get(cfg.CacheHeaderName))
+	w = sendTestRequest(cfg, map[string]interface{}{"query": `query GetUser { user(id: "2") { id name } }`})
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+
+	// every request takes from the budget of the scope, a new operation name doesn't get a new budget
+	w = sendTestRequest(cfg, getUsers("GetUsers1"))
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = sendTestRequest(cfg, getUsers("GetUsers2"))
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = sendTestRequest(cfg, getUsers("GetUsers3"))
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Len(t, *requests, 3)
+}
+
+func TestCacheMiddlewareScopeJWTClaims(t *testing.T) {
+	origin, requests := newTestOrigin(t, map[string]string{
+		"GetUser": `{"data":{"__typename":"Query","user":{"__typename":"User","id":"1","name":"John Doe"}}}`,
+	})
+	cfg := newTestConfig(origin.URL)
+	cfg.ScopeHeaders = "Authorization"
+	cfg.ScopeJWTClaims = "tenant_id"
+	cfg.ScopeJWTHeader = "Authorization"
+	keys, err := auth.ParseKeySet([]byte(`{"keys":[{"kty":"oct","alg":"HS256","k":"` + base64.RawURLEncoding.EncodeToString([]byte("secret")) + `"}]}`))
+	assert.NoError(t, err)
+	ScopeKeys = keys
+	body, _ := json.Marshal(map[string]interface{}{"query": `query GetUser { user(id: "1") { id name } }`})
+	send := func(token string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/graphql", bytes.NewReader(body))
+		r.Header.Set("Content-Type", "application/json")
+		r.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		CacheMiddleware(context.Background(), cfg, w, r)
+		return w
+	}
+
+	w := send(signTestToken("secret", map[string]interface{}{"sub": "1", "tenant_id": "acme"}))
+	assert.Equal(t, CACHE_STATUS_MISS, w.Header().Get(cfg.CacheHeaderName))
+
+	// the users of a tenant share the cache, whatever their token
+	w = send(signTestToken("secret", map[string]interface{}{"sub": "2", "tenant_id": "acme", "iat": 1}))
+	assert.Equal(t, CACHE_STATUS_HIT, w.Header().Get(cfg.CacheHeaderName))
+	assert.Len(t, *requests, 1)
+
+	w = send(signTestToken("secret", map[string]interface{}{"sub": "3", "tenant_id": "globex"}))
+	assert.Equal(t, CACHE_STATUS_MISS, w.Header().Get(cfg.CacheHeaderName))
+	assert.Len(t, *requests, 2)
+
+	// a token that can't be verified is scoped by its raw value
+	forged := signTestToken("forged", map[string]interface{}{"sub": "4", "tenant_id": "acme"})
+	w = send(forged)
+	assert.Equal(t, CACHE_STATUS_MISS, w.Header().Get(cfg.CacheHeaderName))
+	assert.Len(t, *requests, 3)
+
+	// or rejected
+	cfg.ScopeJWTRejectInvalid = true
+	w = send(forged)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.JSONEq(t, `{"data":null,"errors":[{"message":"invalid token","extensions":{"code":"UNAUTHENTICATED"}}]}`, w.Body.String())
+	assert.Len(t, *requests, 3)
+
+	// the claims are only decoded when verification is skipped
+	cfg.ScopeJWTSkipVerification = true
+	w = send(forged)
+	assert.Equal(t, CACHE_STATUS_HIT, w.Header().Get(cfg.CacheHeaderName))
+	assert.Len(t, *requests, 3)
+}
+
+func TestCacheMiddlewarePublicScope(t *testing.T) {
+	origin, requests := newTestOrigin(t, map[string]string{
+		"GetProducts": `{"data":{"__typename":"Query","products":[{"__typename":"Product","id":"1","name":"Chair"}]}}`,
+		"GetMe":       `{"data":{"__typename":"Query","me":{"__typename":"User","id":"1","name":"John Doe"}}}`,
+	})
+	cfg := newTestConfig(origin.URL)
+	cfg.ScopeHeaders = "Authorization"
+	cfg.Types = map[string]config.TypeConfig{"Product": {Scope: "public"}}
+	send := func(query string, token string) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(map[string]interface{}{"query": query})
+		r := httptest.NewRequest(http.MethodPost, "/graphql", bytes.NewReader(body))
+		r.Header.Set("Content-Type", "application/json")
+		r.Header.Set("Authorization", token)
+		w := httptest.NewRecorder()
+		CacheMiddleware(context.Background(), cfg, w, r)
+		return w
+	}
+
+	w := send(`query GetProducts { products { id name } }`, "Bearer user1")
+	assert.Equal(t, CACHE_STATUS_MISS, w.Header().Get(cfg.CacheHeaderName))
+	w = send(`query GetMe { me { id name } }`, "Bearer user1")
+	assert.Equal(t, CACHE_STATUS_MISS, w.Header().Get(cfg.CacheHeaderName))
+
+	// public objects are cached once for every scope, private ones are not
+	w = send(`query GetProducts { products { id name } }`, "Bearer user2")
+	assert.Equal(t, CACHE_STATUS_HIT, w.Header().Get(cfg.CacheHeaderName))
+	assert.JSONEq(t, `{"data":{"products":[{"id":"1","name":"Chair"}]},"errors":null}`, w.Body.String())
+	w = send(`query GetMe { me { id name } }`, "Bearer user2")
+	assert.Equal(t, CACHE_STATUS_MISS, w.Header().Get(cfg.CacheHeaderName))
+	assert.Len(t, *requests, 3)
+}
@@ -12,12 +12,19 @@ import (
 type FlushCacheByTypeRequest struct {
 	Type string `json:"type"`
 	ID   string `json:"id"`
+	// Keys are the values of the key fields of the object, for types with more than one key field
+	Keys map[string]interface{} `json:"keys"`
 }
 
 func GetFlushCacheHandler(cfg *config.Config) http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		ctx := context.Background()
-		cache := graphcache.NewGraphCacheWithOptions(ctx, GetCacheOptions(cfg, GetScopeValues(cfg, r)))
+		scopeValues, err := GetScopeValues(cfg, r)
+		if err != nil {
+			http.Error(w, ErrInvalidToken.Message, http.StatusUnauthorized)
+			return
+		}
+		cache := graphcache.NewGraphCacheWithOptions(ctx, GetCacheOptions(cfg, scopeValues))
 		cache.Flush()
 		w.WriteHeader(http.StatusOK)
 		w.Write([]byte("success"))
@@ -27,7 +34,12 @@ func GetFlushCacheHandler(cfg *config.Config) http.HandlerFunc {
 func GetFlushCacheByTypeHandler(cfg *config.Config) http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		ctx := context.Background()
-		cache := graphcache.NewGraphCacheWithOptions(ctx, GetCacheOptions(cfg, GetScopeValues(cfg, r)))
+		scopeValues, err := GetScopeValues(cfg, r)
+		if err != nil {
+			http.Error(w, ErrInvalidToken.Message, http.StatusUnauthorized)
+			return
+		}
+		cache := graphcache.NewGraphCacheWithOptions(ctx, GetCacheOptions(cfg, scopeValues))
 		flushByTypeRequest := FlushCacheByTypeRequest{}
 		bytes, err := io.ReadAll(r.Body)
 		if err != nil {
@@ -40,7 +52,17 @@ func GetFlushCacheByTypeHandler(cfg *config.Config) http.HandlerFunc {
 			return
 		}
 
-		cache.FlushByType(flushByTypeRequest.Type, flushByTypeRequest.ID)
+		id := flushByTypeRequest.ID
+		if flushByTypeRequest.Keys != nil {
+			keysID, ok := cache.ObjectID(flushByTypeRequest.Type, flushByTypeRequest.Keys)
+			if !ok {
+				http.Error(w, "keys don't match the key fields of the type", http.StatusBadRequest)
+				return
+			}
+			id = keysID
+		}
+
+		cache.FlushByType(flushByTypeRequest.Type, id)
 		w.WriteHeader(http.StatusOK)
 		w.Write([]byte("success"))
 	})
@@ -0,0 +1,139 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"orbitgraphql/config"
+	"orbitgraphql/graphcache"
+	"sync"
+	"time"
+
+	"github.com/vektah/gqlparser/v2/ast"
+)
+
+// COALESCING_POLL_INTERVAL is how often the cache is checked for a response another proxy is fetching
+const COALESCING_POLL_INTERVAL = 50 * time.Millisecond
+
+// CoalescedResponse is the response of a request to the origin that identical requests waited for
+type CoalescedResponse struct {
+	status int
+	header http.Header
+	body   bytes.Buffer
+}
+
+// CoalescedRequest is a request to the origin for a cache miss, identical requests wait for its response
+// instead of sending their own
+type CoalescedRequest struct {
+	done     chan struct{}
+	waiters  int
+	response *CoalescedResponse
+}
+
+// Coalescer keeps the requests to the origin in flight, by query key
+type Coalescer struct {
+	mu       sync.Mutex
+	inflight map[string]*CoalescedRequest
+}
+
+func NewCoalescer() *Coalescer {
+	return &Coalescer{inflight: make(map[string]*CoalescedRequest)}
+}
+
+// coalescer deduplicates the cache misses of the requests handled by this proxy
+var coalescer = NewCoalescer()
+
+var errTooManyWaiters = errors.New("too many requests waiting for the origin")
+var errCoalescingTimeout = errors.New("timed out waiting for the origin")
+
+// Join returns the request in flight for the key and false, or a new one and true when there is none and the
+// caller has to send it, and finish it with Done
+func (c *Coalescer) Join(key string, maxWaiters int) (*CoalescedRequest, bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if inflight, ok := c.inflight[key]; ok {
+		if inflight.waiters >= maxWaiters {
+			return nil, false, errTooManyWaiters
+		}
+		inflight.waiters++
+		return inflight, false, nil
+	}
+	inflight := &CoalescedRequest{done: make(chan struct{})}
+	c.inflight[key] = inflight
+	return inflight, true, nil
+}
+
+// Done hands the response to the requests waiting for it
+func (c *Coalescer) Done(key string, inflight *CoalescedRequest, response *CoalescedResponse) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	inflight.response = response
+	delete(c.inflight, key)
+	close(inflight.done)
+}
+
+// Wait waits for the response of the request for the timeout
+func (r *CoalescedRequest) Wait(timeout time.Duration) (*CoalescedResponse, error) {
+	select {
+	case <-r.done:
+		return r.response, nil
+	case <-time.After(timeout):
+		return nil, errCoalescingTimeout
+	}
+}
+
+// Write writes the response to a request that waited for it
+func (r *CoalescedResponse) Write(ctx context.Context, w http.ResponseWriter) context.Context {
+	for name, values := range r.header {
+		w.Header()[name] = append([]string(nil), values...)
+	}
+	w.WriteHeader(r.status)
+	w.Write(r.body.Bytes())
+	ctx = context.WithValue(ctx, "status", r.status)
+	ctx = context.WithValue(ctx, "contentLength", r.body.Len())
+	return ctx
+}
+
+// coalescingWriter writes the response of a request other requests wait for, and keeps it for them
+type coalescingWriter struct {
+	http.ResponseWriter
+	response *CoalescedResponse
+}
+
+func newCoalescingWriter(w http.ResponseWriter) *coalescingWriter {
+	return &coalescingWriter{ResponseWriter: w, response: &CoalescedResponse{status: http.StatusOK}}
+}
+
+func (w *coalescingWriter) WriteHeader(status int) {
+	w.response.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *coalescingWriter) Write(body []byte) (int, error) {
+	w.response.body.Write(body)
+	return w.ResponseWriter.Write(body)
+}
+
+// Response is the response written, with the headers it was written with
+func (w *coalescingWriter) Response() *CoalescedResponse {
+	w.response.header = w.Header().Clone()
+	return w.response
+}
+
+// WaitForCachedResponse waits for another proxy sharing the cache to fetch the operation from the origin, it gives up
+// when the lock of the operation is released without a cached response or after the timeout
+func WaitForCachedResponse(cfg *config.Config, cache *graphcache.GraphCache, astQuery *ast.QueryDocument, operation *ast.OperationDefinition, request graphcache.GraphQLRequest) (interface{}, bool) {
+	deadline := time.Now().Add(time.Duration(cfg.CoalescingTimeout) * time.Second)
+	for time.Now().Before(deadline) {
+		locked := cache.OperationLocked(operation, request.Variables)
+		if cachedResponse, err := cache.ParseASTBuildResponse(astQuery, request); err == nil && cachedResponse != nil {
+			return cachedResponse, true
+		}
+		if !locked {
+			return nil, false
+		}
+		time.Sleep(COALESCING_POLL_INTERVAL)
+	}
+	return nil, false
+}
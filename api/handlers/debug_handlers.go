@@ -11,7 +11,12 @@ import (
 func GetDebugHandler(cfg *config.Config) http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		ctx := context.Background()
-		cache := graphcache.NewGraphCacheWithOptions(ctx, GetCacheOptions(cfg, GetScopeValues(cfg, r)))
+		scopeValues, err := GetScopeValues(cfg, r)
+		if err != nil {
+			http.Error(w, ErrInvalidToken.Message, http.StatusUnauthorized)
+			return
+		}
+		cache := graphcache.NewGraphCacheWithOptions(ctx, GetCacheOptions(cfg, scopeValues))
 		resp := cache.Look()
 		br, err := json.Marshal(resp)
 		if err != nil {
@@ -1,21 +1,28 @@
 package handlers
 
 import (
-	"bytes"
+	"context"
 	"encoding/base64"
 	"fmt"
-	"io"
 	"net/http"
 	"orbitgraphql/cache"
 	"orbitgraphql/config"
 	"orbitgraphql/graphcache"
+	"orbitgraphql/logger"
 	"strconv"
 	"strings"
+	"time"
 )
 
 var QueryStore *cache.Cache
 var ObjectStore *cache.Cache
 
+// Schema is the schema of the origin, it is nil unless schema aware mode is configured
+var Schema *graphcache.Schema
+
+// TrustedDocuments are the only documents executed, they are nil unless a manifest is configured
+var TrustedDocuments *graphcache.TrustedDocuments
+
 func GetHandlers(cfg *config.Config) *http.ServeMux {
 	api := http.NewServeMux()
 	api.Handle(cfg.HandlersDebugPath, GetDebugHandler(cfg))
@@ -25,9 +32,45 @@ func GetHandlers(cfg *config.Config) *http.ServeMux {
 	return api
 }
 
+// LoadSchema loads the schema of the origin from the configured SDL file or with an introspection query,
+// and keeps reloading it when a refresh interval is configured
+func LoadSchema(cfg *config.Config) error {
+	var schema *graphcache.Schema
+	var err error
+	switch {
+	case cfg.SchemaPath != "":
+		schema, err = graphcache.NewSchemaFromFile(cfg.SchemaPath)
+	case cfg.SchemaIntrospection:
+		logger.Warn(context.Background(), "introspection doesn't return the directives applied to the schema, ",
+			"@cacheControl, @cost and @listSize are ignored unless the schema is loaded from a SDL file with schema_path")
+		schema, err = graphcache.NewSchemaFromIntrospection(cfg.Origin)
+	default:
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	schema.ReloadEvery(context.Background(), time.Duration(cfg.SchemaRefreshInterval)*time.Second)
+	Schema = schema
+	return nil
+}
+
+// LoadTrustedDocuments loads the manifest of the trusted documents, when one is configured
+func LoadTrustedDocuments(cfg *config.Config) error {
+	if cfg.TrustedDocuments == "" {
+		return nil
+	}
+	documents, err := graphcache.NewTrustedDocumentsFromFile(cfg.TrustedDocuments)
+	if err != nil {
+		return err
+	}
+	TrustedDocuments = documents
+	return nil
+}
+
 func GetNewCacheStore(cfg *config.Config) cache.Cache {
 	if cfg.CacheBackend == "redis" {
-		cache.NewRedisCache(cfg.RedisHost, strconv.Itoa(cfg.RedisPort), cfg.CacheTTL)
+		return cache.NewRedisCache(cfg.RedisHost, strconv.Itoa(cfg.RedisPort), cfg.CacheTTL)
 	}
 	return cache.NewInMemoryCache(cfg.CacheTTL)
 }
@@ -42,6 +85,24 @@ func GetCacheOptions(cfg *config.Config, values []interface{}) *graphcache.Graph
 		ObjectStore = &os
 	}
 
+	// the type configuration is validated when the configuration is loaded
+	keyFields, _ := cfg.KeyFields()
+	listInvalidation, _ := cfg.ListInvalidation()
+	maxAges, _ := cfg.MaxAges()
+	fieldCosts, _ := cfg.FieldCosts()
+	listSizes, _ := cfg.ListSizes()
+	scopes, _ := cfg.Scopes()
+	rootFieldTypes, _ := cfg.RootFieldTypes()
+	mutations, _ := cfg.MutationInvalidation()
+	invalidationRules := make(map[string]graphcache.InvalidationRule)
+	for name, mutation := range mutations {
+		invalidationRules[name] = graphcache.InvalidationRule{
+			Types:  mutation.InvalidateTypes,
+			Keys:   mutation.InvalidateKeys,
+			Fields: mutation.InvalidateFields,
+		}
+	}
+
 	valueStr := make([]string, 0)
 	for _, val := range values {
 		valueStr = append(valueStr, fmt.Sprintf("%v", val))
@@ -49,14 +110,35 @@ func GetCacheOptions(cfg *config.Config, values []interface{}) *graphcache.Graph
 	valueHash := base64.StdEncoding.EncodeToString([]byte(strings.Join(valueStr, "::")))
 
 	return &graphcache.GraphCacheOptions{
-		QueryStore:  *QueryStore,
-		ObjectStore: *ObjectStore,
-		Prefix:      valueHash,
-		IDField:     cfg.PrimaryKeyField,
+		QueryStore:        *QueryStore,
+		ObjectStore:       *ObjectStore,
+		Prefix:            valueHash,
+		IDField:           cfg.PrimaryKeyField,
+		KeyFields:         keyFields,
+		ListInvalidation:  listInvalidation,
+		InvalidationRules: invalidationRules,
+		MaxAges:           maxAges,
+		Scopes:            scopes,
+		RootFieldTypes:    rootFieldTypes,
+		QueryLimits: graphcache.QueryLimits{
+			MaxDepth:        cfg.MaxDepth,
+			MaxFields:       cfg.MaxFields,
+			MaxAliases:      cfg.MaxAliases,
+			MaxRootFields:   cfg.MaxRootFields,
+			MaxCost:         cfg.MaxCost,
+			FieldCosts:      fieldCosts,
+			ListSizes:       listSizes,
+			DefaultListSize: cfg.DefaultListSize,
+		},
+		Schema: Schema.Get(),
 	}
 }
 
-func GetScopeValues(cfg *config.Config, r *http.Request) []interface{} {
+// GetScopeValues are the values of the scope headers of the request, cached objects and responses
+// are only shared by requests with the same scope values. With scope claims, the token of the JWT header
+// is scoped by the values of its claims instead, tokens that can't be verified are scoped by their raw
+// value or rejected with an error
+func GetScopeValues(cfg *config.Config, r *http.Request) ([]interface{}, error) {
 	values := make([]interface{}, 0)
 	splittedHeaderNames := strings.Split(cfg.ScopeHeaders, ",")
 	headerNames := make([]string, 0)
@@ -64,20 +146,25 @@ func GetScopeValues(cfg *config.Config, r *http.Request) []interface{} {
 		headerNames = append(headerNames, strings.TrimSpace(header))
 	}
 	for _, header := range headerNames {
-		if header != "" {
+		if header != "" && (cfg.ScopeJWTClaims == "" || !strings.EqualFold(header, cfg.ScopeJWTHeader)) {
 			values = append(values, r.Header.Get(header))
 		}
 	}
 
-	requestBody, err := io.ReadAll(r.Body)
-	if err != nil {
-		return values
+	if cfg.ScopeJWTClaims != "" {
+		// requests without a token share the anonymous scope
+		token := r.Header.Get(cfg.ScopeJWTHeader)
+		if token == "" {
+			return append(values, token), nil
+		}
+		claims, err := ScopeClaims(cfg, token)
+		if err != nil {
+			if cfg.ScopeJWTRejectInvalid {
+				return nil, err
+			}
+			return append(values, token), nil
+		}
+		values = append(values, claims...)
 	}
-	r.Body = io.NopCloser(bytes.NewReader(requestBody))
-
-	request := graphcache.GraphQLRequest{}
-	request.FromBytes(requestBody)
-
-	values = append(values, request.Query, request.OperationName, request.Variables)
-	return values
+	return values, nil
 }
@@ -0,0 +1,67 @@
+package handlers
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"orbitgraphql/config"
+	"orbitgraphql/graphcache"
+	"orbitgraphql/logger"
+	"strconv"
+
+	"github.com/vektah/gqlparser/v2/gqlerror"
+)
+
+// RATE_LIMIT_HITS is the budget of the requests served from the cache, RATE_LIMIT_MISSES of the requests
+// sent to the origin
+const RATE_LIMIT_HITS = "hits"
+const RATE_LIMIT_MISSES = "misses"
+
+var ErrRateLimited = &gqlerror.Error{
+	Message:    "too many requests",
+	Extensions: map[string]interface{}{"code": "RATE_LIMITED"},
+}
+
+// rateLimit is a budget of the scope, or of an operation of the scope when it is named
+type rateLimit struct {
+	operationName string
+	rate          float64
+	burst         int
+}
+
+// rateLimits are the budgets a request takes a token from, every request takes one from the budget of its scope,
+// the operation name is chosen by the client so a budget of its own is only added for the operations configured
+// with one, otherwise a new name for every request would get a new budget
+func rateLimits(cfg *config.Config, bucket string, operationName string) []rateLimit {
+	operation := cfg.Operations[operationName]
+	scope := rateLimit{"", cfg.RateLimitHits, cfg.RateLimitHitsBurst}
+	own := rateLimit{operationName, operation.RateLimitHits, operation.RateLimitHitsBurst}
+	if bucket == RATE_LIMIT_MISSES {
+		scope = rateLimit{"", cfg.RateLimitMisses, cfg.RateLimitMissesBurst}
+		own = rateLimit{operationName, operation.RateLimitMisses, operation.RateLimitMissesBurst}
+	}
+	limits := make([]rateLimit, 0, 2)
+	if cfg.RateLimitByOperation && operationName != "" && own.rate > 0 {
+		limits = append(limits, own)
+	}
+	if scope.rate > 0 {
+		limits = append(limits, scope)
+	}
+	return limits
+}
+
+// RateLimit takes a token from the budgets of the request, the one of its scope and the one of its operation
+// when it has one, it responds with 429 and reports the request was limited when a budget is spent
+func RateLimit(ctx context.Context, cfg *config.Config, w http.ResponseWriter, cache *graphcache.GraphCache, bucket string, operationName string) (context.Context, bool) {
+	// the budget of the operation is taken from first, a request it limits doesn't spend the budget of the scope
+	for _, limit := range rateLimits(cfg, bucket, operationName) {
+		allowed, retryAfter := cache.TakeRateLimitToken(bucket, limit.operationName, limit.rate, limit.burst)
+		if allowed {
+			continue
+		}
+		logger.Warn(ctx, "rate limited, ", bucket, " budget spent")
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+		return WriteGraphQLError(ctx, w, http.StatusTooManyRequests, ErrRateLimited), true
+	}
+	return ctx, false
+}
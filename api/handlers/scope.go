@@ -0,0 +1,66 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"orbitgraphql/auth"
+	"orbitgraphql/config"
+	"strings"
+
+	"github.com/vektah/gqlparser/v2/gqlerror"
+)
+
+// ScopeKeys are the keys the tokens of the scope are verified with, they are nil unless a JWKS is configured
+var ScopeKeys *auth.KeySet
+
+var ErrInvalidToken = &gqlerror.Error{
+	Message:    "invalid token",
+	Extensions: map[string]interface{}{"code": "UNAUTHENTICATED"},
+}
+
+// LoadScopeKeys loads the JWKS the tokens of the scope are verified with, when one is configured
+func LoadScopeKeys(cfg *config.Config) error {
+	if cfg.ScopeJWKS == "" {
+		return nil
+	}
+	keys, err := auth.LoadKeySet(cfg.ScopeJWKS)
+	if err != nil {
+		return err
+	}
+	ScopeKeys = keys
+	return nil
+}
+
+// ScopeClaims are the values of the configured claims of the token in the header, so the requests of every
+// token with the same claims share the cache
+func ScopeClaims(cfg *config.Config, header string) ([]interface{}, error) {
+	token := strings.TrimSpace(header)
+	if len(token) > len("Bearer ") && strings.EqualFold(token[:len("Bearer ")], "Bearer ") {
+		token = strings.TrimSpace(token[len("Bearer "):])
+	}
+
+	var claims map[string]interface{}
+	var err error
+	if cfg.ScopeJWTSkipVerification {
+		claims, err = auth.Decode(token)
+	} else if ScopeKeys != nil {
+		claims, err = ScopeKeys.Verify(token)
+	} else {
+		err = fmt.Errorf("%w: no keys to verify it with", auth.ErrInvalidToken)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	values := make([]interface{}, 0)
+	for _, name := range strings.Split(cfg.ScopeJWTClaims, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		// claims are encoded so a missing claim isn't the same as an empty one
+		value, _ := json.Marshal(claims[name])
+		values = append(values, name+"="+string(value))
+	}
+	return values, nil
+}
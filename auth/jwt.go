@@ -0,0 +1,192 @@
+package auth
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/hmac"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"strings"
+	"time"
+)
+
+var ErrInvalidToken = errors.New("invalid token")
+
+// algorithms are the hashes of the signing algorithms tokens can be signed with
+var algorithms = map[string]crypto.Hash{
+	"HS256": crypto.SHA256,
+	"HS384": crypto.SHA384,
+	"HS512": crypto.SHA512,
+	"RS256": crypto.SHA256,
+	"RS384": crypto.SHA384,
+	"RS512": crypto.SHA512,
+}
+
+// Key is a key of a JWKS, a secret for HS algorithms or a public key for RS algorithms
+type Key struct {
+	ID        string
+	Algorithm string
+	secret    []byte
+	public    *rsa.PublicKey
+}
+
+// KeySet are the keys tokens are verified with
+type KeySet struct {
+	Keys []Key
+}
+
+type jwks struct {
+	Keys []struct {
+		Kty string `json:"kty"`
+		Kid string `json:"kid"`
+		Alg string `json:"alg"`
+		K   string `json:"k"`
+		N   string `json:"n"`
+		E   string `json:"e"`
+	} `json:"keys"`
+}
+
+// LoadKeySet loads the keys of a JWKS file
+func LoadKeySet(path string) (*KeySet, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseKeySet(data)
+}
+
+// ParseKeySet reads the keys of a JWKS, with oct keys for HS algorithms and RSA keys for RS algorithms
+func ParseKeySet(data []byte) (*KeySet, error) {
+	set := jwks{}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, err
+	}
+	keys := &KeySet{}
+	for i, key := range set.Keys {
+		switch key.Kty {
+		case "oct":
+			secret, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(key.K, "="))
+			if err != nil || len(secret) == 0 {
+				return nil, fmt.Errorf("key %d has an invalid secret", i)
+			}
+			keys.Keys = append(keys.Keys, Key{ID: key.Kid, Algorithm: key.Alg, secret: secret})
+		case "RSA":
+			n, errN := base64.RawURLEncoding.DecodeString(strings.TrimRight(key.N, "="))
+			e, errE := base64.RawURLEncoding.DecodeString(strings.TrimRight(key.E, "="))
+			if errN != nil || errE != nil || len(n) == 0 || len(e) == 0 {
+				return nil, fmt.Errorf("key %d has an invalid modulus or exponent", i)
+			}
+			public := &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+			keys.Keys = append(keys.Keys, Key{ID: key.Kid, Algorithm: key.Alg, public: public})
+		default:
+			return nil, fmt.Errorf("key %d has an unsupported type %s", i, key.Kty)
+		}
+	}
+	return keys, nil
+}
+
+// Verify verifies the signature of the token with the keys of the set, and that it is valid now, and returns its claims
+func (ks *KeySet) Verify(token string) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("%w: it doesn't have 3 parts", ErrInvalidToken)
+	}
+	header := struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}{}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidToken, err)
+	}
+	hash, ok := algorithms[header.Alg]
+	if !ok {
+		return nil, fmt.Errorf("%w: unsupported algorithm %s", ErrInvalidToken, header.Alg)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidToken, err)
+	}
+
+	signed := []byte(parts[0] + "." + parts[1])
+	verified := false
+	for _, key := range ks.Keys {
+		if (header.Kid != "" && key.ID != header.Kid) || (key.Algorithm != "" && key.Algorithm != header.Alg) {
+			continue
+		}
+		if key.verify(header.Alg, hash, signed, signature) {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return nil, fmt.Errorf("%w: signature doesn't match a key", ErrInvalidToken)
+	}
+
+	claims, err := Decode(token)
+	if err != nil {
+		return nil, err
+	}
+	now := float64(time.Now().Unix())
+	if exp, ok := numericClaim(claims, "exp"); ok && now >= exp {
+		return nil, fmt.Errorf("%w: it expired", ErrInvalidToken)
+	}
+	if nbf, ok := numericClaim(claims, "nbf"); ok && now < nbf {
+		return nil, fmt.Errorf("%w: it isn't valid yet", ErrInvalidToken)
+	}
+	return claims, nil
+}
+
+// verify reports if the signature is the signature of the input with the key, the key has to be of the
+// type of the algorithm, so a public key is never used as a secret
+func (k Key) verify(algorithm string, hash crypto.Hash, signed []byte, signature []byte) bool {
+	switch {
+	case strings.HasPrefix(algorithm, "HS") && k.secret != nil:
+		mac := hmac.New(hash.New, k.secret)
+		mac.Write(signed)
+		return hmac.Equal(mac.Sum(nil), signature)
+	case strings.HasPrefix(algorithm, "RS") && k.public != nil:
+		digest := hash.New()
+		digest.Write(signed)
+		return rsa.VerifyPKCS1v15(k.public, hash, digest.Sum(nil), signature) == nil
+	}
+	return false
+}
+
+// Decode returns the claims of the token without verifying it, numbers are kept as json.Number
+func Decode(token string) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("%w: it doesn't have 3 parts", ErrInvalidToken)
+	}
+	claims := make(map[string]interface{})
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidToken, err)
+	}
+	return claims, nil
+}
+
+func decodeSegment(segment string, value interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(segment, "="))
+	if err != nil {
+		return err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	return decoder.Decode(value)
+}
+
+func numericClaim(claims map[string]interface{}, name string) (float64, bool) {
+	number, ok := claims[name].(json.Number)
+	if !ok {
+		return 0, false
+	}
+	value, err := number.Float64()
+	return value, err == nil
+}
@@ -0,0 +1,124 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func encodeSegment(value interface{}) string {
+	data, _ := json.Marshal(value)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func signHS256(secret string, header map[string]interface{}, claims map[string]interface{}) string {
+	signed := encodeSegment(header) + "." + encodeSegment(claims)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(signed))
+	return signed + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func signRS256(key *rsa.PrivateKey, header map[string]interface{}, claims map[string]interface{}) string {
+	signed := encodeSegment(header) + "." + encodeSegment(claims)
+	digest := sha256.Sum256([]byte(signed))
+	signature, _ := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func octKeySet(t *testing.T, kid string, secret string) *KeySet {
+	keys, err := ParseKeySet([]byte(fmt.Sprintf(`{"keys":[{"kty":"oct","kid":%q,"alg":"HS256","k":%q}]}`, kid, base64.RawURLEncoding.EncodeToString([]byte(secret)))))
+	assert.NoError(t, err)
+	return keys
+}
+
+func TestVerifyHS256(t *testing.T) {
+	keys := octKeySet(t, "1", "secret")
+	header := map[string]interface{}{"alg": "HS256", "typ": "JWT", "kid": "1"}
+
+	claims, err := keys.Verify(signHS256("secret", header, map[string]interface{}{"sub": "user", "tenant_id": 12345678901234567}))
+	assert.NoError(t, err)
+	assert.Equal(t, "user", claims["sub"])
+	assert.Equal(t, json.Number("12345678901234567"), claims["tenant_id"])
+
+	_, err = keys.Verify(signHS256("other", header, map[string]interface{}{"sub": "user"}))
+	assert.ErrorIs(t, err, ErrInvalidToken)
+
+	// the key of another id isn't used
+	_, err = keys.Verify(signHS256("secret", map[string]interface{}{"alg": "HS256", "kid": "2"}, map[string]interface{}{"sub": "user"}))
+	assert.ErrorIs(t, err, ErrInvalidToken)
+
+	_, err = keys.Verify("not.a-token")
+	assert.ErrorIs(t, err, ErrInvalidToken)
+}
+
+func TestVerifyRS256(t *testing.T) {
+	private, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	jwks := fmt.Sprintf(`{"keys":[{"kty":"RSA","kid":"rsa","alg":"RS256","n":%q,"e":%q}]}`,
+		base64.RawURLEncoding.EncodeToString(private.N.Bytes()),
+		base64.RawURLEncoding.EncodeToString(big.NewInt(int64(private.E)).Bytes()))
+	keys, err := ParseKeySet([]byte(jwks))
+	assert.NoError(t, err)
+
+	claims, err := keys.Verify(signRS256(private, map[string]interface{}{"alg": "RS256", "kid": "rsa"}, map[string]interface{}{"sub": "user"}))
+	assert.NoError(t, err)
+	assert.Equal(t, "user", claims["sub"])
+
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	_, err = keys.Verify(signRS256(other, map[string]interface{}{"alg": "RS256", "kid": "rsa"}, map[string]interface{}{"sub": "user"}))
+	assert.ErrorIs(t, err, ErrInvalidToken)
+
+	// a public key is never used as a secret
+	public := base64.RawURLEncoding.EncodeToString(private.N.Bytes())
+	_, err = keys.Verify(signHS256(public, map[string]interface{}{"alg": "HS256"}, map[string]interface{}{"sub": "user"}))
+	assert.ErrorIs(t, err, ErrInvalidToken)
+}
+
+func TestVerifyTimes(t *testing.T) {
+	keys := octKeySet(t, "", "secret")
+	header := map[string]interface{}{"alg": "HS256"}
+	now := time.Now().Unix()
+
+	_, err := keys.Verify(signHS256("secret", header, map[string]interface{}{"exp": now + 60, "nbf": now - 60}))
+	assert.NoError(t, err)
+
+	_, err = keys.Verify(signHS256("secret", header, map[string]interface{}{"exp": now - 60}))
+	assert.ErrorIs(t, err, ErrInvalidToken)
+
+	_, err = keys.Verify(signHS256("secret", header, map[string]interface{}{"nbf": now + 60}))
+	assert.ErrorIs(t, err, ErrInvalidToken)
+}
+
+func TestVerifyUnsupportedAlgorithm(t *testing.T) {
+	keys := octKeySet(t, "", "secret")
+	token := encodeSegment(map[string]interface{}{"alg": "none"}) + "." + encodeSegment(map[string]interface{}{"sub": "user"}) + "."
+	_, err := keys.Verify(token)
+	assert.ErrorIs(t, err, ErrInvalidToken)
+
+	// decoding doesn't verify the token
+	claims, err := Decode(token)
+	assert.NoError(t, err)
+	assert.Equal(t, "user", claims["sub"])
+}
+
+func TestParseKeySetErrors(t *testing.T) {
+	_, err := ParseKeySet([]byte(`{"keys":[{"kty":"EC","crv":"P-256"}]}`))
+	assert.Error(t, err)
+
+	_, err = ParseKeySet([]byte(`{"keys":[{"kty":"oct","k":""}]}`))
+	assert.Error(t, err)
+
+	_, err = ParseKeySet([]byte(`not json`))
+	assert.Error(t, err)
+}
@@ -1,10 +1,24 @@
 package cache
 
+import "time"
+
 // Cache is an interface that defines the methods that a cache should implement
 // we can have different cache implementations like Redis, Memcached, etc.
 type Cache interface {
 	Set(key string, value interface{}) error
+	// SetWithTTL sets the value of the key to expire after the ttl instead of the ttl of the cache,
+	// a value with a ttl that isn't positive has expired already, the key is deleted instead
+	SetWithTTL(key string, value interface{}, ttl time.Duration) error
+	// SetIfNotExists sets the value of the key to expire after the ttl unless the key exists, it reports if it was set
+	SetIfNotExists(key string, value interface{}, ttl time.Duration) (bool, error)
+	// Expire changes the time left before the key expires to the ttl
+	Expire(key string, ttl time.Duration) error
+	// TTL is the time left before the key expires, it fails when the key doesn't exist
+	TTL(key string) (time.Duration, error)
 	Get(key string) (interface{}, error)
+	// Update replaces the value of the key with the one update makes from its current value (nil when it doesn't
+	// exist) atomically, it is stored with the ttl of the cache unless update reports there is nothing to store
+	Update(key string, update func(value interface{}) (interface{}, bool)) error
 	Del(key string) error
 	Exists(key string) (bool, error)
 	Map() (map[string]interface{}, error)
@@ -12,4 +26,16 @@ type Cache interface {
 	Debug(identifier string) error
 	Flush() error
 	DeleteByPrefix(prefix string) error
+	// DeleteByPattern deletes every key matching the whole pattern, * is the only wildcard
+	DeleteByPattern(pattern string) error
+	// AddToSet adds the members to the set stored at the key, creating it when it doesn't exist
+	AddToSet(key string, members ...string) error
+	// AddToSets adds the members to the sets stored at the keys at once, every member expires after the ttl
+	// of the cache unless it is added again, and the expired members are removed from the sets
+	AddToSets(sets map[string][]string) error
+	// SetMembers lists the members of the set stored at the key that haven't expired
+	SetMembers(key string) ([]string, error)
+	// TakeToken takes a token from the token bucket stored at the key, refilled with rate tokens per second up to
+	// burst tokens, when the bucket is empty it reports how long until it has a token again
+	TakeToken(key string, rate float64, burst int) (bool, time.Duration, error)
 }
@@ -33,18 +33,61 @@ func (c *InMemoryCache) Key(key string) string {
 }
 
 func (c *InMemoryCache) Set(key string, value interface{}) error {
+	return c.SetWithTTL(key, value, time.Duration(c.ttl)*time.Second)
+}
+
+func (c *InMemoryCache) SetWithTTL(key string, value interface{}, ttl time.Duration) error {
 	c.mu.Lock()
 	defer c.mu.Unlock()
+	if ttl <= 0 {
+		delete(c.data, c.Key(key))
+		delete(c.expiration, c.Key(key))
+		return nil
+	}
 	c.data[c.Key(key)] = deepCopy(value)
 	if value == nil {
 		c.expiration[c.Key(key)] = nil
 	} else {
-		t := time.Now().Add(time.Duration(c.ttl) * time.Second)
+		t := time.Now().Add(ttl)
 		c.expiration[c.Key(key)] = &t
 	}
 	return nil
 }
 
+func (c *InMemoryCache) SetIfNotExists(key string, value interface{}, ttl time.Duration) (bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if expiration := c.expiration[c.Key(key)]; expiration != nil && time.Now().Before(*expiration) {
+		return false, nil
+	}
+	c.data[c.Key(key)] = deepCopy(value)
+	t := time.Now().Add(ttl)
+	c.expiration[c.Key(key)] = &t
+	return true, nil
+}
+
+func (c *InMemoryCache) Expire(key string, ttl time.Duration) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	expiration, exists := c.expiration[c.Key(key)]
+	if !exists || expiration == nil || time.Now().After(*expiration) {
+		return errors.New("key not found")
+	}
+	t := time.Now().Add(ttl)
+	c.expiration[c.Key(key)] = &t
+	return nil
+}
+
+func (c *InMemoryCache) TTL(key string) (time.Duration, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	expiration, exists := c.expiration[c.Key(key)]
+	if !exists || expiration == nil || time.Now().After(*expiration) {
+		return 0, errors.New("key not found")
+	}
+	return time.Until(*expiration), nil
+}
+
 func (c *InMemoryCache) Get(key string) (interface{}, error) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
@@ -59,6 +102,23 @@ func (c *InMemoryCache) Get(key string) (interface{}, error) {
 	return deepCopy(value), nil
 }
 
+func (c *InMemoryCache) Update(key string, update func(value interface{}) (interface{}, bool)) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var value interface{}
+	if expiration := c.expiration[c.Key(key)]; expiration != nil && time.Now().Before(*expiration) {
+		value = deepCopy(c.data[c.Key(key)])
+	}
+	updated, ok := update(value)
+	if !ok {
+		return nil
+	}
+	c.data[c.Key(key)] = deepCopy(updated)
+	t := time.Now().Add(time.Duration(c.ttl) * time.Second)
+	c.expiration[c.Key(key)] = &t
+	return nil
+}
+
 func (c *InMemoryCache) Del(key string) error {
 	c.Set(c.Key(key), nil)
 	return nil
@@ -75,6 +135,8 @@ func (c *InMemoryCache) Exists(key string) (bool, error) {
 }
 
 func (c *InMemoryCache) Map() (map[string]interface{}, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	copy := make(map[string]interface{})
 	now := time.Now()
 	for k, v := range c.data {
@@ -110,23 +172,115 @@ func (c *InMemoryCache) Flush() error {
 }
 
 func (c *InMemoryCache) DeleteByPrefix(prefix string) error {
-	var re = regexp.MustCompile(`(?m)` + strings.ReplaceAll(c.Key(prefix), "*", ".*"))
+	return c.DeleteByPattern(prefix + "*")
+}
+
+func (c *InMemoryCache) DeleteByPattern(pattern string) error {
+	// everything in the pattern except * is matched literally
+	re, err := regexp.Compile("^" + strings.ReplaceAll(regexp.QuoteMeta(c.Key(pattern)), `\*`, ".*") + "$")
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	for k := range c.data {
-		if re.Match([]byte(k)) {
-			c.Del(k)
+		if re.MatchString(k) {
+			c.delete(k)
+		}
+	}
+	return nil
+}
+
+func (c *InMemoryCache) AddToSet(key string, members ...string) error {
+	return c.AddToSets(map[string][]string{key: members})
+}
+
+func (c *InMemoryCache) AddToSets(sets map[string][]string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	t := now.Add(time.Duration(c.ttl) * time.Second)
+	for key, members := range sets {
+		// a set is kept as a map of its members to when they expire, so it is listed like every other value
+		set, ok := c.data[c.Key(key)].(map[string]interface{})
+		if expiration := c.expiration[c.Key(key)]; !ok || expiration == nil || now.After(*expiration) {
+			set = make(map[string]interface{})
+		}
+		for member, expiresAt := range set {
+			if memberExpired(expiresAt, now) {
+				delete(set, member)
+			}
+		}
+		for _, member := range members {
+			set[member] = unixSeconds(t)
 		}
+		c.data[c.Key(key)] = set
+		c.expiration[c.Key(key)] = &t
 	}
 	return nil
 }
 
+func (c *InMemoryCache) SetMembers(key string) ([]string, error) {
+	value, err := c.Get(key)
+	if err != nil {
+		return []string{}, nil
+	}
+	set, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("value is not a set")
+	}
+	now := time.Now()
+	members := make([]string, 0)
+	for member, expiresAt := range set {
+		if !memberExpired(expiresAt, now) {
+			members = append(members, member)
+		}
+	}
+	return members, nil
+}
+
+func memberExpired(expiresAt interface{}, now time.Time) bool {
+	seconds, ok := expiresAt.(float64)
+	return !ok || seconds <= unixSeconds(now)
+}
+
+func unixSeconds(t time.Time) float64 {
+	return float64(t.UnixNano()) / float64(time.Second)
+}
+
+func (c *InMemoryCache) TakeToken(key string, rate float64, burst int) (bool, time.Duration, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	// the bucket is kept as a map like every other value, a bucket that expired is full
+	tokens, updated := float64(burst), float64(now.UnixNano())/float64(time.Second)
+	if bucket, ok := c.data[c.Key(key)].(map[string]interface{}); ok {
+		if expiration := c.expiration[c.Key(key)]; expiration != nil && now.Before(*expiration) {
+			tokens, _ = bucket["tokens"].(float64)
+			updated, _ = bucket["updated"].(float64)
+		}
+	}
+	tokens, allowed, retryAfter := takeToken(tokens, updated, now, rate, burst)
+	c.data[c.Key(key)] = map[string]interface{}{"tokens": tokens, "updated": float64(now.UnixNano()) / float64(time.Second)}
+	t := now.Add(bucketTTL(rate, burst))
+	c.expiration[c.Key(key)] = &t
+	return allowed, retryAfter, nil
+}
+
+// delete removes a key from the cache, the caller must hold the lock
+func (c *InMemoryCache) delete(key string) {
+	delete(c.data, key)
+	delete(c.expiration, key)
+}
+
 func (c *InMemoryCache) cleanup() {
 	for {
 		time.Sleep(time.Duration(c.ttl) * time.Second)
 		c.mu.Lock()
 		now := time.Now()
 		for key, expiration := range c.expiration {
-			if expiration != nil && now.After(*expiration) {
-				c.Del(key)
+			if expiration == nil || now.After(*expiration) {
+				c.delete(key)
 			}
 		}
 		c.mu.Unlock()
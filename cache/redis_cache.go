@@ -3,7 +3,11 @@ package cache
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"reflect"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/go-redis/redis/v8"
@@ -34,25 +38,71 @@ func NewRedisCache(host, port string, ttl int) Cache {
 }
 
 func (c *RedisCache) Set(key string, value interface{}) error {
+	return c.SetWithTTL(key, value, time.Second*time.Duration(c.ttl))
+}
+
+func (c *RedisCache) SetWithTTL(key string, value interface{}, ttl time.Duration) error {
+	// redis keeps a key set with a ttl of 0 forever
+	if ttl <= 0 {
+		return c.cache.Del(ctx, c.Key(key), c.Key(key+"_type")).Err()
+	}
+	c.set(c.cache, key, value, ttl)
+	return nil
+}
+
+func (c *RedisCache) set(client redis.Cmdable, key string, value interface{}, ttl time.Duration) {
 	valueType := reflect.TypeOf(value)
 	switch valueType.Kind() {
 	case reflect.Map:
 		br, _ := json.Marshal(value)
-		c.cache.Set(ctx, c.Key(key), string(br), time.Second*time.Duration(c.ttl))
-		c.cache.Set(ctx, c.Key(key+"_type"), "reflect.Map", time.Second*time.Duration(c.ttl))
+		client.Set(ctx, c.Key(key), string(br), ttl)
+		client.Set(ctx, c.Key(key+"_type"), "reflect.Map", ttl)
 	case reflect.Slice:
 		br, _ := json.Marshal(value)
-		c.cache.Set(ctx, c.Key(key), string(br), time.Second*time.Duration(c.ttl))
-		c.cache.Set(ctx, c.Key(key+"_type"), "reflect.Slice", time.Second*time.Duration(c.ttl))
+		client.Set(ctx, c.Key(key), string(br), ttl)
+		client.Set(ctx, c.Key(key+"_type"), "reflect.Slice", ttl)
 	default:
-		c.cache.Set(ctx, c.Key(key), value, time.Second*time.Duration(c.ttl))
+		client.Set(ctx, c.Key(key), value, ttl)
+	}
+}
+
+func (c *RedisCache) SetIfNotExists(key string, value interface{}, ttl time.Duration) (bool, error) {
+	return c.cache.SetNX(ctx, c.Key(key), value, ttl).Result()
+}
+
+func (c *RedisCache) Expire(key string, ttl time.Duration) error {
+	// the type of maps and slices is kept next to them and expires with them
+	pipe := c.cache.TxPipeline()
+	expired := pipe.Expire(ctx, c.Key(key), ttl)
+	pipe.Expire(ctx, c.Key(key+"_type"), ttl)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return err
+	}
+	if !expired.Val() {
+		return errors.New("key not found")
 	}
 	return nil
 }
 
+func (c *RedisCache) TTL(key string) (time.Duration, error) {
+	ttl, err := c.cache.TTL(ctx, c.Key(key)).Result()
+	if err != nil {
+		return 0, err
+	}
+	// redis reports a missing key with -2 and a key without expiry with -1
+	if ttl == -2 {
+		return 0, errors.New("key not found")
+	}
+	return ttl, nil
+}
+
 func (c *RedisCache) Get(key string) (interface{}, error) {
-	typeValue, _ := c.cache.Get(ctx, c.Key(key+"_type")).Result()
-	val, err := c.cache.Get(ctx, c.Key(key)).Result()
+	return c.get(c.cache, key)
+}
+
+func (c *RedisCache) get(client redis.Cmdable, key string) (interface{}, error) {
+	typeValue, _ := client.Get(ctx, c.Key(key+"_type")).Result()
+	val, err := client.Get(ctx, c.Key(key)).Result()
 	if err != nil {
 		return nil, err
 	}
@@ -71,6 +121,36 @@ func (c *RedisCache) Get(key string) (interface{}, error) {
 	return val, nil
 }
 
+// maxUpdateAttempts is how many times an update is retried when the key changes while it is updated
+const maxUpdateAttempts = 10
+
+func (c *RedisCache) Update(key string, update func(value interface{}) (interface{}, bool)) error {
+	// the transaction fails when the key changes between reading it and writing it, and the update is made again
+	for attempt := 0; attempt < maxUpdateAttempts; attempt++ {
+		err := c.cache.Watch(ctx, func(tx *redis.Tx) error {
+			value, err := c.get(tx, key)
+			if err == redis.Nil {
+				value = nil
+			} else if err != nil {
+				return err
+			}
+			updated, ok := update(value)
+			if !ok {
+				return nil
+			}
+			_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+				c.set(pipe, key, updated, time.Second*time.Duration(c.ttl))
+				return nil
+			})
+			return err
+		}, c.Key(key), c.Key(key+"_type"))
+		if err != redis.TxFailedErr {
+			return err
+		}
+	}
+	return fmt.Errorf("key %s kept changing while it was updated", key)
+}
+
 func (c *RedisCache) Del(key string) error {
 	c.cache.Del(ctx, c.Key(key))
 	return nil
@@ -101,6 +181,85 @@ func (c *RedisCache) Flush() error {
 	return nil
 }
 
+func (c *RedisCache) DeleteByPattern(pattern string) error {
+	// escape the glob characters redis understands, so * is the only wildcard
+	escaped := strings.NewReplacer(`\`, `\\`, "?", `\?`, "[", `\[`, "]", `\]`).Replace(c.Key(pattern))
+	allKeys := c.cache.Keys(ctx, escaped)
+	if allKeys == nil {
+		return nil
+	}
+
+	for _, key := range allKeys.Val() {
+		c.cache.Del(ctx, key, key+"_type")
+	}
+
+	return nil
+}
+
+func (c *RedisCache) AddToSet(key string, members ...string) error {
+	return c.AddToSets(map[string][]string{key: members})
+}
+
+func (c *RedisCache) AddToSets(sets map[string][]string) error {
+	// sets are sorted sets of their members scored with when they expire, written in one round trip
+	now := float64(time.Now().UnixNano()) / float64(time.Second)
+	ttl := time.Second * time.Duration(c.ttl)
+	pipe := c.cache.TxPipeline()
+	for key, members := range sets {
+		if len(members) == 0 {
+			continue
+		}
+		values := make([]*redis.Z, 0)
+		for _, member := range members {
+			values = append(values, &redis.Z{Score: now + ttl.Seconds(), Member: member})
+		}
+		pipe.ZRemRangeByScore(ctx, c.Key(key), "-inf", strconv.FormatFloat(now, 'f', -1, 64))
+		pipe.ZAdd(ctx, c.Key(key), values...)
+		pipe.Expire(ctx, c.Key(key), ttl)
+	}
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+func (c *RedisCache) SetMembers(key string) ([]string, error) {
+	now := float64(time.Now().UnixNano()) / float64(time.Second)
+	return c.cache.ZRangeByScore(ctx, c.Key(key), &redis.ZRangeBy{Min: "(" + strconv.FormatFloat(now, 'f', -1, 64), Max: "+inf"}).Result()
+}
+
+// takeTokenScript takes a token from a token bucket atomically, so the bucket is shared by every proxy,
+// the tokens are returned as a string as redis truncates numbers returned by scripts
+var takeTokenScript = redis.NewScript(`
+local bucket = redis.call('HMGET', KEYS[1], 'tokens', 'updated')
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+local tokens = tonumber(bucket[1]) or burst
+local updated = tonumber(bucket[2]) or now
+tokens = math.min(burst, tokens + math.max(0, now - updated) * rate)
+local allowed = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	allowed = 1
+end
+redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'updated', tostring(now))
+redis.call('PEXPIRE', KEYS[1], ARGV[4])
+return {allowed, tostring(tokens)}
+`)
+
+func (c *RedisCache) TakeToken(key string, rate float64, burst int) (bool, time.Duration, error) {
+	now := float64(time.Now().UnixNano()) / float64(time.Second)
+	result, err := takeTokenScript.Run(ctx, c.cache, []string{c.Key(key)}, rate, burst, now, bucketTTL(rate, burst).Milliseconds()+1).Slice()
+	if err != nil || len(result) != 2 {
+		return false, 0, fmt.Errorf("token bucket %s could not be updated: %v", key, err)
+	}
+	if allowed, _ := result[0].(int64); allowed == 1 {
+		return true, 0, nil
+	}
+	tokensValue, _ := result[1].(string)
+	tokens, _ := strconv.ParseFloat(tokensValue, 64)
+	return false, time.Duration((1 - tokens) / rate * float64(time.Second)), nil
+}
+
 func (c *RedisCache) DeleteByPrefix(prefix string) error {
 	allKeys := c.cache.Keys(ctx, c.Key(prefix+"*"))
 	if allKeys == nil {
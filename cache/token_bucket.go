@@ -0,0 +1,21 @@
+package cache
+
+import (
+	"math"
+	"time"
+)
+
+// takeToken refills a token bucket with the tokens it had when it was last updated, and takes a token from it
+func takeToken(tokens float64, updated float64, now time.Time, rate float64, burst int) (float64, bool, time.Duration) {
+	elapsed := float64(now.UnixNano())/float64(time.Second) - updated
+	tokens = math.Min(float64(burst), tokens+math.Max(0, elapsed)*rate)
+	if tokens >= 1 {
+		return tokens - 1, true, 0
+	}
+	return tokens, false, time.Duration((1 - tokens) / rate * float64(time.Second))
+}
+
+// bucketTTL is how long until a token bucket is full again, a bucket isn't kept longer than that
+func bucketTTL(rate float64, burst int) time.Duration {
+	return time.Duration(float64(burst) / rate * float64(time.Second))
+}
@@ -1,9 +1,12 @@
 package config
 
 import (
+	"fmt"
 	"io"
 	"log"
+	"math"
 	"os"
+	"regexp"
 
 	"github.com/kelseyhightower/envconfig"
 	"github.com/pelletier/go-toml/v2"
@@ -18,6 +21,42 @@ type Config struct {
 	ScopeHeaders    string `toml:"scope_headers" envconfig:"ORBIT_SCOPE_HEADERS"`
 	PrimaryKeyField string `toml:"primary_key_field" envconfig:"ORBIT_PRIMARY_KEY_FIELD"`
 
+	// JWT scope configuration, the token of the header is scoped by its claims instead of its raw value, it is
+	// verified with the keys of the JWKS unless verification is skipped
+	ScopeJWTClaims           string `toml:"scope_jwt_claims" envconfig:"ORBIT_SCOPE_JWT_CLAIMS"`
+	ScopeJWTHeader           string `toml:"scope_jwt_header" envconfig:"ORBIT_SCOPE_JWT_HEADER"`
+	ScopeJWKS                string `toml:"scope_jwks" envconfig:"ORBIT_SCOPE_JWKS"`
+	ScopeJWTSkipVerification bool   `toml:"scope_jwt_skip_verification" envconfig:"ORBIT_SCOPE_JWT_SKIP_VERIFICATION"`
+	ScopeJWTRejectInvalid    bool   `toml:"scope_jwt_reject_invalid" envconfig:"ORBIT_SCOPE_JWT_REJECT_INVALID"`
+
+	// PersistedQueries handles automatic persisted queries, queries are registered with their hash in the cache
+	PersistedQueries bool `toml:"persisted_queries" envconfig:"ORBIT_PERSISTED_QUERIES"`
+
+	// Trusted documents configuration, only the documents of the manifest are executed, unless the mode is report
+	TrustedDocuments     string `toml:"trusted_documents" envconfig:"ORBIT_TRUSTED_DOCUMENTS"`
+	TrustedDocumentsMode string `toml:"trusted_documents_mode" envconfig:"ORBIT_TRUSTED_DOCUMENTS_MODE"`
+
+	// Query limits configuration, operations over a limit are rejected, a limit of 0 is no limit
+	MaxDepth        int `toml:"max_depth" envconfig:"ORBIT_MAX_DEPTH"`
+	MaxFields       int `toml:"max_fields" envconfig:"ORBIT_MAX_FIELDS"`
+	MaxAliases      int `toml:"max_aliases" envconfig:"ORBIT_MAX_ALIASES"`
+	MaxRootFields   int `toml:"max_root_fields" envconfig:"ORBIT_MAX_ROOT_FIELDS"`
+	MaxCost         int `toml:"max_cost" envconfig:"ORBIT_MAX_COST"`
+	DefaultListSize int `toml:"default_list_size" envconfig:"ORBIT_DEFAULT_LIST_SIZE"`
+
+	// Rate limiting configuration, the requests per second of a scope served from the cache (hits) and sent to the
+	// origin (misses), and how many can be sent at once, 0 is no limit
+	RateLimitHits        float64 `toml:"rate_limit_hits" envconfig:"ORBIT_RATE_LIMIT_HITS"`
+	RateLimitHitsBurst   int     `toml:"rate_limit_hits_burst" envconfig:"ORBIT_RATE_LIMIT_HITS_BURST"`
+	RateLimitMisses      float64 `toml:"rate_limit_misses" envconfig:"ORBIT_RATE_LIMIT_MISSES"`
+	RateLimitMissesBurst int     `toml:"rate_limit_misses_burst" envconfig:"ORBIT_RATE_LIMIT_MISSES_BURST"`
+	RateLimitByOperation bool    `toml:"rate_limit_by_operation" envconfig:"ORBIT_RATE_LIMIT_BY_OPERATION"`
+
+	// Coalescing configuration, identical requests that miss the cache at the same time wait for one request to the origin
+	Coalescing           bool `toml:"coalescing" envconfig:"ORBIT_COALESCING"`
+	CoalescingTimeout    int  `toml:"coalescing_timeout" envconfig:"ORBIT_COALESCING_TIMEOUT"`
+	CoalescingMaxWaiters int  `toml:"coalescing_max_waiters" envconfig:"ORBIT_COALESCING_MAX_WAITERS"`
+
 	// Handlers configuration
 	HandlersGraphQLPath     string `toml:"handlers_graphql_path" envconfig:"ORBIT_HANDLERS_GRAPHQL_PATH"`
 	HandlersFlushAllPath    string `toml:"handlers_flush_all_path" envconfig:"ORBIT_HANDLERS_FLUSH_ALL_PATH"`
@@ -25,6 +64,20 @@ type Config struct {
 	HandlersDebugPath       string `toml:"handlers_debug_path" envconfig:"ORBIT_HANDLERS_DEBUG_PATH"`
 	HandlersHealthPath      string `toml:"handlers_health_path" envconfig:"ORBIT_HANDLERS_HEALTH_PATH"`
 
+	// Types configures how the objects of a type are cached, by typename
+	Types map[string]TypeConfig `toml:"types" ignored:"true"`
+	// Mutations configures what a mutation invalidates besides the objects it returns, by mutation field
+	Mutations map[string]MutationConfig `toml:"mutations" ignored:"true"`
+	// Operations configures how the responses of an operation are cached, by operation name
+	Operations map[string]OperationConfig `toml:"operations" ignored:"true"`
+	// Tags name groups of types and root query fields that mutations invalidate together
+	Tags map[string]TagConfig `toml:"tags" ignored:"true"`
+
+	// Schema configuration
+	SchemaPath            string `toml:"schema_path" envconfig:"ORBIT_SCHEMA_PATH"`
+	SchemaIntrospection   bool   `toml:"schema_introspection" envconfig:"ORBIT_SCHEMA_INTROSPECTION"`
+	SchemaRefreshInterval int    `toml:"schema_refresh_interval" envconfig:"ORBIT_SCHEMA_REFRESH_INTERVAL"`
+
 	// Redis configuration
 	RedisHost string `toml:"redis_host" envconfig:"ORBIT_REDIS_HOST"`
 	RedisPort int    `toml:"redis_port" envconfig:"ORBIT_REDIS_PORT"`
@@ -34,6 +87,80 @@ type Config struct {
 	LogFormat string `toml:"log_format" envconfig:"ORBIT_LOG_FORMAT"`
 }
 
+// TypeConfig is the configuration of a type of the origin
+type TypeConfig struct {
+	// KeyFields are the fields that identify an object of the type, a field name or a list of them,
+	// or false for types without identity, their objects are embedded in the object they belong to
+	KeyFields interface{} `toml:"key_fields"`
+	// ListInvalidation is when the cached lists of the type are invalidated by a mutation returning an object
+	// of the type, "create" when the object is new, "always" or "never"
+	ListInvalidation string `toml:"list_invalidation"`
+	// MaxAge is the seconds the objects of the type are cached for, 0 doesn't cache them
+	MaxAge *int `toml:"max_age"`
+	// Scope is "public" when the objects of the type are cached once for every scope, or "private" when they
+	// are cached in the scope of the request, the default
+	Scope string `toml:"scope"`
+	// Fields configures the fields of the type, by field name
+	Fields map[string]FieldConfig `toml:"fields"`
+}
+
+// FieldConfig is the configuration of a field of a type
+type FieldConfig struct {
+	// MaxAge is the seconds the field is cached for, over the max age of its type
+	MaxAge *int `toml:"max_age"`
+	// Cost is the cost of the field in the cost of an operation, 1 by default
+	Cost *int `toml:"cost"`
+	// ListSize is the size assumed for the list of the field when it isn't sliced by an argument
+	ListSize *int `toml:"list_size"`
+	// Scope is "public" or "private", over the scope of its type
+	Scope string `toml:"scope"`
+	// Returns is the typename of the object a root query field returns, so the field selecting one object by
+	// its key fields (user(id: "1")) is read from the object cached by other queries
+	Returns string `toml:"returns"`
+}
+
+// OperationConfig is the configuration of an operation of the clients
+type OperationConfig struct {
+	// CachePartialData caches the data of responses with errors, without the fields the errors nulled
+	CachePartialData bool `toml:"cache_partial_data"`
+	// StaleWhileRevalidate is the seconds an expired response is served for while it is refreshed in the background
+	StaleWhileRevalidate int `toml:"stale_while_revalidate"`
+	// StaleIfError is the seconds an expired response is served for when the origin fails
+	StaleIfError int `toml:"stale_if_error"`
+	// RateLimitHits and RateLimitMisses are the budgets of the operation in every scope, with rate_limit_by_operation
+	// they are taken from on top of the budgets of the scope
+	RateLimitHits        float64 `toml:"rate_limit_hits"`
+	RateLimitHitsBurst   int     `toml:"rate_limit_hits_burst"`
+	RateLimitMisses      float64 `toml:"rate_limit_misses"`
+	RateLimitMissesBurst int     `toml:"rate_limit_misses_burst"`
+}
+
+// MutationConfig is what a mutation invalidates after it succeeds
+type MutationConfig struct {
+	// InvalidateTypes are types invalidated with every object of the type
+	InvalidateTypes []string `toml:"invalidate_types"`
+	// InvalidateKeys are keys of objects, templated from the arguments and variables of the mutation
+	// like User:{{params.userId}} or User:{{variables.id}}
+	InvalidateKeys []string `toml:"invalidate_keys"`
+	// InvalidateFields are root query fields, invalidated with every arguments
+	InvalidateFields []string `toml:"invalidate_fields"`
+	// InvalidateTags are the tags the types and root query fields of are invalidated
+	InvalidateTags []string `toml:"invalidate_tags"`
+}
+
+// TagConfig is a group of types and root query fields
+type TagConfig struct {
+	Types  []string `toml:"types"`
+	Fields []string `toml:"fields"`
+}
+
+// keyTemplatePattern matches a key template, a typename and an id with {{params.*}} or {{variables.*}} placeholders
+var keyTemplatePattern = regexp.MustCompile(`^[_A-Za-z][_0-9A-Za-z]*:([^{}]|{{\s*(params|variables)(\.[^{}.\s]+)+\s*}})+$`)
+
+// TRUSTED_DOCUMENTS_ENFORCE rejects the documents that aren't trusted, TRUSTED_DOCUMENTS_REPORT only logs them
+const TRUSTED_DOCUMENTS_ENFORCE = "enforce"
+const TRUSTED_DOCUMENTS_REPORT = "report"
+
 var CONFIG_FILE = "./config.toml"
 
 func NewConfig() *Config {
@@ -66,6 +193,65 @@ func NewConfig() *Config {
 		}
 	}
 
+	if cfg.SchemaPath != "" && cfg.SchemaIntrospection {
+		log.Print("schema_path and schema_introspection can't be used together, configure only one schema source")
+		os.Exit(1)
+	}
+
+	if _, err := cfg.KeyFields(); err != nil {
+		log.Print(err)
+		os.Exit(1)
+	}
+
+	if _, err := cfg.ListInvalidation(); err != nil {
+		log.Print(err)
+		os.Exit(1)
+	}
+
+	if _, err := cfg.MaxAges(); err != nil {
+		log.Print(err)
+		os.Exit(1)
+	}
+
+	if _, err := cfg.FieldCosts(); err != nil {
+		log.Print(err)
+		os.Exit(1)
+	}
+
+	if _, err := cfg.ListSizes(); err != nil {
+		log.Print(err)
+		os.Exit(1)
+	}
+
+	if _, err := cfg.Scopes(); err != nil {
+		log.Print(err)
+		os.Exit(1)
+	}
+
+	if _, err := cfg.RootFieldTypes(); err != nil {
+		log.Print(err)
+		os.Exit(1)
+	}
+
+	if _, err := cfg.MutationInvalidation(); err != nil {
+		log.Print(err)
+		os.Exit(1)
+	}
+
+	if cfg.TrustedDocumentsMode == "" {
+		cfg.TrustedDocumentsMode = TRUSTED_DOCUMENTS_ENFORCE
+	}
+
+	if cfg.TrustedDocumentsMode != TRUSTED_DOCUMENTS_ENFORCE && cfg.TrustedDocumentsMode != TRUSTED_DOCUMENTS_REPORT {
+		log.Print("trusted_documents_mode can only be enforce or report")
+		os.Exit(1)
+	}
+
+	if cfg.ScopeJWTClaims != "" && cfg.ScopeJWKS == "" && !cfg.ScopeJWTSkipVerification {
+		log.Print("scope_jwt_claims needs a scope_jwks to verify the tokens with, or scope_jwt_skip_verification")
+		os.Exit(1)
+	}
+
 	if cfg.Port == 0 {
 		cfg.Port = 9090
 	}
@@ -74,6 +260,10 @@ func NewConfig() *Config {
 		cfg.ScopeHeaders = "Authorization"
 	}
 
+	if cfg.ScopeJWTHeader == "" {
+		cfg.ScopeJWTHeader = "Authorization"
+	}
+
 	if cfg.PrimaryKeyField == "" {
 		cfg.PrimaryKeyField = "id"
 	}
@@ -107,6 +297,37 @@ func NewConfig() *Config {
 		cfg.CacheTTL = 3600
 	}
 
+	if cfg.CoalescingTimeout == 0 {
+		cfg.CoalescingTimeout = 10
+	}
+
+	if cfg.CoalescingMaxWaiters == 0 {
+		cfg.CoalescingMaxWaiters = 1000
+	}
+
+	// without a burst, a second of requests can be sent at once
+	if cfg.RateLimitHitsBurst == 0 {
+		cfg.RateLimitHitsBurst = int(math.Max(1, math.Ceil(cfg.RateLimitHits)))
+	}
+
+	if cfg.RateLimitMissesBurst == 0 {
+		cfg.RateLimitMissesBurst = int(math.Max(1, math.Ceil(cfg.RateLimitMisses)))
+	}
+
+	for name, operation := range cfg.Operations {
+		if operation.RateLimitHits > 0 && operation.RateLimitHitsBurst == 0 {
+			operation.RateLimitHitsBurst = int(math.Max(1, math.Ceil(operation.RateLimitHits)))
+		}
+		if operation.RateLimitMisses > 0 && operation.RateLimitMissesBurst == 0 {
+			operation.RateLimitMissesBurst = int(math.Max(1, math.Ceil(operation.RateLimitMisses)))
+		}
+		cfg.Operations[name] = operation
+	}
+
+	if cfg.DefaultListSize == 0 {
+		cfg.DefaultListSize = 10
+	}
+
 	if cfg.LogLevel == "" {
 		cfg.LogLevel = "info"
 	}
@@ -118,6 +339,183 @@ func NewConfig() *Config {
 	return &cfg
 }
 
+// KeyFields maps the types configured with key fields to them, types configured with key_fields=false
+// map to an empty list
+func (cfg *Config) KeyFields() (map[string][]string, error) {
+	keyFields := make(map[string][]string)
+	for typename, typeConfig := range cfg.Types {
+		switch value := typeConfig.KeyFields.(type) {
+		case nil:
+			continue
+		case bool:
+			if value {
+				return nil, fmt.Errorf("key_fields of type %s can only be false or a list of fields", typename)
+			}
+			keyFields[typename] = []string{}
+		case string:
+			keyFields[typename] = []string{value}
+		case []interface{}:
+			fields := make([]string, 0)
+			for _, field := range value {
+				name, ok := field.(string)
+				if !ok || name == "" {
+					return nil, fmt.Errorf("key_fields of type %s has to be a list of field names", typename)
+				}
+				fields = append(fields, name)
+			}
+			if len(fields) == 0 {
+				return nil, fmt.Errorf("key_fields of type %s is empty, use key_fields=false for types without identity", typename)
+			}
+			keyFields[typename] = fields
+		default:
+			return nil, fmt.Errorf("key_fields of type %s can only be false or a list of fields", typename)
+		}
+	}
+	return keyFields, nil
+}
+
+// ListInvalidation maps the types configured with a list invalidation policy to it
+func (cfg *Config) ListInvalidation() (map[string]string, error) {
+	policies := make(map[string]string)
+	for typename, typeConfig := range cfg.Types {
+		switch typeConfig.ListInvalidation {
+		case "":
+			continue
+		case "create", "always", "never":
+			policies[typename] = typeConfig.ListInvalidation
+		default:
+			return nil, fmt.Errorf("list_invalidation of type %s can only be create, always or never", typename)
+		}
+	}
+	return policies, nil
+}
+
+// MaxAges maps the types (User) and fields of types (User.email) configured with a max age to it
+func (cfg *Config) MaxAges() (map[string]int, error) {
+	maxAges := make(map[string]int)
+	for typename, typeConfig := range cfg.Types {
+		if typeConfig.MaxAge != nil {
+			if *typeConfig.MaxAge < 0 {
+				return nil, fmt.Errorf("max_age of type %s can't be negative", typename)
+			}
+			maxAges[typename] = *typeConfig.MaxAge
+		}
+		for field, fieldConfig := range typeConfig.Fields {
+			if fieldConfig.MaxAge == nil {
+				continue
+			}
+			if *fieldConfig.MaxAge < 0 {
+				return nil, fmt.Errorf("max_age of field %s.%s can't be negative", typename, field)
+			}
+			maxAges[typename+"."+field] = *fieldConfig.MaxAge
+		}
+	}
+	return maxAges, nil
+}
+
+// FieldCosts maps the fields of a type (User.todos) configured with a cost to it
+func (cfg *Config) FieldCosts() (map[string]int, error) {
+	costs := make(map[string]int)
+	for typename, typeConfig := range cfg.Types {
+		for field, fieldConfig := range typeConfig.Fields {
+			if fieldConfig.Cost == nil {
+				continue
+			}
+			if *fieldConfig.Cost < 0 {
+				return nil, fmt.Errorf("cost of field %s.%s can't be negative", typename, field)
+			}
+			costs[typename+"."+field] = *fieldConfig.Cost
+		}
+	}
+	return costs, nil
+}
+
+// ListSizes maps the fields of a type (User.todos) configured with a list size to it
+func (cfg *Config) ListSizes() (map[string]int, error) {
+	listSizes := make(map[string]int)
+	for typename, typeConfig := range cfg.Types {
+		for field, fieldConfig := range typeConfig.Fields {
+			if fieldConfig.ListSize == nil {
+				continue
+			}
+			if *fieldConfig.ListSize < 0 {
+				return nil, fmt.Errorf("list_size of field %s.%s can't be negative", typename, field)
+			}
+			listSizes[typename+"."+field] = *fieldConfig.ListSize
+		}
+	}
+	return listSizes, nil
+}
+
+// Scopes maps the types (Product) and fields of types (Product.price) configured with a scope to it
+func (cfg *Config) Scopes() (map[string]string, error) {
+	scopes := make(map[string]string)
+	for typename, typeConfig := range cfg.Types {
+		switch typeConfig.Scope {
+		case "":
+		case "public", "private":
+			scopes[typename] = typeConfig.Scope
+		default:
+			return nil, fmt.Errorf("scope of type %s can only be public or private", typename)
+		}
+		for field, fieldConfig := range typeConfig.Fields {
+			switch fieldConfig.Scope {
+			case "":
+			case "public", "private":
+				scopes[typename+"."+field] = fieldConfig.Scope
+			default:
+				return nil, fmt.Errorf("scope of field %s.%s can only be public or private", typename, field)
+			}
+		}
+	}
+	return scopes, nil
+}
+
+// RootFieldTypes maps the root query fields (user) configured with the typename of the object they return to it
+func (cfg *Config) RootFieldTypes() (map[string]string, error) {
+	rootFieldTypes := make(map[string]string)
+	for typename, typeConfig := range cfg.Types {
+		for field, fieldConfig := range typeConfig.Fields {
+			if fieldConfig.Returns == "" {
+				continue
+			}
+			if typename != "Query" {
+				return nil, fmt.Errorf("returns of field %s.%s can only be configured on fields of the Query type", typename, field)
+			}
+			rootFieldTypes[field] = fieldConfig.Returns
+		}
+	}
+	return rootFieldTypes, nil
+}
+
+// MutationInvalidation is the configuration of the mutations with their tags resolved to the types and
+// root query fields of the tags
+func (cfg *Config) MutationInvalidation() (map[string]MutationConfig, error) {
+	mutations := make(map[string]MutationConfig)
+	for name, mutation := range cfg.Mutations {
+		for _, key := range mutation.InvalidateKeys {
+			if !keyTemplatePattern.MatchString(key) {
+				return nil, fmt.Errorf("invalidate_keys of mutation %s has an invalid key %s, keys look like Type:{{params.id}}", name, key)
+			}
+		}
+		resolved := MutationConfig{
+			InvalidateTypes:  append([]string{}, mutation.InvalidateTypes...),
+			InvalidateKeys:   mutation.InvalidateKeys,
+			InvalidateFields: append([]string{}, mutation.InvalidateFields...),
+		}
+		for _, tag := range mutation.InvalidateTags {
+			tagConfig, ok := cfg.Tags[tag]
+			if !ok {
+				return nil, fmt.Errorf("invalidate_tags of mutation %s has the tag %s that isn't configured in [tags]", name, tag)
+			}
+			resolved.InvalidateTypes = append(resolved.InvalidateTypes, tagConfig.Types...)
+			resolved.InvalidateFields = append(resolved.InvalidateFields, tagConfig.Fields...)
+		}
+		mutations[name] = resolved
+	}
+	return mutations, nil
+}
+
 func ParseAndUpdateConfigFromTOML(cfg *Config) {
 	// look for the config.toml file in the current directory
 	// if it doesn't exist, use the default configuration
@@ -56,6 +56,12 @@ func TestNewConfigDefaultValues(t *testing.T) {
 	assert.Equal(t, "/debug", cfg.HandlersDebugPath)
 	assert.Equal(t, "/health", cfg.HandlersHealthPath)
 	assert.Equal(t, "x-orbit-cache", cfg.CacheHeaderName)
+	assert.False(t, cfg.Coalescing)
+	assert.Equal(t, 10, cfg.CoalescingTimeout)
+	assert.Equal(t, 1000, cfg.CoalescingMaxWaiters)
+	assert.Equal(t, TRUSTED_DOCUMENTS_ENFORCE, cfg.TrustedDocumentsMode)
+	assert.Equal(t, 10, cfg.DefaultListSize)
+	assert.Equal(t, "Authorization", cfg.ScopeJWTHeader)
 }
 
 func TestNewConfigValidFile(t *testing.T) {
@@ -122,3 +128,391 @@ func TestNewConfigCacheBackendFromEnv(t *testing.T) {
 
 	assert.Equal(t, "redis", cfg.CacheBackend, "Expected CacheBackend to be 'redis' from environment variable")
 }
+
+func TestNewConfigSchema(t *testing.T) {
+	configContent := `
+        origin = "http://localhost"
+        schema_path = "./schema.graphql"
+        schema_refresh_interval = 60
+    `
+	createTestConfigFile(configContent)
+	defer removeTestConfigFile()
+
+	// Temporarily change the CONFIG_FILE constant
+	originalConfigFile := CONFIG_FILE
+	CONFIG_FILE = testConfigFile
+	defer func() { CONFIG_FILE = originalConfigFile }()
+
+	cfg := NewConfig()
+
+	assert.Equal(t, "./schema.graphql", cfg.SchemaPath)
+	assert.False(t, cfg.SchemaIntrospection)
+	assert.Equal(t, 60, cfg.SchemaRefreshInterval)
+
+	os.Setenv("ORBIT_SCHEMA_PATH", "")
+	os.Setenv("ORBIT_SCHEMA_INTROSPECTION", "true")
+	defer os.Unsetenv("ORBIT_SCHEMA_PATH")
+	defer os.Unsetenv("ORBIT_SCHEMA_INTROSPECTION")
+
+	cfg = NewConfig()
+
+	assert.Equal(t, "", cfg.SchemaPath)
+	assert.True(t, cfg.SchemaIntrospection)
+}
+
+func TestNewConfigTypeKeyFields(t *testing.T) {
+	configContent := `
+        origin = "http://localhost"
+
+        [types.Account]
+        key_fields = "uuid"
+
+        [types.Membership]
+        key_fields = ["orgId", "userId"]
+
+        [types.Settings]
+        key_fields = false
+    `
+	createTestConfigFile(configContent)
+	defer removeTestConfigFile()
+
+	// Temporarily change the CONFIG_FILE constant
+	originalConfigFile := CONFIG_FILE
+	CONFIG_FILE = testConfigFile
+	defer func() { CONFIG_FILE = originalConfigFile }()
+
+	cfg := NewConfig()
+
+	keyFields, err := cfg.KeyFields()
+	assert.Nil(t, err)
+	assert.Equal(t, map[string][]string{
+		"Account":    {"uuid"},
+		"Membership": {"orgId", "userId"},
+		"Settings":   {},
+	}, keyFields)
+}
+
+func TestKeyFieldsInvalid(t *testing.T) {
+	for _, keyFields := range []interface{}{true, []interface{}{}, []interface{}{"orgId", 1}, 10} {
+		cfg := &Config{Types: map[string]TypeConfig{"Membership": {KeyFields: keyFields}}}
+		_, err := cfg.KeyFields()
+		assert.NotNil(t, err, keyFields)
+	}
+}
+
+func TestNewConfigTypeListInvalidation(t *testing.T) {
+	configContent := `
+        origin = "http://localhost"
+
+        [types.Todo]
+        list_invalidation = "always"
+
+        [types.AuditLog]
+        list_invalidation = "never"
+
+        [types.Account]
+        key_fields = "uuid"
+    `
+	createTestConfigFile(configContent)
+	defer removeTestConfigFile()
+
+	// Temporarily change the CONFIG_FILE constant
+	originalConfigFile := CONFIG_FILE
+	CONFIG_FILE = testConfigFile
+	defer func() { CONFIG_FILE = originalConfigFile }()
+
+	cfg := NewConfig()
+
+	listInvalidation, err := cfg.ListInvalidation()
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{"Todo": "always", "AuditLog": "never"}, listInvalidation)
+}
+
+func TestListInvalidationInvalid(t *testing.T) {
+	cfg := &Config{Types: map[string]TypeConfig{"Todo": {ListInvalidation: "sometimes"}}}
+	_, err := cfg.ListInvalidation()
+	assert.NotNil(t, err)
+}
+
+func TestNewConfigMutations(t *testing.T) {
+	configContent := `
+        origin = "http://localhost"
+
+        [mutations.markAsDone]
+        invalidate_keys = ["User:{{params.userId}}"]
+        invalidate_tags = ["stats"]
+
+        [mutations.deleteEverything]
+        invalidate_types = ["User", "Todo"]
+
+        [tags.stats]
+        types = ["Stats"]
+        fields = ["totalUsers", "completionRate"]
+    `
+	createTestConfigFile(configContent)
+	defer removeTestConfigFile()
+
+	// Temporarily change the CONFIG_FILE constant
+	originalConfigFile := CONFIG_FILE
+	CONFIG_FILE = testConfigFile
+	defer func() { CONFIG_FILE = originalConfigFile }()
+
+	cfg := NewConfig()
+
+	mutations, err := cfg.MutationInvalidation()
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]MutationConfig{
+		"markAsDone": {
+			InvalidateTypes:  []string{"Stats"},
+			InvalidateKeys:   []string{"User:{{params.userId}}"},
+			InvalidateFields: []string{"totalUsers", "completionRate"},
+		},
+		"deleteEverything": {
+			InvalidateTypes:  []string{"User", "Todo"},
+			InvalidateFields: []string{},
+		},
+	}, mutations)
+}
+
+func TestMutationInvalidationInvalid(t *testing.T) {
+	for _, mutation := range []MutationConfig{
+		{InvalidateKeys: []string{"{{params.userId}}"}},
+		{InvalidateKeys: []string{"User:{{userId}}"}},
+		{InvalidateKeys: []string{"User:{{params.userId}"}},
+		{InvalidateTags: []string{"unknown"}},
+	} {
+		cfg := &Config{Mutations: map[string]MutationConfig{"markAsDone": mutation}}
+		_, err := cfg.MutationInvalidation()
+		assert.NotNil(t, err, mutation)
+	}
+}
+
+func TestNewConfigMaxAges(t *testing.T) {
+	configContent := `
+        origin = "http://localhost"
+
+        [types.User]
+        max_age = 60
+
+        [types.User.fields.email]
+        max_age = 0
+
+        [types.Query.fields.totalUsers]
+        max_age = 10
+    `
+	createTestConfigFile(configContent)
+	defer removeTestConfigFile()
+
+	// Temporarily change the CONFIG_FILE constant
+	originalConfigFile := CONFIG_FILE
+	CONFIG_FILE = testConfigFile
+	defer func() { CONFIG_FILE = originalConfigFile }()
+
+	cfg := NewConfig()
+
+	maxAges, err := cfg.MaxAges()
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]int{"User": 60, "User.email": 0, "Query.totalUsers": 10}, maxAges)
+}
+
+func TestMaxAgesInvalid(t *testing.T) {
+	negative := -1
+	for _, typeConfig := range []TypeConfig{
+		{MaxAge: &negative},
+		{Fields: map[string]FieldConfig{"email": {MaxAge: &negative}}},
+	} {
+		cfg := &Config{Types: map[string]TypeConfig{"User": typeConfig}}
+		_, err := cfg.MaxAges()
+		assert.NotNil(t, err)
+	}
+}
+
+func TestNewConfigOperations(t *testing.T) {
+	configContent := `
+        origin = "http://localhost"
+
+        [operations.GetDashboard]
+        cache_partial_data = true
+        stale_while_revalidate = 30
+        stale_if_error = 600
+    `
+	createTestConfigFile(configContent)
+	defer removeTestConfigFile()
+
+	// Temporarily change the CONFIG_FILE constant
+	originalConfigFile := CONFIG_FILE
+	CONFIG_FILE = testConfigFile
+	defer func() { CONFIG_FILE = originalConfigFile }()
+
+	cfg := NewConfig()
+
+	assert.Equal(t, map[string]OperationConfig{
+		"GetDashboard": {CachePartialData: true, StaleWhileRevalidate: 30, StaleIfError: 600},
+	}, cfg.Operations)
+}
+
+func TestNewConfigQueryLimits(t *testing.T) {
+	configContent := `
+        origin = "http://localhost"
+        max_depth = 10
+        max_cost = 1000
+
+        [types.User.fields.todos]
+        cost = 2
+        list_size = 50
+    `
+	createTestConfigFile(configContent)
+	defer removeTestConfigFile()
+
+	// Temporarily change the CONFIG_FILE constant
+	originalConfigFile := CONFIG_FILE
+	CONFIG_FILE = testConfigFile
+	defer func() { CONFIG_FILE = originalConfigFile }()
+
+	cfg := NewConfig()
+
+	assert.Equal(t, 10, cfg.MaxDepth)
+	assert.Equal(t, 1000, cfg.MaxCost)
+	costs, err := cfg.FieldCosts()
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]int{"User.todos": 2}, costs)
+	listSizes, err := cfg.ListSizes()
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]int{"User.todos": 50}, listSizes)
+}
+
+func TestQueryLimitsInvalid(t *testing.T) {
+	negative := -1
+	cfg := &Config{Types: map[string]TypeConfig{"User": {Fields: map[string]FieldConfig{"todos": {Cost: &negative, ListSize: &negative}}}}}
+	_, err := cfg.FieldCosts()
+	assert.NotNil(t, err)
+	_, err = cfg.ListSizes()
+	assert.NotNil(t, err)
+}
+
+func TestNewConfigRateLimit(t *testing.T) {
+	configContent := `
+        origin = "http://localhost"
+        rate_limit_hits = 50
+        rate_limit_misses = 2.5
+        rate_limit_misses_burst = 10
+    `
+	createTestConfigFile(configContent)
+	defer removeTestConfigFile()
+
+	// Temporarily change the CONFIG_FILE constant
+	originalConfigFile := CONFIG_FILE
+	CONFIG_FILE = testConfigFile
+	defer func() { CONFIG_FILE = originalConfigFile }()
+
+	cfg := NewConfig()
+
+	assert.Equal(t, 50.0, cfg.RateLimitHits)
+	assert.Equal(t, 50, cfg.RateLimitHitsBurst)
+	assert.Equal(t, 2.5, cfg.RateLimitMisses)
+	assert.Equal(t, 10, cfg.RateLimitMissesBurst)
+	assert.False(t, cfg.RateLimitByOperation)
+}
+
+func TestNewConfigOperationRateLimit(t *testing.T) {
+	configContent := `
+        origin = "http://localhost"
+        rate_limit_misses = 10
+        rate_limit_by_operation = true
+
+        [operations.GetDashboard]
+        rate_limit_misses = 2.5
+    `
+	createTestConfigFile(configContent)
+	defer removeTestConfigFile()
+
+	// Temporarily change the CONFIG_FILE constant
+	originalConfigFile := CONFIG_FILE
+	CONFIG_FILE = testConfigFile
+	defer func() { CONFIG_FILE = originalConfigFile }()
+
+	cfg := NewConfig()
+
+	assert.True(t, cfg.RateLimitByOperation)
+	assert.Equal(t, 2.5, cfg.Operations["GetDashboard"].RateLimitMisses)
+	assert.Equal(t, 3, cfg.Operations["GetDashboard"].RateLimitMissesBurst)
+	assert.Equal(t, 0.0, cfg.Operations["GetDashboard"].RateLimitHits)
+}
+
+func TestNewConfigScopeJWT(t *testing.T) {
+	configContent := `
+        origin = "http://localhost"
+        scope_jwt_claims = "tenant_id,sub"
+        scope_jwt_header = "X-Token"
+        scope_jwks = "./jwks.json"
+        scope_jwt_reject_invalid = true
+    `
+	createTestConfigFile(configContent)
+	defer removeTestConfigFile()
+
+	// Temporarily change the CONFIG_FILE constant
+	originalConfigFile := CONFIG_FILE
+	CONFIG_FILE = testConfigFile
+	defer func() { CONFIG_FILE = originalConfigFile }()
+
+	cfg := NewConfig()
+
+	assert.Equal(t, "tenant_id,sub", cfg.ScopeJWTClaims)
+	assert.Equal(t, "X-Token", cfg.ScopeJWTHeader)
+	assert.Equal(t, "./jwks.json", cfg.ScopeJWKS)
+	assert.False(t, cfg.ScopeJWTSkipVerification)
+	assert.True(t, cfg.ScopeJWTRejectInvalid)
+}
+
+func TestNewConfigScopes(t *testing.T) {
+	configContent := `
+        origin = "http://localhost"
+
+        [types.Product]
+        scope = "public"
+
+        [types.Product.fields.viewerRating]
+        scope = "private"
+
+        [types.Query.fields.catalog]
+        scope = "public"
+    `
+	createTestConfigFile(configContent)
+	defer removeTestConfigFile()
+
+	// Temporarily change the CONFIG_FILE constant
+	originalConfigFile := CONFIG_FILE
+	CONFIG_FILE = testConfigFile
+	defer func() { CONFIG_FILE = originalConfigFile }()
+
+	cfg := NewConfig()
+
+	scopes, err := cfg.Scopes()
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{"Product": "public", "Product.viewerRating": "private", "Query.catalog": "public"}, scopes)
+}
+
+func TestRootFieldTypes(t *testing.T) {
+	cfg := &Config{Types: map[string]TypeConfig{
+		"Query": {Fields: map[string]FieldConfig{"user": {Returns: "User"}, "users": {Scope: "public"}}},
+	}}
+	rootFieldTypes, err := cfg.RootFieldTypes()
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{"user": "User"}, rootFieldTypes)
+
+	// only root query fields return the objects they select
+	cfg = &Config{Types: map[string]TypeConfig{"User": {Fields: map[string]FieldConfig{"friend": {Returns: "User"}}}}}
+	_, err = cfg.RootFieldTypes()
+	assert.NotNil(t, err)
+}
+
+func TestScopesInvalid(t *testing.T) {
+	for _, typeConfig := range []TypeConfig{
+		{Scope: "shared"},
+		{Fields: map[string]FieldConfig{"price": {Scope: "PUBLIC"}}},
+	} {
+		cfg := &Config{Types: map[string]TypeConfig{"Product": typeConfig}}
+		_, err := cfg.Scopes()
+		assert.NotNil(t, err)
+	}
+}
@@ -1,8 +1,14 @@
 package graphcache
 
 import (
-	"github.com/vektah/gqlparser/ast"
-	"github.com/vektah/gqlparser/parser"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/vektah/gqlparser/v2/ast"
+	"github.com/vektah/gqlparser/v2/parser"
 )
 
 func GetASTFromQuery(query string) (*ast.QueryDocument, error) {
@@ -10,5 +16,278 @@ func GetASTFromQuery(query string) (*ast.QueryDocument, error) {
 	if err != nil {
 		return nil, err
 	}
+	if err := linkFragmentSpreads(doc); err != nil {
+		return nil, err
+	}
 	return doc, nil
 }
+
+// GetOperation returns the operation of the document a request executes, the one named by operationName,
+// or the only operation of the document when the request doesn't name one
+func GetOperation(doc *ast.QueryDocument, operationName string) (*ast.OperationDefinition, error) {
+	if len(doc.Operations) == 0 {
+		return nil, errors.New("no operations found in query")
+	}
+	if operationName == "" {
+		if len(doc.Operations) > 1 {
+			return nil, errors.New("must provide operation name if query contains multiple operations")
+		}
+		return doc.Operations[0], nil
+	}
+	operation := doc.Operations.ForName(operationName)
+	if operation == nil {
+		return nil, fmt.Errorf("unknown operation named \"%s\"", operationName)
+	}
+	return operation, nil
+}
+
+// linkFragmentSpreads points every fragment spread in the document to its fragment definition
+// the parser leaves FragmentSpread.Definition empty (it is only filled by the validator),
+// so we resolve them here and reject unknown fragments and fragments that spread themselves
+// DocumentHash is the sha256 hash of an operation and the fragments it spreads, printed without the __typename
+// fields the proxy adds to queries, so an operation hashes the same before and after they are added
+// and two documents with the same operation name and variables are told apart
+func DocumentHash(queryDoc *ast.OperationDefinition) string {
+	doc := &ast.QueryDocument{}
+	spread := make(map[string]bool)
+	var withoutTypename func(selectionSet ast.SelectionSet) ast.SelectionSet
+	withoutTypename = func(selectionSet ast.SelectionSet) ast.SelectionSet {
+		selections := make(ast.SelectionSet, 0, len(selectionSet))
+		for _, selection := range selectionSet {
+			switch selection := selection.(type) {
+			case *ast.Field:
+				if selection.Name == TYPENAME_FIELD && (selection.Alias == "" || selection.Alias == selection.Name) {
+					continue
+				}
+				field := *selection
+				field.SelectionSet = withoutTypename(selection.SelectionSet)
+				selections = append(selections, &field)
+			case *ast.InlineFragment:
+				fragment := *selection
+				fragment.SelectionSet = withoutTypename(selection.SelectionSet)
+				selections = append(selections, &fragment)
+			case *ast.FragmentSpread:
+				if selection.Definition != nil && !spread[selection.Name] {
+					spread[selection.Name] = true
+					fragment := *selection.Definition
+					fragment.SelectionSet = withoutTypename(selection.Definition.SelectionSet)
+					doc.Fragments = append(doc.Fragments, &fragment)
+				}
+				selections = append(selections, selection)
+			}
+		}
+		return selections
+	}
+	operation := *queryDoc
+	operation.SelectionSet = withoutTypename(queryDoc.SelectionSet)
+	doc.Operations = ast.OperationList{&operation}
+
+	sum := sha256.Sum256([]byte(printQueryDocument(doc)))
+	return hex.EncodeToString(sum[:])
+}
+
+func linkFragmentSpreads(doc *ast.QueryDocument) error {
+	for _, operation := range doc.Operations {
+		if err := linkSelectionSet(doc, operation.SelectionSet); err != nil {
+			return err
+		}
+	}
+	for _, fragment := range doc.Fragments {
+		if err := linkSelectionSet(doc, fragment.SelectionSet); err != nil {
+			return err
+		}
+	}
+	// every fragment is walked once, the ones already done have no cycle through them
+	states := make(map[string]fragmentState)
+	for _, fragment := range doc.Fragments {
+		if err := detectFragmentCycle(fragment, states); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func linkSelectionSet(doc *ast.QueryDocument, selectionSet ast.SelectionSet) error {
+	for _, selection := range selectionSet {
+		switch selection := selection.(type) {
+		case *ast.Field:
+			if err := linkSelectionSet(doc, selection.SelectionSet); err != nil {
+				return err
+			}
+		case *ast.InlineFragment:
+			if err := linkSelectionSet(doc, selection.SelectionSet); err != nil {
+				return err
+			}
+		case *ast.FragmentSpread:
+			definition := doc.Fragments.ForName(selection.Name)
+			if definition == nil {
+				return fmt.Errorf("unknown fragment \"%s\"", selection.Name)
+			}
+			selection.Definition = definition
+		}
+	}
+	return nil
+}
+
+// fragmentState is where the cycle detection is at with a fragment
+type fragmentState int
+
+const (
+	fragmentUnvisited fragmentState = iota
+	fragmentInProgress
+	fragmentDone
+)
+
+func detectFragmentCycle(fragment *ast.FragmentDefinition, states map[string]fragmentState) error {
+	switch states[fragment.Name] {
+	case fragmentInProgress:
+		return fmt.Errorf("cannot spread fragment \"%s\" within itself", fragment.Name)
+	case fragmentDone:
+		return nil
+	}
+	states[fragment.Name] = fragmentInProgress
+	for _, spread := range fragmentSpreads(fragment.SelectionSet) {
+		if err := detectFragmentCycle(spread.Definition, states); err != nil {
+			return err
+		}
+	}
+	states[fragment.Name] = fragmentDone
+	return nil
+}
+
+// fragmentSpreads returns the fragment spreads used directly in a selection set,
+// including the ones nested inside fields and inline fragments
+func fragmentSpreads(selectionSet ast.SelectionSet) []*ast.FragmentSpread {
+	spreads := make([]*ast.FragmentSpread, 0)
+	for _, selection := range selectionSet {
+		switch selection := selection.(type) {
+		case *ast.Field:
+			spreads = append(spreads, fragmentSpreads(selection.SelectionSet)...)
+		case *ast.InlineFragment:
+			spreads = append(spreads, fragmentSpreads(selection.SelectionSet)...)
+		case *ast.FragmentSpread:
+			spreads = append(spreads, selection)
+		}
+	}
+	return spreads
+}
+
+// collectFields flattens a selection set into the fields that apply to an object of the given typename
+// inline fragments and fragment spreads are expanded when their type condition matches the typename,
+// when the typename is not known (empty) every fragment is expanded, selections excluded by @skip
+// or @include with the variables are left out
+func collectFields(selectionSet ast.SelectionSet, typename string, variables map[string]interface{}) []*ast.Field {
+	fields := make([]*ast.Field, 0)
+	for _, selection := range selectionSet {
+		if !selectionIncluded(selection, variables) {
+			continue
+		}
+		switch selection := selection.(type) {
+		case *ast.Field:
+			fields = append(fields, selection)
+		case *ast.InlineFragment:
+			if typeConditionMatches(selection.TypeCondition, typename) {
+				fields = append(fields, collectFields(selection.SelectionSet, typename, variables)...)
+			}
+		case *ast.FragmentSpread:
+			if selection.Definition != nil && typeConditionMatches(selection.Definition.TypeCondition, typename) {
+				fields = append(fields, collectFields(selection.Definition.SelectionSet, typename, variables)...)
+			}
+		}
+	}
+	return fields
+}
+
+// selectionIncluded evaluates the @skip and @include directives of a selection with the variables of the
+// operation, a condition that isn't a boolean doesn't exclude the selection
+func selectionIncluded(selection ast.Selection, variables map[string]interface{}) bool {
+	var directives ast.DirectiveList
+	switch selection := selection.(type) {
+	case *ast.Field:
+		directives = selection.Directives
+	case *ast.InlineFragment:
+		directives = selection.Directives
+	case *ast.FragmentSpread:
+		directives = selection.Directives
+	}
+	if skip, ok := directiveCondition(directives, "skip", variables); ok && skip {
+		return false
+	}
+	if include, ok := directiveCondition(directives, "include", variables); ok && !include {
+		return false
+	}
+	return true
+}
+
+// directiveCondition is the value of the if argument of the directive, when it is a boolean
+func directiveCondition(directives ast.DirectiveList, name string, variables map[string]interface{}) (bool, bool) {
+	directive := directives.ForName(name)
+	if directive == nil || directive.Arguments.ForName("if") == nil {
+		return false, false
+	}
+	value, err := directive.Arguments.ForName("if").Value.Value(variables)
+	condition, ok := value.(bool)
+	return condition, err == nil && ok
+}
+
+// typeConditionMatches reports if a fragment with the type condition applies to an object of the typename
+// without a schema we can't tell which interfaces or unions a type belongs to, so a fragment applies
+// when the typename is not known or when the condition names the typename itself
+func typeConditionMatches(typeCondition string, typename string) bool {
+	return typeCondition == "" || typename == "" || typeCondition == typename
+}
+
+// fieldResponseKey is the key of a field in the response, its alias or its name when it has no alias
+// (the parser sets the alias to the name, fields built by hand may not have one)
+func fieldResponseKey(field *ast.Field) string {
+	if field.Alias != "" {
+		return field.Alias
+	}
+	return field.Name
+}
+
+// operationVariables returns the variables of a request with the default values of the operation
+// filled in for the variables the request didn't send
+func operationVariables(operation *ast.OperationDefinition, variables map[string]interface{}) map[string]interface{} {
+	resolved := make(map[string]interface{})
+	for _, definition := range operation.VariableDefinitions {
+		if definition.DefaultValue == nil {
+			continue
+		}
+		if value, err := definition.DefaultValue.Value(nil); err == nil {
+			resolved[definition.Variable] = value
+		}
+	}
+	for key, value := range variables {
+		resolved[key] = value
+	}
+	return resolved
+}
+
+// fieldStorageKey is the key a field's value is stored under in the cache, the field name followed by
+// its arguments (with variables resolved) serialized as JSON, so the order of the arguments doesn't matter
+// for example user(id: $id) with {"id": "1"} is stored as user({"id":"1"})
+func fieldStorageKey(field *ast.Field, variables map[string]interface{}) string {
+	if len(field.Arguments) == 0 {
+		return field.Name
+	}
+	arguments := make(map[string]interface{})
+	for _, argument := range field.Arguments {
+		if argument.Value.Kind == ast.Variable {
+			// an argument with a variable the request didn't send is the same as leaving the argument out
+			if _, ok := variables[argument.Value.Raw]; !ok {
+				continue
+			}
+		}
+		value, err := argument.Value.Value(variables)
+		if err != nil {
+			value = argument.Value.String()
+		}
+		arguments[argument.Name] = value
+	}
+	if len(arguments) == 0 {
+		return field.Name
+	}
+	argumentBytes, _ := json.Marshal(arguments)
+	return field.Name + "(" + string(argumentBytes) + ")"
+}
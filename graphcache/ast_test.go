@@ -0,0 +1,144 @@
+package graphcache
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vektah/gqlparser/v2/ast"
+)
+
+func TestGetASTFromQueryLinksFragments(t *testing.T) {
+	doc, err := GetASTFromQuery("{ user { ...UserFields } } fragment UserFields on User { id ...MetaFields } fragment MetaFields on User { meta { ipAddress } }")
+	assert.Nil(t, err)
+
+	spread := doc.Operations[0].SelectionSet[0].(*ast.Field).SelectionSet[0].(*ast.FragmentSpread)
+	assert.Equal(t, doc.Fragments.ForName("UserFields"), spread.Definition)
+
+	nestedSpread := doc.Fragments.ForName("UserFields").SelectionSet[1].(*ast.FragmentSpread)
+	assert.Equal(t, doc.Fragments.ForName("MetaFields"), nestedSpread.Definition)
+}
+
+func TestGetASTFromQueryUnknownFragment(t *testing.T) {
+	_, err := GetASTFromQuery("{ user { ...UserFields } }")
+	assert.EqualError(t, err, "unknown fragment \"UserFields\"")
+}
+
+func TestGetASTFromQueryRecursiveFragments(t *testing.T) {
+	_, err := GetASTFromQuery("{ user { ...A } } fragment A on User { id ...B } fragment B on User { todos { user { ...A } } }")
+	assert.NotNil(t, err)
+
+	_, err = GetASTFromQuery("{ user { ...A } } fragment A on User { id ... on User { ...A } }")
+	assert.NotNil(t, err)
+}
+
+func TestGetASTFromQueryFragmentFanOut(t *testing.T) {
+	// every fragment spreads the next one twice, each fragment is still only walked once
+	query := "{ user { ...F0 } }"
+	for i := 0; i < 24; i++ {
+		query += fmt.Sprintf(" fragment F%d on User { id ...F%d ...F%d }", i, i+1, i+1)
+	}
+	query += " fragment F24 on User { id }"
+
+	start := time.Now()
+	_, err := GetASTFromQuery(query)
+	assert.Nil(t, err)
+	assert.Less(t, time.Since(start), time.Second)
+}
+
+func TestCollectFields(t *testing.T) {
+	doc, err := GetASTFromQuery("{ search { __typename ... on User { id name } ... on Todo { id text } ...UserFields } } fragment UserFields on User { ...MetaFields } fragment MetaFields on User { meta { ipAddress } }")
+	assert.Nil(t, err)
+
+	selectionSet := doc.Operations[0].SelectionSet[0].(*ast.Field).SelectionSet
+
+	fieldNames := func(fields []*ast.Field) []string {
+		names := make([]string, 0)
+		for _, field := range fields {
+			names = append(names, field.Name)
+		}
+		return names
+	}
+
+	assert.Equal(t, []string{"__typename", "id", "name", "meta"}, fieldNames(collectFields(selectionSet, "User", nil)))
+	assert.Equal(t, []string{"__typename", "id", "text"}, fieldNames(collectFields(selectionSet, "Todo", nil)))
+	assert.Equal(t, []string{"__typename", "id", "name", "id", "text", "meta"}, fieldNames(collectFields(selectionSet, "", nil)))
+}
+
+func TestCollectFieldsSkipInclude(t *testing.T) {
+	doc, err := GetASTFromQuery(`query GetUser($withEmail: Boolean!) { user(id: "1") { id name @skip(if: true) email @include(if: $withEmail) ... on User @include(if: false) { avatar } ...UserFields @skip(if: $withEmail) } } fragment UserFields on User { bio }`)
+	assert.Nil(t, err)
+	selectionSet := doc.Operations[0].SelectionSet[0].(*ast.Field).SelectionSet
+
+	fieldNames := func(fields []*ast.Field) []string {
+		names := make([]string, 0)
+		for _, field := range fields {
+			names = append(names, field.Name)
+		}
+		return names
+	}
+
+	assert.Equal(t, []string{"id", "email"}, fieldNames(collectFields(selectionSet, "User", map[string]interface{}{"withEmail": true})))
+	assert.Equal(t, []string{"id", "bio"}, fieldNames(collectFields(selectionSet, "User", map[string]interface{}{"withEmail": false})))
+}
+
+func TestFieldStorageKey(t *testing.T) {
+	doc, err := GetASTFromQuery(`query GetTodos($page: Int, $done: Boolean = false) { todos(page: $page, filter: { done: $done, text: "milk" }, limit: 10) { id } users { id } user(id: $id) { id } }`)
+	assert.Nil(t, err)
+	operation := doc.Operations[0]
+	todos := operation.SelectionSet[0].(*ast.Field)
+	users := operation.SelectionSet[1].(*ast.Field)
+	user := operation.SelectionSet[2].(*ast.Field)
+
+	variables := operationVariables(operation, map[string]interface{}{"page": 2})
+	assert.Equal(t, `todos({"filter":{"done":false,"text":"milk"},"limit":10,"page":2})`, fieldStorageKey(todos, variables))
+	assert.Equal(t, "users", fieldStorageKey(users, variables))
+
+	// variables the request didn't send leave their argument out, null is sent as it is
+	variables = operationVariables(operation, map[string]interface{}{"id": nil})
+	assert.Equal(t, `todos({"filter":{"done":false,"text":"milk"},"limit":10})`, fieldStorageKey(todos, variables))
+	assert.Equal(t, `user({"id":null})`, fieldStorageKey(user, variables))
+}
+
+func TestGetOperation(t *testing.T) {
+	doc, err := GetASTFromQuery("query GetUser { user { id } } mutation UpdateUser { updateUser { id } }")
+	assert.Nil(t, err)
+
+	operation, err := GetOperation(doc, "UpdateUser")
+	assert.Nil(t, err)
+	assert.Equal(t, ast.Mutation, operation.Operation)
+
+	_, err = GetOperation(doc, "")
+	assert.EqualError(t, err, "must provide operation name if query contains multiple operations")
+
+	_, err = GetOperation(doc, "DeleteUser")
+	assert.EqualError(t, err, "unknown operation named \"DeleteUser\"")
+
+	doc, err = GetASTFromQuery("{ user { id } }")
+	assert.Nil(t, err)
+	operation, err = GetOperation(doc, "")
+	assert.Nil(t, err)
+	assert.Equal(t, ast.Query, operation.Operation)
+
+	_, err = GetOperation(&ast.QueryDocument{}, "")
+	assert.EqualError(t, err, "no operations found in query")
+}
+
+func TestDocumentHash(t *testing.T) {
+	query := `query GetUser { user(id: "1") { ...UserFields } } fragment UserFields on User { id name }`
+	transformed, err := AddTypenameToQuery(query)
+	assert.Nil(t, err)
+
+	// the __typename fields the proxy adds don't change the document
+	hash := DocumentHash(mustParse(t, query).Operations[0])
+	assert.Equal(t, hash, DocumentHash(mustParse(t, transformed).Operations[0]))
+
+	// documents with the same operation name and variables are told apart by their fields and fragments
+	assert.NotEqual(t, hash, DocumentHash(mustParse(t, `query GetUser { user(id: "1") { ...UserFields } } fragment UserFields on User { id email }`).Operations[0]))
+	assert.NotEqual(t, DocumentHash(mustParse(t, `{ user(id: "1") { id name } }`).Operations[0]), DocumentHash(mustParse(t, `{ user(id: "1") { id email } }`).Operations[0]))
+
+	// only the operation and the fragments it spreads count
+	doc := mustParse(t, `query GetUser { user(id: "1") { ...UserFields } } query GetUsers { users { id } } fragment UserFields on User { id name }`)
+	assert.Equal(t, hash, DocumentHash(doc.Operations.ForName("GetUser")))
+}
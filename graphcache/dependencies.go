@@ -0,0 +1,125 @@
+package graphcache
+
+import (
+	"encoding/json"
+	"orbitgraphql/logger"
+	"orbitgraphql/utils"
+	"strings"
+
+	"github.com/vektah/gqlparser/v2/ast"
+)
+
+const DEPENDENTS_KEY = "__dependents"
+const TYPE_DEPENDENTS_KEY = "__type_dependents"
+
+// dependent is a cached result that was built with an object, either the response of an operation
+// in the query store, or a root field of the root object in the object store (Field is set)
+type dependent struct {
+	Key   string `json:"key"`
+	Field string `json:"field,omitempty"`
+}
+
+// dependentsKey is the key of the set of results built with the object, the index is shared by all scopes
+// as an object is invalidated in every scope, and its members are keys with their scope
+func (gc *GraphCache) dependentsKey(cacheKey string) string {
+	return gc.sharedKey(DEPENDENTS_KEY + ":" + cacheKey)
+}
+
+// typeDependentsKey is the key of the set of results built with any object of the type
+func (gc *GraphCache) typeDependentsKey(typename string) string {
+	return gc.sharedKey(TYPE_DEPENDENTS_KEY + ":" + typename)
+}
+
+// indexDependents records the objects every root field of the response, and the response of the operation,
+// were built with, so invalidating one of the objects invalidates them too, and the root fields they have
+func (gc *GraphCache) indexDependents(queryDoc *ast.OperationDefinition, response map[string]interface{}, variables map[string]interface{}) {
+	data, ok := response["data"].(map[string]interface{})
+	if !ok {
+		return
+	}
+	queryMember := dependentMember(dependent{Key: gc.GetQueryKey(queryDoc, variables)})
+	vars := operationVariables(queryDoc, variables)
+	typename, _ := data[TYPENAME_FIELD].(string)
+	// the members of every set are added at once
+	sets := make(map[string][]string)
+	for _, field := range collectFields(queryDoc.SelectionSet, typename, vars) {
+		objects := make(map[string]bool)
+		gc.collectObjectKeys(data[fieldResponseKey(field)], objects)
+		rootMember := dependentMember(dependent{Key: gc.Key(ROOT_QUERY_KEY), Field: fieldStorageKey(field, vars)})
+		addSetMembers(sets, gc.fieldDependentsKey(field.Name), queryMember, rootMember)
+		for cacheKey := range objects {
+			addSetMembers(sets, gc.dependentsKey(cacheKey), queryMember, rootMember)
+			addSetMembers(sets, gc.typeDependentsKey(cacheKey[:strings.Index(cacheKey, ":")]), queryMember, rootMember)
+		}
+	}
+	if err := gc.cacheStore.AddToSets(sets); err != nil {
+		logger.Warn(gc.ctx, "indexing the results built with the objects of the response failed: ", err)
+	}
+}
+
+// collectObjectKeys collects the keys of the identified objects in a value of the response, without the scope
+func (gc *GraphCache) collectObjectKeys(value interface{}, objects map[string]bool) {
+	switch value := value.(type) {
+	case []interface{}:
+		for _, item := range value {
+			gc.collectObjectKeys(item, objects)
+		}
+	case map[string]interface{}:
+		if cacheKey, ok := gc.objectKey(value); ok {
+			objects[cacheKey] = true
+		}
+		for _, field := range value {
+			gc.collectObjectKeys(field, objects)
+		}
+	}
+}
+
+// addSetMembers adds the members to the set of the key in sets, once
+func addSetMembers(sets map[string][]string, setKey string, members ...string) {
+	for _, member := range members {
+		if !utils.StringArrayContainsString(sets[setKey], member) {
+			sets[setKey] = append(sets[setKey], member)
+		}
+	}
+}
+
+func dependentMember(d dependent) string {
+	member, _ := json.Marshal(d)
+	return string(member)
+}
+
+// invalidateDependents deletes the cached results built with the objects in the set, in every scope
+func (gc *GraphCache) invalidateDependents(setKey string) {
+	members, err := gc.cacheStore.SetMembers(setKey)
+	if err != nil {
+		return
+	}
+	for _, member := range members {
+		d := dependent{}
+		if err := json.Unmarshal([]byte(member), &d); err != nil {
+			continue
+		}
+		if d.Field == "" {
+			gc.queryCacheStore.Del(d.Key)
+			// the response kept to be served stale is invalidated with it
+			gc.queryCacheStore.Del(d.Key + STALE_KEY_SUFFIX)
+			continue
+		}
+		// the field can be public, cached once for every scope, it is deleted atomically so a field
+		// cached at the same time isn't lost and the deleted field isn't written back
+		for _, key := range []string{d.Key, gc.publicKey(referenceCacheKey(d.Key))} {
+			gc.cacheStore.Update(key, func(value interface{}) (interface{}, bool) {
+				object, ok := value.(map[string]interface{})
+				if !ok {
+					return nil, false
+				}
+				if _, ok := object[d.Field]; !ok {
+					return nil, false
+				}
+				delete(object, d.Field)
+				return object, true
+			})
+		}
+	}
+	gc.cacheStore.Del(setKey)
+}
@@ -0,0 +1,129 @@
+package graphcache
+
+import (
+	"context"
+	"fmt"
+	"orbitgraphql/cache"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func cacheDependentQueries(t *testing.T, gc *GraphCache) {
+	cacheQueryResponse(t, gc, "query GetUsers { users { id name } }", nil, `{"data":{"__typename":"Query","users":[{"__typename":"User","id":"1","name":"John Doe"},{"__typename":"User","id":"42","name":"Jane Doe"}]}}`)
+	cacheQueryResponse(t, gc, `query GetUser { user(id: "42") { id name } }`, nil, `{"data":{"__typename":"Query","user":{"__typename":"User","id":"42","name":"Jane Doe"}}}`)
+	cacheQueryResponse(t, gc, "query GetTodos { todos { id text owner { id } } }", nil, `{"data":{"__typename":"Query","todos":[{"__typename":"Todo","id":"7","text":"Write tests","owner":{"__typename":"User","id":"1"}}]}}`)
+}
+
+func TestInvalidateObjectDependents(t *testing.T) {
+	gc := NewGraphCache()
+	cacheDependentQueries(t, gc)
+
+	getUsers := mustParse(t, "query GetUsers { users { id name } }").Operations[0]
+	exists, _ := gc.queryCacheStore.Exists(gc.GetQueryKey(getUsers, nil))
+	assert.True(t, exists)
+
+	gc.InvalidateCache("data", map[string]interface{}{"updateUser": map[string]interface{}{"__typename": "User", "id": "42", "name": "Janet Doe"}}, nil)
+
+	// the results with the user are invalidated as a whole, not read back with the user missing
+	exists, _ = gc.queryCacheStore.Exists(gc.GetQueryKey(getUsers, nil))
+	assert.False(t, exists)
+	assert.Equal(t, "users (not in cache)", readQuery(t, gc, "query GetUsers { users { id name } }", nil).MissingFields())
+	assert.Equal(t, "user (not in cache)", readQuery(t, gc, `query GetUser { user(id: "42") { id name } }`, nil).MissingFields())
+
+	// results without the user are still cached
+	res := readQuery(t, gc, "query GetTodos { todos { id text owner { id } } }", nil)
+	assert.True(t, res.Complete(), res.MissingFields())
+	exists, _ = gc.cacheStore.Exists(gc.Key("User:1"))
+	assert.True(t, exists)
+}
+
+func TestInvalidateNestedObjectDependents(t *testing.T) {
+	gc := NewGraphCache()
+	cacheDependentQueries(t, gc)
+
+	gc.FlushByType("User", "1")
+
+	assert.Equal(t, "todos (not in cache)", readQuery(t, gc, "query GetTodos { todos { id text owner { id } } }", nil).MissingFields())
+	assert.Equal(t, "users (not in cache)", readQuery(t, gc, "query GetUsers { users { id name } }", nil).MissingFields())
+	res := readQuery(t, gc, `query GetUser { user(id: "42") { id name } }`, nil)
+	assert.True(t, res.Complete(), res.MissingFields())
+}
+
+func TestFlushByTypeDependents(t *testing.T) {
+	gc := NewGraphCache()
+	cacheDependentQueries(t, gc)
+	cacheQueryResponse(t, gc, "query GetStats { totalUsers }", nil, `{"data":{"__typename":"Query","totalUsers":2}}`)
+
+	gc.FlushByType("User", "")
+
+	for _, query := range []string{"query GetUsers { users { id name } }", `query GetUser { user(id: "42") { id name } }`, "query GetTodos { todos { id text owner { id } } }"} {
+		assert.False(t, readQuery(t, gc, query, nil).Complete(), query)
+	}
+	res := readQuery(t, gc, "query GetStats { totalUsers }", nil)
+	assert.True(t, res.Complete(), res.MissingFields())
+}
+
+func TestInvalidateDependentsInEveryScope(t *testing.T) {
+	objectStore := cache.NewInMemoryCache(300)
+	queryStore := cache.NewInMemoryCache(300)
+	scoped := func(prefix string) *GraphCache {
+		return NewGraphCacheWithOptions(context.Background(), &GraphCacheOptions{ObjectStore: objectStore, QueryStore: queryStore, Prefix: prefix})
+	}
+	acme, globex := scoped("acme"), scoped("globex")
+	cacheDependentQueries(t, acme)
+	cacheDependentQueries(t, globex)
+
+	acme.InvalidateCache("data", map[string]interface{}{"updateUser": map[string]interface{}{"__typename": "User", "id": "42"}}, nil)
+
+	assert.Equal(t, "users (not in cache)", readQuery(t, globex, "query GetUsers { users { id name } }", nil).MissingFields())
+	res := readQuery(t, globex, "query GetTodos { todos { id text owner { id } } }", nil)
+	assert.True(t, res.Complete(), res.MissingFields())
+}
+
+func TestCacheAndInvalidateRootFieldsConcurrently(t *testing.T) {
+	gc := NewGraphCache()
+	cacheDependentQueries(t, gc)
+
+	// root fields cached and invalidated at the same time are merged into the root object atomically
+	done := make(chan bool)
+	for i := 0; i < 50; i++ {
+		go func(i int) {
+			cacheQueryResponse(t, gc, fmt.Sprintf("query GetTotal%d { total%d }", i, i), nil, fmt.Sprintf(`{"data":{"__typename":"Query","total%d":%d}}`, i, i))
+			done <- true
+		}(i)
+	}
+	go func() {
+		gc.InvalidateCache("data", map[string]interface{}{"updateUser": map[string]interface{}{"__typename": "User", "id": "42", "name": "Janet Doe"}}, nil)
+		done <- true
+	}()
+	for i := 0; i < 51; i++ {
+		<-done
+	}
+
+	for i := 0; i < 50; i++ {
+		res := readQuery(t, gc, fmt.Sprintf("query GetTotal%d { total%d }", i, i), nil)
+		assert.True(t, res.Complete(), res.MissingFields())
+	}
+	assert.Equal(t, "users (not in cache)", readQuery(t, gc, "query GetUsers { users { id name } }", nil).MissingFields())
+}
+
+func TestExpiredDependentsArePruned(t *testing.T) {
+	gc := NewGraphCacheWithOptions(context.Background(), &GraphCacheOptions{
+		ObjectStore: cache.NewInMemoryCache(1),
+		QueryStore:  cache.NewInMemoryCache(1),
+	})
+	cacheQueryResponse(t, gc, `query GetUser { user(id: "42") { id name } }`, nil, `{"data":{"__typename":"Query","user":{"__typename":"User","id":"42","name":"Jane Doe"}}}`)
+	time.Sleep(600 * time.Millisecond)
+	cacheQueryResponse(t, gc, "query GetUsers { users { id name } }", nil, `{"data":{"__typename":"Query","users":[{"__typename":"User","id":"42","name":"Jane Doe"}]}}`)
+	time.Sleep(600 * time.Millisecond)
+
+	// the set is kept alive by the second query, the members of the first one expired with its result
+	members, err := gc.cacheStore.SetMembers(gc.dependentsKey("User:42"))
+	assert.Nil(t, err)
+	assert.ElementsMatch(t, []string{
+		dependentMember(dependent{Key: gc.GetQueryKey(mustParse(t, "query GetUsers { users { id name } }").Operations[0], nil)}),
+		dependentMember(dependent{Key: gc.Key(ROOT_QUERY_KEY), Field: "users"}),
+	}, members)
+}
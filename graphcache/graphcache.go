@@ -9,27 +9,64 @@ import (
 	"orbitgraphql/logger"
 	"orbitgraphql/utils"
 	"reflect"
+	"strconv"
 	"strings"
+	"time"
 
-	"github.com/vektah/gqlparser/ast"
+	"github.com/vektah/gqlparser/v2/ast"
 )
 
 const DEFAULT_CACHE_PREFIX = "orbit::"
 const TYPENAME_FIELD = "__typename"
+const ROOT_QUERY_KEY = "__query"
 
 // GraphCache is a struct that holds the cache stores for the GraphQL cache
 type GraphCache struct {
-	ctx             context.Context
-	idField         string
-	prefix          string
-	cacheStore      cache.Cache
-	queryCacheStore cache.Cache
+	ctx              context.Context
+	idField          string
+	prefix           string
+	cacheStore       cache.Cache
+	queryCacheStore  cache.Cache
+	schema           *ast.Schema
+	keyFieldsByType  map[string][]string
+	listInvalidation map[string]string
+	// invalidationRules are the rules of the mutation fields, by field name
+	invalidationRules map[string]InvalidationRule
+	// maxAges are the max ages in seconds of types (User) and fields (User.email) configured in the cache
+	maxAges map[string]int
+	// queryLimits are the limits of the operations executed
+	queryLimits QueryLimits
+	// scopes are the scopes of types (Product) and fields (Product.price) configured in the cache
+	scopes map[string]string
+	// rootFieldTypes are the typenames of the objects returned by root query fields configured in the cache
+	rootFieldTypes map[string]string
 }
 type GraphCacheOptions struct {
 	QueryStore  cache.Cache
 	ObjectStore cache.Cache
 	Prefix      string
 	IDField     string
+	// KeyFields maps a typename to the fields that identify its objects when it isn't the IDField,
+	// an empty list means the objects of the type have no identity and are embedded in their parent
+	KeyFields map[string][]string
+	// ListInvalidation maps a typename to when its cached lists are invalidated by mutations returning
+	// an object of the type, LIST_INVALIDATION_CREATE unless it is configured
+	ListInvalidation map[string]string
+	// InvalidationRules maps a mutation field to what it invalidates besides the objects it returns
+	InvalidationRules map[string]InvalidationRule
+	// MaxAges maps a typename (User) or a field of a type (User.email) to the seconds it can be cached for,
+	// over the @cacheControl directives of the schema
+	MaxAges map[string]int
+	// QueryLimits are the limits of the operations executed, they are checked with CheckQueryLimits
+	QueryLimits QueryLimits
+	// Scopes maps a typename (Product) or a field of a type (Product.price) to SCOPE_PUBLIC when it is cached
+	// once for every scope, or SCOPE_PRIVATE, over the @cacheControl directives of the schema
+	Scopes map[string]string
+	// RootFieldTypes maps a root query field (user) to the typename of the object it returns, over the schema,
+	// a root field selecting one object by its key fields is only read from the cached object when its type is known
+	RootFieldTypes map[string]string
+	// Schema is the schema of the origin, without it the types are learned from the responses
+	Schema *ast.Schema
 }
 
 type CacheBackend string
@@ -49,18 +86,44 @@ func NewGraphCacheWithOptions(ctx context.Context, opts *GraphCacheOptions) *Gra
 		opts.IDField = "id"
 	}
 	return &GraphCache{
-		ctx:             ctx,
-		prefix:          opts.Prefix,
-		cacheStore:      opts.ObjectStore,
-		queryCacheStore: opts.QueryStore,
-		idField:         opts.IDField,
+		ctx:               ctx,
+		prefix:            opts.Prefix,
+		cacheStore:        opts.ObjectStore,
+		queryCacheStore:   opts.QueryStore,
+		idField:           opts.IDField,
+		schema:            opts.Schema,
+		keyFieldsByType:   opts.KeyFields,
+		listInvalidation:  opts.ListInvalidation,
+		invalidationRules: opts.InvalidationRules,
+		maxAges:           opts.MaxAges,
+		queryLimits:       opts.QueryLimits,
+		scopes:            opts.Scopes,
+		rootFieldTypes:    opts.RootFieldTypes,
 	}
 }
 
+// WithContext is the same cache with another context, for the work that outlives the request it was made for
+func (gc *GraphCache) WithContext(ctx context.Context) *GraphCache {
+	copy := *gc
+	copy.ctx = ctx
+	return &copy
+}
+
+// Key is the key of a cached value in the scope of the request
 func (gc *GraphCache) Key(key string) string {
+	return DEFAULT_CACHE_PREFIX + gc.prefix + "::" + key
+}
+
+// sharedKey is the key of a cached value that is the same for every scope
+func (gc *GraphCache) sharedKey(key string) string {
 	return DEFAULT_CACHE_PREFIX + "::" + key
 }
 
+// anyScopeKey is a pattern that matches the key in every scope
+func (gc *GraphCache) anyScopeKey(key string) string {
+	return DEFAULT_CACHE_PREFIX + "*::" + key
+}
+
 func (gc *GraphCache) RemoveTypenameFromResponse(response *GraphQLResponse) (*GraphQLResponse, error) {
 	mapResponse := make(map[string]interface{})
 	responseBytes, err := json.Marshal(response)
@@ -121,137 +184,29 @@ func (gc *GraphCache) deleteTypename(data interface{}) interface{} {
 	return data
 }
 
+// ParseASTBuildResponse builds the response for the query from the cache, it is only served when
+// every field the query asks for is in the cache, otherwise the error lists the missing fields
 func (gc *GraphCache) ParseASTBuildResponse(astQuery *ast.QueryDocument, requestBody GraphQLRequest) (interface{}, error) {
 
-	if len(astQuery.Operations) == 0 {
-		return nil, errors.New("no operations found in query")
+	queryDoc, err := GetOperation(astQuery, requestBody.OperationName)
+	if err != nil {
+		return nil, err
 	}
 
-	queryDoc := astQuery.Operations[0]
-
 	reqVariables := requestBody.Variables
 	variables := make(map[string]interface{})
 	if reqVariables != nil {
 		variables = reqVariables
 	}
 
-	queryType := queryDoc.Operation
-	parentKey := queryDoc.Name
-
-	variableDefinitions := []string{}
-
-	for _, val := range queryDoc.VariableDefinitions {
-		variableBytes, _ := json.Marshal(variables[val.Variable])
-		variableDefinitions = append(variableDefinitions, val.Variable+":"+string(variableBytes))
+	response := gc.ReadOperation(queryDoc, variables)
+	if !response.Complete() {
+		return nil, errors.New("fields missing from cache: " + response.MissingFields())
 	}
-
-	queryResponseKey := gc.Key(string(queryType) + ":" + parentKey + "(" + gc.hashString(strings.Join(variableDefinitions, ",")) + ")" + gc.prefix)
-
-	cachedResponse, err := gc.queryCacheStore.Get(queryResponseKey)
-	if err == nil && cachedResponse != nil {
-		switch responseType := cachedResponse.(type) {
-		case string:
-			res, err := gc.TraverseResponseFromKey(responseType)
-			if err != nil || res == nil {
-				logger.Error(gc.ctx, "Error traversing response from key:", err)
-				return nil, err
-			}
-			return res, nil
-		case map[string]interface{}:
-			finalResponse := cachedResponse.(map[string]interface{})
-			for key, value := range finalResponse {
-				if val, ok := value.(string); ok {
-					if strings.HasPrefix(val, DEFAULT_CACHE_PREFIX) {
-						nestedResponse, err := gc.TraverseResponseFromKey(val)
-						if err != nil || nestedResponse == nil {
-							logger.Error(gc.ctx, "Error traversing nested response from key:", val, " ", err)
-							return nil, err
-						}
-						finalResponse[key] = nestedResponse
-					}
-				}
-				if val, ok := value.(map[string]interface{}); ok {
-					for k, v := range val {
-						if v, ok := v.(string); ok {
-							if strings.HasPrefix(v, DEFAULT_CACHE_PREFIX) {
-								nestedResponse, err := gc.TraverseResponseFromKey(v)
-								if err != nil || nestedResponse == nil {
-									logger.Error(gc.ctx, "Error traversing nested response from key:", v, " ", err)
-									return nil, err
-								}
-								val[k] = nestedResponse
-							}
-						}
-					}
-					finalResponse[key] = val
-				}
-				if val, ok := value.([]interface{}); ok {
-					for i, v := range val {
-						if v, ok := v.(string); ok {
-							if strings.HasPrefix(v, DEFAULT_CACHE_PREFIX) {
-								nestedResponse, err := gc.TraverseResponseFromKey(v)
-								if err != nil || nestedResponse == nil {
-									logger.Error(gc.ctx, "Error traversing nested response from key:", v, " ", err)
-									return nil, err
-								}
-								val[i] = nestedResponse
-							}
-						}
-					}
-					finalResponse[key] = val
-
-				}
-				if val, ok := value.([]map[string]interface{}); ok {
-					for i, v := range val {
-						for k, v := range v {
-							if v, ok := v.(string); ok {
-								if strings.HasPrefix(v, DEFAULT_CACHE_PREFIX) {
-									nestedResponse, err := gc.TraverseResponseFromKey(v)
-									if err != nil || nestedResponse == nil {
-										logger.Error(gc.ctx, "Error traversing nested response from key:", v, " ", err)
-										return nil, err
-									}
-									val[i][k] = nestedResponse
-								}
-							}
-						}
-					}
-					finalResponse[key] = val
-				}
-			}
-			return finalResponse, nil
-		case []interface{}:
-			responseArray := cachedResponse.([]interface{})
-			for i, v := range responseArray {
-				if val, ok := v.(string); ok {
-					if strings.HasPrefix(val, DEFAULT_CACHE_PREFIX) {
-						nestedResponse, err := gc.TraverseResponseFromKey(val)
-						if err != nil || nestedResponse == nil {
-							logger.Error(gc.ctx, "Error traversing nested response from key:", val, " ", err)
-							return nil, err
-						}
-						responseArray[i] = nestedResponse
-					}
-				} else if obj, ok := v.(map[string]interface{}); ok {
-					for key, value := range obj {
-						if val, ok := value.(string); ok {
-							if strings.HasPrefix(val, DEFAULT_CACHE_PREFIX) {
-								nestedResponse, err := gc.TraverseResponseFromKey(val)
-								if err != nil || nestedResponse == nil {
-									logger.Error(gc.ctx, "Error traversing nested response from key:", val, " ", err)
-									return nil, err
-								}
-								obj[key] = nestedResponse
-							}
-						}
-					}
-				}
-			}
-		default:
-			return nil, nil
-		}
+	if len(response.Data) == 0 {
+		return nil, errors.New("error getting response from cache")
 	}
-	return nil, errors.New("error getting response from cache")
+	return response.Data, nil
 }
 
 func (gc *GraphCache) TraverseResponseFromKey(response interface{}) (interface{}, error) {
@@ -310,50 +265,87 @@ func (gc *GraphCache) TraverseResponseFromKey(response interface{}) (interface{}
 }
 
 func (gc *GraphCache) CacheObject(field string, object map[string]interface{}, parent map[string]interface{}) string {
-	objectKeys := make([]string, 0)
+	parentScope := SCOPE_PRIVATE
+	if parent != nil {
+		parentScope = gc.objectScope("", parent, nil, SCOPE_PRIVATE)
+	}
+	return gc.cacheObject(field, -1, object, parent, gc.objectScope(field, object, parent, parentScope), nil)
+}
 
-	for key := range object {
-		// if _, ok := val.(map[string]interface{}); !ok {
-		// 	objectKeys = append(objectKeys, key)
-		// }
-		objectKeys = append(objectKeys, key)
+// cacheObject caches the object in its scope, with the fields in the scopes they have
+// index is the position of the object in the list of the field, or -1 when the field isn't a list
+func (gc *GraphCache) cacheObject(field string, index int, object map[string]interface{}, parent map[string]interface{}, scope string, scopes map[string]string) string {
+	if cacheKey, ok := gc.objectKey(object); ok {
+		return gc.storeObject(cacheKey, object, scope, scopes)
+	}
+	if _, ok := object[TYPENAME_FIELD]; !ok || parent == nil {
+		return ""
+	}
+	if parentKey, ok := gc.objectKey(parent); ok {
+		// an object without identity is embedded in its parent, under the field it was returned in
+		return gc.storeObject(embeddedKey(parentKey, field, index), object, scope, scopes)
+	} else if _, ok := parent[TYPENAME_FIELD]; field == "data" && !ok {
+		// the data of the response, its fields are the root fields of the query
+		// they are kept in one object, so every query can read the root fields cached by the others
+		gc.storeObject(ROOT_QUERY_KEY, object, scope, scopes)
+		return ""
 	}
 
-	parentKeys := make([]string, 0)
+	return ""
+}
 
-	for key := range parent {
-		parentKeys = append(parentKeys, key)
+// embeddedKey is the key of an object without identity in the field of its parent,
+// the objects of a list each have their own key so they don't overwrite each other
+func embeddedKey(parentKey string, field string, index int) string {
+	if index < 0 {
+		return parentKey + ":" + field
 	}
+	return parentKey + ":" + field + ":" + strconv.Itoa(index)
+}
 
-	if utils.StringArrayContainsString(objectKeys, TYPENAME_FIELD) && utils.StringArrayContainsString(objectKeys, gc.idField) {
-		typename := object[TYPENAME_FIELD].(string)
-		id := object[gc.idField].(string)
-		cacheKey := typename + ":" + id
-		gc.cacheStore.Set(gc.Key(cacheKey), object)
-		return gc.Key(cacheKey)
-	} else if utils.StringArrayContainsString(objectKeys, TYPENAME_FIELD) && !utils.StringArrayContainsString(objectKeys, gc.idField) && parent != nil && utils.StringArrayContainsString(parentKeys, gc.idField) && utils.StringArrayContainsString(parentKeys, TYPENAME_FIELD) {
-		typename := parent[TYPENAME_FIELD].(string)
-		parentID := parent[gc.idField].(string)
-		cacheKey := typename + ":" + parentID + ":" + field
-		gc.cacheStore.Set(gc.Key(cacheKey), object)
-		return gc.Key(cacheKey)
+// mergeObject stores the fields of the object over the fields already cached for the same key,
+// different queries select different fields of an object and all of them are kept
+// (objects without an id embedded in it are merged the same way), the merge is atomic so fields cached or
+// invalidated at the same time aren't lost
+func (gc *GraphCache) mergeObject(key string, object map[string]interface{}) {
+	var merged interface{}
+	gc.cacheStore.Update(key, func(cached interface{}) (interface{}, bool) {
+		merged = mergeResponseValues(cached, object)
+		return merged, true
+	})
+	// the object is kept until its last field with a max age expires, when it's longer than the ttl of the cache
+	if mergedMap, ok := merged.(map[string]interface{}); ok {
+		if lastExpiry, ok := lastFieldExpiry(mergedMap); ok {
+			if ttl, err := gc.cacheStore.TTL(key); err == nil && lastExpiry > ttl {
+				gc.cacheStore.Expire(key, lastExpiry)
+			}
+		}
 	}
-
-	return ""
 }
 
 func (gc *GraphCache) CacheResponse(field string, object map[string]interface{}, parent map[string]interface{}) (interface{}, string) {
+	return gc.cacheResponse(field, -1, object, parent, SCOPE_PRIVATE)
+}
+
+// cacheResponse caches the objects of the response, objects without identity are in the scope of the object
+// they are in unless their type has one
+func (gc *GraphCache) cacheResponse(field string, index int, object map[string]interface{}, parent map[string]interface{}, parentScope string) (interface{}, string) {
+	// the expiries and scopes are made before the objects in the fields are replaced by references to them
+	_, rootParent := parent[TYPENAME_FIELD]
+	expiries := gc.fieldExpiries(object, field == "data" && parent != nil && !rootParent)
+	scope := gc.objectScope(field, object, parent, parentScope)
+	scopes := gc.fieldScopes(object, scope)
 	for key, value := range object {
 		if nestedObj, ok := value.(map[string]interface{}); ok {
-			_, k := gc.CacheResponse(key, nestedObj, object)
+			_, k := gc.cacheResponse(key, -1, nestedObj, object, scope)
 			if k != "" {
 				object[key] = k
 			}
 		}
 		if objArray, ok := value.([]map[string]interface{}); ok {
 			responseObjects := make([]interface{}, 0)
-			for _, obj := range objArray {
-				_, k := gc.CacheResponse(key, obj, object)
+			for i, obj := range objArray {
+				_, k := gc.cacheResponse(key, i, obj, object, scope)
 				responseObjects = append(responseObjects, k)
 			}
 			if !utils.ArrayContains(responseObjects, "") {
@@ -362,9 +354,9 @@ func (gc *GraphCache) CacheResponse(field string, object map[string]interface{},
 		}
 		if objArray, ok := value.([]interface{}); ok {
 			responseObjects := make([]interface{}, 0)
-			for _, obj := range objArray {
+			for i, obj := range objArray {
 				if objMap, ok := obj.(map[string]interface{}); ok {
-					_, k := gc.CacheResponse(key, objMap, object)
+					_, k := gc.cacheResponse(key, i, objMap, object, scope)
 					responseObjects = append(responseObjects, k)
 				} else {
 					appendToInterfaceArray(obj, &responseObjects)
@@ -376,13 +368,67 @@ func (gc *GraphCache) CacheResponse(field string, object map[string]interface{},
 		}
 	}
 
-	cacheKey := gc.CacheObject(field, object, parent)
+	if len(expiries) > 0 {
+		object[EXPIRES_FIELD] = expiries
+	}
+	cacheKey := gc.cacheObject(field, index, object, parent, scope, scopes)
 
 	return object, cacheKey
 }
 
+// ResponseWithStorageKeys returns a copy of the response with every field of its data under its storage key
+// (see fieldStorageKey) instead of its response key, so the same field selected with other arguments is
+// cached apart, and objects embedded in a field with arguments are keyed with them
+func (gc *GraphCache) ResponseWithStorageKeys(queryDoc *ast.OperationDefinition, response map[string]interface{}, variables map[string]interface{}) map[string]interface{} {
+	keyed := make(map[string]interface{})
+	for key, value := range response {
+		keyed[key] = value
+	}
+	if data, ok := response["data"].(map[string]interface{}); ok {
+		keyed["data"] = valueWithStorageKeys(queryDoc.SelectionSet, data, operationVariables(queryDoc, variables))
+	}
+	return keyed
+}
+
+func valueWithStorageKeys(selectionSet ast.SelectionSet, value interface{}, variables map[string]interface{}) interface{} {
+	switch value := value.(type) {
+	case map[string]interface{}:
+		// fields of every fragment are collected, the response only has the ones that applied to the object
+		fields := make(map[string][]*ast.Field)
+		for _, field := range collectFields(selectionSet, "", variables) {
+			fields[fieldResponseKey(field)] = append(fields[fieldResponseKey(field)], field)
+		}
+		keyed := make(map[string]interface{})
+		for key, fieldValue := range value {
+			if len(fields[key]) == 0 {
+				keyed[key] = fieldValue
+				continue
+			}
+			// a field selected more than once has the sub selections of all of them in the response
+			subSelectionSet := ast.SelectionSet{}
+			for _, field := range fields[key] {
+				subSelectionSet = append(subSelectionSet, field.SelectionSet...)
+			}
+			storageKey := fieldStorageKey(fields[key][0], variables)
+			keyed[storageKey] = mergeResponseValues(keyed[storageKey], valueWithStorageKeys(subSelectionSet, fieldValue, variables))
+		}
+		return keyed
+	case []interface{}:
+		keyed := make([]interface{}, 0)
+		for _, item := range value {
+			keyed = append(keyed, valueWithStorageKeys(selectionSet, item, variables))
+		}
+		return keyed
+	}
+	return value
+}
+
 func appendToInterfaceArray[T any](obj interface{}, responseObjects *[]T) {
 	switch v := obj.(type) {
+	case nil:
+		// a null item of a list is kept, the items after it keep their position
+		var zero T
+		*responseObjects = append(*responseObjects, zero)
 	case T:
 		*responseObjects = append(*responseObjects, v)
 	}
@@ -390,15 +436,61 @@ func appendToInterfaceArray[T any](obj interface{}, responseObjects *[]T) {
 
 func (gc *GraphCache) CacheOperation(queryDoc *ast.OperationDefinition, response map[string]interface{}, variables map[string]interface{}) map[string]interface{} {
 	responseKey := gc.GetQueryResponseKey(queryDoc, response, variables)
+	maxAge, limited := gc.responseMaxAge(gc.ResponseWithStorageKeys(queryDoc, response, variables))
 	for key, value := range responseKey {
-		if value != nil {
+		if value == nil {
+			continue
+		}
+		// a response with a max age of 0 is never cached, and the one cached before it is stale
+		if limited && maxAge <= 0 {
+			gc.queryCacheStore.Del(key)
+			continue
+		}
+		// a query for the fields missing from the cache only has some of the root fields of the operation
+		if cached, err := gc.queryCacheStore.Get(key); err == nil {
+			value = mergeResponseValues(cached, value)
+		}
+		// the response of the operation is cached for the smallest max age of the fields and objects in it
+		if limited {
+			gc.queryCacheStore.SetWithTTL(key, value, time.Duration(maxAge)*time.Second)
+		} else {
 			gc.queryCacheStore.Set(key, value)
 		}
 	}
+	gc.indexDependents(queryDoc, response, variables)
+	// the registry is loaded once, and with a schema the types come from it, there is nothing to learn
+	registry := gc.loadTypeRegistry()
+	gc.indexLists(queryDoc, response, variables, registry)
+	if data, ok := response["data"].(map[string]interface{}); ok && gc.schema == nil {
+		registry.learnFromResponse(queryDoc.SelectionSet, data)
+		for _, field := range collectFields(queryDoc.SelectionSet, "", operationVariables(queryDoc, variables)) {
+			if typename := responseTypename(data[fieldResponseKey(field)]); typename != "" {
+				registry.addRootField(field.Name, typename)
+			}
+		}
+		gc.saveTypeRegistry(registry)
+	}
 	return responseKey
 }
 
-func (gc *GraphCache) GetQueryResponseKey(queryDoc *ast.OperationDefinition, response map[string]interface{}, variables map[string]interface{}) map[string]interface{} {
+// responseTypename is the typename of an object in the response, or of the first object of a list
+func responseTypename(value interface{}) string {
+	switch value := value.(type) {
+	case map[string]interface{}:
+		typename, _ := value[TYPENAME_FIELD].(string)
+		return typename
+	case []interface{}:
+		if len(value) > 0 {
+			return responseTypename(value[0])
+		}
+	}
+	return ""
+}
+
+// GetQueryKey is the key of the cached response of an operation with its variables, and of everything
+// kept for it (its stale response, its lock), the hash of the document keeps apart the documents
+// with the same operation name and variables, like any two anonymous queries
+func (gc *GraphCache) GetQueryKey(queryDoc *ast.OperationDefinition, variables map[string]interface{}) string {
 	queryType := queryDoc.Operation
 	parentKey := queryDoc.Name
 
@@ -409,6 +501,10 @@ func (gc *GraphCache) GetQueryResponseKey(queryDoc *ast.OperationDefinition, res
 		variableDefinitions = append(variableDefinitions, val.Variable+":"+string(variableBytes))
 	}
 
+	return gc.Key(string(queryType) + ":" + parentKey + "(" + gc.hashString(strings.Join(variableDefinitions, ",")) + "):" + DocumentHash(queryDoc))
+}
+
+func (gc *GraphCache) GetQueryResponseKey(queryDoc *ast.OperationDefinition, response map[string]interface{}, variables map[string]interface{}) map[string]interface{} {
 	relationGraph := make(map[string]interface{})
 
 	if response == nil || response["data"] == nil {
@@ -417,66 +513,87 @@ func (gc *GraphCache) GetQueryResponseKey(queryDoc *ast.OperationDefinition, res
 
 	responseData := response["data"].(map[string]interface{})
 
-	relationGraph[gc.Key(string(queryType)+":"+parentKey+"("+gc.hashString(strings.Join(variableDefinitions, ","))+")"+gc.prefix)] = gc.GetResponseTypeID(queryDoc.SelectionSet, responseData)
+	relationGraph[gc.GetQueryKey(queryDoc, variables)] = gc.GetResponseTypeID(queryDoc.SelectionSet, responseData, operationVariables(queryDoc, variables))
 	return relationGraph
 }
 
-func (gc *GraphCache) GetResponseTypeID(selectionSet ast.SelectionSet, response map[string]interface{}) interface{} {
-	updatedSelectionSet := ast.SelectionSet{}
-	// remove __typename field from the selection set
-	for _, selection := range selectionSet {
-		if field, ok := selection.(*ast.Field); ok {
-			if field.Name != TYPENAME_FIELD {
-				updatedSelectionSet = append(updatedSelectionSet, field)
-			}
+// GetResponseTypeID returns the root fields of the response with the references to the cached objects,
+// and the values of scalar fields (or lists of them) as they are
+// the root fields are read from the response by their alias and stored with their name and arguments,
+// so aliased copies of the same field are kept apart and any alias can be used to read them back
+func (gc *GraphCache) GetResponseTypeID(selectionSet ast.SelectionSet, response map[string]interface{}, variables map[string]interface{}) interface{} {
+	typename, _ := response[TYPENAME_FIELD].(string)
+	references := make(map[string]interface{})
+	// fields selected through fragments are flattened in
+	for _, selection := range collectFields(selectionSet, typename, variables) {
+		value := response[fieldResponseKey(selection)]
+		if selection.Name == TYPENAME_FIELD || value == nil {
+			continue
 		}
-	}
+		storageKey := fieldStorageKey(selection, variables)
 
-	if len(updatedSelectionSet) == 0 {
-		return nil
-	}
-	if len(updatedSelectionSet) == 1 {
-		// the response is an object type
-		// so we will return a string with the typename and id
-		// for example, Organisation:1234
-
-		selection := updatedSelectionSet[0].(*ast.Field)
-
-		if response[selection.Name] == nil {
-			return nil
+		if isScalarValue(value) {
+			references[storageKey] = value
+			continue
 		}
 
-		switch reflect.TypeOf(response[selection.Name]).Kind() {
+		switch reflect.TypeOf(value).Kind() {
 		case reflect.Map:
-			selectionRespone, ok := response[selection.Name].(map[string]interface{})
-			if ok && selectionRespone != nil && selectionRespone[gc.idField] != nil && selectionRespone[TYPENAME_FIELD] != nil {
-				id := selectionRespone[gc.idField].(string)
-				typeName := selectionRespone[TYPENAME_FIELD].(string)
-				return map[string]interface{}{updatedSelectionSet[0].(*ast.Field).Name: gc.Key(typeName + ":" + id)}
+			// the response is an object type
+			// so we will store a string with the typename and id
+			// for example, Organisation:1234
+			if key, ok := gc.objectReference(value); ok {
+				references[storageKey] = key
 			}
 		case reflect.Slice:
-			selectionRespone, ok := response[selection.Name].([]interface{})
-			if ok && selectionRespone != nil {
-				responseObjects := make([]interface{}, 0)
-				for _, obj := range selectionRespone {
-					if objMap, ok := obj.(map[string]interface{}); ok {
-						if objMap[gc.idField] != nil && objMap[TYPENAME_FIELD] != nil {
-							id := objMap[gc.idField].(string)
-							typeName := objMap[TYPENAME_FIELD].(string)
-							responseObjects = append(responseObjects, gc.Key(typeName+":"+id))
-						}
-					}
+			selectionRespone, ok := value.([]interface{})
+			if !ok {
+				continue
+			}
+			responseObjects := make([]interface{}, 0)
+			for _, obj := range selectionRespone {
+				if key, ok := gc.objectReference(obj); ok {
+					responseObjects = append(responseObjects, key)
 				}
-				return map[string]interface{}{updatedSelectionSet[0].(*ast.Field).Name: responseObjects}
 			}
-		case reflect.String:
-			selectionResponse, ok := response[selection.Name].(string)
-			if ok {
-				return map[string]interface{}{updatedSelectionSet[0].(*ast.Field).Name: gc.Key(response[TYPENAME_FIELD].(string) + ":" + selectionResponse)}
+			// a list is only stored when every item of it can be read back from the cache
+			if len(responseObjects) == len(selectionRespone) {
+				references[storageKey] = responseObjects
+			}
+		}
+	}
+	if len(references) == 0 {
+		return nil
+	}
+	return references
+}
+
+// isScalarValue reports if a value of the response is a scalar, or a list of them
+func isScalarValue(value interface{}) bool {
+	switch value := value.(type) {
+	case map[string]interface{}:
+		return false
+	case []interface{}:
+		for _, item := range value {
+			if !isScalarValue(item) {
+				return false
 			}
 		}
 	}
-	return nil
+	return true
+}
+
+// objectReference is the key of the cached object for an object of the response with a typename and its key fields
+func (gc *GraphCache) objectReference(value interface{}) (string, bool) {
+	object, ok := value.(map[string]interface{})
+	if !ok || object == nil {
+		return "", false
+	}
+	cacheKey, ok := gc.objectKey(object)
+	if !ok {
+		return "", false
+	}
+	return gc.Key(cacheKey), true
 }
 
 func (gc *GraphCache) GraphSelectionSet(selectionSet ast.SelectionSet, variableDefinitions string) interface{} {
@@ -490,17 +607,39 @@ func (gc *GraphCache) GraphSelectionSet(selectionSet ast.SelectionSet, variableD
 	for _, selection := range selectionSet {
 		switch selection := selection.(type) {
 		case *ast.Field:
-			selections[selection.Alias] = gc.GraphSelectionSet(selection.SelectionSet, variableDefinitions)
+			selections[fieldResponseKey(selection)] = gc.GraphSelectionSet(selection.SelectionSet, variableDefinitions)
 		case *ast.FragmentSpread:
-			// selections[selection.Name] = GraphSelectionSet(selection)
+			// fields selected through a fragment end up in the same object of the response
+			if selection.Definition != nil {
+				mergeSelectionGraph(selections, gc.GraphSelectionSet(selection.Definition.SelectionSet, variableDefinitions))
+			}
 		case *ast.InlineFragment:
-			// selections[selection.TypeCondition.Name] = GraphSelectionSet(selection, variableDefinitions)
+			mergeSelectionGraph(selections, gc.GraphSelectionSet(selection.SelectionSet, variableDefinitions))
 		}
 	}
 
 	return selections
 }
 
+// mergeSelectionGraph merges the graph of a fragment into the graph of the enclosing selection set
+// a field selected in both places keeps the union of its sub selections
+func mergeSelectionGraph(selections map[string]interface{}, fragment interface{}) {
+	fragmentSelections, ok := fragment.(map[string]interface{})
+	if !ok {
+		return
+	}
+	for key, value := range fragmentSelections {
+		existing, exists := selections[key].(map[string]interface{})
+		if exists {
+			mergeSelectionGraph(existing, value)
+			continue
+		}
+		if _, exists := selections[key]; !exists || value != nil {
+			selections[key] = value
+		}
+	}
+}
+
 func (gc *GraphCache) hashVariables(variables map[string]interface{}) string {
 	// base64 encode the variables
 	variablesBytes, _ := json.Marshal(variables)
@@ -551,38 +690,50 @@ func (gc *GraphCache) InvalidateCache(field string, object map[string]interface{
 }
 
 func (gc *GraphCache) InvalidateCacheObject(field string, object map[string]interface{}, parent map[string]interface{}) string {
-	objectKeys := make([]string, 0)
-
-	for key := range object {
-		// if _, ok := val.(map[string]interface{}); !ok {
-		// 	objectKeys = append(objectKeys, key)
-		// }
-		objectKeys = append(objectKeys, key)
-	}
-
-	parentKeys := make([]string, 0)
-
-	for key := range parent {
-		parentKeys = append(parentKeys, key)
+	if typename, ok := object[TYPENAME_FIELD].(string); ok {
+		if _, _, err := gc.identify(typename, object); err != nil {
+			// we can't tell which object changed, so every object of the type is invalidated
+			logger.Warn(gc.ctx, "invalidating every object of type ", typename, ": ", err)
+			gc.FlushByType(typename, "")
+			return ""
+		}
 	}
-
-	if utils.StringArrayContainsString(objectKeys, TYPENAME_FIELD) && utils.StringArrayContainsString(objectKeys, gc.idField) {
+	if cacheKey, ok := gc.objectKey(object); ok {
 		typename := object[TYPENAME_FIELD].(string)
-		id := object[gc.idField].(string)
-		cacheKey := typename + ":" + id
-		gc.cacheStore.DeleteByPrefix(gc.Key(cacheKey))
+		switch gc.listInvalidationPolicy(typename) {
+		case LIST_INVALIDATION_ALWAYS:
+			gc.invalidateLists(typename)
+		case LIST_INVALIDATION_CREATE:
+			// an object we have never cached is new, so it is missing from the cached lists of its type
+			if !gc.objectCached(cacheKey) {
+				gc.invalidateLists(typename)
+			}
+		}
+		gc.invalidateObject(cacheKey)
 		return gc.Key(cacheKey)
-	} else if utils.StringArrayContainsString(objectKeys, TYPENAME_FIELD) && !utils.StringArrayContainsString(objectKeys, gc.idField) && parent != nil && utils.StringArrayContainsString(parentKeys, gc.idField) && utils.StringArrayContainsString(parentKeys, TYPENAME_FIELD) {
-		typename := parent[TYPENAME_FIELD].(string)
-		parentID := parent[gc.idField].(string)
-		cacheKey := typename + ":" + parentID + ":" + field
-		gc.cacheStore.DeleteByPrefix(gc.Key(cacheKey))
+	}
+	if _, ok := object[TYPENAME_FIELD]; !ok || parent == nil {
+		return ""
+	}
+	if parentKey, ok := gc.objectKey(parent); ok {
+		// the field is the storage key, with its arguments, like the one the object was cached with,
+		// the objects of a list are invalidated with the key of the field, which every one of their keys starts with
+		cacheKey := embeddedKey(parentKey, field, -1)
+		gc.invalidateObject(cacheKey)
 		return gc.Key(cacheKey)
 	}
 
 	return ""
 }
 
+// invalidateObject deletes the object and the objects embedded in it from every scope,
+// a mutation made in one scope changes the object for all of them, with every cached result built with it
+func (gc *GraphCache) invalidateObject(cacheKey string) {
+	gc.cacheStore.DeleteByPattern(gc.anyScopeKey(cacheKey))
+	gc.cacheStore.DeleteByPattern(gc.anyScopeKey(cacheKey + ":*"))
+	gc.invalidateDependents(gc.dependentsKey(cacheKey))
+}
+
 func (gc *GraphCache) Debug() {
 	gc.cacheStore.Debug("cacheStore")
 	gc.queryCacheStore.Debug("queryCacheStore")
@@ -595,16 +746,35 @@ func (gc *GraphCache) Look() map[string]interface{} {
 
 	output["cacheStore"] = cacheMap
 	output["queryCacheStore"] = queryCacheMap
+	// the seconds left before every key expires
+	output["cacheStoreTTL"] = storeTTLs(gc.cacheStore, cacheMap)
+	output["queryCacheStoreTTL"] = storeTTLs(gc.queryCacheStore, queryCacheMap)
 
 	return output
 }
 
+func storeTTLs(store cache.Cache, values map[string]interface{}) map[string]interface{} {
+	ttls := make(map[string]interface{})
+	for key := range values {
+		if ttl, err := store.TTL(key); err == nil {
+			ttls[key] = ttl.Seconds()
+		}
+	}
+	return ttls
+}
+
 func (gc *GraphCache) Flush() {
 	gc.cacheStore.Flush()
 	gc.queryCacheStore.Flush()
 }
 
+// FlushByType deletes the object with the id from every scope, or every object of the type when id is empty
+// the id of a type with more than one key field is made by ObjectID
 func (gc *GraphCache) FlushByType(typeName string, id string) {
-	gc.cacheStore.DeleteByPrefix(gc.Key(typeName + ":" + id))
-	gc.queryCacheStore.DeleteByPrefix(gc.Key(typeName + ":" + id))
+	if id == "" {
+		gc.cacheStore.DeleteByPattern(gc.anyScopeKey(typeName + ":*"))
+		gc.invalidateDependents(gc.typeDependentsKey(typeName))
+		return
+	}
+	gc.invalidateObject(typeName + ":" + id)
 }
@@ -8,7 +8,7 @@ import (
 	"orbitgraphql/cache"
 
 	"github.com/stretchr/testify/assert"
-	"github.com/vektah/gqlparser/ast"
+	"github.com/vektah/gqlparser/v2/ast"
 )
 
 func TestNewGraphCache(t *testing.T) {
@@ -177,8 +177,30 @@ func TestGetResponseTypeID(t *testing.T) {
 		"__typename": "User",
 		"id":         "123",
 	}
-	res := gc.GetResponseTypeID(selectionSet, response)
-	assert.Equal(t, map[string]interface{}{"id": gc.Key("User:123")}, res)
+	res := gc.GetResponseTypeID(selectionSet, response, nil)
+	assert.Equal(t, map[string]interface{}{"id": "123"}, res)
+}
+
+func TestGetResponseTypeIDMultipleRootFields(t *testing.T) {
+	gc := NewGraphCache()
+	doc, err := GetASTFromQuery("{ users { id } totalTodos activityStreak(days: 7) tags stats { users } }")
+	assert.Nil(t, err)
+	response := map[string]interface{}{
+		"__typename":     "Query",
+		"users":          []interface{}{map[string]interface{}{"__typename": "User", "id": "1"}},
+		"totalTodos":     float64(12),
+		"activityStreak": []interface{}{true, false, true},
+		"tags":           []interface{}{},
+		"stats":          map[string]interface{}{"__typename": "Stats", "users": float64(1)},
+	}
+	res := gc.GetResponseTypeID(doc.Operations[0].SelectionSet, response, nil)
+	// objects without an id are only cached with the root fields of every query
+	assert.Equal(t, map[string]interface{}{
+		"users":                      []interface{}{gc.Key("User:1")},
+		"totalTodos":                 float64(12),
+		`activityStreak({"days":7})`: []interface{}{true, false, true},
+		"tags":                       []interface{}{},
+	}, res)
 }
 
 func TestGraphSelectionSet(t *testing.T) {
@@ -253,3 +275,170 @@ func TestFlushByType(t *testing.T) {
 	gc := NewGraphCache()
 	assert.NotPanics(t, func() { gc.FlushByType("User", "123") })
 }
+
+func TestGetResponseTypeIDWithFragments(t *testing.T) {
+	gc := NewGraphCache()
+	doc, err := GetASTFromQuery("{ ...RootFields __typename } fragment RootFields on Query { ... on Query { user(id: \"123\") { id } } }")
+	assert.Nil(t, err)
+	response := map[string]interface{}{
+		"__typename": "Query",
+		"user": map[string]interface{}{
+			"__typename": "User",
+			"id":         "123",
+		},
+	}
+	res := gc.GetResponseTypeID(doc.Operations[0].SelectionSet, response, nil)
+	assert.Equal(t, map[string]interface{}{`user({"id":"123"})`: gc.Key("User:123")}, res)
+}
+
+func TestGraphSelectionSetWithFragments(t *testing.T) {
+	gc := NewGraphCache()
+	doc, err := GetASTFromQuery("{ user { id ...UserFields ... on User { todos { id } } } } fragment UserFields on User { name ...MetaFields } fragment MetaFields on User { meta { ipAddress } }")
+	assert.Nil(t, err)
+	res := gc.GraphSelectionSet(doc.Operations[0].SelectionSet, "")
+	assert.Equal(t, map[string]interface{}{
+		"user": map[string]interface{}{
+			"id":   nil,
+			"name": nil,
+			"meta": map[string]interface{}{
+				"ipAddress": nil,
+			},
+			"todos": map[string]interface{}{
+				"id": nil,
+			},
+		},
+	}, res)
+}
+
+func TestCacheResponseWithFragments(t *testing.T) {
+	tests := []struct {
+		name     string
+		query    string
+		response string
+	}{
+		{
+			name:     "Nested named fragments",
+			query:    "query GetUser { user(id: \"1\") { ...UserFields todos { ...TodoFields } } } fragment UserFields on User { id name ...MetaFields } fragment MetaFields on User { meta { ipAddress } } fragment TodoFields on Todo { id text user { ...UserFields } }",
+			response: `{"data":{"__typename":"Query","user":{"__typename":"User","id":"1","name":"John Doe","meta":{"__typename":"MetaInfo","ipAddress":"127.0.0.1"},"todos":[{"__typename":"Todo","id":"10","text":"Buy milk","user":{"__typename":"User","id":"1","name":"John Doe","meta":{"__typename":"MetaInfo","ipAddress":"127.0.0.1"}}}]}}}`,
+		},
+		{
+			name:     "Inline fragments on a union",
+			query:    "query Search { search { ... on User { id name } ... on Todo { id text } } }",
+			response: `{"data":{"__typename":"Query","search":[{"__typename":"User","id":"1","name":"John Doe"},{"__typename":"Todo","id":"10","text":"Buy milk"}]}}`,
+		},
+		{
+			name:     "Root fragment",
+			query:    "query Root { ...RootFields } fragment RootFields on Query { user(id: \"1\") { id name } }",
+			response: `{"data":{"__typename":"Query","user":{"__typename":"User","id":"1","name":"John Doe"}}}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gc := NewGraphCache()
+
+			transformedQuery, err := AddTypenameToQuery(tt.query)
+			assert.Nil(t, err)
+			astWithTypes, err := GetASTFromQuery(transformedQuery)
+			assert.Nil(t, err)
+
+			response := map[string]interface{}{}
+			assert.Nil(t, json.Unmarshal([]byte(tt.response), &response))
+			expected := map[string]interface{}{}
+			assert.Nil(t, json.Unmarshal([]byte(tt.response), &expected))
+
+			for _, op := range astWithTypes.Operations {
+				gc.CacheOperation(op, response, nil)
+			}
+			gc.CacheResponse("data", response, nil)
+
+			astQuery, err := GetASTFromQuery(tt.query)
+			assert.Nil(t, err)
+			res, err := gc.ParseASTBuildResponse(astQuery, GraphQLRequest{Query: tt.query})
+			assert.Nil(t, err)
+
+			// the response only has the fields the client asked for, without the injected __typename
+			assert.Equal(t, gc.deleteTypename(expected["data"]), res)
+		})
+	}
+}
+
+func TestResponseWithStorageKeys(t *testing.T) {
+	gc := NewGraphCache()
+	doc, err := GetASTFromQuery(`query GetUser($page: Int) { me: user(id: "1") { id first: todos(page: 1) { id } page: todos(page: $page) { id } ...Meta } } fragment Meta on User { meta(format: "short") { ipAddress } }`)
+	assert.Nil(t, err)
+	response := map[string]interface{}{
+		"data": map[string]interface{}{
+			"__typename": "Query",
+			"me": map[string]interface{}{
+				"__typename": "User",
+				"id":         "1",
+				"first":      []interface{}{map[string]interface{}{"id": "10"}},
+				"page":       []interface{}{map[string]interface{}{"id": "20"}},
+				"meta":       map[string]interface{}{"ipAddress": "127.0.0.1"},
+			},
+		},
+	}
+	res := gc.ResponseWithStorageKeys(doc.Operations[0], response, map[string]interface{}{"page": 2})
+	assert.Equal(t, map[string]interface{}{
+		"data": map[string]interface{}{
+			"__typename": "Query",
+			`user({"id":"1"})`: map[string]interface{}{
+				"__typename":               "User",
+				"id":                       "1",
+				`todos({"page":1})`:        []interface{}{map[string]interface{}{"id": "10"}},
+				`todos({"page":2})`:        []interface{}{map[string]interface{}{"id": "20"}},
+				`meta({"format":"short"})`: map[string]interface{}{"ipAddress": "127.0.0.1"},
+			},
+		},
+	}, res)
+	// the response itself is not changed
+	assert.Contains(t, response["data"], "me")
+}
+
+func TestInvalidateEmbeddedObjectsWithArguments(t *testing.T) {
+	gc := NewGraphCache()
+	variables := map[string]interface{}{"format": "short"}
+	cacheQueryResponse(t, gc, `query GetUser($format: String) { user(id: "1") { id meta(format: $format) { ipAddress } links(kind: "social") { url } } }`, variables, `{"data":{"__typename":"Query","user":{"__typename":"User","id":"1","meta":{"__typename":"MetaInfo","ipAddress":"127.0.0.1"},"links":[{"__typename":"Link","url":"a"},{"__typename":"Link","url":"b"}]}}}`)
+	for _, key := range []string{`User:1:meta({"format":"short"})`, `User:1:links({"kind":"social"}):0`, `User:1:links({"kind":"social"}):1`} {
+		exists, _ := gc.cacheStore.Exists(gc.Key(key))
+		assert.True(t, exists, key)
+	}
+
+	// a mutation invalidates the embedded objects in its response under the keys they were cached with
+	mutation := mustParse(t, `mutation UpdateUser($format: String) { updateUser(id: "1") { id meta(format: $format) { ipAddress } links(kind: "social") { url } } }`).Operations[0]
+	response := map[string]interface{}{}
+	json.Unmarshal([]byte(`{"data":{"__typename":"Mutation","updateUser":{"__typename":"User","id":"1","meta":{"__typename":"MetaInfo","ipAddress":"10.0.0.1"},"links":[{"__typename":"Link","url":"c"}]}}}`), &response)
+	keyed := gc.ResponseWithStorageKeys(mutation, response, variables)
+	user := keyed["data"].(map[string]interface{})[`updateUser({"id":"1"})`].(map[string]interface{})
+	gc.InvalidateCache("data", keyed, nil)
+	assert.Equal(t, gc.Key(`User:1:meta({"format":"short"})`), user[`meta({"format":"short"})`])
+	assert.Equal(t, []interface{}{gc.Key(`User:1:links({"kind":"social"})`)}, user[`links({"kind":"social"})`])
+	for _, key := range []string{`User:1:meta({"format":"short"})`, `User:1:links({"kind":"social"}):0`, `User:1:links({"kind":"social"}):1`} {
+		exists, _ := gc.cacheStore.Exists(gc.Key(key))
+		assert.False(t, exists, key)
+	}
+}
+
+func TestCacheResponseNestedArguments(t *testing.T) {
+	gc := NewGraphCache()
+	query := `query GetUser($page: Int) { user(id: "1") { id name todos(page: $page) { id } meta(format: "short") { ipAddress } } }`
+	cacheQueryResponse(t, gc, query, map[string]interface{}{"page": 1}, `{"data":{"__typename":"Query","user":{"__typename":"User","id":"1","name":"John Doe","todos":[{"__typename":"Todo","id":"10"}],"meta":{"__typename":"MetaInfo","ipAddress":"127.0.0.1"}}}}`)
+
+	exists, _ := gc.cacheStore.Exists(gc.Key(`User:1:meta({"format":"short"})`))
+	assert.True(t, exists)
+
+	// the same field with other arguments is not in the cache
+	res := readQuery(t, gc, query, map[string]interface{}{"page": 2})
+	assert.Equal(t, "user.todos (not in cache)", res.MissingFields())
+
+	res = readQuery(t, gc, query, map[string]interface{}{"page": 1})
+	assert.True(t, res.Complete(), res.MissingFields())
+	assert.Equal(t, []interface{}{map[string]interface{}{"id": "10"}}, gc.deleteTypename(res.Data["user"]).(map[string]interface{})["todos"])
+
+	// embedded objects are invalidated with the arguments of their field
+	cacheKey := gc.InvalidateCacheObject(`meta({"format":"short"})`, map[string]interface{}{"__typename": "MetaInfo"}, map[string]interface{}{"__typename": "User", "id": "1"})
+	assert.Equal(t, gc.Key(`User:1:meta({"format":"short"})`), cacheKey)
+	exists, _ = gc.cacheStore.Exists(gc.Key(`User:1:meta({"format":"short"})`))
+	assert.False(t, exists)
+}
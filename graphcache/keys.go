@@ -0,0 +1,148 @@
+package graphcache
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+)
+
+// keyFields are the fields that identify the objects of a type, the primary key field unless the type
+// is configured with its own key fields, objects of a type without key fields are embedded in their parent
+func (gc *GraphCache) keyFields(typename string) []string {
+	if fields, ok := gc.keyFieldsByType[typename]; ok {
+		return fields
+	}
+	return []string{gc.idField}
+}
+
+// isKeyField reports if the field identifies the objects of any type
+func (gc *GraphCache) isKeyField(field string) bool {
+	if field == gc.idField {
+		return true
+	}
+	for _, fields := range gc.keyFieldsByType {
+		for _, keyField := range fields {
+			if keyField == field {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ObjectID is the id an object of the type is cached with, made from the values of its key fields
+// with a single key field it is the value of the field, with more than one it is the key fields
+// and their values as JSON ({"orgId":"1","userId":"2"})
+func (gc *GraphCache) ObjectID(typename string, object map[string]interface{}) (string, bool) {
+	id, ok, err := gc.identify(typename, object)
+	return id, ok && err == nil
+}
+
+// identify makes the id of an object of the type, it isn't identified when the type has no key fields
+// or the object doesn't have all of them, and fails when a key field has a value that can't be an id
+func (gc *GraphCache) identify(typename string, object map[string]interface{}) (string, bool, error) {
+	fields := gc.keyFields(typename)
+	if len(fields) == 0 {
+		return "", false, nil
+	}
+	values := make(map[string]string)
+	for _, field := range fields {
+		value, ok := object[field]
+		if !ok || value == nil {
+			return "", false, nil
+		}
+		id, err := canonicalID(value)
+		if err != nil {
+			return "", false, fmt.Errorf("%s.%s can't be used as an id: %w", typename, field, err)
+		}
+		values[field] = id
+	}
+	if len(fields) == 1 {
+		return values[fields[0]], true, nil
+	}
+	// maps are marshalled with sorted keys, so the id doesn't depend on the order of the key fields
+	id, err := json.Marshal(values)
+	if err != nil {
+		return "", false, err
+	}
+	return string(id), true, nil
+}
+
+// canonicalID turns the value of a key field into the part of a cache key it is stored with, the same id
+// returned as a string, an integer, or an integer encoded as a float ("1", 1, 1.0) gives the same key,
+// custom scalars serialized as objects are keyed by their JSON
+func canonicalID(value interface{}) (string, error) {
+	switch value := value.(type) {
+	case string:
+		return value, nil
+	case float64:
+		if math.IsInf(value, 0) || math.IsNaN(value) {
+			return "", fmt.Errorf("invalid number %v", value)
+		}
+		if value == math.Trunc(value) && math.Abs(value) < 1<<53 {
+			return strconv.FormatInt(int64(value), 10), nil
+		}
+		return strconv.FormatFloat(value, 'f', -1, 64), nil
+	case float32:
+		return canonicalID(float64(value))
+	case json.Number:
+		if id, err := value.Int64(); err == nil {
+			return strconv.FormatInt(id, 10), nil
+		}
+		return canonicalID(value.String())
+	case int:
+		return strconv.FormatInt(int64(value), 10), nil
+	case int32:
+		return strconv.FormatInt(int64(value), 10), nil
+	case int64:
+		return strconv.FormatInt(value, 10), nil
+	case uint64:
+		return strconv.FormatUint(value, 10), nil
+	case map[string]interface{}:
+		id, err := json.Marshal(value)
+		if err != nil {
+			return "", err
+		}
+		return string(id), nil
+	}
+	return "", fmt.Errorf("unsupported id %v (%T)", value, value)
+}
+
+// objectKey is the key of an object of the response in the cache (User:1), without the scope prefix
+func (gc *GraphCache) objectKey(object map[string]interface{}) (string, bool) {
+	typename, ok := object[TYPENAME_FIELD].(string)
+	if !ok {
+		return "", false
+	}
+	id, ok := gc.ObjectID(typename, object)
+	if !ok {
+		return "", false
+	}
+	return typename + ":" + id, true
+}
+
+// ValidateObjectIDs checks that the ids of every object in a response can be used in a cache key,
+// a response with an object that can't be identified is not cached
+func (gc *GraphCache) ValidateObjectIDs(value interface{}) error {
+	switch value := value.(type) {
+	case []interface{}:
+		for _, item := range value {
+			if err := gc.ValidateObjectIDs(item); err != nil {
+				return err
+			}
+		}
+	case map[string]interface{}:
+		if typename, ok := value[TYPENAME_FIELD].(string); ok {
+			if _, _, err := gc.identify(typename, value); err != nil {
+				return err
+			}
+		}
+		for _, field := range value {
+			if err := gc.ValidateObjectIDs(field); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
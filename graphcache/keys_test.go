@@ -0,0 +1,150 @@
+package graphcache
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"orbitgraphql/cache"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newKeyFieldsGraphCache() *GraphCache {
+	return NewGraphCacheWithOptions(context.Background(), &GraphCacheOptions{
+		ObjectStore: cache.NewInMemoryCache(300),
+		QueryStore:  cache.NewInMemoryCache(300),
+		KeyFields: map[string][]string{
+			"Account":    {"uuid"},
+			"Membership": {"orgId", "userId"},
+			"Settings":   {},
+		},
+		RootFieldTypes: map[string]string{"membership": "Membership"},
+	})
+}
+
+func TestObjectID(t *testing.T) {
+	gc := newKeyFieldsGraphCache()
+
+	tests := []struct {
+		typename string
+		object   map[string]interface{}
+		id       string
+		ok       bool
+	}{
+		{"User", map[string]interface{}{"id": "1"}, "1", true},
+		{"User", map[string]interface{}{"uuid": "1"}, "", false},
+		{"Account", map[string]interface{}{"id": "1", "uuid": "a-1"}, "a-1", true},
+		{"Account", map[string]interface{}{"id": "1"}, "", false},
+		{"Membership", map[string]interface{}{"userId": "2", "orgId": "1", "role": "ADMIN"}, `{"orgId":"1","userId":"2"}`, true},
+		{"Membership", map[string]interface{}{"orgId": "1"}, "", false},
+		{"Membership", map[string]interface{}{"orgId": "1", "userId": nil}, "", false},
+		{"Settings", map[string]interface{}{"id": "1"}, "", false},
+	}
+	for _, tt := range tests {
+		id, ok := gc.ObjectID(tt.typename, tt.object)
+		assert.Equal(t, tt.id, id, tt.typename)
+		assert.Equal(t, tt.ok, ok, tt.typename)
+	}
+}
+
+func TestCacheResponseKeyFields(t *testing.T) {
+	gc := newKeyFieldsGraphCache()
+	query := `query GetAccount { account(uuid: "a-1") { uuid name settings { theme } memberships { orgId userId role } } }`
+	cacheQueryResponse(t, gc, query, nil, `{"data":{"__typename":"Query","account":{"__typename":"Account","uuid":"a-1","name":"Acme","settings":{"__typename":"Settings","id":"s-1","theme":"dark"},"memberships":[{"__typename":"Membership","orgId":"1","userId":"2","role":"ADMIN"}]}}}`)
+
+	for _, key := range []string{`Account:a-1`, `Account:a-1:settings`, `Membership:{"orgId":"1","userId":"2"}`} {
+		exists, _ := gc.cacheStore.Exists(gc.Key(key))
+		assert.True(t, exists, key)
+	}
+	// settings have an id, but the type has no identity so they are embedded in the account
+	exists, _ := gc.cacheStore.Exists(gc.Key("Settings:s-1"))
+	assert.False(t, exists)
+
+	// root fields selecting an object by its key fields are read from the cached object
+	res := readQuery(t, gc, `query GetMembership { membership(userId: "2", orgId: "1") { role } }`, nil)
+	assert.True(t, res.Complete(), res.MissingFields())
+	assert.Equal(t, map[string]interface{}{"role": "ADMIN"}, gc.deleteTypename(res.Data["membership"]))
+
+	// a mutation returning the membership invalidates it
+	gc.InvalidateCache("data", map[string]interface{}{"updateMembership": map[string]interface{}{"__typename": "Membership", "orgId": "1", "userId": "2", "role": "MEMBER"}}, nil)
+	exists, _ = gc.cacheStore.Exists(gc.Key(`Membership:{"orgId":"1","userId":"2"}`))
+	assert.False(t, exists)
+
+	// flushing by type uses the same ids
+	gc.FlushByType("Account", "a-1")
+	exists, _ = gc.cacheStore.Exists(gc.Key("Account:a-1:settings"))
+	assert.False(t, exists)
+}
+
+func TestParseASTBuildMissingQueryKeyFields(t *testing.T) {
+	gc := newKeyFieldsGraphCache()
+	cacheQueryResponse(t, gc, `query GetMemberships { memberships { orgId userId role } }`, nil, `{"data":{"__typename":"Query","memberships":[{"__typename":"Membership","orgId":"1","userId":"2","role":"ADMIN"}]}}`)
+
+	query := `query GetMemberships { memberships { orgId userId role since } }`
+	missingQuery, err := gc.ParseASTBuildMissingQuery(mustParse(t, query), GraphQLRequest{Query: query})
+	assert.Nil(t, err)
+	assert.Equal(t, "query GetMemberships { memberships { orgId userId since __typename } __typename }", missingQuery)
+}
+
+func TestCanonicalID(t *testing.T) {
+	tests := []struct {
+		value interface{}
+		id    string
+		err   bool
+	}{
+		{"1", "1", false},
+		{"a-1", "a-1", false},
+		{float64(1), "1", false},
+		{float64(12345678901), "12345678901", false},
+		{1.5, "1.5", false},
+		{int64(1), "1", false},
+		{1, "1", false},
+		{json.Number("42"), "42", false},
+		{map[string]interface{}{"tenant": "acme", "id": float64(7)}, `{"id":7,"tenant":"acme"}`, false},
+		{true, "", true},
+		{[]interface{}{"1"}, "", true},
+		{math.NaN(), "", true},
+	}
+	for _, tt := range tests {
+		id, err := canonicalID(tt.value)
+		assert.Equal(t, tt.id, id, "%v", tt.value)
+		assert.Equal(t, tt.err, err != nil, "%v", tt.value)
+	}
+}
+
+func TestCacheResponseNumericIDs(t *testing.T) {
+	gc := newUserFieldGraphCache()
+	cacheQueryResponse(t, gc, "query GetUsers { users { id name } }", nil, `{"data":{"__typename":"Query","users":[{"__typename":"User","id":1,"name":"John Doe"},{"__typename":"User","id":2.0,"name":"Jane Doe"}]}}`)
+
+	for _, key := range []string{"User:1", "User:2"} {
+		exists, _ := gc.cacheStore.Exists(gc.Key(key))
+		assert.True(t, exists, key)
+	}
+
+	// the id is the same whether it is sent as a string or as a number
+	for _, query := range []string{`query GetUser { user(id: "2") { name } }`, `query GetUser { user(id: 2) { name } }`} {
+		res := readQuery(t, gc, query, nil)
+		assert.True(t, res.Complete(), res.MissingFields())
+		assert.Equal(t, map[string]interface{}{"name": "Jane Doe"}, gc.deleteTypename(res.Data["user"]))
+	}
+	res := readQuery(t, gc, `query GetUser($id: ID!) { user(id: $id) { name } }`, map[string]interface{}{"id": float64(1)})
+	assert.True(t, res.Complete(), res.MissingFields())
+}
+
+func TestInvalidIDs(t *testing.T) {
+	gc := NewGraphCache()
+	cacheQueryResponse(t, gc, "query GetUsers { users { id name } }", nil, `{"data":{"__typename":"Query","users":[{"__typename":"User","id":1,"name":"John Doe"}]}}`)
+
+	response := map[string]interface{}{"__typename": "Query", "user": map[string]interface{}{"__typename": "User", "id": true, "name": "John Doe"}}
+	assert.EqualError(t, gc.ValidateObjectIDs(response), "User.id can't be used as an id: unsupported id true (bool)")
+	assert.Nil(t, gc.ValidateObjectIDs(map[string]interface{}{"__typename": "User", "id": nil}))
+
+	// caching doesn't panic, the object isn't stored under a key
+	assert.NotPanics(t, func() { gc.CacheResponse("data", response, nil) })
+
+	// a mutation returning an object we can't identify invalidates every object of its type
+	assert.Equal(t, "", gc.InvalidateCacheObject("updateUser", response["user"].(map[string]interface{}), response))
+	exists, _ := gc.cacheStore.Exists(gc.Key("User:1"))
+	assert.False(t, exists)
+}
@@ -0,0 +1,321 @@
+package graphcache
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+
+	"github.com/vektah/gqlparser/v2/ast"
+	"github.com/vektah/gqlparser/v2/gqlerror"
+)
+
+const COST_DIRECTIVE = "cost"
+const LIST_SIZE_DIRECTIVE = "listSize"
+
+// DEFAULT_SLICING_ARGUMENTS are the arguments that limit the size of a list field, when the schema doesn't name them
+var DEFAULT_SLICING_ARGUMENTS = []string{"first", "last", "limit"}
+
+// QueryLimits are the limits of the operations executed, a limit of 0 is no limit
+type QueryLimits struct {
+	// MaxDepth is how deep fields can be nested, root fields have a depth of 1
+	MaxDepth int
+	// MaxFields is how many fields an operation can select, with the fields of its fragments
+	MaxFields int
+	// MaxAliases is how many fields an operation can alias
+	MaxAliases int
+	// MaxRootFields is how many root fields an operation can select
+	MaxRootFields int
+	// MaxCost is the highest cost of an operation, a field costs its own cost and the cost of its selection set
+	// times the size of its list
+	MaxCost int
+	// FieldCosts are the costs of fields of a type (User.todos) over the @cost directives of the schema,
+	// other fields cost 1
+	FieldCosts map[string]int
+	// ListSizes are the sizes assumed for list fields of a type (User.todos) over the @listSize directives of the
+	// schema, when they aren't sliced by an argument
+	ListSizes map[string]int
+	// DefaultListSize is the size assumed for the other list fields
+	DefaultListSize int
+}
+
+// queryMeasures are what the limits are checked against
+type queryMeasures struct {
+	depth   int
+	fields  int
+	aliases int
+}
+
+// queryMeasurer measures the selection sets of an operation, the fragments are measured once however many
+// times they are spread
+type queryMeasurer struct {
+	gc        *GraphCache
+	variables map[string]interface{}
+	fragments map[string]*fragmentMeasures
+}
+
+// fragmentMeasures are the measures of a fragment, with the depth of its fields from 1
+type fragmentMeasures struct {
+	measures queryMeasures
+	cost     int
+}
+
+// CheckQueryLimits reports the limits the operation is over, as GraphQL errors
+func (gc *GraphCache) CheckQueryLimits(operation *ast.OperationDefinition, variables map[string]interface{}) error {
+	limits := gc.queryLimits
+	if limits.MaxDepth <= 0 && limits.MaxFields <= 0 && limits.MaxAliases <= 0 && limits.MaxRootFields <= 0 && limits.MaxCost <= 0 {
+		return nil
+	}
+	measures := &queryMeasures{}
+	measurer := gc.newQueryMeasurer(operation, variables)
+	cost := measurer.measureSelectionSet(operation.SelectionSet, gc.rootTypename(operation), 1, measures)
+	rootFields := 0
+	for _, field := range collectFields(operation.SelectionSet, "", measurer.variables) {
+		if field.Name != TYPENAME_FIELD {
+			rootFields++
+		}
+	}
+
+	errs := gqlerror.List{}
+	for _, check := range []struct {
+		limit int
+		value int
+		name  string
+		code  string
+	}{
+		{limits.MaxDepth, measures.depth, "depth", "MAX_DEPTH_EXCEEDED"},
+		{limits.MaxFields, measures.fields, "field count", "MAX_FIELDS_EXCEEDED"},
+		{limits.MaxAliases, measures.aliases, "alias count", "MAX_ALIASES_EXCEEDED"},
+		{limits.MaxRootFields, rootFields, "root field count", "MAX_ROOT_FIELDS_EXCEEDED"},
+		{limits.MaxCost, cost, "cost", "MAX_COST_EXCEEDED"},
+	} {
+		if check.limit > 0 && check.value > check.limit {
+			message := fmt.Sprintf("operation has a %s of %d, over the limit of %d", check.name, check.value, check.limit)
+			if check.code == "MAX_COST_EXCEEDED" {
+				// the cost isn't measured past the limit
+				message = fmt.Sprintf("operation has a cost over the limit of %d", check.limit)
+			}
+			errs = append(errs, &gqlerror.Error{
+				Message:    message,
+				Extensions: map[string]interface{}{"code": check.code},
+			})
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+func (gc *GraphCache) newQueryMeasurer(operation *ast.OperationDefinition, variables map[string]interface{}) *queryMeasurer {
+	return &queryMeasurer{
+		gc:        gc,
+		variables: operationVariables(operation, variables),
+		fragments: make(map[string]*fragmentMeasures),
+	}
+}
+
+// overCost reports if the cost is over the max cost, the rest of the operation isn't measured then
+func (m *queryMeasurer) overCost(cost int) bool {
+	return m.gc.queryLimits.MaxCost > 0 && cost > m.gc.queryLimits.MaxCost
+}
+
+// measureSelectionSet measures the fields of the selection set of an object of the typename, and returns its cost
+func (m *queryMeasurer) measureSelectionSet(selectionSet ast.SelectionSet, typename string, depth int, measures *queryMeasures) int {
+	cost := 0
+	for _, selection := range selectionSet {
+		switch selection := selection.(type) {
+		case *ast.Field:
+			if selection.Name == TYPENAME_FIELD {
+				continue
+			}
+			measures.fields = addSaturated(measures.fields, 1)
+			if selection.Alias != "" && selection.Alias != selection.Name {
+				measures.aliases = addSaturated(measures.aliases, 1)
+			}
+			if depth > measures.depth {
+				measures.depth = depth
+			}
+			selectionSetCost := m.measureSelectionSet(selection.SelectionSet, m.gc.fieldTypename(typename, selection.Name), depth+1, measures)
+			fieldCost := addSaturated(m.gc.fieldCost(typename, selection.Name), multiplySaturated(m.gc.fieldListSize(typename, selection, m.variables), selectionSetCost))
+			cost = addSaturated(cost, fieldCost)
+		case *ast.InlineFragment:
+			fragmentTypename := typename
+			if selection.TypeCondition != "" {
+				fragmentTypename = selection.TypeCondition
+			}
+			cost = addSaturated(cost, m.measureSelectionSet(selection.SelectionSet, fragmentTypename, depth, measures))
+		case *ast.FragmentSpread:
+			if selection.Definition != nil {
+				fragment := m.measureFragment(selection.Definition)
+				measures.fields = addSaturated(measures.fields, fragment.measures.fields)
+				measures.aliases = addSaturated(measures.aliases, fragment.measures.aliases)
+				if fragment.measures.depth > 0 && depth+fragment.measures.depth-1 > measures.depth {
+					measures.depth = depth + fragment.measures.depth - 1
+				}
+				cost = addSaturated(cost, fragment.cost)
+			}
+		}
+		if m.overCost(cost) {
+			return cost
+		}
+	}
+	return cost
+}
+
+// measureFragment measures a fragment the first time it is spread
+func (m *queryMeasurer) measureFragment(definition *ast.FragmentDefinition) *fragmentMeasures {
+	if fragment, ok := m.fragments[definition.Name]; ok {
+		return fragment
+	}
+	fragment := &fragmentMeasures{}
+	fragment.cost = m.measureSelectionSet(definition.SelectionSet, definition.TypeCondition, 1, &fragment.measures)
+	m.fragments[definition.Name] = fragment
+	return fragment
+}
+
+// addSaturated adds measures that can't be negative, without wrapping around past the largest int
+func addSaturated(a int, b int) int {
+	a, b = max(a, 0), max(b, 0)
+	if a > math.MaxInt-b {
+		return math.MaxInt
+	}
+	return a + b
+}
+
+// multiplySaturated multiplies measures that can't be negative, without wrapping around past the largest int
+func multiplySaturated(a int, b int) int {
+	a, b = max(a, 0), max(b, 0)
+	if a == 0 || b == 0 {
+		return 0
+	}
+	if a > math.MaxInt/b {
+		return math.MaxInt
+	}
+	return a * b
+}
+
+// rootTypename is the type of the root fields of the operation
+func (gc *GraphCache) rootTypename(operation *ast.OperationDefinition) string {
+	if gc.schema != nil {
+		switch {
+		case operation.Operation == ast.Mutation && gc.schema.Mutation != nil:
+			return gc.schema.Mutation.Name
+		case operation.Operation == ast.Subscription && gc.schema.Subscription != nil:
+			return gc.schema.Subscription.Name
+		case gc.schema.Query != nil:
+			return gc.schema.Query.Name
+		}
+	}
+	switch operation.Operation {
+	case ast.Mutation:
+		return "Mutation"
+	case ast.Subscription:
+		return "Subscription"
+	}
+	return "Query"
+}
+
+// fieldDefinition is the definition of a field of the type in the schema, nil without a schema
+func (gc *GraphCache) fieldDefinition(typename string, field string) *ast.FieldDefinition {
+	if gc.schema == nil || gc.schema.Types[typename] == nil {
+		return nil
+	}
+	return gc.schema.Types[typename].Fields.ForName(field)
+}
+
+// fieldTypename is the type of the value of a field of the type, empty when it can't be told without a schema
+func (gc *GraphCache) fieldTypename(typename string, field string) string {
+	if definition := gc.fieldDefinition(typename, field); definition != nil {
+		return definition.Type.Name()
+	}
+	return ""
+}
+
+// fieldCost is the cost of a field of the type, from the configuration or the @cost directive of the field
+func (gc *GraphCache) fieldCost(typename string, field string) int {
+	if cost, ok := gc.queryLimits.FieldCosts[typename+"."+field]; ok {
+		return cost
+	}
+	if definition := gc.fieldDefinition(typename, field); definition != nil {
+		if cost, ok := directiveIntArgument(definition.Directives, COST_DIRECTIVE, "weight"); ok {
+			return cost
+		}
+	}
+	return 1
+}
+
+// fieldListSize is how many times the selection set of a field of the type is counted, the value of its slicing
+// argument or the size assumed for the list, 1 for fields that aren't lists
+func (gc *GraphCache) fieldListSize(typename string, field *ast.Field, variables map[string]interface{}) int {
+	definition := gc.fieldDefinition(typename, field.Name)
+	slicingArguments := DEFAULT_SLICING_ARGUMENTS
+	var listSize *ast.Directive
+	if definition != nil {
+		listSize = definition.Directives.ForName(LIST_SIZE_DIRECTIVE)
+	}
+	if listSize != nil && listSize.Arguments.ForName("slicingArguments") != nil {
+		slicingArguments = make([]string, 0)
+		if value, err := listSize.Arguments.ForName("slicingArguments").Value.Value(nil); err == nil {
+			if names, ok := value.([]interface{}); ok {
+				for _, name := range names {
+					if name, ok := name.(string); ok {
+						slicingArguments = append(slicingArguments, name)
+					}
+				}
+			}
+		}
+	}
+	for _, name := range slicingArguments {
+		if argument := field.Arguments.ForName(name); argument != nil {
+			if value, err := argument.Value.Value(variables); err == nil {
+				if size, ok := intValue(value); ok && size >= 0 {
+					return size
+				}
+			}
+		}
+	}
+
+	if size, ok := gc.queryLimits.ListSizes[typename+"."+field.Name]; ok {
+		return size
+	}
+	if definition == nil || definition.Type.Elem == nil {
+		return 1
+	}
+	if size, ok := directiveIntArgument(definition.Directives, LIST_SIZE_DIRECTIVE, "assumedSize"); ok {
+		return size
+	}
+	if gc.queryLimits.DefaultListSize > 0 {
+		return gc.queryLimits.DefaultListSize
+	}
+	return 1
+}
+
+// directiveIntArgument is the value of an argument of the directive that is an integer, or a string of one
+func directiveIntArgument(directives ast.DirectiveList, directive string, argument string) (int, bool) {
+	d := directives.ForName(directive)
+	if d == nil || d.Arguments.ForName(argument) == nil {
+		return 0, false
+	}
+	value, err := d.Arguments.ForName(argument).Value.Value(nil)
+	if err != nil {
+		return 0, false
+	}
+	if value, ok := value.(string); ok {
+		size, err := strconv.Atoi(value)
+		return size, err == nil
+	}
+	return intValue(value)
+}
+
+// intValue is the integer of an argument, arguments from variables are decoded from JSON as floats
+func intValue(value interface{}) (int, bool) {
+	switch value := value.(type) {
+	case int64:
+		return int(value), true
+	case int:
+		return value, true
+	case float64:
+		return int(value), true
+	}
+	return 0, false
+}
@@ -0,0 +1,128 @@
+package graphcache
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vektah/gqlparser/v2/gqlerror"
+)
+
+const testLimitsSchema = `
+directive @cost(weight: Int!) on FIELD_DEFINITION
+directive @listSize(assumedSize: Int, slicingArguments: [String!]) on FIELD_DEFINITION
+
+type User {
+  id: ID!
+  name: String!
+  todos(take: Int): [Todo!]! @listSize(slicingArguments: ["take"])
+  friends: [User!]! @listSize(assumedSize: 5)
+}
+
+type Todo {
+  id: ID!
+  text: String! @cost(weight: 3)
+}
+
+type Query {
+  user(id: ID!): User
+  users(first: Int): [User!]!
+}
+`
+
+func newLimitsGraphCache(t *testing.T, limits QueryLimits, sdl string) *GraphCache {
+	opts := &GraphCacheOptions{QueryLimits: limits}
+	if sdl != "" {
+		schema, err := LoadSchemaFromSDL("schema.graphql", sdl)
+		assert.Nil(t, err)
+		opts.Schema = schema
+	}
+	return NewGraphCacheWithOptions(context.Background(), opts)
+}
+
+// limitErrors are the codes of the limits the query is over
+func limitErrors(t *testing.T, gc *GraphCache, query string, variables map[string]interface{}) []string {
+	doc := mustParse(t, query)
+	err := gc.CheckQueryLimits(doc.Operations[0], variables)
+	if err == nil {
+		return nil
+	}
+	codes := make([]string, 0)
+	for _, e := range err.(gqlerror.List) {
+		codes = append(codes, e.Extensions["code"].(string))
+	}
+	return codes
+}
+
+func TestCheckQueryLimits(t *testing.T) {
+	gc := newLimitsGraphCache(t, QueryLimits{MaxDepth: 2, MaxFields: 5, MaxAliases: 1, MaxRootFields: 2}, "")
+
+	assert.Nil(t, limitErrors(t, gc, `query GetUser { user(id: "1") { id name } }`, nil))
+	assert.Equal(t, []string{"MAX_DEPTH_EXCEEDED"}, limitErrors(t, gc, `query GetUser { user(id: "1") { todos { id } } }`, nil))
+	assert.Equal(t, []string{"MAX_FIELDS_EXCEEDED"}, limitErrors(t, gc, `query GetUser { user(id: "1") { id name email } users { id } }`, nil))
+	assert.Equal(t, []string{"MAX_ALIASES_EXCEEDED", "MAX_ROOT_FIELDS_EXCEEDED"}, limitErrors(t, gc, `query GetUsers { a: user(id: "1") { id } b: user(id: "2") { id } c: totalUsers }`, nil))
+
+	// the fields of fragments are counted where they are spread, __typename isn't counted
+	assert.Equal(t, []string{"MAX_DEPTH_EXCEEDED", "MAX_FIELDS_EXCEEDED"}, limitErrors(t, gc, `query GetUser { user(id: "1") { ...UserFields } } fragment UserFields on User { __typename id name todos { id text } }`, nil))
+}
+
+func TestCheckQueryLimitsCost(t *testing.T) {
+	gc := newLimitsGraphCache(t, QueryLimits{MaxCost: 50, DefaultListSize: 10, FieldCosts: map[string]int{"User.name": 2}}, testLimitsSchema)
+
+	cost := func(query string, variables map[string]interface{}) int {
+		measures := &queryMeasures{}
+		operation := mustParse(t, query).Operations[0]
+		return gc.newQueryMeasurer(operation, variables).measureSelectionSet(operation.SelectionSet, gc.rootTypename(operation), 1, measures)
+	}
+	// fields cost 1, or their configured cost or @cost
+	assert.Equal(t, 4, cost(`query GetUser { user(id: "1") { id name } }`, nil))
+	assert.Equal(t, 1+1+10*(1+3), cost(`query GetTodos { user(id: "1") { todos(take: 10) { id text } } }`, nil))
+	// lists count their selection set once for every item, from their slicing argument or the size assumed for them
+	assert.Equal(t, 1+3*1, cost(`query GetUsers($first: Int) { users(first: $first) { id } }`, map[string]interface{}{"first": float64(3)}))
+	assert.Equal(t, 1+10*1, cost(`query GetUsers { users { id } }`, nil))
+	assert.Equal(t, 1+1+5*1, cost(`query GetFriends { user(id: "1") { friends { id } } }`, nil))
+
+	assert.Nil(t, limitErrors(t, gc, `query GetUsers { users(first: 5) { id name } }`, nil))
+	assert.Equal(t, []string{"MAX_COST_EXCEEDED"}, limitErrors(t, gc, `query GetUsers { users(first: 50) { id name } }`, nil))
+}
+
+func TestCheckQueryLimitsListSizesWithoutSchema(t *testing.T) {
+	gc := newLimitsGraphCache(t, QueryLimits{MaxCost: 20, ListSizes: map[string]int{"Query.users": 100}}, "")
+
+	assert.Equal(t, []string{"MAX_COST_EXCEEDED"}, limitErrors(t, gc, `query GetUsers { users { id } }`, nil))
+	assert.Nil(t, limitErrors(t, gc, `query GetUsers { users(limit: 10) { id } }`, nil))
+	// without limits nothing is measured
+	assert.Nil(t, newLimitsGraphCache(t, QueryLimits{}, "").CheckQueryLimits(mustParse(t, `query GetUsers { users { id } }`).Operations[0], nil))
+}
+
+func TestCheckQueryLimitsCostOverflow(t *testing.T) {
+	gc := newLimitsGraphCache(t, QueryLimits{MaxCost: 1000}, "")
+
+	// the cost doesn't wrap around past the largest int
+	assert.Equal(t, []string{"MAX_COST_EXCEEDED"}, limitErrors(t, gc, `query { a(first: 2097152) { b(first: 2097152) { c(first: 2097152) { d(first: 2) { e } } } } }`, nil))
+	assert.Equal(t, math.MaxInt, multiplySaturated(math.MaxInt/2, 3))
+	assert.Equal(t, math.MaxInt, addSaturated(math.MaxInt, 1))
+}
+
+func TestCheckQueryLimitsFragmentFanOut(t *testing.T) {
+	gc := newLimitsGraphCache(t, QueryLimits{MaxFields: 100000000}, "")
+
+	// every fragment spreads the next one twice, each fragment is measured once
+	query := "query { user { ...F0 } }"
+	for i := 0; i < 24; i++ {
+		query += fmt.Sprintf(" fragment F%d on User { id ...F%d ...F%d }", i, i+1, i+1)
+	}
+	query += " fragment F24 on User { id }"
+	operation := mustParse(t, query).Operations[0]
+
+	start := time.Now()
+	measures := &queryMeasures{}
+	gc.newQueryMeasurer(operation, nil).measureSelectionSet(operation.SelectionSet, "Query", 1, measures)
+	assert.Less(t, time.Since(start), time.Second)
+	// the fields of a fragment are counted every time it is spread
+	assert.Equal(t, 1+(1<<25)-1, measures.fields)
+	assert.Equal(t, 2, measures.depth)
+}
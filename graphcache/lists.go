@@ -0,0 +1,141 @@
+package graphcache
+
+import (
+	"orbitgraphql/logger"
+
+	"github.com/vektah/gqlparser/v2/ast"
+)
+
+const LIST_DEPENDENTS_KEY = "__list_dependents"
+
+// ANY_TYPE is the type of empty lists we don't know the type of, they are invalidated by objects of every type
+const ANY_TYPE = "*"
+
+// list invalidation policies, when a mutation returns an object of a type the cached lists of the type are
+// invalidated if the object is new (LIST_INVALIDATION_CREATE), every time (LIST_INVALIDATION_ALWAYS),
+// or never (LIST_INVALIDATION_NEVER), lists with an object that changed are always invalidated with it
+const LIST_INVALIDATION_CREATE = "create"
+const LIST_INVALIDATION_ALWAYS = "always"
+const LIST_INVALIDATION_NEVER = "never"
+
+// listDependentsKey is the key of the set of cached results with a list of objects of the type
+func (gc *GraphCache) listDependentsKey(typename string) string {
+	return gc.sharedKey(LIST_DEPENDENTS_KEY + ":" + typename)
+}
+
+func (gc *GraphCache) listInvalidationPolicy(typename string) string {
+	if policy, ok := gc.listInvalidation[typename]; ok {
+		return policy
+	}
+	return LIST_INVALIDATION_CREATE
+}
+
+// listIndexer records the cached results with lists of objects by the type of the objects, the result of
+// a list is the field of the closest object in the cache it belongs to (or the root field), and the operation
+type listIndexer struct {
+	gc          *GraphCache
+	variables   map[string]interface{}
+	types       *typeRegistry
+	queryMember string
+	// sets are the members added to every set, they are all added at once
+	sets map[string][]string
+}
+
+// indexLists records the lists of objects in the response of the operation, so they are invalidated when
+// an object of their type is created
+func (gc *GraphCache) indexLists(queryDoc *ast.OperationDefinition, response map[string]interface{}, variables map[string]interface{}, types *typeRegistry) {
+	data, ok := response["data"].(map[string]interface{})
+	if !ok {
+		return
+	}
+	indexer := &listIndexer{
+		gc:          gc,
+		variables:   operationVariables(queryDoc, variables),
+		types:       types,
+		queryMember: dependentMember(dependent{Key: gc.GetQueryKey(queryDoc, variables)}),
+		sets:        make(map[string][]string),
+	}
+	indexer.indexObject(queryDoc.SelectionSet, data, dependent{Key: gc.Key(ROOT_QUERY_KEY)})
+	if err := gc.cacheStore.AddToSets(indexer.sets); err != nil {
+		logger.Warn(gc.ctx, "indexing the lists of the response failed: ", err)
+	}
+}
+
+// indexObject indexes the lists in the fields of an object, the fields of an object in the cache own the lists
+// in them, the fields of other objects (the ones embedded in another object) belong to the field they are in
+func (i *listIndexer) indexObject(selectionSet ast.SelectionSet, object map[string]interface{}, owner dependent) {
+	typename, _ := object[TYPENAME_FIELD].(string)
+	cacheKey, identified := i.gc.objectKey(object)
+	root := owner.Field == ""
+	for _, field := range collectFields(selectionSet, typename, i.variables) {
+		if field.Name == TYPENAME_FIELD || len(field.SelectionSet) == 0 {
+			continue
+		}
+		fieldOwner := owner
+		if identified {
+			fieldOwner = dependent{Key: i.gc.Key(cacheKey), Field: fieldStorageKey(field, i.variables)}
+		} else if root {
+			fieldOwner = dependent{Key: owner.Key, Field: fieldStorageKey(field, i.variables)}
+		}
+		i.indexValue(typename, field, object[fieldResponseKey(field)], fieldOwner, root)
+	}
+}
+
+func (i *listIndexer) indexValue(parentTypename string, field *ast.Field, value interface{}, owner dependent, root bool) {
+	switch value := value.(type) {
+	case map[string]interface{}:
+		i.indexObject(field.SelectionSet, value, owner)
+	case []interface{}:
+		types := make(map[string]bool)
+		for _, item := range value {
+			if object, ok := item.(map[string]interface{}); ok {
+				if typename, ok := object[TYPENAME_FIELD].(string); ok {
+					types[typename] = true
+				}
+			}
+			i.indexValue(parentTypename, field, item, owner, root)
+		}
+		// the type of the field covers the objects an interface or union list could have but doesn't yet
+		if typename := i.listType(parentTypename, field, root); len(value) == 0 || typename != ANY_TYPE {
+			types[typename] = true
+		}
+		for typename := range types {
+			addSetMembers(i.sets, i.gc.listDependentsKey(typename), i.queryMember, dependentMember(owner))
+		}
+	}
+}
+
+// listType is the type of the objects of a list, from the schema or an earlier response for the root field
+func (i *listIndexer) listType(parentTypename string, field *ast.Field, root bool) string {
+	if schema := i.gc.schema; schema != nil && schema.Types[parentTypename] != nil {
+		if definition := schema.Types[parentTypename].Fields.ForName(field.Name); definition != nil {
+			return definition.Type.Name()
+		}
+	}
+	if root {
+		if typename, ok := i.types.RootFields[field.Name]; ok {
+			return typename
+		}
+	}
+	return ANY_TYPE
+}
+
+// invalidateLists deletes the cached results with lists of objects of the type, of an interface or union
+// the type belongs to, or empty lists we don't know the type of
+func (gc *GraphCache) invalidateLists(typename string) {
+	types := []string{typename, ANY_TYPE}
+	if gc.schema != nil && gc.schema.Types[typename] != nil {
+		for _, abstract := range gc.schema.GetImplements(gc.schema.Types[typename]) {
+			types = append(types, abstract.Name)
+		}
+	} else {
+		for typeCondition, possibleTypes := range gc.loadTypeRegistry().PossibleTypes {
+			if possibleTypes[typename] {
+				types = append(types, typeCondition)
+			}
+		}
+	}
+	for _, t := range types {
+		gc.invalidateDependents(gc.listDependentsKey(t))
+	}
+}
@@ -0,0 +1,93 @@
+package graphcache
+
+import (
+	"context"
+	"orbitgraphql/cache"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newListInvalidationGraphCache(policies map[string]string) *GraphCache {
+	return NewGraphCacheWithOptions(context.Background(), &GraphCacheOptions{
+		ObjectStore:      cache.NewInMemoryCache(300),
+		QueryStore:       cache.NewInMemoryCache(300),
+		ListInvalidation: policies,
+	})
+}
+
+func mutationResponse(field string, object map[string]interface{}) map[string]interface{} {
+	return map[string]interface{}{field: object}
+}
+
+func TestCreatedObjectInvalidatesLists(t *testing.T) {
+	gc := NewGraphCache()
+	cacheQueryResponse(t, gc, "query GetUsers { users { id name } }", nil, `{"data":{"__typename":"Query","users":[{"__typename":"User","id":"1","name":"John Doe"}]}}`)
+	cacheQueryResponse(t, gc, `query GetUser { user(id: "1") { id todos { id text } } }`, nil, `{"data":{"__typename":"Query","user":{"__typename":"User","id":"1","todos":[{"__typename":"Todo","id":"5","text":"Write tests"}]}}}`)
+
+	gc.InvalidateCache("data", mutationResponse("createTodo", map[string]interface{}{"__typename": "Todo", "id": "9", "text": "Ship it"}), nil)
+
+	// the list of todos is invalidated in the user it belongs to, the rest of the user is still cached
+	assert.Equal(t, "user.todos (not in cache)", readQuery(t, gc, `query GetUser { user(id: "1") { id todos { id text } } }`, nil).MissingFields())
+	res := readQuery(t, gc, "query GetUsers { users { id name } }", nil)
+	assert.True(t, res.Complete(), res.MissingFields())
+
+	gc.InvalidateCache("data", mutationResponse("createUser", map[string]interface{}{"__typename": "User", "id": "2", "name": "Jane Doe"}), nil)
+	assert.Equal(t, "users (not in cache)", readQuery(t, gc, "query GetUsers { users { id name } }", nil).MissingFields())
+}
+
+func TestListInvalidationPolicies(t *testing.T) {
+	tests := []struct {
+		policy      string
+		invalidated bool
+	}{
+		{LIST_INVALIDATION_CREATE, false},
+		{LIST_INVALIDATION_ALWAYS, true},
+		{LIST_INVALIDATION_NEVER, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			gc := newListInvalidationGraphCache(map[string]string{"Todo": tt.policy})
+			cacheQueryResponse(t, gc, "query GetDoneTodos { todos(done: true) { id text } }", nil, `{"data":{"__typename":"Query","todos":[{"__typename":"Todo","id":"5","text":"Write tests"}]}}`)
+			cacheQueryResponse(t, gc, `query GetTodo { todo(id: "6") { id text } }`, nil, `{"data":{"__typename":"Query","todo":{"__typename":"Todo","id":"6","text":"Ship it"}}}`)
+
+			// a todo that is not in the list changes, it could have moved into it
+			gc.InvalidateCache("data", mutationResponse("markAsDone", map[string]interface{}{"__typename": "Todo", "id": "6", "text": "Ship it"}), nil)
+			res := readQuery(t, gc, "query GetDoneTodos { todos(done: true) { id text } }", nil)
+			assert.Equal(t, tt.invalidated, !res.Complete(), res.MissingFields())
+		})
+	}
+
+	gc := newListInvalidationGraphCache(map[string]string{"Todo": LIST_INVALIDATION_NEVER})
+	cacheQueryResponse(t, gc, "query GetTodos { todos { id } }", nil, `{"data":{"__typename":"Query","todos":[{"__typename":"Todo","id":"5"}]}}`)
+	gc.InvalidateCache("data", mutationResponse("createTodo", map[string]interface{}{"__typename": "Todo", "id": "9"}), nil)
+	res := readQuery(t, gc, "query GetTodos { todos { id } }", nil)
+	assert.True(t, res.Complete(), res.MissingFields())
+}
+
+func TestEmptyListInvalidation(t *testing.T) {
+	gc := NewGraphCache()
+	cacheQueryResponse(t, gc, "query GetTodos { todos { id } }", nil, `{"data":{"__typename":"Query","todos":[]}}`)
+
+	// without a schema we don't know the type of an empty list, any new object invalidates it
+	gc.InvalidateCache("data", mutationResponse("createUser", map[string]interface{}{"__typename": "User", "id": "2"}), nil)
+	assert.Equal(t, "todos (not in cache)", readQuery(t, gc, "query GetTodos { todos { id } }", nil).MissingFields())
+
+	gc = loadTestSchema(t)
+	cacheQueryResponse(t, gc, "query GetUsers { users { id } }", nil, `{"data":{"__typename":"Query","users":[]}}`)
+	gc.InvalidateCache("data", mutationResponse("createTodo", map[string]interface{}{"__typename": "Todo", "id": "9"}), nil)
+	res := readQuery(t, gc, "query GetUsers { users { id } }", nil)
+	assert.True(t, res.Complete(), res.MissingFields())
+	gc.InvalidateCache("data", mutationResponse("createUser", map[string]interface{}{"__typename": "User", "id": "2"}), nil)
+	assert.Equal(t, "users (not in cache)", readQuery(t, gc, "query GetUsers { users { id } }", nil).MissingFields())
+}
+
+func TestAbstractListInvalidation(t *testing.T) {
+	gc := loadTestSchema(t)
+	query := `query Search { search(text: "doe") { ... on User { id name } ... on Todo { id text } } }`
+	cacheQueryResponse(t, gc, query, nil, `{"data":{"__typename":"Query","search":[{"__typename":"User","id":"1","name":"John Doe"}]}}`)
+
+	// a new todo could be a result of the search, the list has SearchResult items
+	gc.InvalidateCache("data", mutationResponse("createTodo", map[string]interface{}{"__typename": "Todo", "id": "9"}), nil)
+	assert.False(t, readQuery(t, gc, query, nil).Complete())
+}
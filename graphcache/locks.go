@@ -0,0 +1,33 @@
+package graphcache
+
+import (
+	"time"
+
+	"github.com/vektah/gqlparser/v2/ast"
+)
+
+// LOCK_KEY_SUFFIX is the suffix of the key of the lock of an operation being fetched from the origin
+const LOCK_KEY_SUFFIX = "::lock"
+
+func (gc *GraphCache) lockKey(queryDoc *ast.OperationDefinition, variables map[string]interface{}) string {
+	return gc.GetQueryKey(queryDoc, variables) + LOCK_KEY_SUFFIX
+}
+
+// LockOperation takes the lock of the operation for the ttl, so only one of the proxies sharing the cache fetches it
+// from the origin, it reports if the lock was taken
+func (gc *GraphCache) LockOperation(queryDoc *ast.OperationDefinition, variables map[string]interface{}, ttl time.Duration) bool {
+	locked, err := gc.queryCacheStore.SetIfNotExists(gc.lockKey(queryDoc, variables), "1", ttl)
+	// without the lock store every proxy fetches the operation itself
+	return locked || err != nil
+}
+
+// UnlockOperation releases the lock of the operation
+func (gc *GraphCache) UnlockOperation(queryDoc *ast.OperationDefinition, variables map[string]interface{}) {
+	gc.queryCacheStore.Del(gc.lockKey(queryDoc, variables))
+}
+
+// OperationLocked reports if the operation is being fetched from the origin
+func (gc *GraphCache) OperationLocked(queryDoc *ast.OperationDefinition, variables map[string]interface{}) bool {
+	locked, err := gc.queryCacheStore.Exists(gc.lockKey(queryDoc, variables))
+	return err == nil && locked
+}
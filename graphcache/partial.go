@@ -0,0 +1,242 @@
+package graphcache
+
+import (
+	"errors"
+
+	"github.com/vektah/gqlparser/v2/ast"
+)
+
+// missingSelections is a tree of the response keys that are missing from the cache
+// list indexes are left out, the same selection is fetched for every item of a list
+type missingSelections struct {
+	// all is set when everything below the response key is missing
+	all      bool
+	children map[string]*missingSelections
+}
+
+func newMissingSelections(missing []MissingField) *missingSelections {
+	root := &missingSelections{children: make(map[string]*missingSelections)}
+	for _, field := range missing {
+		node := root
+		for _, element := range field.Path {
+			key, ok := element.(string)
+			if !ok {
+				continue
+			}
+			if node.children[key] == nil {
+				node.children[key] = &missingSelections{children: make(map[string]*missingSelections)}
+			}
+			node = node.children[key]
+		}
+		node.all = true
+	}
+	return root
+}
+
+// partial reports if some of the fields of the selection set are in the cache,
+// that is when not every field of it is entirely missing
+func (m *missingSelections) partial(selectionSet ast.SelectionSet, variables map[string]interface{}) bool {
+	for _, field := range collectFields(selectionSet, "", variables) {
+		if field.Name == TYPENAME_FIELD {
+			continue
+		}
+		if node := m.children[fieldResponseKey(field)]; node == nil || !node.all {
+			return true
+		}
+	}
+	return false
+}
+
+// fragmentPathElement is how a fragment shows up in the path of a missing field
+func fragmentPathElement(typeCondition string) string {
+	return "... on " + typeCondition
+}
+
+// ParseASTBuildMissingQuery builds a query for only the fields of the request that are missing from the cache
+// it fails when the response can be served from the cache, or when nothing of it is cached,
+// in which case the query of the request has to be sent as it is
+// the missing query has the __typename field added, so its response can be cached like any other
+func (gc *GraphCache) ParseASTBuildMissingQuery(astQuery *ast.QueryDocument, requestBody GraphQLRequest) (string, error) {
+	queryDoc, err := GetOperation(astQuery, requestBody.OperationName)
+	if err != nil {
+		return "", err
+	}
+
+	reqVariables := requestBody.Variables
+	variables := make(map[string]interface{})
+	if reqVariables != nil {
+		variables = reqVariables
+	}
+
+	response := gc.ReadOperation(queryDoc, variables)
+	if response.Complete() {
+		return "", errors.New("nothing is missing from cache")
+	}
+	missing := newMissingSelections(response.Missing)
+	vars := operationVariables(queryDoc, variables)
+	if !missing.partial(queryDoc.SelectionSet, vars) {
+		return "", errors.New("nothing of the response is in cache")
+	}
+
+	missingDoc := &ast.QueryDocument{
+		Operations: ast.OperationList{gc.missingOperation(queryDoc, missing, vars)},
+	}
+	return AddTypenameToQuery(printQueryDocument(missingDoc))
+}
+
+// missingOperation returns the operation with only the selections that are missing from the cache
+// fragment spreads are turned into inline fragments, so the operation doesn't need any fragment definitions,
+// and variables the missing selections don't use are left out
+func (gc *GraphCache) missingOperation(queryDoc *ast.OperationDefinition, missing *missingSelections, variables map[string]interface{}) *ast.OperationDefinition {
+	selectionSet := gc.pruneSelectionSet(queryDoc.SelectionSet, missing, false, variables)
+
+	used := make(map[string]bool)
+	variablesInDirectives(queryDoc.Directives, used)
+	variablesInSelectionSet(selectionSet, used)
+	variableDefinitions := ast.VariableDefinitionList{}
+	for _, definition := range queryDoc.VariableDefinitions {
+		if used[definition.Variable] {
+			variableDefinitions = append(variableDefinitions, definition)
+		}
+	}
+
+	return &ast.OperationDefinition{
+		Operation:           queryDoc.Operation,
+		Name:                queryDoc.Name,
+		VariableDefinitions: variableDefinitions,
+		Directives:          queryDoc.Directives,
+		SelectionSet:        selectionSet,
+	}
+}
+
+// pruneSelectionSet keeps the selections that lead to a missing field, without the ones excluded by @skip or @include
+// objects keep their key fields, so the response can be stored with the objects already in the cache
+func (gc *GraphCache) pruneSelectionSet(selectionSet ast.SelectionSet, missing *missingSelections, keepID bool, variables map[string]interface{}) ast.SelectionSet {
+	pruned := ast.SelectionSet{}
+	idFields := ast.SelectionSet{}
+	for _, selection := range selectionSet {
+		if !selectionIncluded(selection, variables) {
+			continue
+		}
+		switch selection := selection.(type) {
+		case *ast.Field:
+			node := missing.children[fieldResponseKey(selection)]
+			if node == nil {
+				if keepID && gc.isKeyField(selection.Name) && len(selection.SelectionSet) == 0 {
+					idFields = append(idFields, selection)
+				}
+				continue
+			}
+			field := *selection
+			if node.all {
+				field.SelectionSet = inlineFragmentSpreads(selection.SelectionSet)
+			} else {
+				field.SelectionSet = gc.pruneSelectionSet(selection.SelectionSet, node, true, variables)
+				if len(field.SelectionSet) == 0 {
+					continue
+				}
+			}
+			pruned = append(pruned, &field)
+		case *ast.InlineFragment:
+			if fragment := gc.pruneFragment(selection.TypeCondition, selection.Directives, selection.SelectionSet, missing, keepID, variables); fragment != nil {
+				pruned = append(pruned, fragment)
+			}
+		case *ast.FragmentSpread:
+			if selection.Definition == nil {
+				continue
+			}
+			if fragment := gc.pruneFragment(selection.Definition.TypeCondition, selection.Directives, selection.Definition.SelectionSet, missing, keepID, variables); fragment != nil {
+				pruned = append(pruned, fragment)
+			}
+		}
+	}
+	if len(pruned) == 0 {
+		return pruned
+	}
+	return append(idFields, pruned...)
+}
+
+func (gc *GraphCache) pruneFragment(typeCondition string, directives ast.DirectiveList, selectionSet ast.SelectionSet, missing *missingSelections, keepID bool, variables map[string]interface{}) *ast.InlineFragment {
+	fragment := &ast.InlineFragment{TypeCondition: typeCondition, Directives: directives}
+	if node := missing.children[fragmentPathElement(typeCondition)]; node != nil && node.all {
+		fragment.SelectionSet = inlineFragmentSpreads(selectionSet)
+		return fragment
+	}
+	fragment.SelectionSet = gc.pruneSelectionSet(selectionSet, missing, keepID, variables)
+	if len(fragment.SelectionSet) == 0 {
+		return nil
+	}
+	return fragment
+}
+
+// inlineFragmentSpreads returns a copy of the selection set with every fragment spread replaced by
+// an inline fragment with the same type condition and selections
+func inlineFragmentSpreads(selectionSet ast.SelectionSet) ast.SelectionSet {
+	if len(selectionSet) == 0 {
+		return selectionSet
+	}
+	inlined := ast.SelectionSet{}
+	for _, selection := range selectionSet {
+		switch selection := selection.(type) {
+		case *ast.Field:
+			field := *selection
+			field.SelectionSet = inlineFragmentSpreads(selection.SelectionSet)
+			inlined = append(inlined, &field)
+		case *ast.InlineFragment:
+			fragment := *selection
+			fragment.SelectionSet = inlineFragmentSpreads(selection.SelectionSet)
+			inlined = append(inlined, &fragment)
+		case *ast.FragmentSpread:
+			if selection.Definition == nil {
+				continue
+			}
+			inlined = append(inlined, &ast.InlineFragment{
+				TypeCondition: selection.Definition.TypeCondition,
+				Directives:    selection.Directives,
+				SelectionSet:  inlineFragmentSpreads(selection.Definition.SelectionSet),
+			})
+		}
+	}
+	return inlined
+}
+
+func variablesInSelectionSet(selectionSet ast.SelectionSet, used map[string]bool) {
+	for _, selection := range selectionSet {
+		switch selection := selection.(type) {
+		case *ast.Field:
+			for _, argument := range selection.Arguments {
+				variablesInValue(argument.Value, used)
+			}
+			variablesInDirectives(selection.Directives, used)
+			variablesInSelectionSet(selection.SelectionSet, used)
+		case *ast.InlineFragment:
+			variablesInDirectives(selection.Directives, used)
+			variablesInSelectionSet(selection.SelectionSet, used)
+		case *ast.FragmentSpread:
+			variablesInDirectives(selection.Directives, used)
+			if selection.Definition != nil {
+				variablesInSelectionSet(selection.Definition.SelectionSet, used)
+			}
+		}
+	}
+}
+
+func variablesInDirectives(directives ast.DirectiveList, used map[string]bool) {
+	for _, directive := range directives {
+		for _, argument := range directive.Arguments {
+			variablesInValue(argument.Value, used)
+		}
+	}
+}
+
+func variablesInValue(value *ast.Value, used map[string]bool) {
+	if value == nil {
+		return
+	}
+	if value.Kind == ast.Variable {
+		used[value.Raw] = true
+	}
+	for _, child := range value.Children {
+		variablesInValue(child.Value, used)
+	}
+}
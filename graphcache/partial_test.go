@@ -0,0 +1,106 @@
+package graphcache
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseASTBuildMissingQuery(t *testing.T) {
+	tests := []struct {
+		name      string
+		cached    string
+		response  string
+		query     string
+		variables map[string]interface{}
+		expected  string
+	}{
+		{
+			name:      "Missing field of an object",
+			cached:    "query GetUser($id: ID!) { user(id: $id) { id name } }",
+			response:  `{"data":{"__typename":"Query","user":{"__typename":"User","id":"1","name":"John Doe"}}}`,
+			query:     "query GetUser($id: ID!, $days: Int) { user(id: $id) { id name completionRate(days: $days) } }",
+			variables: map[string]interface{}{"id": "1", "days": 7},
+			expected:  "query GetUser ($id: ID!, $days: Int) { user(id: $id) { id completionRate(days: $days) __typename } __typename }",
+		},
+		{
+			name:      "Missing nested object",
+			cached:    "query GetUser($id: ID!) { user(id: $id) { id name } }",
+			response:  `{"data":{"__typename":"Query","user":{"__typename":"User","id":"1","name":"John Doe"}}}`,
+			query:     "query GetUser($id: ID!, $done: Boolean) { user(id: $id) { id name todos(done: $done) { id text } } }",
+			variables: map[string]interface{}{"id": "1"},
+			expected:  "query GetUser ($id: ID!, $done: Boolean) { user(id: $id) { id todos(done: $done) { id text __typename } __typename } __typename }",
+		},
+		{
+			name:     "Missing field of every item of a list in a fragment",
+			cached:   "query GetUsers { users { id name } }",
+			response: `{"data":{"__typename":"Query","users":[{"__typename":"User","id":"1","name":"John Doe"},{"__typename":"User","id":"2","name":"Jane Doe"}]}}`,
+			query:    "query GetUsers { users { ...UserFields } } fragment UserFields on User { id name meta { ipAddress } }",
+			expected: "query GetUsers { users { ... on User { id meta { ipAddress __typename } } __typename } __typename }",
+		},
+		{
+			name:     "Missing root field",
+			cached:   "query GetUsers { users { id name } }",
+			response: `{"data":{"__typename":"Query","users":[{"__typename":"User","id":"1","name":"John Doe"}]}}`,
+			query:    "query Dashboard($limit: Int, $text: String) { users(limit: $limit) { id name } todos(text: $text) { id text } }",
+			expected: "query Dashboard ($text: String) { todos(text: $text) { id text __typename } __typename }",
+		},
+		{
+			name:      "Fields excluded by @skip or @include",
+			cached:    "query GetUser($id: ID!) { user(id: $id) { id name } }",
+			response:  `{"data":{"__typename":"Query","user":{"__typename":"User","id":"1","name":"John Doe"}}}`,
+			query:     "query GetUser($id: ID!, $full: Boolean!) { user(id: $id) { id name email @include(if: $full) phone @skip(if: $full) } }",
+			variables: map[string]interface{}{"id": "1", "full": false},
+			expected:  "query GetUser ($id: ID!, $full: Boolean!) { user(id: $id) { id phone @skip(if: $full) __typename } __typename }",
+		},
+		{
+			name:     "Unknown type condition",
+			cached:   "query Search { search { id } }",
+			response: `{"data":{"__typename":"Query","search":[{"__typename":"User","id":"1"}]}}`,
+			query:    "query Search { search { id ...Named } } fragment Named on Node { name }",
+			expected: "query Search { search { id ... on Node { name } __typename } __typename }",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gc := NewGraphCache()
+			cacheQueryResponse(t, gc, tt.cached, tt.variables, tt.response)
+
+			missingQuery, err := gc.ParseASTBuildMissingQuery(mustParse(t, tt.query), GraphQLRequest{Query: tt.query, Variables: tt.variables})
+			assert.Nil(t, err)
+			assert.Equal(t, tt.expected, missingQuery)
+		})
+	}
+}
+
+func TestParseASTBuildMissingQueryNothingToMerge(t *testing.T) {
+	gc := NewGraphCache()
+	cacheQueryResponse(t, gc, "query GetUsers { users { id name } }", nil, `{"data":{"__typename":"Query","users":[{"__typename":"User","id":"1","name":"John Doe"}]}}`)
+
+	// everything is cached
+	_, err := gc.ParseASTBuildMissingQuery(mustParse(t, "query GetUsers { users { id } }"), GraphQLRequest{})
+	assert.NotNil(t, err)
+
+	// nothing is cached
+	_, err = gc.ParseASTBuildMissingQuery(mustParse(t, "query GetTodos { todos { id } }"), GraphQLRequest{})
+	assert.NotNil(t, err)
+}
+
+func TestPartialResponseIsMerged(t *testing.T) {
+	gc := NewGraphCache()
+	cacheQueryResponse(t, gc, "query GetUsers { users { id name } }", nil, `{"data":{"__typename":"Query","users":[{"__typename":"User","id":"1","name":"John Doe"}]}}`)
+
+	query := "query GetUsers { users { id name meta { ipAddress } } }"
+	missingQuery, err := gc.ParseASTBuildMissingQuery(mustParse(t, query), GraphQLRequest{})
+	assert.Nil(t, err)
+	cacheQueryResponse(t, gc, missingQuery, nil, `{"data":{"__typename":"Query","users":[{"__typename":"User","id":"1","meta":{"__typename":"MetaInfo","ipAddress":"127.0.0.1"}}]}}`)
+
+	res, err := gc.ParseASTBuildResponse(mustParse(t, query), GraphQLRequest{})
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]interface{}{
+		"users": []interface{}{
+			map[string]interface{}{"id": "1", "name": "John Doe", "meta": map[string]interface{}{"ipAddress": "127.0.0.1"}},
+		},
+	}, gc.deleteTypename(res))
+}
@@ -0,0 +1,56 @@
+package graphcache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+
+	"github.com/vektah/gqlparser/v2/gqlerror"
+)
+
+const PERSISTED_QUERY_KEY = "__persisted_query"
+
+// PERSISTED_QUERY_NOT_FOUND is the error of an automatic persisted query request with a hash that isn't registered,
+// clients send the query with its hash next
+const PERSISTED_QUERY_NOT_FOUND = "PersistedQueryNotFound"
+
+var ErrPersistedQueryNotFound = &gqlerror.Error{
+	Message:    PERSISTED_QUERY_NOT_FOUND,
+	Extensions: map[string]interface{}{"code": "PERSISTED_QUERY_NOT_FOUND"},
+}
+var ErrPersistedQueryHashMismatch = errors.New("provided sha does not match query")
+
+// persistedQueryKey is the key of the query with the hash, queries are shared by every scope
+func (gc *GraphCache) persistedQueryKey(hash string) string {
+	return gc.sharedKey(PERSISTED_QUERY_KEY + ":" + hash)
+}
+
+// PersistQuery registers the query with its sha256 hash
+func (gc *GraphCache) PersistQuery(hash string, query string) error {
+	if err := VerifyPersistedQuery(hash, query); err != nil {
+		return err
+	}
+	return gc.queryCacheStore.Set(gc.persistedQueryKey(hash), query)
+}
+
+// VerifyPersistedQuery checks the query matches the sha256 hash it was sent with
+func VerifyPersistedQuery(hash string, query string) error {
+	sum := sha256.Sum256([]byte(query))
+	if hex.EncodeToString(sum[:]) != hash {
+		return ErrPersistedQueryHashMismatch
+	}
+	return nil
+}
+
+// PersistedQuery is the query registered with the hash
+func (gc *GraphCache) PersistedQuery(hash string) (string, error) {
+	query, err := gc.queryCacheStore.Get(gc.persistedQueryKey(hash))
+	if err != nil {
+		return "", ErrPersistedQueryNotFound
+	}
+	queryString, ok := query.(string)
+	if !ok {
+		return "", ErrPersistedQueryNotFound
+	}
+	return queryString, nil
+}
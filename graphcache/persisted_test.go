@@ -0,0 +1,55 @@
+package graphcache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPersistedQueries(t *testing.T) {
+	gc := NewGraphCache()
+	query := `query GetUser { user(id: "1") { id name } }`
+	sum := sha256.Sum256([]byte(query))
+	hash := hex.EncodeToString(sum[:])
+
+	_, err := gc.PersistedQuery(hash)
+	assert.Equal(t, ErrPersistedQueryNotFound, err)
+
+	assert.Equal(t, ErrPersistedQueryHashMismatch, gc.PersistQuery(hash, `query GetUsers { users { id } }`))
+	assert.Nil(t, gc.PersistQuery(hash, query))
+	persisted, err := gc.PersistedQuery(hash)
+	assert.Nil(t, err)
+	assert.Equal(t, query, persisted)
+
+	// queries are registered for every scope
+	other := NewGraphCacheWithOptions(gc.ctx, &GraphCacheOptions{
+		QueryStore:  gc.queryCacheStore,
+		ObjectStore: gc.cacheStore,
+		Prefix:      "other",
+	})
+	persisted, err = other.PersistedQuery(hash)
+	assert.Nil(t, err)
+	assert.Equal(t, query, persisted)
+}
+
+func TestPersistedQueryResponseKeys(t *testing.T) {
+	gc := NewGraphCache()
+	getName := `query GetUser { user(id: "1") { id name } }`
+	getEmail := `query GetUser { user(id: "1") { id email } }`
+	for _, query := range []string{getName, getEmail} {
+		sum := sha256.Sum256([]byte(query))
+		assert.Nil(t, gc.PersistQuery(hex.EncodeToString(sum[:]), query))
+	}
+
+	// the responses of persisted documents are cached by the hash of the document, not only by the name
+	// of their operation and their variables
+	nameKey := gc.GetQueryKey(mustParse(t, getName).Operations[0], nil)
+	assert.NotEqual(t, nameKey, gc.GetQueryKey(mustParse(t, getEmail).Operations[0], nil))
+	transformed, err := AddTypenameToQuery(getName)
+	assert.Nil(t, err)
+	assert.Equal(t, nameKey, gc.GetQueryKey(mustParse(t, transformed).Operations[0], nil))
+	assert.True(t, strings.HasSuffix(nameKey, ":"+DocumentHash(mustParse(t, getName).Operations[0])))
+}
@@ -0,0 +1,166 @@
+package graphcache
+
+import (
+	"strings"
+	"time"
+
+	"github.com/vektah/gqlparser/v2/ast"
+)
+
+// EXPIRES_FIELD is the field of a cached object with the time its fields with a max age expire at,
+// fields without one are kept as long as the object is
+const EXPIRES_FIELD = "__expires"
+
+const CACHE_CONTROL_DIRECTIVE = "cacheControl"
+
+// hasMaxAges reports if any type or field can have a max age, without them everything is cached for the ttl of the cache
+func (gc *GraphCache) hasMaxAges() bool {
+	return len(gc.maxAges) > 0 || gc.schema != nil
+}
+
+// typeMaxAge is the max age of the objects of a type, from the configuration or the @cacheControl
+// directive of the type in the schema
+func (gc *GraphCache) typeMaxAge(typename string) (int, bool) {
+	if maxAge, ok := gc.maxAges[typename]; ok {
+		return maxAge, true
+	}
+	if gc.schema != nil && gc.schema.Types[typename] != nil {
+		return directiveMaxAge(gc.schema.Types[typename].Directives)
+	}
+	return 0, false
+}
+
+// fieldMaxAge is the max age of a field of the type, a field without its own max age that returns objects
+// has the max age of their type, and a field of scalars the one of the type it belongs to, like
+// @cacheControl hints are resolved
+func (gc *GraphCache) fieldMaxAge(typename string, field string, valueTypename string) (int, bool) {
+	if maxAge, ok := gc.maxAges[typename+"."+field]; ok {
+		return maxAge, true
+	}
+	if gc.schema != nil && gc.schema.Types[typename] != nil {
+		if definition := gc.schema.Types[typename].Fields.ForName(field); definition != nil {
+			if maxAge, ok := directiveMaxAge(definition.Directives); ok {
+				return maxAge, true
+			}
+		}
+	}
+	if valueTypename != "" {
+		return gc.typeMaxAge(valueTypename)
+	}
+	return gc.typeMaxAge(typename)
+}
+
+func directiveMaxAge(directives ast.DirectiveList) (int, bool) {
+	directive := directives.ForName(CACHE_CONTROL_DIRECTIVE)
+	if directive == nil || directive.Arguments.ForName("maxAge") == nil {
+		return 0, false
+	}
+	maxAge, err := directive.Arguments.ForName("maxAge").Value.Value(nil)
+	if value, ok := maxAge.(int64); err == nil && ok {
+		return int(value), true
+	}
+	return 0, false
+}
+
+// valueMaxAge is the max age of a field of the response with everything in it, the smallest max age of
+// the field and of the fields of the objects in its value
+func (gc *GraphCache) valueMaxAge(typename string, field string, value interface{}) (int, bool) {
+	maxAge, limited := gc.fieldMaxAge(typename, field, responseTypename(value))
+	switch value := value.(type) {
+	case map[string]interface{}:
+		objectTypename, _ := value[TYPENAME_FIELD].(string)
+		for key, fieldValue := range value {
+			if key == TYPENAME_FIELD || key == EXPIRES_FIELD {
+				continue
+			}
+			if fieldMaxAge, ok := gc.valueMaxAge(objectTypename, storageKeyFieldName(key), fieldValue); ok && (!limited || fieldMaxAge < maxAge) {
+				maxAge, limited = fieldMaxAge, true
+			}
+		}
+	case []interface{}:
+		for _, item := range value {
+			if itemMaxAge, ok := gc.valueMaxAge(typename, field, item); ok && (!limited || itemMaxAge < maxAge) {
+				maxAge, limited = itemMaxAge, true
+			}
+		}
+	}
+	return maxAge, limited
+}
+
+// responseMaxAge is the max age of a response, the smallest max age of the fields and objects in it,
+// it isn't limited when none of them has one
+func (gc *GraphCache) responseMaxAge(response map[string]interface{}) (int, bool) {
+	data, ok := response["data"].(map[string]interface{})
+	if !ok || !gc.hasMaxAges() {
+		return 0, false
+	}
+	maxAge, limited := 0, false
+	typename, _ := data[TYPENAME_FIELD].(string)
+	for key, value := range data {
+		if key == TYPENAME_FIELD {
+			continue
+		}
+		if fieldMaxAge, ok := gc.valueMaxAge(typename, storageKeyFieldName(key), value); ok && (!limited || fieldMaxAge < maxAge) {
+			maxAge, limited = fieldMaxAge, true
+		}
+	}
+	return maxAge, limited
+}
+
+// fieldExpiries is the time the fields of an object of the response with a max age expire at, by storage key,
+// the root fields expire with the first field or object in them, the fields of other objects with their own
+// max age as the objects they refer to are cached on their own
+func (gc *GraphCache) fieldExpiries(object map[string]interface{}, root bool) map[string]interface{} {
+	expiries := make(map[string]interface{})
+	typename, ok := object[TYPENAME_FIELD].(string)
+	if !ok || !gc.hasMaxAges() {
+		return expiries
+	}
+	now := float64(time.Now().UnixNano()) / float64(time.Second)
+	for key, value := range object {
+		if key == TYPENAME_FIELD || key == EXPIRES_FIELD {
+			continue
+		}
+		maxAge, limited := 0, false
+		if root {
+			maxAge, limited = gc.valueMaxAge(typename, storageKeyFieldName(key), value)
+		} else {
+			maxAge, limited = gc.fieldMaxAge(typename, storageKeyFieldName(key), responseTypename(value))
+		}
+		if limited {
+			expiries[key] = now + float64(maxAge)
+		}
+	}
+	return expiries
+}
+
+// fieldExpired reports if the field of a cached object is past its max age
+func fieldExpired(object map[string]interface{}, storageKey string) bool {
+	expiries, ok := object[EXPIRES_FIELD].(map[string]interface{})
+	if !ok {
+		return false
+	}
+	expiresAt, ok := expiries[storageKey].(float64)
+	return ok && float64(time.Now().UnixNano())/float64(time.Second) >= expiresAt
+}
+
+// lastFieldExpiry is the time left before the last field of a cached object with a max age expires
+func lastFieldExpiry(object map[string]interface{}) (time.Duration, bool) {
+	expiries, ok := object[EXPIRES_FIELD].(map[string]interface{})
+	if !ok {
+		return 0, false
+	}
+	last, found := 0.0, false
+	for _, expiresAt := range expiries {
+		if expiresAt, ok := expiresAt.(float64); ok && (!found || expiresAt > last) {
+			last, found = expiresAt, true
+		}
+	}
+	return time.Until(time.Unix(0, int64(last*float64(time.Second)))), found
+}
+
+// storageKeyFieldName is the name of the field a storage key is for, without its arguments
+func storageKeyFieldName(storageKey string) string {
+	name, _, _ := strings.Cut(storageKey, "(")
+	return name
+}
@@ -0,0 +1,174 @@
+package graphcache
+
+import (
+	"context"
+	"orbitgraphql/cache"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testPoliciesSchema = `
+directive @cacheControl(maxAge: Int, scope: CacheControlScope) on FIELD_DEFINITION | OBJECT | INTERFACE | UNION
+
+enum CacheControlScope {
+  PUBLIC
+  PRIVATE
+}
+
+type User @cacheControl(maxAge: 120) {
+  id: ID!
+  name: String!
+  email: String @cacheControl(maxAge: 0, scope: PRIVATE)
+  todos: [Todo!]!
+}
+
+type Todo @cacheControl(maxAge: 30) {
+  id: ID!
+  text: String!
+}
+
+type Query {
+  user(id: ID!): User @cacheControl(maxAge: 60)
+  users: [User!]!
+  totalUsers: Int
+}
+`
+
+func newPoliciesGraphCache(t *testing.T, maxAges map[string]int, sdl string) *GraphCache {
+	opts := &GraphCacheOptions{
+		ObjectStore: cache.NewInMemoryCache(300),
+		QueryStore:  cache.NewInMemoryCache(300),
+		MaxAges:     maxAges,
+	}
+	if sdl != "" {
+		schema, err := LoadSchemaFromSDL("schema.graphql", sdl)
+		assert.Nil(t, err)
+		opts.Schema = schema
+	}
+	return NewGraphCacheWithOptions(context.Background(), opts)
+}
+
+// expiresIn is the seconds until the field of the cached object expires
+func expiresIn(t *testing.T, gc *GraphCache, key string, storageKey string) float64 {
+	object, err := gc.cacheStore.Get(gc.Key(key))
+	assert.Nil(t, err)
+	expiries, _ := object.(map[string]interface{})[EXPIRES_FIELD].(map[string]interface{})
+	expiresAt, ok := expiries[storageKey].(float64)
+	if !assert.True(t, ok, key+"."+storageKey) {
+		return 0
+	}
+	return expiresAt - float64(time.Now().UnixNano())/float64(time.Second)
+}
+
+func TestFieldMaxAge(t *testing.T) {
+	gc := newPoliciesGraphCache(t, map[string]int{"Todo": 10, "User.name": 5}, testPoliciesSchema)
+
+	tests := []struct {
+		typename      string
+		field         string
+		valueTypename string
+		maxAge        int
+		limited       bool
+	}{
+		{"User", "email", "", 0, true},
+		{"User", "id", "", 120, true},
+		{"User", "name", "", 5, true},
+		{"User", "todos", "Todo", 10, true},
+		{"Query", "user", "User", 60, true},
+		{"Query", "users", "User", 120, true},
+		{"Query", "totalUsers", "", 0, false},
+	}
+	for _, tt := range tests {
+		maxAge, limited := gc.fieldMaxAge(tt.typename, tt.field, tt.valueTypename)
+		assert.Equal(t, tt.limited, limited, tt.typename+"."+tt.field)
+		assert.Equal(t, tt.maxAge, maxAge, tt.typename+"."+tt.field)
+	}
+}
+
+func TestCacheResponseMaxAges(t *testing.T) {
+	gc := newPoliciesGraphCache(t, nil, testPoliciesSchema)
+	cacheQueryResponse(t, gc, `query GetUsers { users { id name todos { id text } } totalUsers }`, nil, `{"data":{"__typename":"Query","users":[{"__typename":"User","id":"1","name":"John Doe","todos":[{"__typename":"Todo","id":"5","text":"Write tests"}]}],"totalUsers":1}}`)
+
+	// a root field expires with the first field or object in it, the users list with the todos of the users
+	assert.InDelta(t, 30, expiresIn(t, gc, ROOT_QUERY_KEY, "users"), 1)
+	// the fields of objects expire with their own max age
+	assert.InDelta(t, 120, expiresIn(t, gc, "User:1", "name"), 1)
+	assert.InDelta(t, 30, expiresIn(t, gc, "User:1", "todos"), 1)
+	assert.InDelta(t, 30, expiresIn(t, gc, "Todo:5", "text"), 1)
+	// fields without a max age are kept as long as the cache keeps them
+	root, _ := gc.cacheStore.Get(gc.Key(ROOT_QUERY_KEY))
+	assert.NotContains(t, root.(map[string]interface{})[EXPIRES_FIELD], "totalUsers")
+
+	res := readQuery(t, gc, `query GetUsers { users { id name todos { id text } } totalUsers }`, nil)
+	assert.True(t, res.Complete(), res.MissingFields())
+}
+
+func TestExpiredFieldsAreMissing(t *testing.T) {
+	gc := newPoliciesGraphCache(t, nil, testPoliciesSchema)
+	cacheQueryResponse(t, gc, `query GetUser { user(id: "1") { id name email } }`, nil, `{"data":{"__typename":"Query","user":{"__typename":"User","id":"1","name":"John Doe","email":"john@example.com"}}}`)
+
+	// the email isn't cached, the user is read from the cached object when the root field expires with it
+	assert.Equal(t, "user.email (expired)", readQuery(t, gc, `query GetUser { user(id: "1") { id name email } }`, nil).MissingFields())
+	res := readQuery(t, gc, `query GetUserName { user(id: "1") { id name } }`, nil)
+	assert.True(t, res.Complete(), res.MissingFields())
+
+	// only the expired fields are fetched again
+	missing, err := gc.ParseASTBuildMissingQuery(mustParse(t, `query GetUserEmail { user(id: "1") { name email } }`), GraphQLRequest{Query: `query GetUserEmail { user(id: "1") { name email } }`})
+	assert.Nil(t, err)
+	assert.Contains(t, missing, "email")
+	assert.NotContains(t, missing, " name ")
+}
+
+func TestConfiguredMaxAges(t *testing.T) {
+	gc := newPoliciesGraphCache(t, map[string]int{"Query.totalUsers": 0, "User": 0}, "")
+	cacheQueryResponse(t, gc, "query GetStats { totalUsers users { id } todos { id } }", nil, `{"data":{"__typename":"Query","totalUsers":2,"users":[{"__typename":"User","id":"1"}],"todos":[{"__typename":"Todo","id":"5"}]}}`)
+
+	// a list without a reference to fall back on expires with the objects in it
+	assert.Equal(t, "totalUsers (expired), users (expired)", readQuery(t, gc, "query GetStats { totalUsers users { id } }", nil).MissingFields())
+	res := readQuery(t, gc, "query GetTodos { todos { id } }", nil)
+	assert.True(t, res.Complete(), res.MissingFields())
+}
+
+func TestMaxAgeZeroResponsesAreNotCached(t *testing.T) {
+	gc := newPoliciesGraphCache(t, map[string]int{"Query.totalUsers": 0}, "")
+	query := "query GetStats { totalUsers }"
+	key := gc.GetQueryKey(mustParse(t, query).Operations[0], nil)
+	gc.queryCacheStore.Set(key, map[string]interface{}{"totalUsers": 1})
+
+	// a response with a max age of 0 isn't stored, with a ttl of 0 redis would keep it forever,
+	// and the response cached before it is deleted
+	cacheQueryResponse(t, gc, query, nil, `{"data":{"__typename":"Query","totalUsers":2}}`)
+	exists, err := gc.queryCacheStore.Exists(key)
+	assert.Nil(t, err)
+	assert.False(t, exists)
+
+	// a value set with a ttl that isn't positive has expired already
+	assert.Nil(t, gc.queryCacheStore.Set(key, "cached"))
+	assert.Nil(t, gc.queryCacheStore.SetWithTTL(key, "cached", 0))
+	_, err = gc.queryCacheStore.TTL(key)
+	assert.NotNil(t, err)
+}
+
+func TestMaxAgesSetKeyTTLs(t *testing.T) {
+	gc := newPoliciesGraphCache(t, map[string]int{"User": 600, "Todo": 30}, "")
+	query := `query GetUser { user(id: "1") { id name todos { id text } } }`
+	cacheQueryResponse(t, gc, query, nil, `{"data":{"__typename":"Query","user":{"__typename":"User","id":"1","name":"John Doe","todos":[{"__typename":"Todo","id":"5","text":"Write tests"}]}}}`)
+
+	// objects with a max age longer than the ttl of the cache are kept until their fields expire
+	ttl, err := gc.cacheStore.TTL(gc.Key("User:1"))
+	assert.Nil(t, err)
+	assert.InDelta(t, 600, ttl.Seconds(), 1)
+	ttl, err = gc.cacheStore.TTL(gc.Key("Todo:5"))
+	assert.Nil(t, err)
+	assert.InDelta(t, 300, ttl.Seconds(), 1)
+
+	// the response of the operation expires with the first object in it
+	ttl, err = gc.queryCacheStore.TTL(gc.GetQueryKey(mustParse(t, query).Operations[0], nil))
+	assert.Nil(t, err)
+	assert.InDelta(t, 30, ttl.Seconds(), 1)
+
+	look := gc.Look()
+	assert.InDelta(t, 600, look["cacheStoreTTL"].(map[string]interface{})[gc.Key("User:1")], 1)
+}
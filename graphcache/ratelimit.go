@@ -0,0 +1,29 @@
+package graphcache
+
+import (
+	"orbitgraphql/logger"
+	"time"
+)
+
+const RATE_LIMIT_KEY = "__rate_limit"
+
+// rateLimitKey is the key of the token bucket of the scope, of an operation of the scope when it is named
+func (gc *GraphCache) rateLimitKey(bucket string, operationName string) string {
+	if operationName != "" {
+		return gc.Key(RATE_LIMIT_KEY + ":" + bucket + ":" + operationName)
+	}
+	return gc.Key(RATE_LIMIT_KEY + ":" + bucket)
+}
+
+// TakeRateLimitToken takes a token from the token bucket of the scope, refilled with rate tokens per second up to
+// burst tokens, when it is empty it reports how long until it has a token again. The buckets are kept in the query
+// store, so they are shared by the proxies sharing it
+func (gc *GraphCache) TakeRateLimitToken(bucket string, operationName string, rate float64, burst int) (bool, time.Duration) {
+	allowed, retryAfter, err := gc.queryCacheStore.TakeToken(gc.rateLimitKey(bucket, operationName), rate, burst)
+	if err != nil {
+		// requests aren't limited while the store is unavailable
+		logger.Warn(gc.ctx, err)
+		return true, 0
+	}
+	return allowed, retryAfter
+}
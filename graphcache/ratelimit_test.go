@@ -0,0 +1,43 @@
+package graphcache
+
+import (
+	"context"
+	"orbitgraphql/cache"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTakeRateLimitToken(t *testing.T) {
+	store := cache.NewInMemoryCache(300)
+	scope := func(prefix string) *GraphCache {
+		return NewGraphCacheWithOptions(context.Background(), &GraphCacheOptions{QueryStore: store, ObjectStore: store, Prefix: prefix})
+	}
+	gc := scope("client1")
+
+	for i := 0; i < 2; i++ {
+		allowed, _ := gc.TakeRateLimitToken("hits", "", 1, 2)
+		assert.True(t, allowed)
+	}
+	allowed, retryAfter := gc.TakeRateLimitToken("hits", "", 1, 2)
+	assert.False(t, allowed)
+	assert.InDelta(t, time.Second.Seconds(), retryAfter.Seconds(), 0.1)
+
+	// every scope, bucket and operation has its own budget
+	allowed, _ = scope("client2").TakeRateLimitToken("hits", "", 1, 2)
+	assert.True(t, allowed)
+	allowed, _ = gc.TakeRateLimitToken("misses", "", 1, 2)
+	assert.True(t, allowed)
+	allowed, _ = gc.TakeRateLimitToken("hits", "GetUser", 1, 2)
+	assert.True(t, allowed)
+
+	// the bucket is refilled with the rate
+	allowed, _ = gc.TakeRateLimitToken("misses", "", 100, 1)
+	assert.True(t, allowed)
+	allowed, _ = gc.TakeRateLimitToken("misses", "", 100, 1)
+	assert.False(t, allowed)
+	time.Sleep(20 * time.Millisecond)
+	allowed, _ = gc.TakeRateLimitToken("misses", "", 100, 1)
+	assert.True(t, allowed)
+}
@@ -0,0 +1,294 @@
+package graphcache
+
+import (
+	"fmt"
+	"orbitgraphql/utils"
+	"strings"
+
+	"github.com/vektah/gqlparser/v2/ast"
+)
+
+// CachedResponse is the response to an operation built from the cache
+// it is only complete when Missing is empty, otherwise Data has everything that was found in the cache
+type CachedResponse struct {
+	Data    map[string]interface{}
+	Missing []MissingField
+}
+
+// MissingField is a selection of the query that could not be resolved from the cache
+type MissingField struct {
+	// Path is the path of the selection in the response, response keys and list indexes
+	Path []interface{}
+	// Reason is why the selection could not be resolved
+	Reason string
+}
+
+func (m MissingField) String() string {
+	path := make([]string, 0)
+	for _, element := range m.Path {
+		path = append(path, fmt.Sprintf("%v", element))
+	}
+	return strings.Join(path, ".") + " (" + m.Reason + ")"
+}
+
+func (r *CachedResponse) Complete() bool {
+	return len(r.Missing) == 0
+}
+
+// MissingFields lists the missing selections of the response, for logs and errors
+func (r *CachedResponse) MissingFields() string {
+	missing := make([]string, 0)
+	for _, field := range r.Missing {
+		missing = append(missing, field.String())
+	}
+	return strings.Join(missing, ", ")
+}
+
+// cacheReader builds the response of an operation by walking its selection set over the cached objects
+type cacheReader struct {
+	gc        *GraphCache
+	variables map[string]interface{}
+	// types is loaded the first time a fragment can't be resolved with the schema
+	types   *typeRegistry
+	missing []MissingField
+}
+
+// ReadOperation builds the response for an operation from the cache
+// the root fields come from the root fields cached by any query, or for root fields
+// like user(id: "1") from the object they refer to, when some other query has cached it
+// every other field is read from the cached objects, so the response only has what the query asks for
+func (gc *GraphCache) ReadOperation(queryDoc *ast.OperationDefinition, variables map[string]interface{}) *CachedResponse {
+	reader := &cacheReader{
+		gc:        gc,
+		variables: operationVariables(queryDoc, variables),
+	}
+
+	response := &CachedResponse{Data: make(map[string]interface{})}
+	if queryDoc.Operation != ast.Query {
+		response.Missing = append(response.Missing, MissingField{Path: []interface{}{}, Reason: "only queries are read from the cache"})
+		return response
+	}
+
+	// the root fields cached by every query, and the ones cached for this operation
+	root := make(map[string]interface{})
+	if cachedRoot, ok := gc.cachedObject(ROOT_QUERY_KEY); ok {
+		root = cachedRoot
+	}
+	cachedOperation, err := gc.queryCacheStore.Get(gc.GetQueryKey(queryDoc, variables))
+	if cachedOperationMap, ok := cachedOperation.(map[string]interface{}); err == nil && ok {
+		for key, value := range cachedOperationMap {
+			if _, ok := root[key]; !ok {
+				root[key] = value
+			}
+		}
+	}
+	rootTypename, ok := root[TYPENAME_FIELD].(string)
+	if !ok {
+		rootTypename = "Query"
+	}
+
+	for _, field := range collectFields(queryDoc.SelectionSet, "", reader.variables) {
+		path := []interface{}{fieldResponseKey(field)}
+		if field.Name == TYPENAME_FIELD {
+			response.Data[fieldResponseKey(field)] = rootTypename
+			continue
+		}
+		// an expired root field can still refer to an object that isn't, which has expiries of its own
+		value, ok := root[fieldStorageKey(field, reader.variables)]
+		expired := ok && fieldExpired(root, fieldStorageKey(field, reader.variables))
+		if !ok || expired {
+			value, ok = reader.rootFieldReference(field)
+		}
+		if !ok && expired {
+			reader.miss(path, "expired")
+			continue
+		}
+		if !ok {
+			reader.miss(path, "not in cache")
+			continue
+		}
+		reader.setResponseValue(response.Data, field, reader.readValue(field.SelectionSet, value, path))
+	}
+
+	response.Missing = reader.missing
+	return response
+}
+
+// rootFieldReference resolves a root field that selects one object by its key fields, like user(id: "1"),
+// to the cached object, so it can be served from objects cached by other queries
+func (r *cacheReader) rootFieldReference(field *ast.Field) (interface{}, bool) {
+	if len(field.Arguments) == 0 || len(field.SelectionSet) == 0 {
+		return nil, false
+	}
+	typename := r.rootFieldType(field.Name)
+	if typename == "" {
+		return nil, false
+	}
+	// the arguments have to be exactly the key fields of the type
+	keyFields := r.gc.keyFields(typename)
+	if len(field.Arguments) != len(keyFields) {
+		return nil, false
+	}
+	keys := make(map[string]interface{})
+	for _, argument := range field.Arguments {
+		if !utils.StringArrayContainsString(keyFields, argument.Name) {
+			return nil, false
+		}
+		value, err := argument.Value.Value(r.variables)
+		if err != nil {
+			return nil, false
+		}
+		keys[argument.Name] = value
+	}
+	id, ok := r.gc.ObjectID(typename, keys)
+	if !ok {
+		return nil, false
+	}
+	if !r.gc.objectCached(typename + ":" + id) {
+		return nil, false
+	}
+	return r.gc.Key(typename + ":" + id), true
+}
+
+// rootFieldType is the typename of the object a root field returns, from the configuration or the schema,
+// it is never guessed from the responses or the name of the field (deletedUser(id: "1") isn't User:1)
+func (r *cacheReader) rootFieldType(field string) string {
+	if typename, ok := r.gc.rootFieldTypes[field]; ok {
+		return typename
+	}
+	if r.gc.schema != nil {
+		return schemaRootFieldType(r.gc.schema, field)
+	}
+	return ""
+}
+
+// fragmentApplies resolves a type condition with the schema when it knows both types,
+// and with what we learned from earlier responses otherwise
+func (r *cacheReader) fragmentApplies(typeCondition string, typename string) (bool, bool) {
+	if r.gc.schema != nil {
+		if applies, known := schemaFragmentApplies(r.gc.schema, typeCondition, typename); known {
+			return applies, known
+		}
+	}
+	if r.types == nil {
+		r.types = r.gc.loadTypeRegistry()
+	}
+	return r.types.fragmentApplies(typeCondition, typename)
+}
+
+func (r *cacheReader) miss(path []interface{}, reason string) {
+	r.missing = append(r.missing, MissingField{Path: path, Reason: reason})
+}
+
+// readValue builds the response for a selection set from a cached value
+// the cached value can be a reference to an object in the cache store, an object, or a list of either
+func (r *cacheReader) readValue(selectionSet ast.SelectionSet, cached interface{}, path []interface{}) interface{} {
+	if len(selectionSet) == 0 {
+		return cached
+	}
+	switch value := cached.(type) {
+	case string:
+		if !strings.HasPrefix(value, DEFAULT_CACHE_PREFIX) {
+			r.miss(path, "expected a reference to a cached object")
+			return nil
+		}
+		// the public and private fields of the object are read together
+		objectMap, ok := r.gc.cachedObject(referenceCacheKey(value))
+		if !ok {
+			r.miss(path, "object not in cache")
+			return nil
+		}
+		return r.readObject(selectionSet, objectMap, path)
+	case map[string]interface{}:
+		return r.readObject(selectionSet, value, path)
+	case []interface{}:
+		response := make([]interface{}, 0)
+		for i, item := range value {
+			response = append(response, r.readValue(selectionSet, item, appendPath(path, i)))
+		}
+		return response
+	case nil:
+		return nil
+	}
+	r.miss(path, "unexpected value in cache")
+	return nil
+}
+
+func (r *cacheReader) readObject(selectionSet ast.SelectionSet, object map[string]interface{}, path []interface{}) map[string]interface{} {
+	typename, _ := object[TYPENAME_FIELD].(string)
+	response := make(map[string]interface{})
+	r.readSelectionSet(selectionSet, typename, object, response, path)
+	return response
+}
+
+func (r *cacheReader) readSelectionSet(selectionSet ast.SelectionSet, typename string, object map[string]interface{}, response map[string]interface{}, path []interface{}) {
+	for _, selection := range selectionSet {
+		if !selectionIncluded(selection, r.variables) {
+			continue
+		}
+		switch selection := selection.(type) {
+		case *ast.Field:
+			fieldPath := appendPath(path, fieldResponseKey(selection))
+			value, ok := object[fieldStorageKey(selection, r.variables)]
+			if !ok {
+				r.miss(fieldPath, "not in cache")
+				continue
+			}
+			if fieldExpired(object, fieldStorageKey(selection, r.variables)) {
+				r.miss(fieldPath, "expired")
+				continue
+			}
+			r.setResponseValue(response, selection, r.readValue(selection.SelectionSet, value, fieldPath))
+		case *ast.InlineFragment:
+			r.readFragment(selection.TypeCondition, selection.SelectionSet, typename, object, response, path)
+		case *ast.FragmentSpread:
+			if selection.Definition != nil {
+				r.readFragment(selection.Definition.TypeCondition, selection.Definition.SelectionSet, typename, object, response, path)
+			}
+		}
+	}
+}
+
+func (r *cacheReader) readFragment(typeCondition string, selectionSet ast.SelectionSet, typename string, object map[string]interface{}, response map[string]interface{}, path []interface{}) {
+	applies, known := r.fragmentApplies(typeCondition, typename)
+	if !known {
+		// we can't tell if the origin would include the fields of this fragment
+		r.miss(appendPath(path, fragmentPathElement(typeCondition)), "unknown type condition")
+		return
+	}
+	if applies {
+		r.readSelectionSet(selectionSet, typename, object, response, path)
+	}
+}
+
+// setResponseValue sets the value of a field in the response, a field can be selected more than once
+// (for example directly and through a fragment), in which case the selections are merged
+func (r *cacheReader) setResponseValue(response map[string]interface{}, field *ast.Field, value interface{}) {
+	response[fieldResponseKey(field)] = mergeResponseValues(response[fieldResponseKey(field)], value)
+}
+
+func mergeResponseValues(existing interface{}, value interface{}) interface{} {
+	switch existingValue := existing.(type) {
+	case map[string]interface{}:
+		if valueMap, ok := value.(map[string]interface{}); ok {
+			for key, v := range valueMap {
+				existingValue[key] = mergeResponseValues(existingValue[key], v)
+			}
+			return existingValue
+		}
+	case []interface{}:
+		if valueList, ok := value.([]interface{}); ok && len(valueList) == len(existingValue) {
+			for i, v := range valueList {
+				existingValue[i] = mergeResponseValues(existingValue[i], v)
+			}
+			return existingValue
+		}
+	}
+	return value
+}
+
+func appendPath(path []interface{}, element interface{}) []interface{} {
+	newPath := make([]interface{}, len(path), len(path)+1)
+	copy(newPath, path)
+	return append(newPath, element)
+}
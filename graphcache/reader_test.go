@@ -0,0 +1,319 @@
+package graphcache
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"orbitgraphql/cache"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vektah/gqlparser/v2/ast"
+)
+
+// cacheQueryResponse caches the response of a query the same way the cache handler does
+func cacheQueryResponse(t *testing.T, gc *GraphCache, query string, variables map[string]interface{}, responseJSON string) {
+	transformedQuery, err := AddTypenameToQuery(query)
+	assert.Nil(t, err)
+	astWithTypes, err := GetASTFromQuery(transformedQuery)
+	assert.Nil(t, err)
+
+	response := map[string]interface{}{}
+	assert.Nil(t, json.Unmarshal([]byte(responseJSON), &response))
+	for _, op := range astWithTypes.Operations {
+		gc.CacheOperation(op, response, variables)
+	}
+	gc.CacheResponse("data", gc.ResponseWithStorageKeys(astWithTypes.Operations[0], response, variables), nil)
+}
+
+func readQuery(t *testing.T, gc *GraphCache, query string, variables map[string]interface{}) *CachedResponse {
+	astQuery, err := GetASTFromQuery(query)
+	assert.Nil(t, err)
+	return gc.ReadOperation(astQuery.Operations[0], variables)
+}
+
+// newUserFieldGraphCache is a cache where the user root field is configured to return a User
+func newUserFieldGraphCache() *GraphCache {
+	return NewGraphCacheWithOptions(context.Background(), &GraphCacheOptions{
+		ObjectStore:    cache.NewInMemoryCache(300),
+		QueryStore:     cache.NewInMemoryCache(300),
+		RootFieldTypes: map[string]string{"user": "User"},
+	})
+}
+
+const usersResponse = `{"data":{"__typename":"Query","users":[{"__typename":"User","id":"1","name":"John Doe","email":"john@example.com"},{"__typename":"User","id":"2","name":"Jane Doe","email":"jane@example.com"}]}}`
+
+func TestReadOperationFromOtherQuery(t *testing.T) {
+	gc := newUserFieldGraphCache()
+	cacheQueryResponse(t, gc, "query GetUsers { users { id name email } }", nil, usersResponse)
+
+	res := readQuery(t, gc, "query GetUser($id: ID!) { user(id: $id) { id name } }", map[string]interface{}{"id": "2"})
+	assert.True(t, res.Complete())
+	assert.Equal(t, map[string]interface{}{
+		"user": map[string]interface{}{"id": "2", "name": "Jane Doe"},
+	}, gc.deleteTypename(res.Data))
+
+	res = readQuery(t, gc, `query { jane: user(id: "2") { email } }`, nil)
+	assert.True(t, res.Complete())
+	assert.Equal(t, map[string]interface{}{
+		"jane": map[string]interface{}{"email": "jane@example.com"},
+	}, gc.deleteTypename(res.Data))
+
+	// the user is not in the cache
+	res = readQuery(t, gc, `query { user(id: "3") { id } }`, nil)
+	assert.False(t, res.Complete())
+	assert.Equal(t, []MissingField{{Path: []interface{}{"user"}, Reason: "not in cache"}}, res.Missing)
+
+	// only a root field that selects an object by its id can be served from other queries
+	res = readQuery(t, gc, `query { user(id: "1", active: true) { id } }`, nil)
+	assert.False(t, res.Complete())
+
+	// the type of a root field isn't guessed from its name
+	res = readQuery(t, gc, `query { deletedUser(id: "1") { id } }`, nil)
+	assert.False(t, res.Complete())
+	unconfigured := NewGraphCache()
+	cacheQueryResponse(t, unconfigured, "query GetUsers { users { id name email } }", nil, usersResponse)
+	res = readQuery(t, unconfigured, `query { user(id: "1") { id } }`, nil)
+	assert.False(t, res.Complete())
+}
+
+func TestReadOperationMissingFields(t *testing.T) {
+	gc := NewGraphCache()
+	cacheQueryResponse(t, gc, "query GetUsers { users { id name } }", nil, `{"data":{"__typename":"Query","users":[{"__typename":"User","id":"1","name":"John Doe"},{"__typename":"User","id":"2","name":"Jane Doe"}]}}`)
+
+	res := readQuery(t, gc, "query GetUsers { users { id name email } }", nil)
+	assert.False(t, res.Complete())
+	assert.Equal(t, []MissingField{
+		{Path: []interface{}{"users", 0, "email"}, Reason: "not in cache"},
+		{Path: []interface{}{"users", 1, "email"}, Reason: "not in cache"},
+	}, res.Missing)
+	assert.Equal(t, "users.0.email (not in cache), users.1.email (not in cache)", res.MissingFields())
+
+	// everything that was found is still in the response
+	assert.Equal(t, map[string]interface{}{
+		"users": []interface{}{
+			map[string]interface{}{"id": "1", "name": "John Doe"},
+			map[string]interface{}{"id": "2", "name": "Jane Doe"},
+		},
+	}, gc.deleteTypename(res.Data))
+
+	_, err := gc.ParseASTBuildResponse(mustParse(t, "query GetUsers { users { id name email } }"), GraphQLRequest{})
+	assert.EqualError(t, err, "fields missing from cache: users.0.email (not in cache), users.1.email (not in cache)")
+}
+
+func TestReadOperationMergesObjectsFromQueries(t *testing.T) {
+	gc := NewGraphCache()
+	cacheQueryResponse(t, gc, "query GetUsers { users { id name } }", nil, `{"data":{"__typename":"Query","users":[{"__typename":"User","id":"1","name":"John Doe"}]}}`)
+	cacheQueryResponse(t, gc, `query GetUser { user(id: "1") { id email } }`, nil, `{"data":{"__typename":"Query","user":{"__typename":"User","id":"1","email":"john@example.com"}}}`)
+
+	res := readQuery(t, gc, "query GetUsers { users { id name email } }", nil)
+	assert.True(t, res.Complete())
+	assert.Equal(t, map[string]interface{}{
+		"users": []interface{}{
+			map[string]interface{}{"id": "1", "name": "John Doe", "email": "john@example.com"},
+		},
+	}, gc.deleteTypename(res.Data))
+}
+
+func TestReadOperationRootFieldArguments(t *testing.T) {
+	gc := NewGraphCache()
+	query := "query GetUsers($limit: Int = 1) { users(limit: $limit) { id } }"
+	cacheQueryResponse(t, gc, query, nil, `{"data":{"__typename":"Query","users":[{"__typename":"User","id":"1"}]}}`)
+
+	// the default value of the variable is the same as sending it
+	res := readQuery(t, gc, query, nil)
+	assert.True(t, res.Complete())
+
+	res = readQuery(t, gc, query, map[string]interface{}{"limit": 2})
+	assert.False(t, res.Complete())
+}
+
+func TestReadOperationFragments(t *testing.T) {
+	gc := NewGraphCache()
+	query := "query Search { search { ...Named ... on Todo { id text } } } fragment Named on Node { id name }"
+	cacheQueryResponse(t, gc, query, nil, `{"data":{"__typename":"Query","search":[{"__typename":"User","id":"1","name":"John Doe"},{"__typename":"Todo","id":"10","text":"Buy milk"}]}}`)
+
+	res := readQuery(t, gc, query, nil)
+	assert.True(t, res.Complete(), res.MissingFields())
+	assert.Equal(t, map[string]interface{}{
+		"search": []interface{}{
+			map[string]interface{}{"id": "1", "name": "John Doe"},
+			map[string]interface{}{"id": "10", "text": "Buy milk"},
+		},
+	}, gc.deleteTypename(res.Data))
+
+	// nothing is known about the type condition, so we can't tell if the fragment applies
+	res = readQuery(t, gc, "query Search { search { id ... on Entity { id } } }", nil)
+	assert.False(t, res.Complete())
+	assert.Equal(t, "search.0.... on Entity (unknown type condition), search.1.... on Entity (unknown type condition)", res.MissingFields())
+}
+
+func TestReadOperationListOfEmbeddedObjects(t *testing.T) {
+	gc := NewGraphCache()
+	query := `query GetUser { user(id: "1") { id tags { name } } }`
+	cacheQueryResponse(t, gc, query, nil, `{"data":{"__typename":"Query","user":{"__typename":"User","id":"1","tags":[{"__typename":"Tag","name":"a"},{"__typename":"Tag","name":"b"}]}}}`)
+
+	// every object of the list is kept, not only the last one
+	res := readQuery(t, gc, `query GetUser { user(id: "1") { id tags { name } } }`, nil)
+	assert.True(t, res.Complete(), res.MissingFields())
+	assert.Equal(t, map[string]interface{}{
+		"user": map[string]interface{}{
+			"id": "1",
+			"tags": []interface{}{
+				map[string]interface{}{"name": "a"},
+				map[string]interface{}{"name": "b"},
+			},
+		},
+	}, gc.deleteTypename(res.Data))
+}
+
+func TestReadOperationListWithNulls(t *testing.T) {
+	gc := NewGraphCache()
+	query := `query GetUser { user(id: "1") { id scores friends { id } } scores }`
+	cacheQueryResponse(t, gc, query, nil, `{"data":{"__typename":"Query","user":{"__typename":"User","id":"1","scores":[1,null,2],"friends":[null,{"__typename":"User","id":"2"}]},"scores":[3,null,4]}}`)
+
+	res := readQuery(t, gc, query, nil)
+	assert.True(t, res.Complete(), res.MissingFields())
+	assert.Equal(t, map[string]interface{}{
+		"user": map[string]interface{}{
+			"id":      "1",
+			"scores":  []interface{}{float64(1), nil, float64(2)},
+			"friends": []interface{}{nil, map[string]interface{}{"id": "2"}},
+		},
+		"scores": []interface{}{float64(3), nil, float64(4)},
+	}, gc.deleteTypename(res.Data))
+}
+
+func TestReadOperationSkipInclude(t *testing.T) {
+	gc := NewGraphCache()
+	cacheQueryResponse(t, gc, "query GetUsers { users { id name } }", nil, `{"data":{"__typename":"Query","users":[{"__typename":"User","id":"1","name":"John Doe"}]}}`)
+
+	// the excluded fields aren't read, so they aren't missing either
+	query := "query GetUsers($withEmail: Boolean!) { users { id name @skip(if: true) email @include(if: $withEmail) ... on User @include(if: $withEmail) { phone } } }"
+	res := readQuery(t, gc, query, map[string]interface{}{"withEmail": false})
+	assert.True(t, res.Complete(), res.MissingFields())
+	assert.Equal(t, map[string]interface{}{
+		"users": []interface{}{map[string]interface{}{"id": "1"}},
+	}, gc.deleteTypename(res.Data))
+
+	res = readQuery(t, gc, query, map[string]interface{}{"withEmail": true})
+	assert.Equal(t, "users.0.email (not in cache), users.0.phone (not in cache)", res.MissingFields())
+}
+
+func TestCacheOperationSkipInclude(t *testing.T) {
+	gc := NewGraphCache()
+	// the response of a query doesn't have the fields it excludes, they aren't cached as missing
+	cacheQueryResponse(t, gc, "query GetUser($withEmail: Boolean!) { user(id: \"1\") { id name email @include(if: $withEmail) } }", map[string]interface{}{"withEmail": false}, `{"data":{"__typename":"Query","user":{"__typename":"User","id":"1","name":"John Doe"}}}`)
+
+	res := readQuery(t, gc, `query GetUser { user(id: "1") { id name } }`, nil)
+	assert.True(t, res.Complete(), res.MissingFields())
+	res = readQuery(t, gc, `query GetUser { user(id: "1") { id name email } }`, nil)
+	assert.Equal(t, "user.email (not in cache)", res.MissingFields())
+}
+
+func TestReadOperationMutation(t *testing.T) {
+	gc := NewGraphCache()
+	res := readQuery(t, gc, "mutation { createUser { id } }", nil)
+	assert.False(t, res.Complete())
+}
+
+func TestCacheIsScoped(t *testing.T) {
+	objectStore := cache.NewInMemoryCache(300)
+	queryStore := cache.NewInMemoryCache(300)
+	newScope := func(prefix string) *GraphCache {
+		return NewGraphCacheWithOptions(context.Background(), &GraphCacheOptions{ObjectStore: objectStore, QueryStore: queryStore, Prefix: prefix})
+	}
+
+	first := newScope("first")
+	second := newScope("second")
+	cacheQueryResponse(t, first, "query GetUsers { users { id name } }", nil, `{"data":{"__typename":"Query","users":[{"__typename":"User","id":"1","name":"John Doe"}]}}`)
+	cacheQueryResponse(t, second, "query GetUsers { users { id name } }", nil, `{"data":{"__typename":"Query","users":[{"__typename":"User","id":"1","name":"John Doe"}]}}`)
+
+	assert.True(t, readQuery(t, first, "query GetUsers { users { id name } }", nil).Complete())
+	assert.False(t, readQuery(t, newScope("third"), "query GetUsers { users { id name } }", nil).Complete())
+
+	// a mutation in one scope invalidates the object in every scope
+	first.InvalidateCache("data", map[string]interface{}{"__typename": "User", "id": "1"}, nil)
+	assert.False(t, readQuery(t, first, "query GetUsers { users { id name } }", nil).Complete())
+	assert.False(t, readQuery(t, second, "query GetUsers { users { id name } }", nil).Complete())
+}
+
+func mustParse(t *testing.T, query string) *ast.QueryDocument {
+	doc, err := GetASTFromQuery(query)
+	assert.Nil(t, err)
+	return doc
+}
+
+func TestReadOperationAliasedRootFields(t *testing.T) {
+	gc := NewGraphCache()
+	query := `query GetUsers { me: user(id: "1") { id name } other: user(id: "2") { id userName: name } }`
+	cacheQueryResponse(t, gc, query, nil, `{"data":{"__typename":"Query","me":{"__typename":"User","id":"1","name":"John Doe"},"other":{"__typename":"User","id":"2","userName":"Jane Doe"}}}`)
+
+	root, err := gc.queryCacheStore.Get(gc.GetQueryKey(mustParse(t, query).Operations[0], nil))
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]interface{}{
+		`user({"id":"1"})`: gc.Key("User:1"),
+		`user({"id":"2"})`: gc.Key("User:2"),
+	}, root)
+
+	res := readQuery(t, gc, query, nil)
+	assert.True(t, res.Complete(), res.MissingFields())
+	assert.Equal(t, map[string]interface{}{
+		"me":    map[string]interface{}{"id": "1", "name": "John Doe"},
+		"other": map[string]interface{}{"id": "2", "userName": "Jane Doe"},
+	}, gc.deleteTypename(res.Data))
+
+	// the fields are stored by name, so other aliases read the same data
+	res = readQuery(t, gc, `query { a: user(id: "2") { id fullName: name } b: user(id: "1") { name } }`, nil)
+	assert.True(t, res.Complete(), res.MissingFields())
+	assert.Equal(t, map[string]interface{}{
+		"a": map[string]interface{}{"id": "2", "fullName": "Jane Doe"},
+		"b": map[string]interface{}{"name": "John Doe"},
+	}, gc.deleteTypename(res.Data))
+}
+
+func TestReadOperationMultipleRootFields(t *testing.T) {
+	gc := NewGraphCache()
+	query := "query Dashboard { users { id name } totalTodos completionRate(days: 7) activityStreak7Days stats { users todos { id } } }"
+	cacheQueryResponse(t, gc, query, nil, `{"data":{"__typename":"Query","users":[{"__typename":"User","id":"1","name":"John Doe"}],"totalTodos":3,"completionRate":0.5,"activityStreak7Days":[true,false],"stats":{"__typename":"Stats","users":1,"todos":[{"__typename":"Todo","id":"10"}]}}}`)
+
+	res := readQuery(t, gc, query, nil)
+	assert.True(t, res.Complete(), res.MissingFields())
+	assert.Equal(t, map[string]interface{}{
+		"users":               []interface{}{map[string]interface{}{"id": "1", "name": "John Doe"}},
+		"totalTodos":          float64(3),
+		"completionRate":      0.5,
+		"activityStreak7Days": []interface{}{true, false},
+		"stats":               map[string]interface{}{"users": float64(1), "todos": []interface{}{map[string]interface{}{"id": "10"}}},
+	}, gc.deleteTypename(res.Data))
+
+	// root fields cached by one query are read by the others
+	res = readQuery(t, gc, "query Totals { __typename totalTodos stats { users } }", nil)
+	assert.True(t, res.Complete(), res.MissingFields())
+	assert.Equal(t, map[string]interface{}{
+		"__typename": "Query",
+		"totalTodos": float64(3),
+		"stats":      map[string]interface{}{"users": float64(1)},
+	}, res.Data)
+
+	res = readQuery(t, gc, "query Totals { totalTodos completionRate(days: 30) }", nil)
+	assert.Equal(t, "completionRate (not in cache)", res.MissingFields())
+}
+
+func TestParseASTBuildResponseOperationName(t *testing.T) {
+	gc := NewGraphCache()
+	cacheQueryResponse(t, gc, "query GetUsers { users { id name } }", nil, `{"data":{"__typename":"Query","users":[{"__typename":"User","id":"1","name":"John Doe"}]}}`)
+
+	doc := mustParse(t, "query GetTodos { todos { id } } query GetUsers { users { name } }")
+	res, err := gc.ParseASTBuildResponse(doc, GraphQLRequest{OperationName: "GetUsers"})
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]interface{}{
+		"users": []interface{}{map[string]interface{}{"name": "John Doe"}},
+	}, res)
+
+	_, err = gc.ParseASTBuildResponse(doc, GraphQLRequest{OperationName: "GetTodos"})
+	assert.NotNil(t, err)
+
+	_, err = gc.ParseASTBuildResponse(doc, GraphQLRequest{})
+	assert.EqualError(t, err, "must provide operation name if query contains multiple operations")
+}
@@ -2,16 +2,17 @@ package graphcache
 
 import (
 	"encoding/json"
-	"regexp"
-	"strings"
-)
+	"net/url"
 
-var operationNameRegex = regexp.MustCompile(`(?m)(query|mutation|subscription)\s+(\w+)\s*`)
+	"github.com/vektah/gqlparser/v2/ast"
+	"github.com/vektah/gqlparser/v2/parser"
+)
 
 type GraphQLRequest struct {
 	OperationName string                 `json:"operationName"`
 	Query         string                 `json:"query"`
 	Variables     map[string]interface{} `json:"variables"`
+	Extensions    map[string]interface{} `json:"extensions,omitempty"`
 }
 
 func (gr *GraphQLRequest) Map() map[string]interface{} {
@@ -29,12 +30,61 @@ func (gr *GraphQLRequest) Bytes() []byte {
 
 func (gr *GraphQLRequest) FromBytes(req []byte) {
 	json.Unmarshal(req, gr)
-	// if the request doesn't contain an operation name, try to extract it from the query
-	if gr.OperationName == "" && len(gr.Query) > 0 {
-		m2 := operationNameRegex.FindString(gr.Query)
-		operationNames := strings.Split(m2, " ")
-		if len(operationNames) > 1 {
-			gr.OperationName = strings.TrimSpace(operationNames[1])
+	gr.inferOperationName()
+}
+
+// FromQuery reads a request sent with GET, with the variables and extensions encoded as JSON
+func (gr *GraphQLRequest) FromQuery(values url.Values) error {
+	gr.Query = values.Get("query")
+	gr.OperationName = values.Get("operationName")
+	if variables := values.Get("variables"); variables != "" {
+		if err := json.Unmarshal([]byte(variables), &gr.Variables); err != nil {
+			return err
 		}
 	}
+	if extensions := values.Get("extensions"); extensions != "" {
+		if err := json.Unmarshal([]byte(extensions), &gr.Extensions); err != nil {
+			return err
+		}
+	}
+	gr.inferOperationName()
+	return nil
+}
+
+// PersistedQueryHash is the sha256 hash of the query of an automatic persisted query request
+func (gr *GraphQLRequest) PersistedQueryHash() (string, bool) {
+	persistedQuery, ok := gr.Extensions["persistedQuery"].(map[string]interface{})
+	if !ok {
+		return "", false
+	}
+	hash, ok := persistedQuery["sha256Hash"].(string)
+	return hash, ok && hash != ""
+}
+
+// ResolvePersistedQuery sets the query of an automatic persisted query request, without the persisted query
+// extension the origin doesn't need
+func (gr *GraphQLRequest) ResolvePersistedQuery(query string) {
+	gr.Query = query
+	extensions := make(map[string]interface{})
+	for name, value := range gr.Extensions {
+		if name != "persistedQuery" {
+			extensions[name] = value
+		}
+	}
+	gr.Extensions = extensions
+	gr.inferOperationName()
+}
+
+// inferOperationName takes the operation name from the parsed query when the request doesn't contain one,
+// a query with more than one operation has to name the one to execute, and a query that doesn't parse
+// is rejected later, so both are left without a name
+func (gr *GraphQLRequest) inferOperationName() {
+	if gr.OperationName != "" || len(gr.Query) == 0 {
+		return
+	}
+	doc, err := parser.ParseQuery(&ast.Source{Input: gr.Query})
+	if err != nil || len(doc.Operations) != 1 {
+		return
+	}
+	gr.OperationName = doc.Operations[0].Name
 }
@@ -1,6 +1,7 @@
 package graphcache
 
 import (
+	"net/url"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -45,3 +46,58 @@ func TestGraphQLRequest_FromBytes_EmptyJSON(t *testing.T) {
 	assert.Empty(t, gqlReq.Query)
 	assert.Nil(t, gqlReq.Variables)
 }
+
+func TestGraphQLRequest_FromBytes_MultipleOperations(t *testing.T) {
+	req := []byte(`{"query":"query GetUser { user { id } } mutation UpdateUser { updateUser { id } }"}`)
+	var gqlReq GraphQLRequest
+	gqlReq.FromBytes(req)
+
+	// the operation to execute can't be told from the query
+	assert.Empty(t, gqlReq.OperationName)
+}
+
+func TestGraphQLRequest_FromQuery(t *testing.T) {
+	values := url.Values{}
+	values.Set("variables", `{"id":"123"}`)
+	values.Set("extensions", `{"persistedQuery":{"version":1,"sha256Hash":"abc"}}`)
+	var gqlReq GraphQLRequest
+	assert.Nil(t, gqlReq.FromQuery(values))
+
+	assert.Empty(t, gqlReq.Query)
+	assert.Equal(t, map[string]interface{}{"id": "123"}, gqlReq.Variables)
+	hash, ok := gqlReq.PersistedQueryHash()
+	assert.True(t, ok)
+	assert.Equal(t, "abc", hash)
+
+	values.Set("variables", `{"id":`)
+	assert.NotNil(t, gqlReq.FromQuery(values))
+}
+
+func TestGraphQLRequest_ResolvePersistedQuery(t *testing.T) {
+	req := []byte(`{"extensions":{"persistedQuery":{"version":1,"sha256Hash":"abc"},"tracing":true}}`)
+	var gqlReq GraphQLRequest
+	gqlReq.FromBytes(req)
+	gqlReq.ResolvePersistedQuery("query TestQuery { id name }")
+
+	// the origin receives the query without the persisted query extension
+	assert.Equal(t, "TestQuery", gqlReq.OperationName)
+	assert.Equal(t, `{"operationName":"TestQuery","query":"query TestQuery { id name }","variables":null,"extensions":{"tracing":true}}`, string(gqlReq.Bytes()))
+	_, ok := gqlReq.PersistedQueryHash()
+	assert.False(t, ok)
+}
+
+func TestGraphQLRequest_FromBytes_OperationKeywordsInStringsAndComments(t *testing.T) {
+	req := []byte(`{"query":"# query Commented\nquery GetUser { search(text: \"query Quoted\") { id } }"}`)
+	var gqlReq GraphQLRequest
+	gqlReq.FromBytes(req)
+
+	// only the operation of the document names it
+	assert.Equal(t, "GetUser", gqlReq.OperationName)
+
+	req = []byte(`{"query":"{ search(text: \"query Quoted\") { id } }"}`)
+	gqlReq = GraphQLRequest{}
+	gqlReq.FromBytes(req)
+
+	// an anonymous operation has no name, whatever its strings contain
+	assert.Empty(t, gqlReq.OperationName)
+}
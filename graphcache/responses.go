@@ -22,3 +22,54 @@ func (gr *GraphQLResponse) Bytes() []byte {
 func (gr *GraphQLResponse) FromBytes(bytes []byte) {
 	json.Unmarshal(bytes, gr)
 }
+
+// ResponseErrors are the top level errors of a response
+func ResponseErrors(response map[string]interface{}) []interface{} {
+	errors, _ := response["errors"].([]interface{})
+	return errors
+}
+
+// RemoveErroredFields deletes the fields of the data that are null because of an error, so they are not cached
+// as null, an error nulls its field or, for a non null field, the closest nullable field of its path, a list
+// with a null item is deleted as a whole, it reports false when an error doesn't have a path in the data
+func RemoveErroredFields(response map[string]interface{}) bool {
+	data, ok := response["data"].(map[string]interface{})
+	if !ok {
+		return false
+	}
+	for _, err := range ResponseErrors(response) {
+		errMap, _ := err.(map[string]interface{})
+		path, ok := errMap["path"].([]interface{})
+		if !ok || len(path) == 0 {
+			return false
+		}
+		removeErroredField(data, path)
+	}
+	return true
+}
+
+func removeErroredField(data map[string]interface{}, path []interface{}) {
+	var value interface{} = data
+	object, field := data, ""
+	for _, segment := range path {
+		switch segment := segment.(type) {
+		case string:
+			fieldObject, ok := value.(map[string]interface{})
+			if !ok {
+				return
+			}
+			object, field = fieldObject, segment
+			value = fieldObject[segment]
+		case float64:
+			list, ok := value.([]interface{})
+			if !ok || int(segment) < 0 || int(segment) >= len(list) {
+				return
+			}
+			value = list[int(segment)]
+		}
+		if value == nil {
+			delete(object, field)
+			return
+		}
+	}
+}
@@ -58,3 +58,56 @@ func TestGraphQLResponse_FromBytes(t *testing.T) {
 		t.Errorf("expected %v, got %v", expected, gr)
 	}
 }
+
+func TestRemoveErroredFields(t *testing.T) {
+	tests := []struct {
+		name      string
+		response  string
+		data      string
+		removable bool
+	}{
+		{
+			name:      "nullable field",
+			response:  `{"data":{"user":{"id":"1","email":null},"todos":[]},"errors":[{"message":"forbidden","path":["user","email"]}]}`,
+			data:      `{"todos":[],"user":{"id":"1"}}`,
+			removable: true,
+		},
+		{
+			name:      "null bubbled to the parent",
+			response:  `{"data":{"user":null,"todos":[]},"errors":[{"message":"forbidden","path":["user","email"]}]}`,
+			data:      `{"todos":[]}`,
+			removable: true,
+		},
+		{
+			name:      "null item of a list",
+			response:  `{"data":{"user":{"id":"1","todos":[{"id":"1"},null]}},"errors":[{"message":"not found","path":["user","todos",1,"text"]}]}`,
+			data:      `{"user":{"id":"1"}}`,
+			removable: true,
+		},
+		{
+			name:      "error without a path",
+			response:  `{"data":{"user":{"id":"1"}},"errors":[{"message":"rate limited"}]}`,
+			data:      `{"user":{"id":"1"}}`,
+			removable: false,
+		},
+		{
+			name:      "no data",
+			response:  `{"data":null,"errors":[{"message":"internal error","path":["user"]}]}`,
+			data:      `null`,
+			removable: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			response := make(map[string]interface{})
+			json.Unmarshal([]byte(tt.response), &response)
+			if removable := RemoveErroredFields(response); removable != tt.removable {
+				t.Errorf("expected %v, got %v", tt.removable, removable)
+			}
+			data, _ := json.Marshal(response["data"])
+			if string(data) != tt.data {
+				t.Errorf("expected %v, got %v", tt.data, string(data))
+			}
+		})
+	}
+}
@@ -0,0 +1,122 @@
+package graphcache
+
+import (
+	"fmt"
+	"orbitgraphql/logger"
+	"regexp"
+	"strings"
+
+	"github.com/vektah/gqlparser/v2/ast"
+)
+
+const FIELD_DEPENDENTS_KEY = "__field_dependents"
+
+// KEY_TEMPLATE_PATTERN matches the placeholders of a key template, {{params.userId}} is the userId argument
+// of the mutation and {{variables.id}} the id variable of the request, nested values are reached with dots
+var KEY_TEMPLATE_PATTERN = regexp.MustCompile(`{{\s*([^{}]*?)\s*}}`)
+
+// InvalidationRule is what a mutation invalidates besides the objects it returns, for side effects
+// its response doesn't show
+type InvalidationRule struct {
+	// Types are invalidated with every object of the type
+	Types []string
+	// Keys are templates of the keys of objects (User:{{params.userId}})
+	Keys []string
+	// Fields are root query fields, invalidated with every arguments they were cached with
+	Fields []string
+}
+
+// fieldDependentsKey is the key of the set of results with the root query field
+func (gc *GraphCache) fieldDependentsKey(field string) string {
+	return gc.sharedKey(FIELD_DEPENDENTS_KEY + ":" + field)
+}
+
+// ApplyInvalidationRules invalidates what the rules of the mutation fields of the operation declare,
+// for the fields that returned a value
+func (gc *GraphCache) ApplyInvalidationRules(operation *ast.OperationDefinition, response map[string]interface{}, variables map[string]interface{}) {
+	if len(gc.invalidationRules) == 0 {
+		return
+	}
+	data, ok := response["data"].(map[string]interface{})
+	if !ok {
+		return
+	}
+	vars := operationVariables(operation, variables)
+	for _, field := range collectFields(operation.SelectionSet, "", vars) {
+		rule, ok := gc.invalidationRules[field.Name]
+		if !ok || data[fieldResponseKey(field)] == nil {
+			continue
+		}
+		params := make(map[string]interface{})
+		for _, argument := range field.Arguments {
+			if value, err := argument.Value.Value(vars); err == nil {
+				params[argument.Name] = value
+			}
+		}
+		gc.applyInvalidationRule(rule, map[string]interface{}{"params": params, "variables": vars})
+	}
+}
+
+func (gc *GraphCache) applyInvalidationRule(rule InvalidationRule, values map[string]interface{}) {
+	for _, typename := range rule.Types {
+		gc.FlushByType(typename, "")
+	}
+	for _, template := range rule.Keys {
+		typename, id, err := gc.renderKeyTemplate(template, values)
+		if err != nil {
+			// we can't tell which object to invalidate, so every object of the type is invalidated
+			logger.Warn(gc.ctx, "invalidating every object of type ", typename, ": ", err)
+			gc.FlushByType(typename, "")
+			continue
+		}
+		gc.FlushByType(typename, id)
+	}
+	for _, field := range rule.Fields {
+		gc.invalidateDependents(gc.fieldDependentsKey(field))
+	}
+}
+
+// renderKeyTemplate fills in the placeholders of a key template with the values of the mutation, a placeholder
+// that is the whole id of a type with more than one key field can be an input object with the key fields
+func (gc *GraphCache) renderKeyTemplate(template string, values map[string]interface{}) (string, string, error) {
+	typename, idTemplate, found := strings.Cut(template, ":")
+	if !found {
+		return typename, "", fmt.Errorf("key %s has no id", template)
+	}
+	if match := KEY_TEMPLATE_PATTERN.FindStringSubmatch(idTemplate); match != nil && match[0] == idTemplate {
+		if object, ok := lookupTemplateValue(values, match[1]).(map[string]interface{}); ok {
+			if id, ok := gc.ObjectID(typename, object); ok {
+				return typename, id, nil
+			}
+			return typename, "", fmt.Errorf("%s doesn't have the key fields of %s", match[1], typename)
+		}
+	}
+	var renderErr error
+	id := KEY_TEMPLATE_PATTERN.ReplaceAllStringFunc(idTemplate, func(placeholder string) string {
+		path := KEY_TEMPLATE_PATTERN.FindStringSubmatch(placeholder)[1]
+		value := lookupTemplateValue(values, path)
+		if value == nil {
+			renderErr = fmt.Errorf("%s has no value", path)
+			return ""
+		}
+		id, err := canonicalID(value)
+		if err != nil {
+			renderErr = fmt.Errorf("%s can't be used as an id: %w", path, err)
+		}
+		return id
+	})
+	return typename, id, renderErr
+}
+
+// lookupTemplateValue is the value at the dotted path, nil when there is none
+func lookupTemplateValue(values map[string]interface{}, path string) interface{} {
+	var value interface{} = values
+	for _, name := range strings.Split(path, ".") {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		value = object[name]
+	}
+	return value
+}
@@ -0,0 +1,109 @@
+package graphcache
+
+import (
+	"context"
+	"orbitgraphql/cache"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newInvalidationRulesGraphCache(rules map[string]InvalidationRule) *GraphCache {
+	return NewGraphCacheWithOptions(context.Background(), &GraphCacheOptions{
+		ObjectStore:       cache.NewInMemoryCache(300),
+		QueryStore:        cache.NewInMemoryCache(300),
+		KeyFields:         map[string][]string{"Membership": {"orgId", "userId"}},
+		InvalidationRules: rules,
+	})
+}
+
+func applyMutation(t *testing.T, gc *GraphCache, mutation string, variables map[string]interface{}, data map[string]interface{}) {
+	operation := mustParse(t, mutation).Operations[0]
+	gc.ApplyInvalidationRules(operation, map[string]interface{}{"data": data}, variables)
+}
+
+func TestInvalidationRuleKeys(t *testing.T) {
+	gc := newInvalidationRulesGraphCache(map[string]InvalidationRule{
+		"markAsDone": {Keys: []string{"User:{{params.userId}}"}},
+		"leaveOrg":   {Keys: []string{"Membership:{{ variables.membership }}"}},
+	})
+	cacheDependentQueries(t, gc)
+	cacheQueryResponse(t, gc, `query GetMembership { membership(orgId: "1", userId: "2") { orgId userId role } }`, nil, `{"data":{"__typename":"Query","membership":{"__typename":"Membership","orgId":"1","userId":"2","role":"admin"}}}`)
+
+	// the mutation changes the user without returning it
+	applyMutation(t, gc, `mutation MarkAsDone($userId: ID!) { markAsDone(id: "7", userId: $userId) }`, map[string]interface{}{"userId": 42}, map[string]interface{}{"markAsDone": true})
+	assert.Equal(t, "user (not in cache)", readQuery(t, gc, `query GetUser { user(id: "42") { id name } }`, nil).MissingFields())
+	res := readQuery(t, gc, "query GetTodos { todos { id text owner { id } } }", nil)
+	assert.True(t, res.Complete(), res.MissingFields())
+
+	applyMutation(t, gc, `mutation LeaveOrg($membership: MembershipInput!) { leaveOrg(membership: $membership) }`, map[string]interface{}{"membership": map[string]interface{}{"userId": 2, "orgId": "1"}}, map[string]interface{}{"leaveOrg": true})
+	assert.False(t, readQuery(t, gc, `query GetMembership { membership(orgId: "1", userId: "2") { orgId userId role } }`, nil).Complete())
+}
+
+func TestInvalidationRuleMissingParam(t *testing.T) {
+	gc := newInvalidationRulesGraphCache(map[string]InvalidationRule{
+		"markAsDone": {Keys: []string{"User:{{params.userId}}"}},
+	})
+	cacheDependentQueries(t, gc)
+
+	// without the user id every user is invalidated
+	applyMutation(t, gc, `mutation { markAsDone(id: "7") }`, nil, map[string]interface{}{"markAsDone": true})
+	assert.False(t, readQuery(t, gc, `query GetUser { user(id: "42") { id name } }`, nil).Complete())
+	assert.False(t, readQuery(t, gc, "query GetUsers { users { id name } }", nil).Complete())
+}
+
+func TestInvalidationRuleTypesAndFields(t *testing.T) {
+	gc := newInvalidationRulesGraphCache(map[string]InvalidationRule{
+		"deleteEverything": {Types: []string{"Todo"}, Fields: []string{"totalUsers", "users"}},
+	})
+	cacheDependentQueries(t, gc)
+	cacheQueryResponse(t, gc, "query GetStats { totalUsers }", nil, `{"data":{"__typename":"Query","totalUsers":2}}`)
+	cacheQueryResponse(t, gc, "query GetAdmins { users(role: ADMIN) { id name } }", nil, `{"data":{"__typename":"Query","users":[{"__typename":"User","id":"1","name":"John Doe"}]}}`)
+
+	// a failed mutation invalidates nothing
+	applyMutation(t, gc, `mutation { deleteEverything }`, nil, map[string]interface{}{"deleteEverything": nil})
+	res := readQuery(t, gc, "query GetStats { totalUsers }", nil)
+	assert.True(t, res.Complete(), res.MissingFields())
+
+	applyMutation(t, gc, `mutation { deleteEverything }`, nil, map[string]interface{}{"deleteEverything": true})
+	assert.Equal(t, "totalUsers (not in cache)", readQuery(t, gc, "query GetStats { totalUsers }", nil).MissingFields())
+	// the field is invalidated with every arguments
+	assert.Equal(t, "users (not in cache)", readQuery(t, gc, "query GetUsers { users { id name } }", nil).MissingFields())
+	assert.Equal(t, "users (not in cache)", readQuery(t, gc, "query GetAdmins { users(role: ADMIN) { id name } }", nil).MissingFields())
+	assert.Equal(t, "todos (not in cache)", readQuery(t, gc, "query GetTodos { todos { id text owner { id } } }", nil).MissingFields())
+	res = readQuery(t, gc, `query GetUser { user(id: "42") { id name } }`, nil)
+	assert.True(t, res.Complete(), res.MissingFields())
+
+	getStats := mustParse(t, "query GetStats { totalUsers }").Operations[0]
+	exists, _ := gc.queryCacheStore.Exists(gc.GetQueryKey(getStats, nil))
+	assert.False(t, exists)
+}
+
+func TestRenderKeyTemplate(t *testing.T) {
+	gc := newInvalidationRulesGraphCache(nil)
+	values := map[string]interface{}{
+		"params":    map[string]interface{}{"id": 1.0, "input": map[string]interface{}{"userId": "u1"}, "flag": true},
+		"variables": map[string]interface{}{"org": "acme"},
+	}
+	tests := []struct {
+		template string
+		typename string
+		id       string
+		fails    bool
+	}{
+		{"User:{{params.id}}", "User", "1", false},
+		{"User:{{params.input.userId}}", "User", "u1", false},
+		{"Org:{{variables.org}}-{{params.id}}", "Org", "acme-1", false},
+		{"User:{{params.missing}}", "User", "", true},
+		{"User:{{params.flag}}", "User", "", true},
+		{"User", "User", "", true},
+	}
+	for _, tt := range tests {
+		typename, id, err := gc.renderKeyTemplate(tt.template, values)
+		assert.Equal(t, tt.typename, typename, tt.template)
+		assert.Equal(t, tt.fails, err != nil, tt.template)
+		if !tt.fails {
+			assert.Equal(t, tt.id, id, tt.template)
+		}
+	}
+}
@@ -0,0 +1,401 @@
+package graphcache
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"orbitgraphql/logger"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vektah/gqlparser/v2"
+	"github.com/vektah/gqlparser/v2/ast"
+)
+
+// INTROSPECTION_QUERY asks the origin for everything needed to rebuild its schema as SDL.
+// Introspection has no way to return the directives applied to types and fields, so the rebuilt
+// schema has no @cacheControl, @cost or @listSize hints
+const INTROSPECTION_QUERY = `query IntrospectionQuery {
+  __schema {
+    queryType { name }
+    mutationType { name }
+    subscriptionType { name }
+    types { ...FullType }
+    directives {
+      name
+      isRepeatable
+      locations
+      args { ...InputValue }
+    }
+  }
+}
+fragment FullType on __Type {
+  kind
+  name
+  fields(includeDeprecated: true) {
+    name
+    args { ...InputValue }
+    type { ...TypeRef }
+  }
+  inputFields { ...InputValue }
+  interfaces { ...TypeRef }
+  enumValues(includeDeprecated: true) { name }
+  possibleTypes { ...TypeRef }
+}
+fragment InputValue on __InputValue {
+  name
+  type { ...TypeRef }
+  defaultValue
+}
+fragment TypeRef on __Type {
+  kind
+  name
+  ofType { kind name ofType { kind name ofType { kind name ofType { kind name ofType { kind name ofType { kind name ofType { kind name } } } } } } }
+}`
+
+// builtinScalars and builtinDirectives are part of every schema, gqlparser adds them to the schemas it loads
+var builtinScalars = map[string]bool{"Int": true, "Float": true, "String": true, "Boolean": true, "ID": true}
+var builtinDirectives = map[string]bool{"include": true, "skip": true, "deprecated": true, "specifiedBy": true, "defer": true}
+
+// Schema is the schema of the origin, loaded from a SDL file or with an introspection query
+// it can be reloaded while the proxy is running, readers always get a complete schema
+type Schema struct {
+	mu     sync.RWMutex
+	schema *ast.Schema
+	source string
+	load   func() (*ast.Schema, error)
+}
+
+// NewSchemaFromFile loads the schema from a SDL file
+func NewSchemaFromFile(path string) (*Schema, error) {
+	schema := &Schema{
+		source: path,
+		load: func() (*ast.Schema, error) {
+			return LoadSchemaFromFile(path)
+		},
+	}
+	return schema, schema.Reload()
+}
+
+// NewSchemaFromIntrospection loads the schema with an introspection query against the origin
+func NewSchemaFromIntrospection(origin string) (*Schema, error) {
+	schema := &Schema{
+		source: origin,
+		load: func() (*ast.Schema, error) {
+			return LoadSchemaFromIntrospection(context.Background(), origin)
+		},
+	}
+	return schema, schema.Reload()
+}
+
+// Get returns the current schema
+func (s *Schema) Get() *ast.Schema {
+	if s == nil {
+		return nil
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.schema
+}
+
+// Reload loads the schema again, the current schema is kept if it fails
+func (s *Schema) Reload() error {
+	schema, err := s.load()
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.schema = schema
+	s.mu.Unlock()
+	return nil
+}
+
+// ReloadEvery reloads the schema on an interval until the context is done
+func (s *Schema) ReloadEvery(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := s.Reload(); err != nil {
+					logger.Error(ctx, "error reloading schema from ", s.source, ": ", err)
+				}
+			}
+		}
+	}()
+}
+
+// LoadSchemaFromFile parses and validates the SDL in a file
+func LoadSchemaFromFile(path string) (*ast.Schema, error) {
+	sdl, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return LoadSchemaFromSDL(path, string(sdl))
+}
+
+// LoadSchemaFromSDL parses and validates a schema
+func LoadSchemaFromSDL(name string, sdl string) (*ast.Schema, error) {
+	schema, err := gqlparser.LoadSchema(&ast.Source{Name: name, Input: sdl})
+	if err != nil {
+		return nil, err
+	}
+	return schema, nil
+}
+
+// LoadSchemaFromIntrospection sends an introspection query to the origin and loads the schema from its result
+func LoadSchemaFromIntrospection(ctx context.Context, origin string) (*ast.Schema, error) {
+	request := GraphQLRequest{Query: INTROSPECTION_QUERY, OperationName: "IntrospectionQuery"}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, origin, bytes.NewReader(request.Bytes()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("introspection query failed with status %d", resp.StatusCode)
+	}
+
+	result := introspectionResult{}
+	if err := json.Unmarshal(body, &result); err != nil {
+		return nil, err
+	}
+	if len(result.Errors) > 0 {
+		return nil, fmt.Errorf("introspection query failed: %v", result.Errors[0]["message"])
+	}
+	if result.Data.Schema == nil {
+		return nil, errors.New("introspection query returned no schema")
+	}
+	return LoadSchemaFromSDL(origin, result.Data.Schema.SDL())
+}
+
+type introspectionResult struct {
+	Data struct {
+		Schema *introspectionSchema `json:"__schema"`
+	} `json:"data"`
+	Errors []map[string]interface{} `json:"errors"`
+}
+
+type introspectionSchema struct {
+	QueryType        *introspectionTypeRef    `json:"queryType"`
+	MutationType     *introspectionTypeRef    `json:"mutationType"`
+	SubscriptionType *introspectionTypeRef    `json:"subscriptionType"`
+	Types            []introspectionType      `json:"types"`
+	Directives       []introspectionDirective `json:"directives"`
+}
+
+type introspectionType struct {
+	Kind          string                    `json:"kind"`
+	Name          string                    `json:"name"`
+	Fields        []introspectionField      `json:"fields"`
+	InputFields   []introspectionInputValue `json:"inputFields"`
+	Interfaces    []introspectionTypeRef    `json:"interfaces"`
+	EnumValues    []struct{ Name string }   `json:"enumValues"`
+	PossibleTypes []introspectionTypeRef    `json:"possibleTypes"`
+}
+
+type introspectionField struct {
+	Name string                    `json:"name"`
+	Args []introspectionInputValue `json:"args"`
+	Type introspectionTypeRef      `json:"type"`
+}
+
+type introspectionInputValue struct {
+	Name         string               `json:"name"`
+	Type         introspectionTypeRef `json:"type"`
+	DefaultValue *string              `json:"defaultValue"`
+}
+
+type introspectionDirective struct {
+	Name         string                    `json:"name"`
+	IsRepeatable bool                      `json:"isRepeatable"`
+	Locations    []string                  `json:"locations"`
+	Args         []introspectionInputValue `json:"args"`
+}
+
+type introspectionTypeRef struct {
+	Kind   string                `json:"kind"`
+	Name   string                `json:"name"`
+	OfType *introspectionTypeRef `json:"ofType"`
+}
+
+func (t introspectionTypeRef) String() string {
+	switch t.Kind {
+	case "NON_NULL":
+		if t.OfType != nil {
+			return t.OfType.String() + "!"
+		}
+	case "LIST":
+		if t.OfType != nil {
+			return "[" + t.OfType.String() + "]"
+		}
+	}
+	return t.Name
+}
+
+// SDL prints the introspected schema as SDL, without the built in scalars, directives and introspection types
+func (s *introspectionSchema) SDL() string {
+	sdl := &strings.Builder{}
+
+	sdl.WriteString("schema {\n")
+	if s.QueryType != nil {
+		sdl.WriteString("  query: " + s.QueryType.Name + "\n")
+	}
+	if s.MutationType != nil {
+		sdl.WriteString("  mutation: " + s.MutationType.Name + "\n")
+	}
+	if s.SubscriptionType != nil {
+		sdl.WriteString("  subscription: " + s.SubscriptionType.Name + "\n")
+	}
+	sdl.WriteString("}\n")
+
+	for _, directive := range s.Directives {
+		if builtinDirectives[directive.Name] {
+			continue
+		}
+		sdl.WriteString("\ndirective @" + directive.Name + printInputValues(directive.Args))
+		if directive.IsRepeatable {
+			sdl.WriteString(" repeatable")
+		}
+		sdl.WriteString(" on " + strings.Join(directive.Locations, " | ") + "\n")
+	}
+
+	for _, t := range s.Types {
+		if strings.HasPrefix(t.Name, "__") || builtinScalars[t.Name] {
+			continue
+		}
+		sdl.WriteString("\n")
+		switch t.Kind {
+		case "SCALAR":
+			sdl.WriteString("scalar " + t.Name + "\n")
+		case "OBJECT", "INTERFACE":
+			if t.Kind == "OBJECT" {
+				sdl.WriteString("type " + t.Name)
+			} else {
+				sdl.WriteString("interface " + t.Name)
+			}
+			if len(t.Interfaces) > 0 {
+				interfaces := make([]string, 0)
+				for _, i := range t.Interfaces {
+					interfaces = append(interfaces, i.Name)
+				}
+				sdl.WriteString(" implements " + strings.Join(interfaces, " & "))
+			}
+			sdl.WriteString(" {\n")
+			for _, field := range t.Fields {
+				sdl.WriteString("  " + field.Name + printInputValues(field.Args) + ": " + field.Type.String() + "\n")
+			}
+			sdl.WriteString("}\n")
+		case "UNION":
+			possibleTypes := make([]string, 0)
+			for _, p := range t.PossibleTypes {
+				possibleTypes = append(possibleTypes, p.Name)
+			}
+			sdl.WriteString("union " + t.Name + " = " + strings.Join(possibleTypes, " | ") + "\n")
+		case "ENUM":
+			sdl.WriteString("enum " + t.Name + " {\n")
+			for _, value := range t.EnumValues {
+				sdl.WriteString("  " + value.Name + "\n")
+			}
+			sdl.WriteString("}\n")
+		case "INPUT_OBJECT":
+			sdl.WriteString("input " + t.Name + " {\n")
+			for _, field := range t.InputFields {
+				sdl.WriteString("  " + printInputValue(field) + "\n")
+			}
+			sdl.WriteString("}\n")
+		}
+	}
+	return sdl.String()
+}
+
+func printInputValues(values []introspectionInputValue) string {
+	if len(values) == 0 {
+		return ""
+	}
+	printed := make([]string, 0)
+	for _, value := range values {
+		printed = append(printed, printInputValue(value))
+	}
+	return "(" + strings.Join(printed, ", ") + ")"
+}
+
+func printInputValue(value introspectionInputValue) string {
+	printed := value.Name + ": " + value.Type.String()
+	if value.DefaultValue != nil {
+		printed += " = " + *value.DefaultValue
+	}
+	return printed
+}
+
+// ValidateQuery validates a document against the schema of the origin, it always passes without a schema
+func (gc *GraphCache) ValidateQuery(query string) error {
+	if gc.schema == nil {
+		return nil
+	}
+	_, errs := gqlparser.LoadQuery(gc.schema, query)
+	if len(errs) > 0 {
+		// the same code graphql servers like gqlgen and apollo use, so clients handle them alike
+		for _, err := range errs {
+			if err.Extensions == nil {
+				err.Extensions = map[string]interface{}{"code": "GRAPHQL_VALIDATION_FAILED"}
+			}
+		}
+		return errs
+	}
+	return nil
+}
+
+// schemaFragmentApplies reports if a fragment with the type condition applies to an object of the typename
+// according to the schema, and if the schema knows both types
+func schemaFragmentApplies(schema *ast.Schema, typeCondition string, typename string) (applies bool, known bool) {
+	if typeCondition == "" || typeCondition == typename {
+		return true, true
+	}
+	condition, object := schema.Types[typeCondition], schema.Types[typename]
+	if condition == nil || object == nil {
+		return false, false
+	}
+	for _, possibleType := range schema.GetPossibleTypes(condition) {
+		if possibleType.Name == typename {
+			return true, true
+		}
+	}
+	return false, true
+}
+
+// schemaRootFieldType is the object type a root field of the query type returns, it is empty for fields
+// that return lists, scalars or abstract types
+func schemaRootFieldType(schema *ast.Schema, field string) string {
+	if schema.Query == nil {
+		return ""
+	}
+	definition := schema.Query.Fields.ForName(field)
+	if definition == nil || definition.Type.Elem != nil {
+		return ""
+	}
+	if t := schema.Types[definition.Type.Name()]; t != nil && t.Kind == ast.Object {
+		return t.Name
+	}
+	return ""
+}
@@ -0,0 +1,180 @@
+package graphcache
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"orbitgraphql/cache"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vektah/gqlparser/v2/gqlerror"
+)
+
+const testSchemaFile = "testdata/schema/schema.graphql"
+
+func loadTestSchema(t *testing.T) *GraphCache {
+	schema, err := LoadSchemaFromFile(testSchemaFile)
+	assert.Nil(t, err)
+	return NewGraphCacheWithOptions(context.Background(), &GraphCacheOptions{
+		ObjectStore: cache.NewInMemoryCache(300),
+		QueryStore:  cache.NewInMemoryCache(300),
+		Schema:      schema,
+	})
+}
+
+func TestLoadSchemaFromFile(t *testing.T) {
+	schema, err := LoadSchemaFromFile(testSchemaFile)
+	assert.Nil(t, err)
+	assert.Equal(t, "Query", schema.Query.Name)
+	assert.Equal(t, "Mutation", schema.Mutation.Name)
+	assert.NotNil(t, schema.Types["SearchResult"])
+
+	_, err = LoadSchemaFromFile("testdata/schema/missing.graphql")
+	assert.NotNil(t, err)
+
+	_, err = LoadSchemaFromSDL("invalid.graphql", "type Query { user: Unknown }")
+	assert.NotNil(t, err)
+}
+
+func TestLoadSchemaFromIntrospection(t *testing.T) {
+	introspection, err := os.ReadFile("testdata/schema/introspection.json")
+	assert.Nil(t, err)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		request := GraphQLRequest{}
+		json.Unmarshal(body, &request)
+		assert.Equal(t, "IntrospectionQuery", request.OperationName)
+		w.Write(introspection)
+	}))
+	defer origin.Close()
+
+	introspected, err := LoadSchemaFromIntrospection(context.Background(), origin.URL)
+	assert.Nil(t, err)
+	expected, err := LoadSchemaFromFile(testSchemaFile)
+	assert.Nil(t, err)
+
+	// the introspected schema has the same types and fields as the SDL it was built from
+	for name, definition := range expected.Types {
+		introspectedDefinition := introspected.Types[name]
+		if !assert.NotNil(t, introspectedDefinition, name) {
+			continue
+		}
+		assert.Equal(t, definition.Kind, introspectedDefinition.Kind, name)
+		for _, field := range definition.Fields {
+			introspectedField := introspectedDefinition.Fields.ForName(field.Name)
+			if assert.NotNil(t, introspectedField, name+"."+field.Name) {
+				assert.Equal(t, field.Type.String(), introspectedField.Type.String(), name+"."+field.Name)
+				assert.Equal(t, len(field.Arguments), len(introspectedField.Arguments), name+"."+field.Name)
+			}
+		}
+	}
+	assert.NotNil(t, introspected.Directives["cacheControl"])
+	assert.Equal(t, "Mutation", introspected.Mutation.Name)
+	assert.Nil(t, introspected.Subscription)
+}
+
+func TestLoadSchemaFromIntrospectionErrors(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"data":null,"errors":[{"message":"introspection is disabled"}]}`))
+	}))
+	defer origin.Close()
+
+	_, err := LoadSchemaFromIntrospection(context.Background(), origin.URL)
+	assert.EqualError(t, err, "introspection query failed: introspection is disabled")
+}
+
+func TestSchemaReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "schema.graphql")
+	os.WriteFile(path, []byte("type Query { user: String }"), 0644)
+
+	schema, err := NewSchemaFromFile(path)
+	assert.Nil(t, err)
+	assert.NotNil(t, schema.Get().Query.Fields.ForName("user"))
+
+	os.WriteFile(path, []byte("type Query { todo: String }"), 0644)
+	assert.Nil(t, schema.Reload())
+	assert.Nil(t, schema.Get().Query.Fields.ForName("user"))
+	assert.NotNil(t, schema.Get().Query.Fields.ForName("todo"))
+
+	// an invalid schema keeps the last one that loaded
+	os.WriteFile(path, []byte("type Query { todo: Unknown }"), 0644)
+	assert.NotNil(t, schema.Reload())
+	assert.NotNil(t, schema.Get().Query.Fields.ForName("todo"))
+
+	var noSchema *Schema
+	assert.Nil(t, noSchema.Get())
+}
+
+func TestValidateQuery(t *testing.T) {
+	gc := loadTestSchema(t)
+	assert.Nil(t, gc.ValidateQuery(`query GetUser($id: ID!) { user(id: $id) { id name ... on Node { id } } }`))
+
+	err := gc.ValidateQuery(`query GetUser { user(id: "1") { id email } }`)
+	var errs gqlerror.List
+	assert.ErrorAs(t, err, &errs)
+	assert.Len(t, errs, 1)
+	assert.Equal(t, `Cannot query field "email" on type "User".`, errs[0].Message)
+
+	// without a schema every document passes
+	assert.Nil(t, NewGraphCache().ValidateQuery(`query GetUser { user(id: "1") { id email } }`))
+}
+
+func TestSchemaFragmentApplies(t *testing.T) {
+	schema, err := LoadSchemaFromFile(testSchemaFile)
+	assert.Nil(t, err)
+
+	tests := []struct {
+		typeCondition string
+		typename      string
+		applies       bool
+		known         bool
+	}{
+		{"", "User", true, true},
+		{"User", "User", true, true},
+		{"Todo", "User", false, true},
+		{"Node", "User", true, true},
+		{"Node", "Todo", true, true},
+		{"SearchResult", "Todo", true, true},
+		{"Organisation", "User", false, false},
+		{"Node", "", false, false},
+	}
+	for _, tt := range tests {
+		applies, known := schemaFragmentApplies(schema, tt.typeCondition, tt.typename)
+		assert.Equal(t, tt.applies, applies, tt.typeCondition+" on "+tt.typename)
+		assert.Equal(t, tt.known, known, tt.typeCondition+" on "+tt.typename)
+	}
+}
+
+func TestSchemaRootFieldType(t *testing.T) {
+	schema, err := LoadSchemaFromFile(testSchemaFile)
+	assert.Nil(t, err)
+
+	assert.Equal(t, "User", schemaRootFieldType(schema, "user"))
+	assert.Equal(t, "", schemaRootFieldType(schema, "users"))
+	assert.Equal(t, "", schemaRootFieldType(schema, "node"))
+	assert.Equal(t, "", schemaRootFieldType(schema, "search"))
+	assert.Equal(t, "", schemaRootFieldType(schema, "organisation"))
+}
+
+func TestReadOperationWithSchema(t *testing.T) {
+	query := `query GetUser($id: ID!) { user(id: $id) { ... on Node { id } name } }`
+	variables := map[string]interface{}{"id": "1"}
+	response := `{"data":{"__typename":"Query","users":[{"__typename":"User","id":"1","name":"John Doe"}]}}`
+
+	// without a schema we can't tell if the fragment on Node applies to a User
+	gc := NewGraphCache()
+	cacheQueryResponse(t, gc, "query GetUsers { users { id name } }", nil, response)
+	cached := readQuery(t, gc, query, variables)
+	assert.False(t, cached.Complete())
+
+	gc = loadTestSchema(t)
+	cacheQueryResponse(t, gc, "query GetUsers { users { id name } }", nil, response)
+	cached = readQuery(t, gc, query, variables)
+	assert.True(t, cached.Complete(), cached.MissingFields())
+	assert.Equal(t, map[string]interface{}{"id": "1", "name": "John Doe"}, gc.deleteTypename(cached.Data["user"]))
+}
@@ -0,0 +1,237 @@
+package graphcache
+
+import (
+	"orbitgraphql/utils"
+	"strings"
+
+	"github.com/vektah/gqlparser/v2/ast"
+)
+
+// scopes of the cached fields, public fields are cached once for every scope, private fields in the scope
+// of the request, fields are private unless their type or the field is configured as public
+const SCOPE_PUBLIC = "public"
+const SCOPE_PRIVATE = "private"
+
+// PUBLIC_PREFIX is the prefix of the keys of public fields, a scope prefix is base64 padded to a multiple
+// of 4 characters so it can't be the same
+const PUBLIC_PREFIX = "public"
+
+// publicKey is the key of the public fields of a cached object
+func (gc *GraphCache) publicKey(key string) string {
+	return DEFAULT_CACHE_PREFIX + PUBLIC_PREFIX + "::" + key
+}
+
+// scopeKey is the key of the fields of a cached object in the scope
+func (gc *GraphCache) scopeKey(key string, scope string) string {
+	if scope == SCOPE_PUBLIC {
+		return gc.publicKey(key)
+	}
+	return gc.Key(key)
+}
+
+// referenceCacheKey is the key of the object a reference is for, without its scope
+func referenceCacheKey(reference string) string {
+	_, cacheKey, _ := strings.Cut(strings.TrimPrefix(reference, DEFAULT_CACHE_PREFIX), "::")
+	return cacheKey
+}
+
+// hasScopes reports if any type or field can be public, without them everything is cached in the scope of the request
+func (gc *GraphCache) hasScopes() bool {
+	return len(gc.scopes) > 0 || gc.schema != nil
+}
+
+// typeScope is the scope of the objects of a type, from the configuration or the @cacheControl directive
+// of the type in the schema
+func (gc *GraphCache) typeScope(typename string) (string, bool) {
+	if scope, ok := gc.scopes[typename]; ok {
+		return scope, true
+	}
+	if gc.schema != nil && gc.schema.Types[typename] != nil {
+		return directiveScope(gc.schema.Types[typename].Directives)
+	}
+	return "", false
+}
+
+// fieldScope is the scope of a field of an object of the type, a field without its own scope that returns
+// objects has the scope of their type, and the other fields the scope of the object they belong to
+func (gc *GraphCache) fieldScope(typename string, field string, valueTypename string, objectScope string) string {
+	if scope, ok := gc.scopes[typename+"."+field]; ok {
+		return scope
+	}
+	if gc.schema != nil && gc.schema.Types[typename] != nil {
+		if definition := gc.schema.Types[typename].Fields.ForName(field); definition != nil {
+			if scope, ok := directiveScope(definition.Directives); ok {
+				return scope
+			}
+		}
+	}
+	if scope, ok := gc.typeScope(valueTypename); ok && valueTypename != "" {
+		return scope
+	}
+	return objectScope
+}
+
+func directiveScope(directives ast.DirectiveList) (string, bool) {
+	directive := directives.ForName(CACHE_CONTROL_DIRECTIVE)
+	if directive == nil || directive.Arguments.ForName("scope") == nil {
+		return "", false
+	}
+	scope, err := directive.Arguments.ForName("scope").Value.Value(nil)
+	if value, ok := scope.(string); err == nil && ok {
+		switch strings.ToLower(value) {
+		case SCOPE_PUBLIC:
+			return SCOPE_PUBLIC, true
+		case SCOPE_PRIVATE:
+			return SCOPE_PRIVATE, true
+		}
+	}
+	return "", false
+}
+
+// objectScope is the scope of an object of the response, the scope of its type, or for an object without
+// identity the scope of the field it is in, the other objects and the root object are private by default
+func (gc *GraphCache) objectScope(field string, object map[string]interface{}, parent map[string]interface{}, parentScope string) string {
+	typename, _ := object[TYPENAME_FIELD].(string)
+	if scope, ok := gc.typeScope(typename); ok && typename != "" {
+		return scope
+	}
+	if _, identified := gc.objectKey(object); identified || parent == nil {
+		return SCOPE_PRIVATE
+	}
+	parentTypename, ok := parent[TYPENAME_FIELD].(string)
+	if !ok {
+		return SCOPE_PRIVATE
+	}
+	return gc.fieldScope(parentTypename, storageKeyFieldName(field), typename, parentScope)
+}
+
+// fieldScopes is the scope of every field of an object of the response, by storage key, they are made before
+// the objects in the fields are replaced by references to them
+func (gc *GraphCache) fieldScopes(object map[string]interface{}, objectScope string) map[string]string {
+	scopes := make(map[string]string)
+	if !gc.hasScopes() {
+		return scopes
+	}
+	typename, ok := object[TYPENAME_FIELD].(string)
+	if !ok {
+		typename = "Query"
+	}
+	for key, value := range object {
+		if key == TYPENAME_FIELD || key == EXPIRES_FIELD {
+			continue
+		}
+		scopes[key] = gc.fieldScope(typename, storageKeyFieldName(key), responseTypename(value), objectScope)
+	}
+	return scopes
+}
+
+// storeObject caches the fields of an object in their scope, the public fields once for every scope and
+// the private fields in the scope of the request, and returns the reference to the object in its own scope
+// a public field with a reference to a private object is private, so no scope reads the objects of another
+func (gc *GraphCache) storeObject(cacheKey string, object map[string]interface{}, scope string, scopes map[string]string) string {
+	if !gc.hasScopes() {
+		gc.mergeObject(gc.Key(cacheKey), object)
+		return gc.Key(cacheKey)
+	}
+	if scopes == nil {
+		scopes = gc.fieldScopes(object, scope)
+	}
+	typename, _ := object[TYPENAME_FIELD].(string)
+	expiries, _ := object[EXPIRES_FIELD].(map[string]interface{})
+	parts := map[string]map[string]interface{}{SCOPE_PUBLIC: {}, SCOPE_PRIVATE: {}}
+	fields := map[string]int{}
+	for key, value := range object {
+		if key == EXPIRES_FIELD {
+			continue
+		}
+		// both parts are identified like the object
+		if key == TYPENAME_FIELD || utils.StringArrayContainsString(gc.keyFields(typename), key) {
+			parts[SCOPE_PUBLIC][key] = value
+			parts[SCOPE_PRIVATE][key] = value
+			continue
+		}
+		fieldScope := scopes[key]
+		if fieldScope != SCOPE_PUBLIC || hasPrivateReference(value) {
+			fieldScope = SCOPE_PRIVATE
+		}
+		parts[fieldScope][key] = value
+		fields[fieldScope]++
+		if expiresAt, ok := expiries[key]; ok {
+			partExpiries, _ := parts[fieldScope][EXPIRES_FIELD].(map[string]interface{})
+			if partExpiries == nil {
+				partExpiries = make(map[string]interface{})
+				parts[fieldScope][EXPIRES_FIELD] = partExpiries
+			}
+			partExpiries[key] = expiresAt
+		}
+	}
+	// the part of the scope of the object is always cached, the reference to the object is to it
+	for partScope, part := range parts {
+		if fields[partScope] > 0 || partScope == scope {
+			gc.mergeObject(gc.scopeKey(cacheKey, partScope), part)
+		}
+	}
+	return gc.scopeKey(cacheKey, scope)
+}
+
+// hasPrivateReference reports if a value has a reference to an object cached in the scope of the request
+func hasPrivateReference(value interface{}) bool {
+	switch value := value.(type) {
+	case string:
+		return strings.HasPrefix(value, DEFAULT_CACHE_PREFIX) && !strings.HasPrefix(value, DEFAULT_CACHE_PREFIX+PUBLIC_PREFIX+"::")
+	case []interface{}:
+		for _, item := range value {
+			if hasPrivateReference(item) {
+				return true
+			}
+		}
+	case map[string]interface{}:
+		for _, field := range value {
+			if hasPrivateReference(field) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// cachedObject reads the object with the key, with its public and private fields, the private fields of
+// the request's scope take precedence
+func (gc *GraphCache) cachedObject(cacheKey string) (map[string]interface{}, bool) {
+	if !gc.hasScopes() {
+		object, err := gc.cacheStore.Get(gc.Key(cacheKey))
+		objectMap, ok := object.(map[string]interface{})
+		return objectMap, err == nil && ok
+	}
+	merged, found := make(map[string]interface{}), false
+	for _, key := range []string{gc.publicKey(cacheKey), gc.Key(cacheKey)} {
+		object, err := gc.cacheStore.Get(key)
+		objectMap, ok := object.(map[string]interface{})
+		if err != nil || !ok {
+			continue
+		}
+		found = true
+		for field, value := range objectMap {
+			if field == EXPIRES_FIELD {
+				merged[field] = mergeResponseValues(merged[field], value)
+				continue
+			}
+			merged[field] = value
+		}
+	}
+	return merged, found
+}
+
+// objectCached reports if any part of the object with the key is cached
+func (gc *GraphCache) objectCached(cacheKey string) bool {
+	keys := []string{gc.Key(cacheKey)}
+	if gc.hasScopes() {
+		keys = append(keys, gc.publicKey(cacheKey))
+	}
+	for _, key := range keys {
+		if exists, err := gc.cacheStore.Exists(key); err == nil && exists {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,130 @@
+package graphcache
+
+import (
+	"context"
+	"orbitgraphql/cache"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newScopedGraphCaches are caches of two scopes sharing the same stores
+func newScopedGraphCaches(scopes map[string]string, sdl string, t *testing.T) (*GraphCache, *GraphCache) {
+	objectStore := cache.NewInMemoryCache(300)
+	queryStore := cache.NewInMemoryCache(300)
+	caches := make([]*GraphCache, 0)
+	for _, prefix := range []string{"c2NvcGVB", "c2NvcGVC"} {
+		opts := &GraphCacheOptions{ObjectStore: objectStore, QueryStore: queryStore, Prefix: prefix, Scopes: scopes}
+		if sdl != "" {
+			schema, err := LoadSchemaFromSDL("schema.graphql", sdl)
+			assert.Nil(t, err)
+			opts.Schema = schema
+		}
+		caches = append(caches, NewGraphCacheWithOptions(context.Background(), opts))
+	}
+	return caches[0], caches[1]
+}
+
+const productsResponse = `{"data":{"__typename":"Query","products":[{"__typename":"Product","id":"1","name":"Chair","price":10,"viewerRating":5}],"me":{"__typename":"User","id":"1","name":"John Doe"}}}`
+
+func TestScopesPublicObjectsAreShared(t *testing.T) {
+	gcA, gcB := newScopedGraphCaches(map[string]string{"Product": SCOPE_PUBLIC, "Product.viewerRating": SCOPE_PRIVATE}, "", t)
+	cacheQueryResponse(t, gcA, "query GetProducts { products { id name price viewerRating } me { id name } }", nil, productsResponse)
+
+	// the public fields are cached once, the private ones in the scope
+	public, err := gcA.cacheStore.Get(gcA.publicKey("Product:1"))
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]interface{}{"__typename": "Product", "id": "1", "name": "Chair", "price": float64(10)}, public)
+	private, err := gcA.cacheStore.Get(gcA.Key("Product:1"))
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]interface{}{"__typename": "Product", "id": "1", "viewerRating": float64(5)}, private)
+	exists, _ := gcA.cacheStore.Exists(gcA.publicKey("User:1"))
+	assert.False(t, exists)
+
+	// another scope reads the public fields, and only them
+	response := readQuery(t, gcB, "query { products { id name price } }", nil)
+	assert.True(t, response.Complete(), response.MissingFields())
+	assert.Equal(t, map[string]interface{}{"products": []interface{}{map[string]interface{}{"id": "1", "name": "Chair", "price": float64(10)}}}, response.Data)
+	response = readQuery(t, gcB, "query { products { id viewerRating } }", nil)
+	assert.Equal(t, "products.0.viewerRating (not in cache)", response.MissingFields())
+	response = readQuery(t, gcB, "query { me { id name } }", nil)
+	assert.Equal(t, "me (not in cache)", response.MissingFields())
+
+	// a query mixing both is read from the public and the private fields
+	response = readQuery(t, gcA, "query { products { name viewerRating } me { name } }", nil)
+	assert.True(t, response.Complete(), response.MissingFields())
+	assert.Equal(t, map[string]interface{}{
+		"products": []interface{}{map[string]interface{}{"name": "Chair", "viewerRating": float64(5)}},
+		"me":       map[string]interface{}{"name": "John Doe"},
+	}, response.Data)
+}
+
+func TestScopesPublicFieldWithPrivateObject(t *testing.T) {
+	gcA, gcB := newScopedGraphCaches(map[string]string{"Product": SCOPE_PUBLIC}, "", t)
+	cacheQueryResponse(t, gcA, "query { product(id: \"1\") { id name seller { id name } } }", nil,
+		`{"data":{"__typename":"Query","product":{"__typename":"Product","id":"1","name":"Chair","seller":{"__typename":"User","id":"7","name":"John Doe"}}}}`)
+
+	// the seller is private, so the field referring to it is too
+	response := readQuery(t, gcB, "query { product(id: \"1\") { name } }", nil)
+	assert.True(t, response.Complete(), response.MissingFields())
+	response = readQuery(t, gcB, "query { product(id: \"1\") { seller { name } } }", nil)
+	assert.Equal(t, "product.seller (not in cache)", response.MissingFields())
+	response = readQuery(t, gcA, "query { product(id: \"1\") { seller { name } } }", nil)
+	assert.True(t, response.Complete(), response.MissingFields())
+}
+
+func TestScopesFromSchema(t *testing.T) {
+	sdl := `
+directive @cacheControl(maxAge: Int, scope: CacheControlScope) on FIELD_DEFINITION | OBJECT | INTERFACE | UNION
+
+enum CacheControlScope {
+  PUBLIC
+  PRIVATE
+}
+
+type Product @cacheControl(scope: PUBLIC) {
+  id: ID!
+  name: String!
+  dimensions: Dimensions
+  viewerRating: Int @cacheControl(scope: PRIVATE)
+}
+
+type Dimensions {
+  width: Int
+}
+
+type Query {
+  products: [Product!]!
+}
+`
+	gc, _ := newScopedGraphCaches(nil, sdl, t)
+	scope, ok := gc.typeScope("Product")
+	assert.True(t, ok)
+	assert.Equal(t, SCOPE_PUBLIC, scope)
+	assert.Equal(t, SCOPE_PRIVATE, gc.fieldScope("Product", "viewerRating", "", SCOPE_PUBLIC))
+	assert.Equal(t, SCOPE_PUBLIC, gc.fieldScope("Query", "products", "Product", SCOPE_PRIVATE))
+	assert.Equal(t, SCOPE_PRIVATE, gc.fieldScope("Query", "totalUsers", "", SCOPE_PRIVATE))
+
+	// objects without identity have the scope of the field they are in
+	cacheQueryResponse(t, gc, "query { products { id dimensions { width } } }", nil,
+		`{"data":{"__typename":"Query","products":[{"__typename":"Product","id":"1","dimensions":{"__typename":"Dimensions","width":40}}]}}`)
+	exists, _ := gc.cacheStore.Exists(gc.publicKey("Product:1:dimensions"))
+	assert.True(t, exists)
+}
+
+func TestScopesInvalidation(t *testing.T) {
+	gcA, gcB := newScopedGraphCaches(map[string]string{"Product": SCOPE_PUBLIC}, "", t)
+	cacheQueryResponse(t, gcA, "query GetProducts { products { id name } }", nil, `{"data":{"__typename":"Query","products":[{"__typename":"Product","id":"1","name":"Chair"}]}}`)
+	response := readQuery(t, gcB, "query GetProducts { products { id name } }", nil)
+	assert.True(t, response.Complete(), response.MissingFields())
+
+	// the public fields are invalidated for every scope
+	gcB.FlushByType("Product", "1")
+	exists, _ := gcA.cacheStore.Exists(gcA.publicKey("Product:1"))
+	assert.False(t, exists)
+	root, err := gcA.cacheStore.Get(gcA.publicKey(ROOT_QUERY_KEY))
+	assert.Nil(t, err)
+	assert.NotContains(t, root, "products")
+	response = readQuery(t, gcA, "query GetProducts { products { id name } }", nil)
+	assert.False(t, response.Complete())
+}
@@ -0,0 +1,59 @@
+package graphcache
+
+import (
+	"time"
+
+	"github.com/vektah/gqlparser/v2/ast"
+)
+
+// STALE_KEY_SUFFIX is the suffix of the key of the response of an operation kept to be served after it expires
+const STALE_KEY_SUFFIX = "::stale"
+
+// StaleResponse is the last response of an operation, kept after it expires
+type StaleResponse struct {
+	Data map[string]interface{}
+	// ExpiredFor is how long ago the response expired, it is negative while the response is fresh
+	ExpiredFor time.Duration
+}
+
+func (gc *GraphCache) staleKey(queryDoc *ast.OperationDefinition, variables map[string]interface{}) string {
+	return gc.GetQueryKey(queryDoc, variables) + STALE_KEY_SUFFIX
+}
+
+// CacheStaleResponse keeps the response of the operation for the window after it expires, the response
+// expires with the cached response of the operation, it has to be cached first
+func (gc *GraphCache) CacheStaleResponse(queryDoc *ast.OperationDefinition, response map[string]interface{}, variables map[string]interface{}, window time.Duration) {
+	data, ok := response["data"].(map[string]interface{})
+	if !ok {
+		return
+	}
+	// the cached response is gone already when it has a max age of 0
+	fresh, err := gc.queryCacheStore.TTL(gc.GetQueryKey(queryDoc, variables))
+	if err != nil {
+		fresh = 0
+	}
+	expiresAt := time.Now().Add(fresh)
+	gc.queryCacheStore.SetWithTTL(gc.staleKey(queryDoc, variables), map[string]interface{}{
+		"data":      data,
+		"expiresAt": float64(expiresAt.UnixNano()) / float64(time.Second),
+	}, fresh+window)
+}
+
+// ReadStaleResponse is the response kept for the operation, it isn't found when the operation was invalidated
+// or the window it was kept for is over
+func (gc *GraphCache) ReadStaleResponse(queryDoc *ast.OperationDefinition, variables map[string]interface{}) (*StaleResponse, bool) {
+	cached, err := gc.queryCacheStore.Get(gc.staleKey(queryDoc, variables))
+	cachedMap, ok := cached.(map[string]interface{})
+	if err != nil || !ok {
+		return nil, false
+	}
+	data, ok := cachedMap["data"].(map[string]interface{})
+	expiresAt, expires := cachedMap["expiresAt"].(float64)
+	if !ok || !expires {
+		return nil, false
+	}
+	return &StaleResponse{
+		Data:       data,
+		ExpiredFor: time.Since(time.Unix(0, int64(expiresAt*float64(time.Second)))),
+	}, true
+}
@@ -0,0 +1,54 @@
+package graphcache
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func cacheStaleQueryResponse(t *testing.T, gc *GraphCache, query string, responseJSON string, window time.Duration) {
+	cacheQueryResponse(t, gc, query, nil, responseJSON)
+	response := map[string]interface{}{}
+	assert.Nil(t, json.Unmarshal([]byte(responseJSON), &response))
+	gc.CacheStaleResponse(mustParse(t, query).Operations[0], response, nil, window)
+}
+
+func TestReadStaleResponse(t *testing.T) {
+	gc := newPoliciesGraphCache(t, map[string]int{"User": 0}, "")
+	query := `query GetUser { user(id: "1") { id name } }`
+	cacheStaleQueryResponse(t, gc, query, `{"data":{"__typename":"Query","user":{"__typename":"User","id":"1","name":"John Doe"}}}`, time.Minute)
+
+	assert.False(t, readQuery(t, gc, query, nil).Complete())
+	stale, ok := gc.ReadStaleResponse(mustParse(t, query).Operations[0], nil)
+	assert.True(t, ok)
+	assert.Equal(t, "John Doe", stale.Data["user"].(map[string]interface{})["name"])
+	assert.GreaterOrEqual(t, stale.ExpiredFor, time.Duration(0))
+
+	// the response is kept for the window after it expires
+	ttl, err := gc.queryCacheStore.TTL(gc.staleKey(mustParse(t, query).Operations[0], nil))
+	assert.Nil(t, err)
+	assert.InDelta(t, 60, ttl.Seconds(), 1)
+}
+
+func TestStaleResponseBeforeExpiry(t *testing.T) {
+	gc := newPoliciesGraphCache(t, map[string]int{"User": 120}, "")
+	query := `query GetUser { user(id: "1") { id name } }`
+	cacheStaleQueryResponse(t, gc, query, `{"data":{"__typename":"Query","user":{"__typename":"User","id":"1","name":"John Doe"}}}`, time.Minute)
+
+	stale, ok := gc.ReadStaleResponse(mustParse(t, query).Operations[0], nil)
+	assert.True(t, ok)
+	assert.InDelta(t, -120, stale.ExpiredFor.Seconds(), 1)
+}
+
+func TestInvalidationDeletesStaleResponse(t *testing.T) {
+	gc := newPoliciesGraphCache(t, map[string]int{"User": 0}, "")
+	query := `query GetUser { user(id: "1") { id name } }`
+	cacheStaleQueryResponse(t, gc, query, `{"data":{"__typename":"Query","user":{"__typename":"User","id":"1","name":"John Doe"}}}`, time.Minute)
+
+	// an invalidated response isn't served stale
+	gc.FlushByType("User", "1")
+	_, ok := gc.ReadStaleResponse(mustParse(t, query).Operations[0], nil)
+	assert.False(t, ok)
+}
@@ -1,9 +1,11 @@
 package graphcache
 
 import (
+	"bytes"
 	"strings"
 
-	"github.com/vektah/gqlparser/ast"
+	"github.com/vektah/gqlparser/v2/ast"
+	"github.com/vektah/gqlparser/v2/formatter"
 )
 
 func AddTypenameToQuery(query string) (string, error) {
@@ -17,95 +19,106 @@ func AddTypenameToQuery(query string) (string, error) {
 	for _, operation := range astQuery.Operations {
 		operation.SelectionSet = processSelectionSet(operation.SelectionSet)
 	}
+	for _, fragment := range astQuery.Fragments {
+		fragment.SelectionSet = processSelectionSet(fragment.SelectionSet)
+	}
 
-	modifiedQuery := ""
+	return printQueryDocument(astQuery), nil
+}
 
-	for _, operation := range astQuery.Operations {
-		modifiedQuery += string(operation.Operation) + " "
-		if operation.Name != "" {
-			modifiedQuery += operation.Name
-		}
-		if len(operation.VariableDefinitions) > 0 {
-			modifiedQuery += "("
-			for i, variable := range operation.VariableDefinitions {
-				if i > 0 {
-					modifiedQuery += ", "
-				}
-				modifiedQuery += "$" + variable.Variable + ": " + variable.Type.Name()
-				if variable.Type.NonNull {
-					modifiedQuery += "!"
-				}
-			}
-			modifiedQuery += ") "
-		}
-		// modifiedQuery += " "
+// printQueryDocument prints a query document on a single line with gqlparser's formatter
+// the formatter prints every operation and fragment with their aliases, arguments, directives
+// and variable definitions (including list types and default values) as they were parsed,
+// except for the directives of variable definitions, the operations with any are printed with printOperation
+func printQueryDocument(doc *ast.QueryDocument) string {
+	definitions := make([]string, 0, len(doc.Operations)+1)
+	for _, operation := range doc.Operations {
+		definitions = append(definitions, printOperation(operation))
+	}
+	if len(doc.Fragments) > 0 {
+		definitions = append(definitions, formatQueryDocument(&ast.QueryDocument{Fragments: doc.Fragments}))
+	}
+	return strings.Join(definitions, " ")
+}
 
-		modifiedQuery += convertSelectionSetToString(operation.SelectionSet)
+// printOperation prints an operation, the formatter leaves out the directives of its variable definitions
+// so they are printed after its name, and the formatter prints the rest of the operation
+func printOperation(operation *ast.OperationDefinition) string {
+	directives := false
+	for _, definition := range operation.VariableDefinitions {
+		directives = directives || len(definition.Directives) > 0
+	}
+	if !directives {
+		return formatQueryDocument(&ast.QueryDocument{Operations: ast.OperationList{operation}})
 	}
 
-	return modifiedQuery, nil
+	withoutVariables := *operation
+	withoutVariables.VariableDefinitions = nil
+	printed := formatQueryDocument(&ast.QueryDocument{Operations: ast.OperationList{&withoutVariables}})
+	header := string(operation.Operation)
+	if operation.Name != "" {
+		header += " " + operation.Name
+	}
+	variables := make([]string, 0, len(operation.VariableDefinitions))
+	for _, definition := range operation.VariableDefinitions {
+		variable := "$" + definition.Variable + ": " + definition.Type.String()
+		if definition.DefaultValue != nil {
+			variable += " = " + definition.DefaultValue.String()
+		}
+		variables = append(variables, variable+printDirectives(definition.Directives))
+	}
+	return header + " (" + strings.Join(variables, ", ") + ")" + strings.TrimPrefix(printed, header)
 }
 
-func convertSelectionSetToString(selectionSet ast.SelectionSet) string {
-	var builder []string
-	for _, selection := range selectionSet {
-		switch selection := selection.(type) {
-		case *ast.Field:
-			field := []string{}
-			field = append(field, selection.Name)
-			if len(selection.Arguments) > 0 {
-				args := []string{}
-				args = append(args, "(")
-				for i, arg := range selection.Arguments {
-					if i > 0 {
-						args = append(args, ", ")
-					}
-					args = append(args, arg.Name)
-					args = append(args, ": ")
-					args = append(args, arg.Value.String())
-				}
-				args = append(args, ")")
-				field = append(field, strings.Join(args, ""))
-			}
-			builder = append(builder, strings.Join(field, ""))
-			if len(selection.SelectionSet) > 0 {
-				builder = append(builder, convertSelectionSetToString(selection.SelectionSet))
-			}
-		case *ast.InlineFragment:
-			builder = append(builder, "...")
-			if len(selection.SelectionSet) > 0 {
-				builder = append(builder, convertSelectionSetToString(selection.SelectionSet))
-			}
-		case *ast.FragmentSpread:
-			// Handle fragment spreads if necessary
+func printDirectives(directives ast.DirectiveList) string {
+	printed := ""
+	for _, directive := range directives {
+		printed += " @" + directive.Name
+		if len(directive.Arguments) == 0 {
+			continue
 		}
+		arguments := make([]string, 0, len(directive.Arguments))
+		for _, argument := range directive.Arguments {
+			arguments = append(arguments, argument.Name+": "+argument.Value.String())
+		}
+		printed += "(" + strings.Join(arguments, ", ") + ")"
 	}
-	if len(builder) > 0 {
-		block := []string{}
-		block = append(block, "{")
-		block = append(block, builder...)
-		block = append(block, "}")
-		return strings.Join(block, " ")
-	}
-	return ""
+	return printed
+}
+
+func formatQueryDocument(doc *ast.QueryDocument) string {
+	var buf bytes.Buffer
+	formatter.NewFormatter(&buf, formatter.WithIndent("")).FormatQueryDocument(doc)
+	// string values are always printed quoted with their line breaks escaped,
+	// so every line break in the output is between two tokens and can be replaced with a space
+	return strings.TrimSpace(strings.ReplaceAll(buf.String(), "\n", " "))
 }
 
 func processSelectionSet(selectionSet ast.SelectionSet) ast.SelectionSet {
 	updatedSelectionSets := make(ast.SelectionSet, 0)
 	for _, selection := range selectionSet {
-		if field, ok := selection.(*ast.Field); ok {
+		switch selection := selection.(type) {
+		case *ast.Field:
 			// Process the field
-			if len(field.SelectionSet) > 0 {
-				field.SelectionSet = processSelectionSet(field.SelectionSet)
+			if len(selection.SelectionSet) > 0 {
+				selection.SelectionSet = processSelectionSet(selection.SelectionSet)
 			}
-			updatedSelectionSets = append(updatedSelectionSets, field)
+			updatedSelectionSets = append(updatedSelectionSets, selection)
+		case *ast.InlineFragment:
+			// the enclosing selection set gets the __typename, so the fragment only needs its fields processed
+			selection.SelectionSet = processInlineFragmentSelectionSet(selection.SelectionSet)
+			updatedSelectionSets = append(updatedSelectionSets, selection)
+		case *ast.FragmentSpread:
+			// fragment definitions are processed on their own in AddTypenameToQuery
+			updatedSelectionSets = append(updatedSelectionSets, selection)
 		}
 	}
 
 	if len(updatedSelectionSets) > 0 {
 		exists := false
 		for _, s := range updatedSelectionSets {
-			if field, ok := s.(*ast.Field); ok && field.Name == "__typename" {
+			// an aliased __typename doesn't put __typename in the response, so it doesn't count
+			if field, ok := s.(*ast.Field); ok && field.Name == "__typename" && (field.Alias == "" || field.Alias == field.Name) {
 				exists = true
 				break
 			}
@@ -120,3 +133,18 @@ func processSelectionSet(selectionSet ast.SelectionSet) ast.SelectionSet {
 	}
 	return updatedSelectionSets
 }
+
+// processInlineFragmentSelectionSet adds __typename to the fields nested inside an inline fragment
+func processInlineFragmentSelectionSet(selectionSet ast.SelectionSet) ast.SelectionSet {
+	for _, selection := range selectionSet {
+		switch selection := selection.(type) {
+		case *ast.Field:
+			if len(selection.SelectionSet) > 0 {
+				selection.SelectionSet = processSelectionSet(selection.SelectionSet)
+			}
+		case *ast.InlineFragment:
+			selection.SelectionSet = processInlineFragmentSelectionSet(selection.SelectionSet)
+		}
+	}
+	return selectionSet
+}
@@ -1,10 +1,14 @@
 package graphcache
 
 import (
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
-	"github.com/vektah/gqlparser/ast"
+	"github.com/vektah/gqlparser/v2/ast"
 )
 
 func TestAddTypenameToQuery(t *testing.T) {
@@ -21,13 +25,33 @@ func TestAddTypenameToQuery(t *testing.T) {
 		{
 			name:     "Query with variables",
 			query:    "query GetUser($id: ID!) { user(id: $id) { id name } }",
-			expected: "query GetUser($id: ID!) { user(id: $id) { id name __typename } __typename }",
+			expected: "query GetUser ($id: ID!) { user(id: $id) { id name __typename } __typename }",
 		},
 		{
 			name:     "Query with nested fields",
 			query:    "{ user { id name posts { title content } } }",
 			expected: "query { user { id name posts { title content __typename } __typename } __typename }",
 		},
+		{
+			name:     "Query with named fragment",
+			query:    "query GetUser { user { ...UserFields } } fragment UserFields on User { id name }",
+			expected: "query GetUser { user { ... UserFields __typename } __typename } fragment UserFields on User { id name __typename }",
+		},
+		{
+			name:     "Query with nested fragment spreads",
+			query:    "{ user { ...UserFields } } fragment UserFields on User { id ...MetaFields } fragment MetaFields on User { meta { ipAddress } }",
+			expected: "query { user { ... UserFields __typename } __typename } fragment UserFields on User { id ... MetaFields __typename } fragment MetaFields on User { meta { ipAddress __typename } __typename }",
+		},
+		{
+			name:     "Query with inline fragments on a union",
+			query:    "{ search { ... on User { id name } ... on Todo { id user { id } } } }",
+			expected: "query { search { ... on User { id name } ... on Todo { id user { id __typename } } __typename } __typename }",
+		},
+		{
+			name:     "Query with inline fragment without type condition",
+			query:    "{ user { ... { id } } }",
+			expected: "query { user { ... { id } __typename } __typename }",
+		},
 	}
 
 	for _, tt := range tests {
@@ -39,29 +63,120 @@ func TestAddTypenameToQuery(t *testing.T) {
 	}
 }
 
-func TestConvertSelectionSetToString(t *testing.T) {
+func TestProcessSelectionSet(t *testing.T) {
 	selectionSet := ast.SelectionSet{
 		&ast.Field{Name: "id"},
 		&ast.Field{Name: "name"},
 	}
 
-	expected := "{ id name }"
-	result := convertSelectionSetToString(selectionSet)
+	expected := ast.SelectionSet{
+		&ast.Field{Name: "id"},
+		&ast.Field{Name: "name"},
+		&ast.Field{Name: "__typename"},
+	}
+
+	result := processSelectionSet(selectionSet)
 	assert.Equal(t, expected, result)
 }
 
-func TestProcessSelectionSet(t *testing.T) {
+func TestAddTypenameToQueryInvalidFragments(t *testing.T) {
+	_, err := AddTypenameToQuery("{ user { ...UserFields } }")
+	assert.Error(t, err)
+
+	_, err = AddTypenameToQuery("{ user { ...A } } fragment A on User { ...B } fragment B on User { ...A }")
+	assert.Error(t, err)
+}
+
+func TestProcessSelectionSetWithFragments(t *testing.T) {
+	spread := &ast.FragmentSpread{Name: "UserFields"}
 	selectionSet := ast.SelectionSet{
-		&ast.Field{Name: "id"},
-		&ast.Field{Name: "name"},
+		spread,
+		&ast.InlineFragment{
+			TypeCondition: "User",
+			SelectionSet: ast.SelectionSet{
+				&ast.Field{Name: "meta", SelectionSet: ast.SelectionSet{&ast.Field{Name: "ipAddress"}}},
+			},
+		},
 	}
 
 	expected := ast.SelectionSet{
-		&ast.Field{Name: "id"},
-		&ast.Field{Name: "name"},
+		spread,
+		&ast.InlineFragment{
+			TypeCondition: "User",
+			SelectionSet: ast.SelectionSet{
+				&ast.Field{Name: "meta", SelectionSet: ast.SelectionSet{&ast.Field{Name: "ipAddress"}, &ast.Field{Name: "__typename"}}},
+			},
+		},
 		&ast.Field{Name: "__typename"},
 	}
 
 	result := processSelectionSet(selectionSet)
 	assert.Equal(t, expected, result)
 }
+
+var updateGolden = flag.Bool("update", false, "update the golden files of the query printer tests")
+
+// TestAddTypenameToQueryGolden runs every query in testdata/typename through the __typename rewrite
+// and compares the output with the golden file next to it, run with -update to regenerate them
+func TestAddTypenameToQueryGolden(t *testing.T) {
+	queryFiles, err := filepath.Glob(filepath.Join("testdata", "typename", "*.graphql"))
+	assert.NoError(t, err)
+	assert.NotEmpty(t, queryFiles)
+
+	for _, queryFile := range queryFiles {
+		t.Run(filepath.Base(queryFile), func(t *testing.T) {
+			query, err := os.ReadFile(queryFile)
+			assert.NoError(t, err)
+
+			result, err := AddTypenameToQuery(string(query))
+			assert.NoError(t, err)
+
+			goldenFile := strings.TrimSuffix(queryFile, ".graphql") + ".golden"
+			if *updateGolden {
+				assert.NoError(t, os.WriteFile(goldenFile, []byte(result+"\n"), 0644))
+			}
+			golden, err := os.ReadFile(goldenFile)
+			assert.NoError(t, err)
+			assert.Equal(t, strings.TrimSpace(string(golden)), result)
+
+			// the rewritten query is the original query plus __typename fields
+			original, err := GetASTFromQuery(string(query))
+			assert.NoError(t, err)
+			rewritten, err := GetASTFromQuery(result)
+			assert.NoError(t, err)
+			assert.Equal(t, printQueryDocument(withoutTypename(original)), printQueryDocument(withoutTypename(rewritten)))
+
+			// running the rewrite again doesn't change the query
+			again, err := AddTypenameToQuery(result)
+			assert.NoError(t, err)
+			assert.Equal(t, result, again)
+		})
+	}
+}
+
+func withoutTypename(doc *ast.QueryDocument) *ast.QueryDocument {
+	var strip func(selectionSet ast.SelectionSet) ast.SelectionSet
+	strip = func(selectionSet ast.SelectionSet) ast.SelectionSet {
+		stripped := ast.SelectionSet{}
+		for _, selection := range selectionSet {
+			switch selection := selection.(type) {
+			case *ast.Field:
+				if selection.Name == "__typename" {
+					continue
+				}
+				selection.SelectionSet = strip(selection.SelectionSet)
+			case *ast.InlineFragment:
+				selection.SelectionSet = strip(selection.SelectionSet)
+			}
+			stripped = append(stripped, selection)
+		}
+		return stripped
+	}
+	for _, operation := range doc.Operations {
+		operation.SelectionSet = strip(operation.SelectionSet)
+	}
+	for _, fragment := range doc.Fragments {
+		fragment.SelectionSet = strip(fragment.SelectionSet)
+	}
+	return doc
+}
@@ -0,0 +1,105 @@
+package graphcache
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/vektah/gqlparser/v2/ast"
+	"github.com/vektah/gqlparser/v2/formatter"
+	"github.com/vektah/gqlparser/v2/gqlerror"
+	"github.com/vektah/gqlparser/v2/parser"
+)
+
+// ErrOperationNotTrusted is the error of a request with a document that isn't in the trusted documents
+var ErrOperationNotTrusted = &gqlerror.Error{
+	Message:    "operation is not in the trusted documents",
+	Extensions: map[string]interface{}{"code": "OPERATION_NOT_TRUSTED"},
+}
+
+// TrustedDocuments are the documents of the operations of our own clients, the only ones executed
+// when the trusted documents are enforced
+type TrustedDocuments struct {
+	// queries are the documents by their hash in the manifest
+	queries map[string]string
+	// normalized are the normalized documents, so a document is trusted whatever its formatting
+	normalized map[string]bool
+}
+
+// apolloManifest is the persisted query manifest of Apollo clients
+type apolloManifest struct {
+	Format     string `json:"format"`
+	Operations []struct {
+		ID   string `json:"id"`
+		Body string `json:"body"`
+	} `json:"operations"`
+}
+
+// NewTrustedDocumentsFromFile loads the trusted documents from a manifest, a JSON object of hashes
+// to documents or an Apollo persisted query manifest
+func NewTrustedDocumentsFromFile(path string) (*TrustedDocuments, error) {
+	manifest, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseTrustedDocuments(manifest)
+}
+
+// ParseTrustedDocuments reads the trusted documents of a manifest
+func ParseTrustedDocuments(manifest []byte) (*TrustedDocuments, error) {
+	queries := make(map[string]string)
+	apollo := apolloManifest{}
+	if err := json.Unmarshal(manifest, &apollo); err == nil && apollo.Format == "apollo-persisted-query-manifest" {
+		for _, operation := range apollo.Operations {
+			queries[operation.ID] = operation.Body
+		}
+	} else if err := json.Unmarshal(manifest, &queries); err != nil {
+		return nil, fmt.Errorf("trusted documents manifest has to map hashes to documents: %w", err)
+	}
+
+	documents := &TrustedDocuments{queries: queries, normalized: make(map[string]bool)}
+	for hash, query := range queries {
+		normalized, err := NormalizeDocument(query)
+		if err != nil {
+			return nil, fmt.Errorf("trusted document %s: %w", hash, err)
+		}
+		documents.normalized[normalized] = true
+	}
+	return documents, nil
+}
+
+// Query is the document with the hash
+func (td *TrustedDocuments) Query(hash string) (string, bool) {
+	if td == nil {
+		return "", false
+	}
+	query, ok := td.queries[hash]
+	return query, ok
+}
+
+// Trusted reports if the document is one of the trusted documents, formatted in any way
+func (td *TrustedDocuments) Trusted(query string) bool {
+	if td == nil {
+		return false
+	}
+	sum := sha256.Sum256([]byte(query))
+	if trusted, ok := td.queries[hex.EncodeToString(sum[:])]; ok && trusted == query {
+		return true
+	}
+	normalized, err := NormalizeDocument(query)
+	return err == nil && td.normalized[normalized]
+}
+
+// NormalizeDocument prints the document in a canonical form, without comments and with the same whitespace
+func NormalizeDocument(query string) (string, error) {
+	doc, err := parser.ParseQuery(&ast.Source{Input: query})
+	if err != nil {
+		return "", err
+	}
+	var normalized bytes.Buffer
+	formatter.NewFormatter(&normalized).FormatQueryDocument(doc)
+	return normalized.String(), nil
+}
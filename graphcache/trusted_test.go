@@ -0,0 +1,45 @@
+package graphcache
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTrustedDocuments(t *testing.T) {
+	documents, err := ParseTrustedDocuments([]byte(`{"abc":"query GetUser { user(id: \"1\") { id name } }"}`))
+	assert.Nil(t, err)
+
+	query, ok := documents.Query("abc")
+	assert.True(t, ok)
+	assert.True(t, documents.Trusted(query))
+	// the documents are trusted whatever their formatting
+	assert.True(t, documents.Trusted("# the user\nquery GetUser {\n  user(id: \"1\") {\n    id\n    name\n  }\n}"))
+	assert.False(t, documents.Trusted(`query GetUser { user(id: "1") { id name email } }`))
+	assert.False(t, documents.Trusted(`query GetUser {`))
+
+	_, ok = documents.Query("def")
+	assert.False(t, ok)
+}
+
+func TestTrustedDocumentsApolloManifest(t *testing.T) {
+	documents, err := ParseTrustedDocuments([]byte(`{
+		"format": "apollo-persisted-query-manifest",
+		"version": 1,
+		"operations": [{"id": "abc", "name": "GetUser", "type": "query", "body": "query GetUser { user(id: \"1\") { id name } }"}]
+	}`))
+	assert.Nil(t, err)
+	query, ok := documents.Query("abc")
+	assert.True(t, ok)
+	assert.Equal(t, `query GetUser { user(id: "1") { id name } }`, query)
+}
+
+func TestTrustedDocumentsInvalid(t *testing.T) {
+	for _, manifest := range []string{`["query GetUser { user { id } }"]`, `{"abc":"query GetUser {"}`} {
+		_, err := ParseTrustedDocuments([]byte(manifest))
+		assert.NotNil(t, err)
+	}
+
+	var documents *TrustedDocuments
+	assert.False(t, documents.Trusted(`query GetUser { user { id } }`))
+}
@@ -0,0 +1,201 @@
+package graphcache
+
+import (
+	"orbitgraphql/logger"
+	"orbitgraphql/utils"
+	"strconv"
+	"strings"
+
+	"github.com/vektah/gqlparser/v2/ast"
+)
+
+const TYPE_REGISTRY_KEY = "__types"
+
+// the facts of the type registry are kept in sets, added to atomically, so proxies learning from responses
+// at the same time don't lose what the others learned
+const (
+	typesSet         = "types"
+	possibleTypesSet = "possibleTypes"
+	rootFieldsSet    = "rootFields"
+)
+
+// typeRegistry keeps what we learn about the origin's types from its responses
+// without a schema it is the only way to know which typenames are object types,
+// which object types a fragment on an interface or a union applies to,
+// and which type the objects of a root field are
+type typeRegistry struct {
+	// Types are the typenames we have seen in responses, these are always object types
+	Types map[string]bool
+	// PossibleTypes maps the type condition of a fragment to the typenames it does or doesn't apply to
+	PossibleTypes map[string]map[string]bool
+	// RootFields maps a root field to the typename of the objects it returned, ANY_TYPE when it returned several
+	RootFields map[string]string
+
+	// learned are the members of every set learned since the registry was loaded
+	learned map[string][]string
+}
+
+func newTypeRegistry() *typeRegistry {
+	return &typeRegistry{
+		Types:         make(map[string]bool),
+		PossibleTypes: make(map[string]map[string]bool),
+		RootFields:    make(map[string]string),
+		learned:       make(map[string][]string),
+	}
+}
+
+func (gc *GraphCache) typeRegistryKey(set string) string {
+	return gc.sharedKey(TYPE_REGISTRY_KEY + ":" + set)
+}
+
+// loadTypeRegistry reads the type registry from the object store, types don't depend on the scope
+// of a request so the registry is shared by all scopes. With a schema the types come from it instead,
+// so the registry is left empty
+func (gc *GraphCache) loadTypeRegistry() *typeRegistry {
+	registry := newTypeRegistry()
+	if gc.schema != nil {
+		return registry
+	}
+	types, _ := gc.cacheStore.SetMembers(gc.typeRegistryKey(typesSet))
+	for _, typename := range types {
+		registry.Types[typename] = true
+	}
+	possibleTypes, _ := gc.cacheStore.SetMembers(gc.typeRegistryKey(possibleTypesSet))
+	for _, member := range possibleTypes {
+		parts := strings.Split(member, ":")
+		if len(parts) != 3 {
+			continue
+		}
+		if registry.PossibleTypes[parts[0]] == nil {
+			registry.PossibleTypes[parts[0]] = make(map[string]bool)
+		}
+		// a fragment that ever applied to the type does, it can only look like it doesn't
+		// when a field of it was left out of a response
+		registry.PossibleTypes[parts[0]][parts[1]] = registry.PossibleTypes[parts[0]][parts[1]] || parts[2] == "true"
+	}
+	rootFields, _ := gc.cacheStore.SetMembers(gc.typeRegistryKey(rootFieldsSet))
+	for _, member := range rootFields {
+		if field, typename, ok := strings.Cut(member, ":"); ok {
+			registry.setRootField(field, typename)
+		}
+	}
+	registry.learned = make(map[string][]string)
+	return registry
+}
+
+// saveTypeRegistry adds what the registry learned to the sets of the object store, everything learned
+// from a response is added again so the facts still seen in responses don't expire
+func (gc *GraphCache) saveTypeRegistry(registry *typeRegistry) {
+	for set, members := range registry.learned {
+		if err := gc.cacheStore.AddToSet(gc.typeRegistryKey(set), members...); err != nil {
+			logger.Warn(gc.ctx, "saving the types learned from the response failed: ", err)
+		}
+	}
+	registry.learned = make(map[string][]string)
+}
+
+func (r *typeRegistry) learn(set string, member string) {
+	if !utils.StringArrayContainsString(r.learned[set], member) {
+		r.learned[set] = append(r.learned[set], member)
+	}
+}
+
+func (r *typeRegistry) addType(typename string) {
+	r.Types[typename] = true
+	r.learn(typesSet, typename)
+}
+
+func (r *typeRegistry) addPossibleType(typeCondition string, typename string, applies bool) {
+	if r.PossibleTypes[typeCondition] == nil {
+		r.PossibleTypes[typeCondition] = make(map[string]bool)
+	}
+	r.PossibleTypes[typeCondition][typename] = applies
+	r.learn(possibleTypesSet, typeCondition+":"+typename+":"+strconv.FormatBool(applies))
+}
+
+func (r *typeRegistry) addRootField(field string, typename string) {
+	r.setRootField(field, typename)
+	r.learn(rootFieldsSet, field+":"+typename)
+}
+
+func (r *typeRegistry) setRootField(field string, typename string) {
+	if known, ok := r.RootFields[field]; ok && known != typename {
+		typename = ANY_TYPE
+	}
+	r.RootFields[field] = typename
+}
+
+// fragmentApplies reports if a fragment with the type condition applies to an object of the typename,
+// and if we know enough about the types to tell
+func (r *typeRegistry) fragmentApplies(typeCondition string, typename string) (applies bool, known bool) {
+	if typeCondition == "" || typeCondition == typename {
+		return true, true
+	}
+	if typename == "" {
+		return false, false
+	}
+	if applies, ok := r.PossibleTypes[typeCondition][typename]; ok {
+		return applies, true
+	}
+	if r.Types[typeCondition] {
+		// the condition is another object type
+		return false, true
+	}
+	return false, false
+}
+
+// learnFromResponse records the typenames in a response, and which fragments applied to them
+func (r *typeRegistry) learnFromResponse(selectionSet ast.SelectionSet, value interface{}) {
+	switch value := value.(type) {
+	case []interface{}:
+		for _, item := range value {
+			r.learnFromResponse(selectionSet, item)
+		}
+	case map[string]interface{}:
+		typename, _ := value[TYPENAME_FIELD].(string)
+		if typename != "" {
+			r.addType(typename)
+		}
+		r.learnFromSelectionSet(selectionSet, typename, value)
+	}
+}
+
+func (r *typeRegistry) learnFromSelectionSet(selectionSet ast.SelectionSet, typename string, object map[string]interface{}) {
+	for _, selection := range selectionSet {
+		switch selection := selection.(type) {
+		case *ast.Field:
+			if len(selection.SelectionSet) > 0 {
+				r.learnFromResponse(selection.SelectionSet, object[fieldResponseKey(selection)])
+			}
+		case *ast.InlineFragment:
+			r.learnFromFragment(selection.TypeCondition, selection.SelectionSet, typename, object)
+		case *ast.FragmentSpread:
+			if selection.Definition != nil {
+				r.learnFromFragment(selection.Definition.TypeCondition, selection.Definition.SelectionSet, typename, object)
+			}
+		}
+	}
+}
+
+func (r *typeRegistry) learnFromFragment(typeCondition string, selectionSet ast.SelectionSet, typename string, object map[string]interface{}) {
+	if typeCondition != "" && typename != "" && typeCondition != typename && !r.Types[typeCondition] {
+		// a fragment that applies puts all of its fields in the response, so if one of them
+		// is missing the fragment doesn't apply to the typename
+		fields := 0
+		applies := true
+		for _, selection := range selectionSet {
+			if field, ok := selection.(*ast.Field); ok && field.Name != TYPENAME_FIELD {
+				fields++
+				if _, ok := object[fieldResponseKey(field)]; !ok {
+					applies = false
+				}
+			}
+		}
+		if fields > 0 {
+			r.addPossibleType(typeCondition, typename, applies)
+		}
+	}
+	if applies, _ := r.fragmentApplies(typeCondition, typename); applies || typename == "" {
+		r.learnFromSelectionSet(selectionSet, typename, object)
+	}
+}
@@ -0,0 +1,83 @@
+package graphcache
+
+import (
+	"context"
+	"orbitgraphql/cache"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTypeRegistryFragmentApplies(t *testing.T) {
+	registry := newTypeRegistry()
+	registry.addType("User")
+	registry.addType("Todo")
+	registry.addPossibleType("Node", "User", true)
+
+	tests := []struct {
+		typeCondition string
+		typename      string
+		applies       bool
+		known         bool
+	}{
+		{"", "User", true, true},
+		{"User", "User", true, true},
+		{"Todo", "User", false, true},
+		{"Node", "User", true, true},
+		{"Node", "Todo", false, false},
+		{"User", "", false, false},
+	}
+	for _, tt := range tests {
+		applies, known := registry.fragmentApplies(tt.typeCondition, tt.typename)
+		assert.Equal(t, tt.applies, applies, tt.typeCondition+" on "+tt.typename)
+		assert.Equal(t, tt.known, known, tt.typeCondition+" on "+tt.typename)
+	}
+}
+
+func TestTypeRegistryIsShared(t *testing.T) {
+	gc := NewGraphCache()
+	registry := gc.loadTypeRegistry()
+	registry.addType("User")
+	registry.addRootField("users", "User")
+	gc.saveTypeRegistry(registry)
+
+	loaded := gc.loadTypeRegistry()
+	assert.Equal(t, map[string]bool{"User": true}, loaded.Types)
+	assert.Equal(t, map[string]string{"users": "User"}, loaded.RootFields)
+}
+
+func TestTypeRegistryConcurrentUpdates(t *testing.T) {
+	gc := NewGraphCache()
+	// two proxies load the registry before either saves what it learned
+	first := gc.loadTypeRegistry()
+	second := gc.loadTypeRegistry()
+	first.addType("User")
+	first.addPossibleType("Node", "User", true)
+	first.addRootField("search", "User")
+	second.addType("Todo")
+	second.addPossibleType("Node", "User", false)
+	second.addRootField("search", "Todo")
+	gc.saveTypeRegistry(first)
+	gc.saveTypeRegistry(second)
+
+	loaded := gc.loadTypeRegistry()
+	assert.Equal(t, map[string]bool{"User": true, "Todo": true}, loaded.Types)
+	assert.Equal(t, map[string]map[string]bool{"Node": {"User": true}}, loaded.PossibleTypes)
+	// a root field that returned objects of several types has no type of its own
+	assert.Equal(t, map[string]string{"search": ANY_TYPE}, loaded.RootFields)
+}
+
+func TestTypeRegistryWithSchema(t *testing.T) {
+	schema, err := LoadSchemaFromSDL("schema.graphql", `type User { id: ID! } type Query { user(id: ID!): User }`)
+	assert.Nil(t, err)
+	gc := NewGraphCacheWithOptions(context.Background(), &GraphCacheOptions{
+		ObjectStore: cache.NewInMemoryCache(300),
+		QueryStore:  cache.NewInMemoryCache(300),
+		Schema:      schema,
+	})
+	cacheQueryResponse(t, gc, `query GetUser { user(id: "1") { id } }`, nil, `{"data":{"__typename":"Query","user":{"__typename":"User","id":"1"}}}`)
+
+	// the types come from the schema, nothing is learned from the responses
+	exists, _ := gc.cacheStore.Exists(gc.typeRegistryKey(typesSet))
+	assert.False(t, exists)
+}
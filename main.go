@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"log"
 	"orbitgraphql/api"
+	"orbitgraphql/api/handlers"
 	"orbitgraphql/config"
 	"orbitgraphql/logger"
 	"strconv"
@@ -24,13 +25,40 @@ func main() {
 	cfg := config.NewConfig()
 	fmt.Println("🛠️ configuration initalized")
 	fmt.Println("⚙️ configuration: ")
-	fmt.Print("→ cache_backend=", cfg.CacheBackend, "\n→ cache_header_name=", cfg.CacheHeaderName, "\n→ origin=", cfg.Origin, "\n→ port=", cfg.Port, "\n→ scope_headers=", cfg.ScopeHeaders, "\n→ primary_key_field=", cfg.PrimaryKeyField, "\n→ log_level=", cfg.LogLevel, "\n→ log_format=", cfg.LogFormat, "\n→ redis_host=", cfg.RedisHost, "\n→ redis_port=", cfg.RedisPort, "\n→ cache_ttl=", cfg.CacheTTL, "\n→ handlers_graphql_path=", cfg.HandlersGraphQLPath, "\n→ handlers_flush_all_path=", cfg.HandlersFlushAllPath, "\n→ handlers_flush_by_type_path=", cfg.HandlersFlushByTypePath, "\n→ handlers_debug_path=", cfg.HandlersDebugPath, "\n→ handlers_health_path=", cfg.HandlersHealthPath, "\n\n")
+	fmt.Print("→ cache_backend=", cfg.CacheBackend, "\n→ cache_header_name=", cfg.CacheHeaderName, "\n→ origin=", cfg.Origin, "\n→ port=", cfg.Port, "\n→ scope_headers=", cfg.ScopeHeaders, "\n→ primary_key_field=", cfg.PrimaryKeyField, "\n→ log_level=", cfg.LogLevel, "\n→ log_format=", cfg.LogFormat, "\n→ redis_host=", cfg.RedisHost, "\n→ redis_port=", cfg.RedisPort, "\n→ cache_ttl=", cfg.CacheTTL, "\n→ handlers_graphql_path=", cfg.HandlersGraphQLPath, "\n→ handlers_flush_all_path=", cfg.HandlersFlushAllPath, "\n→ handlers_flush_by_type_path=", cfg.HandlersFlushByTypePath, "\n→ handlers_debug_path=", cfg.HandlersDebugPath, "\n→ handlers_health_path=", cfg.HandlersHealthPath, "\n→ schema_path=", cfg.SchemaPath, "\n→ schema_introspection=", cfg.SchemaIntrospection, "\n→ schema_refresh_interval=", cfg.SchemaRefreshInterval, "\n→ trusted_documents=", cfg.TrustedDocuments, "\n→ trusted_documents_mode=", cfg.TrustedDocumentsMode, "\n→ scope_jwt_claims=", cfg.ScopeJWTClaims, "\n→ scope_jwks=", cfg.ScopeJWKS, "\n\n")
 
 	logger.Configure(&logger.Config{
 		Format: string(cfg.LogFormat),
 		Level:  cfg.LogLevel,
 	})
 
+	if cfg.SchemaPath != "" || cfg.SchemaIntrospection {
+		fmt.Println("🛠️ loading schema...")
+		err := handlers.LoadSchema(cfg)
+		if err != nil {
+			log.Fatal("‼️ error loading schema: ", err)
+		}
+		fmt.Println("🛠️ schema loaded")
+	}
+
+	if cfg.TrustedDocuments != "" {
+		fmt.Println("🛠️ loading trusted documents...")
+		err := handlers.LoadTrustedDocuments(cfg)
+		if err != nil {
+			log.Fatal("‼️ error loading trusted documents: ", err)
+		}
+		fmt.Println("🛠️ trusted documents loaded")
+	}
+
+	if cfg.ScopeJWKS != "" {
+		fmt.Println("🛠️ loading scope keys...")
+		err := handlers.LoadScopeKeys(cfg)
+		if err != nil {
+			log.Fatal("‼️ error loading scope keys: ", err)
+		}
+		fmt.Println("🛠️ scope keys loaded")
+	}
+
 	server := api.NewServer(cfg)
 
 	// Start the server and log any errors
@@ -64,8 +64,7 @@ func RunUsersOperations(t *testing.T, client *test_client.GraphQLClient) (time.D
 	assert.NotNil(t, user)
 	totalTimeTaken += tt
 
-	client.FlushByType("User", "")
-
+	// the new user invalidates the cached lists of users
 	users, _, tt, err := client.PaginateUsers()
 	if err != nil {
 		fmt.Println("error paginating users ", err)